@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 
@@ -15,15 +19,27 @@ import (
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 
+	"chart-organizer/backend/gen/contracts/admin/v1/adminv1connect"
+	"chart-organizer/backend/gen/contracts/apikey/v1/apikeyv1connect"
 	"chart-organizer/backend/gen/contracts/auth/v1/authv1connect"
 	"chart-organizer/backend/gen/contracts/dataset/v1/datasetv1connect"
+	"chart-organizer/backend/gen/contracts/organization/v1/organizationv1connect"
 	"chart-organizer/backend/gen/contracts/viz/v1/vizv1connect"
 
+	"chart-organizer/backend/internal/handlers/admin"
+	"chart-organizer/backend/internal/handlers/apikey"
 	"chart-organizer/backend/internal/handlers/auth"
 	"chart-organizer/backend/internal/handlers/dataset"
+	"chart-organizer/backend/internal/handlers/organization"
 	"chart-organizer/backend/internal/handlers/viz"
 	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/keyring"
+	"chart-organizer/backend/internal/oidc"
+	"chart-organizer/backend/internal/policy"
 	"chart-organizer/backend/internal/repository"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	datasetRepo "chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/storage"
 )
 
 func getAddr() string {
@@ -36,6 +52,19 @@ func getAddr() string {
 	return "0.0.0.0:8080"
 }
 
+// Defaults to 1 GiB
+func getMaxUploadSize() (int64, error) {
+	megabytes := os.Getenv("MAX_UPLOAD_SIZE_MB")
+	if megabytes == "" {
+		return 1024 << 20, nil
+	}
+	n, err := strconv.ParseInt(megabytes, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("MAX_UPLOAD_SIZE_MB must be a positive number of megabytes, got %q", megabytes)
+	}
+	return n << 20, nil
+}
+
 func main() {
 	// Load .env
 	err := godotenv.Load()
@@ -58,6 +87,27 @@ func main() {
 	defer db.Close()
 	repository.InitDatabase(db)
 
+	// Open the storage of dataset files
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Streamed uploads interrupted by a restart can't be resumed
+	err = datasetRepo.RemoveUploadFiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Garbage collect abandoned resumable uploads
+	go func() {
+		for ; ; time.Sleep(time.Hour) {
+			if err := datasetRepo.RemoveExpiredUploadSessions(db, store); err != nil {
+				slog.Error("Failed to remove expired upload sessions", "error", err)
+			}
+		}
+	}()
+
 	var sqliteVersion string
 	err = db.QueryRow("SELECT sqlite_version()").Scan(&sqliteVersion)
 	if err != nil {
@@ -66,26 +116,83 @@ func main() {
 	}
 	slog.Info(fmt.Sprintf("SQLite version %s loaded", sqliteVersion))
 
-	// Configure interceptors
-	interceptors.JwtKey = []byte(os.Getenv("JWT_KEY"))
+	// Bootstrap administrators
+	if adminUsernames := os.Getenv("ADMIN_USERNAMES"); adminUsernames != "" {
+		err = authRepo.PromoteToAdmin(db, strings.Split(adminUsernames, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load the JWT signing keys
+	keys, generated, err := keyring.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if generated {
+		slog.Warn("Neither JWT_KEYRING nor JWT_KEY is set, using a random key. Tokens won't survive a restart.")
+	}
+
+	// Load the username and password policy
+	credentialPolicy, err := policy.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Discover the identity provider for single sign-on
+	var oidcProvider *oidc.Provider
+	oidcConfig, oidcEnabled := oidc.ConfigFromEnv()
+	if oidcEnabled {
+		oidcProvider, err = oidc.Discover(context.Background(), oidcConfig, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info(fmt.Sprintf("Single sign-on enabled with %s", oidcConfig.Issuer))
+	}
+
+	maxUploadSize, err := getMaxUploadSize()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Create interceptors
 	debugInterceptor := interceptors.NewDebugInterceptor()
-	authInterceptor := interceptors.NewAuthInterceptor()
+	authInterceptor := interceptors.NewAuthInterceptor(db, keys)
+	adminInterceptor := interceptors.NewAdminInterceptor()
 
 	// Configure Connect options with interceptors
 	connectOptions := connect.WithInterceptors(debugInterceptor, authInterceptor)
+	adminConnectOptions := connect.WithInterceptors(debugInterceptor, authInterceptor, adminInterceptor)
 
 	// Adding routes with interceptors
 	mux := http.NewServeMux()
 
-	authPath, authHandler := authv1connect.NewAuthServiceHandler(&auth.AuthHandler{DB: db}, connectOptions)
-	datasetPath, datasetHandler := datasetv1connect.NewDatasetServiceHandler(&dataset.DatasetHandler{DB: db}, connectOptions)
+	authServer := &auth.AuthHandler{DB: db, Storage: store, Keyring: keys, Oidc: oidcProvider, Policy: credentialPolicy}
+	authPath, authHandler := authv1connect.NewAuthServiceHandler(authServer, connectOptions)
+	datasetPath, datasetHandler := datasetv1connect.NewDatasetServiceHandler(&dataset.DatasetHandler{DB: db, Storage: store, MaxUploadSize: maxUploadSize}, connectOptions)
+	apiKeyPath, apiKeyHandler := apikeyv1connect.NewApiKeyServiceHandler(&apikey.ApiKeyHandler{DB: db}, connectOptions)
+	organizationPath, organizationHandler := organizationv1connect.NewOrganizationServiceHandler(&organization.OrganizationHandler{DB: db, Storage: store}, connectOptions)
+	adminPath, adminHandler := adminv1connect.NewAdminServiceHandler(&admin.AdminHandler{DB: db, Storage: store, Policy: credentialPolicy}, adminConnectOptions)
 	vizPath, vizHandler := vizv1connect.NewDashboardServiceHandler(&viz.VisualizationHandler{DB: db}, connectOptions)
 
 	mux.Handle(authPath, authHandler)
 	mux.Handle(datasetPath, datasetHandler)
 	mux.Handle(vizPath, vizHandler)
+	mux.Handle(apiKeyPath, apiKeyHandler)
+	mux.Handle(organizationPath, organizationHandler)
+	mux.Handle(adminPath, adminHandler)
+
+	// Public keys for other services to verify our tokens
+	mux.Handle("GET /.well-known/jwks.json", keys.JWKSHandler())
+
+	// Browsers are sent to the login route to start a single sign-on login,
+	// and the identity provider redirects back to the callback
+	postLoginRedirect := os.Getenv("OIDC_POST_LOGIN_REDIRECT")
+	if postLoginRedirect == "" {
+		postLoginRedirect = "http://localhost:3000/login"
+	}
+	mux.Handle("GET /auth/oidc/login", authServer.OidcLoginHandler())
+	mux.Handle("GET /auth/oidc/callback", authServer.OidcCallbackHandler(postLoginRedirect))
 
 	// Get server address
 	addr := getAddr()
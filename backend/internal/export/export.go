@@ -0,0 +1,369 @@
+// Package export writes the rows of a dataset in other formats
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+
+	"chart-organizer/backend/internal/ingest"
+	"chart-organizer/backend/internal/schema"
+)
+
+// Formats of exported files
+const (
+	FormatCSV     = "csv"
+	FormatJSON    = "json"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+	// Arrow IPC file, also known as Feather
+	FormatArrow = "arrow"
+)
+
+var Formats = []string{FormatCSV, FormatJSON, FormatNDJSON, FormatParquet, FormatArrow}
+
+// Quoting of CSV fields
+const (
+	// Fields that contain the delimiter, a quote or a line break
+	QuoteMinimal = "minimal"
+	QuoteAll     = "all"
+	// Every field except values of integer and float columns
+	QuoteNonNumeric = "nonnumeric"
+)
+
+var Quotings = []string{QuoteMinimal, QuoteAll, QuoteNonNumeric}
+
+var contentTypes = map[string]string{
+	FormatCSV:     "text/csv",
+	FormatJSON:    "application/json",
+	FormatNDJSON:  "application/x-ndjson",
+	FormatParquet: "application/vnd.apache.parquet",
+	FormatArrow:   "application/vnd.apache.arrow.file",
+}
+
+// Options of an export. Settings that are not set have their default.
+type Options struct {
+	// One of Formats, csv by default
+	Format string
+	// Field delimiter of csv files, a comma by default
+	Delimiter rune
+	// One of Quotings, minimal by default
+	Quoting string
+}
+
+// Validate checks the options and fills in the defaults
+func (o *Options) Validate() error {
+	if o.Format == "" {
+		o.Format = FormatCSV
+	}
+	if !slices.Contains(Formats, o.Format) {
+		return fmt.Errorf("unknown format %q, expected one of %s", o.Format, strings.Join(Formats, ", "))
+	}
+	if o.Format != FormatCSV {
+		if o.Delimiter != 0 || o.Quoting != "" {
+			return errors.New("the delimiter and quoting can only be set for csv")
+		}
+		return nil
+	}
+
+	if o.Delimiter == 0 {
+		o.Delimiter = ','
+	}
+	if o.Delimiter == '"' || o.Delimiter == '\r' || o.Delimiter == '\n' || o.Delimiter == utf8.RuneError {
+		return fmt.Errorf("%q can't be the delimiter", o.Delimiter)
+	}
+	if o.Quoting == "" {
+		o.Quoting = QuoteMinimal
+	}
+	if !slices.Contains(Quotings, o.Quoting) {
+		return fmt.Errorf("unknown quoting %q, expected one of %s", o.Quoting, strings.Join(Quotings, ", "))
+	}
+	return nil
+}
+
+// ContentType is the media type of files of the format
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Filename replaces the extension of the name of a dataset with the one of the format
+func Filename(name string, format string) string {
+	name = ingest.CSVFilename(name)
+	if extension := filepath.Ext(name); strings.EqualFold(extension, ".csv") {
+		name = strings.TrimSuffix(name, extension)
+	}
+	return name + "." + format
+}
+
+// Writer writes rows of a dataset, as read from its CSV file
+type Writer interface {
+	Write(record []string) error
+	// Close writes the end of the file, but does not close the underlying writer
+	Close() error
+}
+
+// NewWriter writes the start of a file with the columns, with options that
+// have been validated. Typed formats write values that don't have the type
+// of their column as text in JSON, and as null in Parquet and Arrow.
+func NewWriter(w io.Writer, columns []schema.Column, options Options) (Writer, error) {
+	switch options.Format {
+	case FormatCSV:
+		return newCSVWriter(w, columns, options)
+	case FormatJSON, FormatNDJSON:
+		return newJSONWriter(w, columns, options.Format == FormatJSON)
+	case FormatParquet, FormatArrow:
+		return newTypedWriter(w, columns, options.Format)
+	}
+	return nil, fmt.Errorf("unknown format %q", options.Format)
+}
+
+func arrowType(columnType string) arrow.DataType {
+	switch columnType {
+	case schema.TypeInteger:
+		return arrow.PrimitiveTypes.Int64
+	case schema.TypeFloat:
+		return arrow.PrimitiveTypes.Float64
+	case schema.TypeBoolean:
+		return arrow.FixedWidthTypes.Boolean
+	case schema.TypeDatetime:
+		return arrow.FixedWidthTypes.Timestamp_us
+	}
+	return arrow.BinaryTypes.String
+}
+
+// Record batches are written once the buffered values take this much memory,
+// or have this many rows. Every batch is a row group of Parquet files.
+const (
+	maxBatchSize = 32 << 20
+	maxBatchRows = 1 << 16
+)
+
+// Writes typed values of the columns in record batches, with values that
+// don't have the type as nulls
+type typedWriter struct {
+	columns []schema.Column
+	builder *array.RecordBuilder
+	rows    int
+	size    int
+	write   func(arrow.RecordBatch) error
+	close   func() error
+}
+
+func newTypedWriter(w io.Writer, columns []schema.Column, format string) (*typedWriter, error) {
+	fields := make([]arrow.Field, len(columns))
+	for i, c := range columns {
+		fields[i] = arrow.Field{Name: c.Name, Type: arrowType(c.Type), Nullable: true}
+	}
+	arrowSchema := arrow.NewSchema(fields, nil)
+	t := &typedWriter{columns: columns, builder: array.NewRecordBuilder(memory.DefaultAllocator, arrowSchema)}
+
+	// The Parquet writer closes the underlying writer if it can
+	w = struct{ io.Writer }{w}
+	if format == FormatParquet {
+		properties := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+		writer, err := pqarrow.NewFileWriter(arrowSchema, w, properties, pqarrow.DefaultWriterProps())
+		if err != nil {
+			return nil, err
+		}
+		t.write, t.close = writer.Write, writer.Close
+		return t, nil
+	}
+	writer, err := ipc.NewFileWriter(w, ipc.WithSchema(arrowSchema))
+	if err != nil {
+		return nil, err
+	}
+	t.write, t.close = writer.Write, writer.Close
+	return t, nil
+}
+
+func (t *typedWriter) Write(record []string) error {
+	for i, c := range t.columns {
+		value, ok := c.ParseValue(record[i])
+		if !ok || value == nil {
+			t.builder.Field(i).AppendNull()
+			continue
+		}
+		switch builder := t.builder.Field(i).(type) {
+		case *array.StringBuilder:
+			text := strings.ToValidUTF8(value.(string), "\uFFFD")
+			builder.Append(text)
+			t.size += len(text)
+		case *array.Int64Builder:
+			builder.Append(value.(int64))
+		case *array.Float64Builder:
+			builder.Append(value.(float64))
+		case *array.BooleanBuilder:
+			builder.Append(value.(bool))
+		case *array.TimestampBuilder:
+			builder.Append(arrow.Timestamp(value.(time.Time).UnixMicro()))
+		}
+		t.size += 8
+	}
+
+	t.rows++
+	if t.rows >= maxBatchRows || t.size >= maxBatchSize {
+		return t.flush()
+	}
+	return nil
+}
+
+// Write the buffered rows as a record batch
+func (t *typedWriter) flush() error {
+	batch := t.builder.NewRecordBatch()
+	defer batch.Release()
+	t.rows, t.size = 0, 0
+	return t.write(batch)
+}
+
+func (t *typedWriter) Close() error {
+	defer t.builder.Release()
+	if t.rows > 0 {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+	return t.close()
+}
+
+type csvWriter struct {
+	w       *bufio.Writer
+	columns []schema.Column
+	options Options
+}
+
+func newCSVWriter(w io.Writer, columns []schema.Column, options Options) (*csvWriter, error) {
+	c := &csvWriter{w: bufio.NewWriter(w), columns: columns, options: options}
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	return c, c.writeRecord(header, true)
+}
+
+func (c *csvWriter) Write(record []string) error {
+	return c.writeRecord(record, false)
+}
+
+func (c *csvWriter) writeRecord(record []string, header bool) error {
+	for i, field := range record {
+		if i > 0 {
+			c.w.WriteRune(c.options.Delimiter)
+		}
+
+		quote := c.needsQuotes(field)
+		switch c.options.Quoting {
+		case QuoteAll:
+			quote = true
+		case QuoteNonNumeric:
+			numeric := c.columns[i].Type == schema.TypeInteger || c.columns[i].Type == schema.TypeFloat
+			quote = quote || header || !numeric
+		}
+		if !quote {
+			c.w.WriteString(field)
+			continue
+		}
+		c.w.WriteByte('"')
+		c.w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		c.w.WriteByte('"')
+	}
+	// Errors of the underlying writer are kept by the buffered writer
+	_, err := c.w.WriteString("\n")
+	return err
+}
+
+// The same fields as encoding/csv quotes
+func (c *csvWriter) needsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsRune(field, c.options.Delimiter) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return r == ' ' || r == '\t'
+}
+
+func (c *csvWriter) Close() error {
+	return c.w.Flush()
+}
+
+// Writes an array of objects or one object per line, with typed values
+type jsonWriter struct {
+	w     *bufio.Writer
+	array bool
+	// The JSON encoded names of the columns and the key separator
+	keys    []string
+	columns []schema.Column
+	rows    int
+}
+
+func newJSONWriter(w io.Writer, columns []schema.Column, array bool) (*jsonWriter, error) {
+	j := &jsonWriter{w: bufio.NewWriter(w), array: array, columns: columns}
+	for _, c := range columns {
+		key, err := json.Marshal(c.Name)
+		if err != nil {
+			return nil, err
+		}
+		j.keys = append(j.keys, string(key)+":")
+	}
+	if array {
+		j.w.WriteString("[")
+	}
+	return j, nil
+}
+
+func (j *jsonWriter) Write(record []string) error {
+	switch {
+	case j.array && j.rows > 0:
+		j.w.WriteString(",\n")
+	case j.array:
+		j.w.WriteString("\n")
+	}
+	j.rows++
+
+	j.w.WriteByte('{')
+	for i, c := range j.columns {
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		j.w.WriteString(j.keys[i])
+		// Values that don't have the type of the column are text
+		value, _ := c.ParseValue(record[i])
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		j.w.Write(encoded)
+	}
+	// Errors of the underlying writer are kept by the buffered writer
+	if j.array {
+		return j.w.WriteByte('}')
+	}
+	_, err := j.w.WriteString("}\n")
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	if j.array {
+		if j.rows > 0 {
+			j.w.WriteString("\n")
+		}
+		j.w.WriteString("]\n")
+	}
+	return j.w.Flush()
+}
@@ -0,0 +1,314 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+var columns = []schema.Column{
+	{Name: "name", Type: schema.TypeText},
+	{Name: "count", Type: schema.TypeInteger},
+	{Name: "ratio", Type: schema.TypeFloat},
+	{Name: "paid", Type: schema.TypeBoolean},
+	{Name: "at", Type: schema.TypeDatetime},
+	{Name: "kind", Type: schema.TypeCategorical},
+}
+
+// Rows as read from the CSV file of a dataset, the last one with values
+// that don't have the type of their column
+var records = [][]string{
+	{"Zürich", "1", "0.5", "true", "2024-01-02T03:04:05Z", "a"},
+	{"", "", "", "", "", ""},
+	{"say \"hi\"", "-2", "1e3", "false", "2024-01-02", "b;c"},
+	{" padded", "x", "y", "maybe", "never", "line\nbreak"},
+}
+
+func export(t *testing.T, columns []schema.Column, records [][]string, options Options) []byte {
+	t.Helper()
+	if err := options.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, columns, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options Options
+		want    string
+	}{
+		{"minimal", Options{},
+			"name,count,ratio,paid,at,kind\n" +
+				"Zürich,1,0.5,true,2024-01-02T03:04:05Z,a\n" +
+				",,,,,\n" +
+				"\"say \"\"hi\"\"\",-2,1e3,false,2024-01-02,b;c\n" +
+				"\" padded\",x,y,maybe,never,\"line\nbreak\"\n"},
+		{"all", Options{Quoting: QuoteAll},
+			"\"name\",\"count\",\"ratio\",\"paid\",\"at\",\"kind\"\n" +
+				"\"Zürich\",\"1\",\"0.5\",\"true\",\"2024-01-02T03:04:05Z\",\"a\"\n" +
+				"\"\",\"\",\"\",\"\",\"\",\"\"\n" +
+				"\"say \"\"hi\"\"\",\"-2\",\"1e3\",\"false\",\"2024-01-02\",\"b;c\"\n" +
+				"\" padded\",\"x\",\"y\",\"maybe\",\"never\",\"line\nbreak\"\n"},
+		// The header and values of other columns than integers and floats
+		{"nonnumeric", Options{Quoting: QuoteNonNumeric},
+			"\"name\",\"count\",\"ratio\",\"paid\",\"at\",\"kind\"\n" +
+				"\"Zürich\",1,0.5,\"true\",\"2024-01-02T03:04:05Z\",\"a\"\n" +
+				"\"\",,,\"\",\"\",\"\"\n" +
+				"\"say \"\"hi\"\"\",-2,1e3,\"false\",\"2024-01-02\",\"b;c\"\n" +
+				"\" padded\",x,y,\"maybe\",\"never\",\"line\nbreak\"\n"},
+		{"semicolons", Options{Delimiter: ';'},
+			"name;count;ratio;paid;at;kind\n" +
+				"Zürich;1;0.5;true;2024-01-02T03:04:05Z;a\n" +
+				";;;;;\n" +
+				"\"say \"\"hi\"\"\";-2;1e3;false;2024-01-02;\"b;c\"\n" +
+				"\" padded\";x;y;maybe;never;\"line\nbreak\"\n"},
+		{"tabs", Options{Delimiter: '\t', Quoting: QuoteMinimal},
+			"name\tcount\tratio\tpaid\tat\tkind\n" +
+				"Zürich\t1\t0.5\ttrue\t2024-01-02T03:04:05Z\ta\n" +
+				"\t\t\t\t\t\n" +
+				"\"say \"\"hi\"\"\"\t-2\t1e3\tfalse\t2024-01-02\tb;c\n" +
+				"\" padded\"\tx\ty\tmaybe\tnever\t\"line\nbreak\"\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(export(t, columns, records, tt.options)); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	want := `{"name":"Zürich","count":1,"ratio":0.5,"paid":true,"at":"2024-01-02T03:04:05Z","kind":"a"}` + "\n" +
+		`{"name":null,"count":null,"ratio":null,"paid":null,"at":null,"kind":null}` + "\n" +
+		`{"name":"say \"hi\"","count":-2,"ratio":1000,"paid":false,"at":"2024-01-02T00:00:00Z","kind":"b;c"}` + "\n" +
+		// Values that don't have the type of their column are text
+		`{"name":" padded","count":"x","ratio":"y","paid":"maybe","at":"never","kind":"line\nbreak"}` + "\n"
+
+	if got := string(export(t, columns, records, Options{Format: FormatNDJSON})); got != want {
+		t.Errorf("ndjson\n%s\nwant\n%s", got, want)
+	}
+
+	wantArray := "[\n" + strings.ReplaceAll(strings.TrimSuffix(want, "\n"), "}\n{", "},\n{") + "\n]\n"
+	if got := string(export(t, columns, records, Options{Format: FormatJSON})); got != wantArray {
+		t.Errorf("json\n%s\nwant\n%s", got, wantArray)
+	}
+	if got := string(export(t, columns, nil, Options{Format: FormatJSON})); got != "[]\n" {
+		t.Errorf("json without rows %q", got)
+	}
+}
+
+// Values that don't have the type of their column are null in typed formats
+var typedRows = [][]string{
+	{"Zürich", "1", "0.5", "true", "2024-01-02T03:04:05Z", "a"},
+	{"", "", "", "", "", ""},
+	{"say \"hi\"", "-2", "1000", "false", "2024-01-02T00:00:00Z", "b;c"},
+	{" padded", "", "", "", "", "line\nbreak"},
+}
+
+// The values of the rows of the record, nulls are empty
+func recordRows(record arrow.RecordBatch) [][]string {
+	var rows [][]string
+	for r := range int(record.NumRows()) {
+		row := make([]string, record.NumCols())
+		for c, column := range record.Columns() {
+			if !column.IsNull(r) {
+				row[c] = column.ValueStr(r)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// readParquet returns the fields and rows of a Parquet file
+func readParquet(t *testing.T, data []byte) ([]string, [][]string) {
+	t.Helper()
+	table, err := pqarrow.ReadTable(context.Background(), bytes.NewReader(data), nil, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+
+	var fields []string
+	for _, f := range table.Schema().Fields() {
+		fields = append(fields, f.Name+" "+f.Type.String())
+	}
+	var rows [][]string
+	reader := array.NewTableReader(table, -1)
+	defer reader.Release()
+	for reader.Next() {
+		rows = append(rows, recordRows(reader.RecordBatch())...)
+	}
+	return fields, rows
+}
+
+var wantFields = []string{"name utf8", "count int64", "ratio float64", "paid bool", "at timestamp[us, tz=UTC]", "kind utf8"}
+
+func TestParquet(t *testing.T) {
+	fields, rows := readParquet(t, export(t, columns, records, Options{Format: FormatParquet}))
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("fields %q, want %q", fields, wantFields)
+	}
+	if !reflect.DeepEqual(rows, typedRows) {
+		t.Errorf("rows\n%q\nwant\n%q", rows, typedRows)
+	}
+
+	// Without rows
+	if fields, rows = readParquet(t, export(t, columns, nil, Options{Format: FormatParquet})); len(fields) != len(columns) || len(rows) != 0 {
+		t.Errorf("fields %q and rows %q of a file without rows", fields, rows)
+	}
+}
+
+func TestArrow(t *testing.T) {
+	for _, records := range [][][]string{records, nil} {
+		data := export(t, columns, records, Options{Format: FormatArrow})
+		reader, err := ipc.NewFileReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+
+		var fields []string
+		for _, f := range reader.Schema().Fields() {
+			fields = append(fields, f.Name+" "+f.Type.String())
+		}
+		if !reflect.DeepEqual(fields, wantFields) {
+			t.Errorf("fields %q, want %q", fields, wantFields)
+		}
+
+		rows := [][]string{}
+		for i := range reader.NumRecords() {
+			record, err := reader.RecordBatch(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, recordRows(record)...)
+		}
+		if want := typedRows[:len(records)]; !reflect.DeepEqual(rows, want) {
+			t.Errorf("rows\n%q\nwant\n%q", rows, want)
+		}
+	}
+}
+
+// Buffered rows are written in record batches
+func TestTypedBatches(t *testing.T) {
+	var many [][]string
+	for range maxBatchRows + 1 {
+		many = append(many, records[0])
+	}
+	reader, err := ipc.NewFileReader(bytes.NewReader(export(t, columns, many, Options{Format: FormatArrow})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.NumRecords() != 2 {
+		t.Errorf("%d record batches, want 2", reader.NumRecords())
+	}
+}
+
+// Text that isn't UTF-8 is replaced in typed formats, which require UTF-8
+func TestInvalidUTF8(t *testing.T) {
+	_, rows := readParquet(t, export(t, columns[:1], [][]string{{"caf\xE9"}}, Options{Format: FormatParquet}))
+	if want := [][]string{{"caf\uFFFD"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q, want %q", rows, want)
+	}
+}
+
+// The underlying writer is not closed with the file
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTypedClose(t *testing.T) {
+	for _, format := range []string{FormatParquet, FormatArrow} {
+		var out closeRecorder
+		w, err := NewWriter(&out, columns, Options{Format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if out.closed {
+			t.Errorf("%s closed the underlying writer", format)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		options Options
+		want    Options
+		err     string
+	}{
+		{Options{}, Options{Format: FormatCSV, Delimiter: ',', Quoting: QuoteMinimal}, ""},
+		{Options{Delimiter: '|', Quoting: QuoteAll}, Options{Format: FormatCSV, Delimiter: '|', Quoting: QuoteAll}, ""},
+		{Options{Format: FormatArrow}, Options{Format: FormatArrow}, ""},
+		{Options{Format: "xlsx"}, Options{}, `unknown format "xlsx"`},
+		{Options{Format: FormatJSON, Delimiter: ';'}, Options{}, "the delimiter and quoting can only be set for csv"},
+		{Options{Format: FormatParquet, Quoting: QuoteAll}, Options{}, "the delimiter and quoting can only be set for csv"},
+		{Options{Delimiter: '"'}, Options{}, `'"' can't be the delimiter`},
+		{Options{Delimiter: '\n'}, Options{}, `'\n' can't be the delimiter`},
+		{Options{Quoting: "some"}, Options{}, `unknown quoting "some"`},
+	} {
+		options := tt.options
+		err := options.Validate()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%+v: got %v, want %q", tt.options, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || options != tt.want {
+			t.Errorf("%+v: got %+v, %v, want %+v", tt.options, options, err, tt.want)
+		}
+	}
+}
+
+func TestFilename(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{"sales.csv", FormatParquet, "sales.parquet"},
+		{"sales.CSV", FormatCSV, "sales.csv"},
+		{"sales.xlsx", FormatArrow, "sales.arrow"},
+		{"sales", FormatNDJSON, "sales.ndjson"},
+		{"sales.2024", FormatJSON, "sales.2024.json"},
+	} {
+		if got := Filename(tt.name, tt.format); got != tt.want {
+			t.Errorf("Filename(%q, %q) = %q, want %q", tt.name, tt.format, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+
+	adminv1 "chart-organizer/backend/gen/contracts/admin/v1"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/policy"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	datasetRepo "chart-organizer/backend/internal/repository/dataset"
+	lockoutRepo "chart-organizer/backend/internal/repository/lockout"
+	sessionRepo "chart-organizer/backend/internal/repository/session"
+	vizRepo "chart-organizer/backend/internal/repository/viz"
+	"chart-organizer/backend/internal/storage"
+)
+
+// AdminHandler serves the AdminService.
+// The admin role is checked by interceptors.NewAdminInterceptor before any of these run.
+type AdminHandler struct {
+	DB      *sql.DB
+	Storage storage.Storage
+	Policy  *policy.Policy
+}
+
+const defaultPageSize = 50
+const maxPageSize = 500
+
+var errUserNotFound = connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+
+// Make sure the user exists, and that admins don't lock themselves out
+func (h *AdminHandler) checkTargetUser(ctx context.Context, userId string) (authRepo.User, error) {
+	if currentUserId, _ := interceptors.GetUserId(ctx); currentUserId == userId {
+		return authRepo.User{}, connect.NewError(connect.CodeFailedPrecondition, errors.New("administrators can't change their own account here"))
+	}
+
+	user, err := authRepo.GetUser(h.DB, userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, errUserNotFound
+		}
+		return user, connect.NewError(connect.CodeInternal, err)
+	}
+	return user, nil
+}
+
+// ListUsers implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) ListUsers(
+	ctx context.Context,
+	req *connect.Request[adminv1.ListUsersRequest],
+) (*connect.Response[adminv1.ListUsersResponse], error) {
+	pageSize := int(req.Msg.PageSize)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pageSize = min(pageSize, maxPageSize)
+
+	users, err := authRepo.SearchUsers(h.DB, req.Msg.Query, pageSize, max(int(req.Msg.Offset), 0))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var resUsers []*adminv1.AdminUser
+	for _, u := range users {
+		resUsers = append(resUsers, &adminv1.AdminUser{
+			Id:        u.ID,
+			Username:  u.Username,
+			Role:      u.Role,
+			Disabled:  u.Disabled,
+			CreatedAt: u.CreatedAt,
+		})
+	}
+
+	res := &adminv1.ListUsersResponse{
+		Users: resUsers,
+	}
+	return connect.NewResponse(res), nil
+}
+
+// DisableUser implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) DisableUser(
+	ctx context.Context,
+	req *connect.Request[adminv1.DisableUserRequest],
+) (*connect.Response[adminv1.DisableUserResponse], error) {
+	if _, err := h.checkTargetUser(ctx, req.Msg.UserId); err != nil {
+		return nil, err
+	}
+
+	err := authRepo.SetDisabled(h.DB, req.Msg.UserId, true)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	err = sessionRepo.RevokeAllSessions(h.DB, req.Msg.UserId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&adminv1.DisableUserResponse{}), nil
+}
+
+// EnableUser implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) EnableUser(
+	ctx context.Context,
+	req *connect.Request[adminv1.EnableUserRequest],
+) (*connect.Response[adminv1.EnableUserResponse], error) {
+	if _, err := h.checkTargetUser(ctx, req.Msg.UserId); err != nil {
+		return nil, err
+	}
+
+	err := authRepo.SetDisabled(h.DB, req.Msg.UserId, false)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&adminv1.EnableUserResponse{}), nil
+}
+
+// SetUserRole implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) SetUserRole(
+	ctx context.Context,
+	req *connect.Request[adminv1.SetUserRoleRequest],
+) (*connect.Response[adminv1.SetUserRoleResponse], error) {
+	if req.Msg.Role != authRepo.RoleUser && req.Msg.Role != authRepo.RoleAdmin {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("role must be %q or %q", authRepo.RoleUser, authRepo.RoleAdmin))
+	}
+	if _, err := h.checkTargetUser(ctx, req.Msg.UserId); err != nil {
+		return nil, err
+	}
+
+	err := authRepo.SetRole(h.DB, req.Msg.UserId, req.Msg.Role)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	// The role is carried in the access token, so make the user log in again
+	err = sessionRepo.RevokeAllSessions(h.DB, req.Msg.UserId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&adminv1.SetUserRoleResponse{}), nil
+}
+
+// ResetPassword implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) ResetPassword(
+	ctx context.Context,
+	req *connect.Request[adminv1.ResetPasswordRequest],
+) (*connect.Response[adminv1.ResetPasswordResponse], error) {
+	user, err := h.checkTargetUser(ctx, req.Msg.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if violations := h.Policy.CheckPassword(req.Msg.NewPassword, user.Username); len(violations) > 0 {
+		return nil, policy.NewError(connect.CodeInvalidArgument, violations)
+	}
+
+	err = authRepo.UpdatePassword(h.DB, req.Msg.UserId, req.Msg.NewPassword)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to update password"))
+	}
+
+	err = sessionRepo.RevokeAllSessions(h.DB, req.Msg.UserId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&adminv1.ResetPasswordResponse{}), nil
+}
+
+// GetStorageUsage implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) GetStorageUsage(
+	ctx context.Context,
+	req *connect.Request[adminv1.GetStorageUsageRequest],
+) (*connect.Response[adminv1.GetStorageUsageResponse], error) {
+	_, err := authRepo.GetUser(h.DB, req.Msg.UserId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errUserNotFound
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	datasets, err := datasetRepo.GetDatasetsUploadedByUser(h.DB, req.Msg.UserId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &adminv1.GetStorageUsageResponse{}
+	for _, d := range datasets {
+		size, err := datasetRepo.GetDatasetStorageSize(h.DB, h.Storage, d.ID)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+
+		res.TotalBytes += size
+		res.Datasets = append(res.Datasets, &adminv1.DatasetUsage{
+			Id:        d.ID,
+			Name:      d.Name,
+			SizeBytes: size,
+		})
+	}
+
+	return connect.NewResponse(res), nil
+}
+
+// DeleteDataset implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) DeleteDataset(
+	ctx context.Context,
+	req *connect.Request[adminv1.DeleteDatasetRequest],
+) (*connect.Response[adminv1.DeleteDatasetResponse], error) {
+	err := datasetRepo.DeleteDataset(h.DB, h.Storage, req.Msg.DatasetId, true)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&adminv1.DeleteDatasetResponse{}), nil
+}
+
+// DeleteDashboard implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) DeleteDashboard(
+	ctx context.Context,
+	req *connect.Request[adminv1.DeleteDashboardRequest],
+) (*connect.Response[adminv1.DeleteDashboardResponse], error) {
+	err := vizRepo.DeleteDashboard(h.DB, req.Msg.DashboardId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dashboard not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&adminv1.DeleteDashboardResponse{}), nil
+}
+
+// ListLockouts implements adminv1connect.AdminServiceHandler.
+func (h *AdminHandler) ListLockouts(
+	ctx context.Context,
+	req *connect.Request[adminv1.ListLockoutsRequest],
+) (*connect.Response[adminv1.ListLockoutsResponse], error) {
+	limit := int(req.Msg.Limit)
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	lockouts, err := lockoutRepo.GetLockouts(h.DB, limit)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var resLockouts []*adminv1.Lockout
+	for _, l := range lockouts {
+		resLockouts = append(resLockouts, &adminv1.Lockout{
+			Id:          l.ID,
+			KeyType:     l.KeyType,
+			Key:         l.Key,
+			Failures:    int32(l.Failures),
+			LockedAt:    l.LockedAt,
+			LockedUntil: l.LockedUntil,
+		})
+	}
+
+	res := &adminv1.ListLockoutsResponse{
+		Lockouts: resLockouts,
+	}
+	return connect.NewResponse(res), nil
+}
@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+
+	adminv1 "chart-organizer/backend/gen/contracts/admin/v1"
+	"chart-organizer/backend/gen/contracts/admin/v1/adminv1connect"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/keyring"
+	"chart-organizer/backend/internal/repository/apikey"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	"chart-organizer/backend/internal/repository/repositorytest"
+	sessionRepo "chart-organizer/backend/internal/repository/session"
+)
+
+type testServer struct {
+	db     *sql.DB
+	keys   *keyring.Keyring
+	client adminv1connect.AdminServiceClient
+}
+
+// Serve the admin service behind the interceptors of the real server
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	db := repositorytest.NewDB(t)
+	keys, err := keyring.New([]*keyring.Key{keyring.NewHMACKey("test", []byte("0123456789abcdef0123456789abcdef"))}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(adminv1connect.NewAdminServiceHandler(&AdminHandler{DB: db},
+		connect.WithInterceptors(interceptors.NewAuthInterceptor(db, keys), interceptors.NewAdminInterceptor())))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return &testServer{db: db, keys: keys, client: adminv1connect.NewAdminServiceClient(server.Client(), server.URL)}
+}
+
+// Create a user with the role and return their ID and the access token of a new session
+func (s *testServer) login(t *testing.T, username string, role string) (string, string) {
+	t.Helper()
+	if err := authRepo.AddNewUser(s.db, username, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	userID, err := authRepo.GetUserID(s.db, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authRepo.SetRole(s.db, userID, role); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, _, err := sessionRepo.CreateSession(s.db, userID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.keys.Sign(&interceptors.Claims{
+		UserID:           userID,
+		Username:         username,
+		Role:             role,
+		SessionID:        sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID, token
+}
+
+func listUsers(s *testServer, authorization string) error {
+	req := connect.NewRequest(&adminv1.ListUsersRequest{})
+	if authorization != "" {
+		req.Header().Set("Authorization", authorization)
+	}
+	_, err := s.client.ListUsers(context.Background(), req)
+	return err
+}
+
+func TestAdminRoleRequired(t *testing.T) {
+	s := newTestServer(t)
+	adminID, adminToken := s.login(t, "alice", authRepo.RoleAdmin)
+	_, userToken := s.login(t, "bob", authRepo.RoleUser)
+	_, key, err := apikey.CreateApiKey(s.db, adminID, "script", interceptors.Scopes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name          string
+		authorization string
+		code          connect.Code
+	}{
+		{"anonymous", "", connect.CodeUnauthenticated},
+		{"user", "Bearer " + userToken, connect.CodePermissionDenied},
+		// API keys never act as administrators, not even those of one
+		{"API key of an admin", "ApiKey " + key, connect.CodePermissionDenied},
+		{"admin", "Bearer " + adminToken, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := listUsers(s, tt.authorization)
+			if connect.CodeOf(err) != tt.code && (tt.code != 0 || err != nil) {
+				t.Errorf("got %v, want %v", err, tt.code)
+			}
+		})
+	}
+}
+
+// The role is carried by the access token, so changing it ends the sessions
+// of the user rather than letting a demoted admin keep using theirs
+func TestDemotedAdminIsLoggedOut(t *testing.T) {
+	s := newTestServer(t)
+	_, aliceToken := s.login(t, "alice", authRepo.RoleAdmin)
+	bobID, bobToken := s.login(t, "bob", authRepo.RoleAdmin)
+
+	req := connect.NewRequest(&adminv1.SetUserRoleRequest{UserId: bobID, Role: authRepo.RoleUser})
+	req.Header().Set("Authorization", "Bearer "+aliceToken)
+	if _, err := s.client.SetUserRole(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if err := listUsers(s, "Bearer "+bobToken); connect.CodeOf(err) != connect.CodeUnauthenticated {
+		t.Errorf("token of the demoted admin: got %v, want unauthenticated", err)
+	}
+}
+
+func TestAdminCannotChangeOwnAccount(t *testing.T) {
+	s := newTestServer(t)
+	aliceID, aliceToken := s.login(t, "alice", authRepo.RoleAdmin)
+	ctx := context.Background()
+
+	disable := connect.NewRequest(&adminv1.DisableUserRequest{UserId: aliceID})
+	disable.Header().Set("Authorization", "Bearer "+aliceToken)
+	if _, err := s.client.DisableUser(ctx, disable); connect.CodeOf(err) != connect.CodeFailedPrecondition {
+		t.Errorf("DisableUser: got %v, want failed precondition", err)
+	}
+	demote := connect.NewRequest(&adminv1.SetUserRoleRequest{UserId: aliceID, Role: authRepo.RoleUser})
+	demote.Header().Set("Authorization", "Bearer "+aliceToken)
+	if _, err := s.client.SetUserRole(ctx, demote); connect.CodeOf(err) != connect.CodeFailedPrecondition {
+		t.Errorf("SetUserRole: got %v, want failed precondition", err)
+	}
+	unknown := connect.NewRequest(&adminv1.DisableUserRequest{UserId: "unknown"})
+	unknown.Header().Set("Authorization", "Bearer "+aliceToken)
+	if _, err := s.client.DisableUser(ctx, unknown); connect.CodeOf(err) != connect.CodeNotFound {
+		t.Errorf("DisableUser of an unknown user: got %v, want not found", err)
+	}
+
+	if err := listUsers(s, "Bearer "+aliceToken); err != nil {
+		t.Errorf("the admin was locked out: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"connectrpc.com/connect"
+
+	apikeyv1 "chart-organizer/backend/gen/contracts/apikey/v1"
+	"chart-organizer/backend/internal/interceptors"
+	apikeyRepo "chart-organizer/backend/internal/repository/apikey"
+)
+
+type ApiKeyHandler struct {
+	DB *sql.DB
+}
+
+// API keys can only be managed by a user logged in with a session,
+// otherwise a leaked key could be used to mint new ones.
+func getSessionUserId(ctx context.Context) (string, error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return "", connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func toProto(k apikeyRepo.ApiKey) *apikeyv1.ApiKey {
+	return &apikeyv1.ApiKey{
+		Id:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     k.Scopes,
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
+
+// CreateApiKey implements apikeyv1connect.ApiKeyServiceHandler.
+func (h *ApiKeyHandler) CreateApiKey(
+	ctx context.Context,
+	req *connect.Request[apikeyv1.CreateApiKeyRequest],
+) (*connect.Response[apikeyv1.CreateApiKeyResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate input
+	if req.Msg.Name == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("name is required"))
+	}
+	if len(req.Msg.Scopes) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("at least one scope is required"))
+	}
+	var scopes []string
+	for _, scope := range req.Msg.Scopes {
+		if !slices.Contains(interceptors.Scopes, scope) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("unknown scope %q", scope))
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	expiresAt := ""
+	if req.Msg.ExpiresAt != "" {
+		expiry, err := time.Parse(time.RFC3339, req.Msg.ExpiresAt)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("expires_at must be an RFC 3339 timestamp"))
+		}
+		if expiry.Before(time.Now()) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("expires_at must be in the future"))
+		}
+		expiresAt = expiry.Format(time.RFC3339)
+	}
+
+	apiKey, key, err := apikeyRepo.CreateApiKey(h.DB, userId, req.Msg.Name, scopes, expiresAt)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &apikeyv1.CreateApiKeyResponse{
+		ApiKey: toProto(apiKey),
+		Key:    key,
+	}
+	return connect.NewResponse(res), nil
+}
+
+// ListApiKeys implements apikeyv1connect.ApiKeyServiceHandler.
+func (h *ApiKeyHandler) ListApiKeys(
+	ctx context.Context,
+	req *connect.Request[apikeyv1.ListApiKeysRequest],
+) (*connect.Response[apikeyv1.ListApiKeysResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := apikeyRepo.GetAllApiKeysFromUser(h.DB, userId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var resApiKeys []*apikeyv1.ApiKey
+	for _, k := range apiKeys {
+		resApiKeys = append(resApiKeys, toProto(k))
+	}
+
+	res := &apikeyv1.ListApiKeysResponse{
+		ApiKeys: resApiKeys,
+	}
+	return connect.NewResponse(res), nil
+}
+
+// RevokeApiKey implements apikeyv1connect.ApiKeyServiceHandler.
+func (h *ApiKeyHandler) RevokeApiKey(
+	ctx context.Context,
+	req *connect.Request[apikeyv1.RevokeApiKeyRequest],
+) (*connect.Response[apikeyv1.RevokeApiKeyResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = apikeyRepo.RevokeApiKey(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		if errors.Is(err, apikeyRepo.ErrApiKeyNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&apikeyv1.RevokeApiKeyResponse{}), nil
+}
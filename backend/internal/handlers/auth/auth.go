@@ -4,7 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"log"
@@ -14,33 +20,199 @@ import (
 
 	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
 	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/keyring"
+	"chart-organizer/backend/internal/oidc"
+	"chart-organizer/backend/internal/policy"
 	authRepo "chart-organizer/backend/internal/repository/auth"
+	datasetRepo "chart-organizer/backend/internal/repository/dataset"
+	lockoutRepo "chart-organizer/backend/internal/repository/lockout"
+	organizationRepo "chart-organizer/backend/internal/repository/organization"
+	sessionRepo "chart-organizer/backend/internal/repository/session"
+	totpRepo "chart-organizer/backend/internal/repository/totp"
+	"chart-organizer/backend/internal/storage"
 )
 
+// AccessTokenTTL defines how long an access token is valid.
+// Access tokens are kept short-lived so that revoking a session takes effect quickly.
+const AccessTokenTTL = 15 * time.Minute
+
 type AuthHandler struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Storage storage.Storage
+	Keyring *keyring.Keyring
+	// Nil when single sign-on is not configured
+	Oidc   *oidc.Provider
+	Policy *policy.Policy
 }
 
-func generateJWT(username string, userID string) (string, error) {
-	jwtKey := []byte(os.Getenv("JWT_KEY"))
+func (s *AuthHandler) generateJWT(user authRepo.User, sessionID string) (string, error) {
 	currentTime := time.Now()
-	expirationTime := currentTime.Add(24 * time.Hour)
+	expirationTime := currentTime.Add(AccessTokenTTL)
 	claims := &interceptors.Claims{
-		Username: username,
-		UserID:   userID,
+		Username:  user.Username,
+		UserID:    user.ID,
+		Role:      user.Role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(currentTime),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	return s.Keyring.Sign(claims)
+}
+
+var errAccountDisabled = connect.NewError(connect.CodePermissionDenied, errors.New("account is disabled"))
+
+// Start a new session for the user and return its access and refresh tokens.
+// Disabled users can't start a session.
+func (s *AuthHandler) startSession(userID string, userAgent string) (string, string, error) {
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		return "", "", connect.NewError(connect.CodeInternal, errors.New("failed to retrieve user"))
+	}
+	if user.Disabled {
+		return "", "", errAccountDisabled
+	}
+
+	sessionID, refreshToken, err := sessionRepo.CreateSession(s.DB, userID, userAgent)
+	if err != nil {
+		return "", "", connect.NewError(connect.CodeInternal, errors.New("failed to create session"))
+	}
+
+	token, err := s.generateJWT(user, sessionID)
+	if err != nil {
+		return "", "", connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+	}
+
+	return token, refreshToken, nil
+}
+
+// Confirm a sensitive change with the password of the user, or with a
+// reauthentication token if the user has no password because they log in
+// through an identity provider
+func (s *AuthHandler) confirmIdentity(userID string, password string, reauthenticationToken string) error {
+	if reauthenticationToken != "" {
+		subject, err := s.parseReauthenticationToken(reauthenticationToken)
+		if err != nil || subject != userID {
+			return connect.NewError(connect.CodePermissionDenied, errors.New("invalid or expired reauthentication token"))
+		}
+		return nil
+	}
+
+	hasPassword, err := authRepo.HasPassword(s.DB, userID)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !hasPassword {
+		return connect.NewError(connect.CodeFailedPrecondition, errors.New("the account has no password, reauthenticate with single sign-on"))
+	}
+	if password == "" {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("password is required"))
+	}
+
+	isValid, err := authRepo.CheckPassword(s.DB, userID, password)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !isValid {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("password is incorrect"))
+	}
+	return nil
+}
+
+// Get the IP of the client.
+// X-Forwarded-For is only trusted when TRUST_FORWARDED_FOR is set, i.e. when
+// the backend runs behind reverse proxies that append the address of their
+// peer to it. Entries left of those the proxies appended are sent by the
+// client, so the one appended by the outermost proxy is taken.
+func clientIP(peerAddr string, forwardedFor []string) string {
+	if proxies := trustedProxies(); proxies > 0 {
+		var entries []string
+		for _, header := range forwardedFor {
+			for _, entry := range strings.Split(header, ",") {
+				entries = append(entries, strings.TrimSpace(entry))
+			}
+		}
+		if len(entries) >= proxies && entries[len(entries)-proxies] != "" {
+			return entries[len(entries)-proxies]
+		}
+	}
+	host, _, err := net.SplitHostPort(peerAddr)
+	if err != nil {
+		return peerAddr
+	}
+	return host
+}
+
+// The number of reverse proxies in front of the backend, from TRUST_FORWARDED_FOR.
+// "true" stands for one.
+func trustedProxies() int {
+	value := os.Getenv("TRUST_FORWARDED_FOR")
+	if value == "true" {
+		return 1
+	}
+	proxies, err := strconv.Atoi(value)
+	if err != nil || proxies < 0 {
+		return 0
+	}
+	return proxies
+}
+
+func lockedOutError(lockedUntil time.Time) error {
+	retryAfter := int64(math.Ceil(time.Until(lockedUntil).Seconds()))
+	connectErr := connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("too many failed logins, try again in %d seconds", retryAfter))
+	connectErr.Meta().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	if detail, err := connect.NewErrorDetail(&authv1.RetryInfo{
+		RetryAfterSeconds: retryAfter,
+		RetryAt:           lockedUntil.Format(time.RFC3339),
+	}); err == nil {
+		connectErr.AddDetail(detail)
+	}
+	return connectErr
+}
+
+// Check that neither the username nor the client is locked out.
+// Returns the zero time if logging in is allowed.
+func (s *AuthHandler) getLockedUntil(username string, ip string) (time.Time, error) {
+	usernameLockedUntil, err := lockoutRepo.GetLockedUntil(s.DB, lockoutRepo.KeyTypeUsername, username)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ipLockedUntil, err := lockoutRepo.GetLockedUntil(s.DB, lockoutRepo.KeyTypeIP, ip)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if ipLockedUntil.After(usernameLockedUntil) {
+		return ipLockedUntil, nil
+	}
+	return usernameLockedUntil, nil
+}
+
+// Record a failed login for both the username and the client.
+// Returns the time until which either is now locked, or the zero time.
+func (s *AuthHandler) recordLoginFailure(username string, ip string) (time.Time, error) {
+	usernameLockedUntil, err := lockoutRepo.RecordFailure(s.DB, lockoutRepo.UsernamePolicy, lockoutRepo.KeyTypeUsername, username)
 	if err != nil {
-		return "", err
+		return time.Time{}, err
+	}
+	ipLockedUntil, err := lockoutRepo.RecordFailure(s.DB, lockoutRepo.IPPolicy, lockoutRepo.KeyTypeIP, ip)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !usernameLockedUntil.IsZero() {
+		slog.Warn("Username locked out", "username", username, "until", usernameLockedUntil)
+	}
+	if !ipLockedUntil.IsZero() {
+		slog.Warn("Client IP locked out", "ip", ip, "until", ipLockedUntil)
 	}
 
-	return tokenString, nil
+	if ipLockedUntil.After(usernameLockedUntil) {
+		return ipLockedUntil, nil
+	}
+	return usernameLockedUntil, nil
 }
 
 func (s *AuthHandler) Signup(
@@ -53,14 +225,18 @@ func (s *AuthHandler) Signup(
 	password := req.Msg.Password
 
 	// Validate input
-	if username == "" || password == "" {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("username and password are required"))
+	violations := append(s.Policy.CheckUsername(username), s.Policy.CheckPassword(password, username)...)
+	if len(violations) > 0 {
+		return nil, policy.NewError(connect.CodeInvalidArgument, violations)
 	}
 
 	// Try to add the user
 	err := authRepo.AddNewUser(s.DB, username, password)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to create user: "+err.Error()))
+		if errors.Is(err, authRepo.ErrUsernameTaken) {
+			return nil, policy.UsernameTakenError()
+		}
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to create user"))
 	}
 
 	// Get the user ID
@@ -69,14 +245,15 @@ func (s *AuthHandler) Signup(
 		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to retrieve user ID"))
 	}
 
-	// Generate JWT
-	token, err := generateJWT(username, userID)
+	// Start a session and generate its tokens
+	token, refreshToken, err := s.startSession(userID, req.Header().Get("User-Agent"))
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+		return nil, err
 	}
 
 	res := connect.NewResponse(&authv1.SignupResponse{
-		JwtToken: token,
+		JwtToken:     token,
+		RefreshToken: refreshToken,
 	})
 	return res, nil
 }
@@ -95,6 +272,16 @@ func (s *AuthHandler) Login(
 		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("username and password are required"))
 	}
 
+	// Refuse before running bcrypt if the username or client is locked out
+	ip := clientIP(req.Peer().Addr, req.Header().Values("X-Forwarded-For"))
+	lockedUntil, err := s.getLockedUntil(username, ip)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if !lockedUntil.IsZero() {
+		return nil, lockedOutError(lockedUntil)
+	}
+
 	// Check credentials
 	isValid, err := authRepo.CheckUsernameAndPassword(s.DB, username, password)
 	if err != nil {
@@ -102,23 +289,328 @@ func (s *AuthHandler) Login(
 	}
 
 	if !isValid {
+		lockedUntil, err := s.recordLoginFailure(username, ip)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		if !lockedUntil.IsZero() {
+			return nil, lockedOutError(lockedUntil)
+		}
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid username or password"))
 	}
 
+	err = lockoutRepo.ResetFailures(s.DB, lockoutRepo.KeyTypeUsername, username)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
 	// Get the user ID
 	userID, err := authRepo.GetUserID(s.DB, username)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to retrieve user ID"))
 	}
 
-	// Generate JWT
-	token, err := generateJWT(username, userID)
+	user, err := authRepo.GetUser(s.DB, userID)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to retrieve user"))
+	}
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+
+	// Users with two-factor authentication get a challenge instead of tokens
+	totpEnabled, err := totpRepo.IsTotpEnabled(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if totpEnabled {
+		challengeToken, err := s.generateChallengeToken(userID)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+		}
+
+		res := connect.NewResponse(&authv1.LoginResponse{
+			TotpRequired:   true,
+			ChallengeToken: challengeToken,
+		})
+		return res, nil
+	}
+
+	// Start a session and generate its tokens
+	token, refreshToken, err := s.startSession(userID, req.Header().Get("User-Agent"))
+	if err != nil {
+		return nil, err
 	}
 
 	res := connect.NewResponse(&authv1.LoginResponse{
-		JwtToken: token,
+		JwtToken:     token,
+		RefreshToken: refreshToken,
+	})
+	return res, nil
+}
+
+// RefreshToken implements authv1connect.AuthServiceHandler.
+// The refresh token is rotated, so the client must store the new one.
+func (s *AuthHandler) RefreshToken(
+	ctx context.Context,
+	req *connect.Request[authv1.RefreshTokenRequest],
+) (*connect.Response[authv1.RefreshTokenResponse], error) {
+	if req.Msg.RefreshToken == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("refresh token is required"))
+	}
+
+	sessionID, userID, refreshToken, err := sessionRepo.RotateRefreshToken(s.DB, req.Msg.RefreshToken)
+	if err != nil {
+		if errors.Is(err, sessionRepo.ErrInvalidRefreshToken) || errors.Is(err, sessionRepo.ErrRefreshTokenReused) {
+			return nil, connect.NewError(connect.CodeUnauthenticated, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to retrieve user"))
+	}
+
+	token, err := s.generateJWT(user, sessionID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+	}
+
+	res := connect.NewResponse(&authv1.RefreshTokenResponse{
+		JwtToken:     token,
+		RefreshToken: refreshToken,
+	})
+	return res, nil
+}
+
+// Logout implements authv1connect.AuthServiceHandler.
+// Without an access token, only the session of the given refresh token can be revoked.
+func (s *AuthHandler) Logout(
+	ctx context.Context,
+	req *connect.Request[authv1.LogoutRequest],
+) (*connect.Response[authv1.LogoutResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		if req.Msg.RefreshToken == "" {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+		}
+
+		err := sessionRepo.RevokeSessionByRefreshToken(s.DB, req.Msg.RefreshToken)
+		if err != nil {
+			if errors.Is(err, sessionRepo.ErrInvalidRefreshToken) {
+				return nil, connect.NewError(connect.CodeUnauthenticated, err)
+			}
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+
+		return connect.NewResponse(&authv1.LogoutResponse{}), nil
+	}
+
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch {
+	case req.Msg.AllSessions:
+		err = sessionRepo.RevokeAllSessions(s.DB, userID)
+	case req.Msg.SessionId != "":
+		err = sessionRepo.RevokeSession(s.DB, userID, req.Msg.SessionId)
+	default:
+		sessionID, _ := interceptors.GetSessionId(ctx)
+		err = sessionRepo.RevokeSession(s.DB, userID, sessionID)
+	}
+	if err != nil {
+		if errors.Is(err, sessionRepo.ErrSessionNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&authv1.LogoutResponse{}), nil
+}
+
+// ListSessions implements authv1connect.AuthServiceHandler.
+func (s *AuthHandler) ListSessions(
+	ctx context.Context,
+	req *connect.Request[authv1.ListSessionsRequest],
+) (*connect.Response[authv1.ListSessionsResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+	currentSessionID, _ := interceptors.GetSessionId(ctx)
+
+	sessions, err := sessionRepo.GetActiveSessions(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var resSessions []*authv1.Session
+	for _, session := range sessions {
+		resSessions = append(resSessions, &authv1.Session{
+			Id:         session.ID,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == currentSessionID,
+		})
+	}
+
+	res := connect.NewResponse(&authv1.ListSessionsResponse{
+		Sessions: resSessions,
+	})
+	return res, nil
+}
+
+// ChangePassword implements authv1connect.AuthServiceHandler.
+// Every session except the current one is revoked.
+func (s *AuthHandler) ChangePassword(
+	ctx context.Context,
+	req *connect.Request[authv1.ChangePasswordRequest],
+) (*connect.Response[authv1.ChangePasswordResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.confirmIdentity(userID, req.Msg.OldPassword, req.Msg.ReauthenticationToken); err != nil {
+		return nil, err
+	}
+
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if violations := s.Policy.CheckPassword(req.Msg.NewPassword, user.Username); len(violations) > 0 {
+		return nil, policy.NewError(connect.CodeInvalidArgument, violations)
+	}
+
+	err = authRepo.UpdatePassword(s.DB, userID, req.Msg.NewPassword)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to update password"))
+	}
+
+	sessionID, _ := interceptors.GetSessionId(ctx)
+	err = sessionRepo.RevokeOtherSessions(s.DB, userID, sessionID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&authv1.ChangePasswordResponse{}), nil
+}
+
+// DeleteAccount implements authv1connect.AuthServiceHandler.
+// The user's datasets, the dashboards built on them and the stored CSV files are deleted as well.
+func (s *AuthHandler) DeleteAccount(
+	ctx context.Context,
+	req *connect.Request[authv1.DeleteAccountRequest],
+) (*connect.Response[authv1.DeleteAccountResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.confirmIdentity(userID, req.Msg.Password, req.Msg.ReauthenticationToken); err != nil {
+		return nil, err
+	}
+
+	// Organizations must not be left without an owner
+	soleOwner, err := organizationRepo.IsSoleOwnerOfAny(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if soleOwner {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("transfer ownership of or delete your organizations first"))
+	}
+
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	// Everything of the account goes in one transaction, so that a failure
+	// leaves the account as it was. Stored files are removed once it is committed.
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	defer tx.Rollback()
+
+	datasetFiles, err := datasetRepo.DeleteAllDatasetsFromUser(tx, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to delete datasets: "+err.Error()))
+	}
+
+	uploadFiles, err := datasetRepo.RemoveUploadSessionsFromUser(tx, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to delete uploads: "+err.Error()))
+	}
+
+	err = authRepo.DeleteUser(tx, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to delete user: "+err.Error()))
+	}
+
+	// Failed logins are kept by username, which can be taken again by a new account
+	err = lockoutRepo.ResetFailuresTx(tx, lockoutRepo.KeyTypeUsername, user.Username)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to delete failed logins: "+err.Error()))
+	}
+
+	err = lockoutRepo.ResetFailuresTx(tx, lockoutRepo.KeyTypeTotp, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to delete failed logins: "+err.Error()))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	// The account is gone either way, files left behind are only logged
+	if err = datasetRepo.DeleteStoredFiles(s.Storage, append(datasetFiles, uploadFiles...)); err != nil {
+		slog.Error("Failed to delete the files of a deleted account", "user", userID, "error", err)
+	}
+
+	return connect.NewResponse(&authv1.DeleteAccountResponse{}), nil
+}
+
+// GetCurrentUser implements authv1connect.AuthServiceHandler.
+func (s *AuthHandler) GetCurrentUser(
+	ctx context.Context,
+	req *connect.Request[authv1.GetCurrentUserRequest],
+) (*connect.Response[authv1.GetCurrentUserResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := connect.NewResponse(&authv1.GetCurrentUserResponse{
+		User: &authv1.User{
+			Id:        user.ID,
+			Username:  user.Username,
+			CreatedAt: user.CreatedAt,
+			Role:      user.Role,
+		},
 	})
 	return res, nil
 }
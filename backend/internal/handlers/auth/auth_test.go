@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+
+	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
+	"chart-organizer/backend/internal/ingest"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/keyring"
+	"chart-organizer/backend/internal/policy"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	datasetRepo "chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/repository/repositorytest"
+	sessionRepo "chart-organizer/backend/internal/repository/session"
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
+)
+
+// A handler for users signing up and logging in with passwords
+func newPasswordHandler(t *testing.T) *AuthHandler {
+	t.Helper()
+	db := repositorytest.NewDB(t)
+	keys, err := keyring.New([]*keyring.Key{keyring.NewHMACKey("test", []byte("0123456789abcdef0123456789abcdef"))}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AuthHandler{DB: db, Storage: storage.NewLocal(t.TempDir()), Keyring: keys, Policy: policy.Default()}
+}
+
+func accessClaims(t *testing.T, s *AuthHandler, token string) *interceptors.Claims {
+	t.Helper()
+	claims := &interceptors.Claims{}
+	if _, err := jwt.ParseWithClaims(token, claims, s.Keyring.Keyfunc); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func refresh(s *AuthHandler, refreshToken string) (*authv1.RefreshTokenResponse, error) {
+	res, err := s.RefreshToken(context.Background(), connect.NewRequest(&authv1.RefreshTokenRequest{RefreshToken: refreshToken}))
+	if err != nil {
+		return nil, err
+	}
+	return res.Msg, nil
+}
+
+func TestRefreshToken(t *testing.T) {
+	s := newPasswordHandler(t)
+	signup, err := s.Signup(context.Background(), connect.NewRequest(&authv1.SignupRequest{Username: "alice", Password: "correct horse battery"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := accessClaims(t, s, signup.Msg.JwtToken)
+	if err := authRepo.SetRole(s.DB, first.UserID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshing keeps the session and rotates the refresh token
+	refreshed, err := refresh(s, signup.Msg.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.RefreshToken == "" || refreshed.RefreshToken == signup.Msg.RefreshToken {
+		t.Errorf("refresh token %q was not rotated", refreshed.RefreshToken)
+	}
+	claims := accessClaims(t, s, refreshed.JwtToken)
+	// The access token has the current role of the user
+	if claims.SessionID != first.SessionID || claims.UserID != first.UserID || claims.Username != "alice" || claims.Role != "admin" {
+		t.Errorf("claims %+v, first %+v", claims, first)
+	}
+
+	again, err := refresh(s, refreshed.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replaced token is refused, and using it again ends the session
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"reused token", refreshed.RefreshToken, sessionRepo.ErrRefreshTokenReused},
+		{"token of the revoked session", again.RefreshToken, sessionRepo.ErrInvalidRefreshToken},
+		{"first token", signup.Msg.RefreshToken, sessionRepo.ErrRefreshTokenReused},
+		{"unknown token", "unknown", sessionRepo.ErrInvalidRefreshToken},
+	} {
+		_, err := refresh(s, tt.token)
+		var connectErr *connect.Error
+		if !errors.As(err, &connectErr) || connectErr.Code() != connect.CodeUnauthenticated || !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if active, err := sessionRepo.IsSessionActive(s.DB, first.UserID, first.SessionID); err != nil || active {
+		t.Errorf("session active %t, %v after a token was reused", active, err)
+	}
+
+	if _, err := refresh(s, ""); connect.CodeOf(err) != connect.CodeInvalidArgument {
+		t.Errorf("empty token: got %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	const peer = "10.0.0.2:51234"
+	for _, tt := range []struct {
+		trust        string
+		forwardedFor []string
+		want         string
+	}{
+		{"", []string{"203.0.113.7"}, "10.0.0.2"},
+		{"false", []string{"203.0.113.7"}, "10.0.0.2"},
+		{"true", nil, "10.0.0.2"},
+		{"true", []string{"203.0.113.7"}, "203.0.113.7"},
+		// The client sent a forged entry, which the proxy appended to
+		{"true", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"true", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"2", []string{"198.51.100.1, 203.0.113.7, 10.0.0.1"}, "203.0.113.7"},
+		// Fewer entries than proxies
+		{"2", []string{"203.0.113.7"}, "10.0.0.2"},
+		{"-1", []string{"203.0.113.7"}, "10.0.0.2"},
+	} {
+		t.Setenv("TRUST_FORWARDED_FOR", tt.trust)
+		if got := clientIP(peer, tt.forwardedFor); got != tt.want {
+			t.Errorf("TRUST_FORWARDED_FOR=%q, X-Forwarded-For %q: got %s, want %s", tt.trust, tt.forwardedFor, got, tt.want)
+		}
+	}
+}
+
+// Sign up alice with a personal dataset and an unfinished upload.
+// Returns the context of her requests and the directory of the stored files.
+func newAccount(t *testing.T, s *AuthHandler) (context.Context, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s.Storage = storage.NewLocal(dir)
+
+	signup, err := s.Signup(context.Background(), connect.NewRequest(&authv1.SignupRequest{Username: "alice", Password: "correct horse battery"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := accessClaims(t, s, signup.Msg.JwtToken)
+
+	_, err = datasetRepo.AddNewDataset(s.DB, s.Storage, claims.UserID, "", "personal", []byte("x\n1\n"), schema.Schema{Columns: []schema.Column{{Name: "x", Type: schema.TypeInteger}}, RowCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := datasetRepo.CreateUploadSession(s.DB, claims.UserID, "", "", "upload.csv", 8, ingest.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datasetRepo.WriteUploadChunk(s.DB, s.Storage, upload.ID, 0, []byte("x\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), interceptors.UserIDKey, claims.UserID)
+	ctx = context.WithValue(ctx, interceptors.SessionIDKey, claims.SessionID)
+	return ctx, dir
+}
+
+func storedFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	s := newPasswordHandler(t)
+	ctx, dir := newAccount(t, s)
+	userID, _ := interceptors.GetUserId(ctx)
+	if n := storedFiles(t, dir); n != 2 {
+		t.Fatalf("%d stored files before the deletion", n)
+	}
+
+	req := connect.NewRequest(&authv1.DeleteAccountRequest{Password: "wrong password"})
+	if _, err := s.DeleteAccount(ctx, req); connect.CodeOf(err) != connect.CodePermissionDenied {
+		t.Errorf("wrong password: got %v, want permission denied", err)
+	}
+
+	req = connect.NewRequest(&authv1.DeleteAccountRequest{Password: "correct horse battery"})
+	if _, err := s.DeleteAccount(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authRepo.GetUser(s.DB, userID); err != sql.ErrNoRows {
+		t.Errorf("the user is still there: %v", err)
+	}
+	for _, table := range []string{"datasets", "upload_sessions", "upload_chunks", "sessions"} {
+		var n int
+		if err := s.DB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil || n != 0 {
+			t.Errorf("%d rows left in %s, %v", n, table, err)
+		}
+	}
+	if n := storedFiles(t, dir); n != 0 {
+		t.Errorf("%d stored files left", n)
+	}
+}
+
+// An account that can't be deleted completely is kept as it was
+func TestDeleteAccountRollsBack(t *testing.T) {
+	s := newPasswordHandler(t)
+	ctx, dir := newAccount(t, s)
+	userID, _ := interceptors.GetUserId(ctx)
+
+	// Deleting the second factor fails after the datasets and uploads are gone
+	if _, err := s.DB.Exec("DROP TABLE user_totp"); err != nil {
+		t.Fatal(err)
+	}
+	req := connect.NewRequest(&authv1.DeleteAccountRequest{Password: "correct horse battery"})
+	if _, err := s.DeleteAccount(ctx, req); connect.CodeOf(err) != connect.CodeInternal {
+		t.Fatalf("got %v, want internal", err)
+	}
+
+	if _, err := authRepo.GetUser(s.DB, userID); err != nil {
+		t.Errorf("the user is gone: %v", err)
+	}
+	datasets, err := datasetRepo.GetAllDatasetsFromUser(s.DB, userID)
+	if err != nil || len(datasets) != 1 {
+		t.Errorf("datasets %+v, %v", datasets, err)
+	}
+	var uploads int
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM upload_chunks").Scan(&uploads); err != nil || uploads != 1 {
+		t.Errorf("%d upload chunks, %v", uploads, err)
+	}
+	if n := storedFiles(t, dir); n != 2 {
+		t.Errorf("%d stored files left of 2", n)
+	}
+}
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+
+	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
+	"chart-organizer/backend/internal/oidc"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	oidcRepo "chart-organizer/backend/internal/repository/oidc"
+	totpRepo "chart-organizer/backend/internal/repository/totp"
+)
+
+var errOidcDisabled = connect.NewError(connect.CodeFailedPrecondition, errors.New("single sign-on is not configured"))
+
+// The state of a login is also kept in a cookie, so that a login can only be
+// completed in the browser that started it. Otherwise a user could be sent to
+// the callback with the code and state of someone else's login, and be
+// logged in to their account.
+const oidcStateCookie = "oidc_state"
+
+// How often a number is appended to a username taken by another user
+const maxUsernameSuffix = 20
+
+// ReauthenticationTTL defines how long a reauthentication token confirms sensitive changes.
+// The user must also have authenticated at the identity provider this recently.
+const ReauthenticationTTL = 5 * time.Minute
+
+// The audience of reauthentication tokens, so that they can't be used in place of another token
+const reauthenticationTokenAudience = "reauthentication"
+
+func (s *AuthHandler) generateReauthenticationToken(userID string) (string, error) {
+	currentTime := time.Now()
+	claims := &jwt.RegisteredClaims{
+		Subject:   userID,
+		Audience:  jwt.ClaimStrings{reauthenticationTokenAudience},
+		IssuedAt:  jwt.NewNumericDate(currentTime),
+		ExpiresAt: jwt.NewNumericDate(currentTime.Add(ReauthenticationTTL)),
+	}
+	return s.Keyring.Sign(claims)
+}
+
+// Returns the user ID the reauthentication token was issued for
+func (s *AuthHandler) parseReauthenticationToken(tokenString string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, s.Keyring.Keyfunc,
+		jwt.WithAudience(reauthenticationTokenAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+func (s *AuthHandler) stateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.Oidc.RedirectURL(), "https://"),
+		// Lax, so that the cookie is sent on the redirect back from the identity provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Create the state of a login and the cookie that binds it to the browser.
+// Returns the URL of the identity provider.
+func (s *AuthHandler) beginOidcLogin(reauthenticate bool) (string, *http.Cookie, error) {
+	state, err := oidc.NewLoginState()
+	if err != nil {
+		return "", nil, connect.NewError(connect.CodeInternal, err)
+	}
+	state.Reauthenticate = reauthenticate
+
+	err = oidcRepo.AddLoginState(s.DB, state)
+	if err != nil {
+		return "", nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	cookie := s.stateCookie(state.State, int(oidcRepo.LoginStateTTL.Seconds()))
+	return s.Oidc.AuthorizationURL(state), cookie, nil
+}
+
+// BeginOidcLogin implements authv1connect.AuthServiceHandler.
+func (s *AuthHandler) BeginOidcLogin(
+	ctx context.Context,
+	req *connect.Request[authv1.BeginOidcLoginRequest],
+) (*connect.Response[authv1.BeginOidcLoginResponse], error) {
+	if s.Oidc == nil {
+		return nil, errOidcDisabled
+	}
+
+	authorizationURL, cookie, err := s.beginOidcLogin(req.Msg.Reauthenticate)
+	if err != nil {
+		return nil, err
+	}
+
+	res := connect.NewResponse(&authv1.BeginOidcLoginResponse{
+		AuthorizationUrl: authorizationURL,
+	})
+	res.Header().Add("Set-Cookie", cookie.String())
+	return res, nil
+}
+
+// OidcLoginHandler starts a single sign-on login and redirects the browser to
+// the identity provider, for frontends that can't keep cookies of the backend.
+// With ?reauthenticate=true, the login confirms a sensitive change.
+func (s *AuthHandler) OidcLoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Oidc == nil {
+			http.Error(w, errOidcDisabled.Message(), http.StatusNotFound)
+			return
+		}
+
+		authorizationURL, cookie, err := s.beginOidcLogin(r.URL.Query().Get("reauthenticate") == "true")
+		if err != nil {
+			http.Error(w, "failed to start the login", http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, cookie)
+		http.Redirect(w, r, authorizationURL, http.StatusFound)
+	})
+}
+
+// CompleteOidcLogin implements authv1connect.AuthServiceHandler.
+func (s *AuthHandler) CompleteOidcLogin(
+	ctx context.Context,
+	req *connect.Request[authv1.CompleteOidcLoginRequest],
+) (*connect.Response[authv1.CompleteOidcLoginResponse], error) {
+	if s.Oidc == nil {
+		return nil, errOidcDisabled
+	}
+
+	cookieState := ""
+	if cookie, err := (&http.Request{Header: req.Header()}).Cookie(oidcStateCookie); err == nil {
+		cookieState = cookie.Value
+	}
+
+	result, err := s.completeOidcLogin(ctx, req.Msg.Code, req.Msg.State, cookieState, req.Header().Get("User-Agent"))
+	if err != nil {
+		return nil, err
+	}
+
+	res := connect.NewResponse(result)
+	res.Header().Add("Set-Cookie", s.stateCookie("", -1).String())
+	return res, nil
+}
+
+// OidcCallbackHandler handles the redirect back from the identity provider.
+// On success, the user is sent to postLoginRedirect with the tokens, or the
+// challenge of the second factor, in the URL fragment, so they never reach
+// any server logs. On failure, the fragment carries an error instead.
+func (s *AuthHandler) OidcCallbackHandler(postLoginRedirect string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fragment := url.Values{}
+
+		query := r.URL.Query()
+		if providerError := query.Get("error"); providerError != "" {
+			fragment.Set("error", providerError)
+		} else if s.Oidc == nil {
+			fragment.Set("error", errOidcDisabled.Message())
+		} else {
+			cookieState := ""
+			if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+				cookieState = cookie.Value
+			}
+
+			result, err := s.completeOidcLogin(r.Context(), query.Get("code"), query.Get("state"), cookieState, r.UserAgent())
+			if err != nil {
+				var connectErr *connect.Error
+				if errors.As(err, &connectErr) {
+					fragment.Set("error", connectErr.Message())
+				} else {
+					fragment.Set("error", err.Error())
+				}
+			} else if result.ReauthenticationToken != "" {
+				fragment.Set("reauthentication_token", result.ReauthenticationToken)
+			} else if result.TotpRequired {
+				fragment.Set("totp_required", "true")
+				fragment.Set("challenge_token", result.ChallengeToken)
+			} else {
+				fragment.Set("jwt_token", result.JwtToken)
+				fragment.Set("refresh_token", result.RefreshToken)
+			}
+			http.SetCookie(w, s.stateCookie("", -1))
+		}
+
+		http.Redirect(w, r, postLoginRedirect+"#"+fragment.Encode(), http.StatusFound)
+	})
+}
+
+// Redeem the code, find or provision the user linked to the subject and start
+// a session, or issue a challenge if the user has a second factor.
+// A reauthentication returns a reauthentication token instead.
+func (s *AuthHandler) completeOidcLogin(ctx context.Context, code string, state string, cookieState string, userAgent string) (*authv1.CompleteOidcLoginResponse, error) {
+	if code == "" || state == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("code and state are required"))
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(cookieState)) != 1 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("the login was not started in this browser"))
+	}
+
+	loginState, err := oidcRepo.TakeLoginState(s.DB, state)
+	if err != nil {
+		if errors.Is(err, oidcRepo.ErrInvalidLoginState) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	claims, err := s.Oidc.Exchange(ctx, code, loginState)
+	if err != nil {
+		slog.Warn("OIDC login failed", "error", err)
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("single sign-on failed"))
+	}
+
+	if loginState.Reauthenticate {
+		return s.completeReauthentication(claims)
+	}
+
+	// Provision the user on their first login
+	userID, err := authRepo.GetUserIDByIdentity(s.DB, s.Oidc.Issuer(), claims.Subject)
+	if err == sql.ErrNoRows {
+		var usernames []string
+		usernames, err = s.externalUsernames(claims)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		if len(usernames) == 0 {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("no username allowed by the username policy could be derived from the identity provider"))
+		}
+		userID, _, err = authRepo.AddNewExternalUser(s.DB, usernames, s.Oidc.Issuer(), claims.Subject)
+	}
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to provision user: "+err.Error()))
+	}
+
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to retrieve user"))
+	}
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+
+	// The identity provider replaces the password, not the second factor
+	totpEnabled, err := totpRepo.IsTotpEnabled(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if totpEnabled {
+		challengeToken, err := s.generateChallengeToken(userID)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+		}
+		return &authv1.CompleteOidcLoginResponse{TotpRequired: true, ChallengeToken: challengeToken}, nil
+	}
+
+	token, refreshToken, err := s.startSession(userID, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authv1.CompleteOidcLoginResponse{JwtToken: token, RefreshToken: refreshToken}, nil
+}
+
+// Issue a reauthentication token to the user linked to the subject, if they
+// have just authenticated at the identity provider
+func (s *AuthHandler) completeReauthentication(claims *oidc.IDTokenClaims) (*authv1.CompleteOidcLoginResponse, error) {
+	if claims.AuthTime == nil || time.Since(claims.AuthTime.Time) > ReauthenticationTTL {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("the identity provider did not ask for the login again"))
+	}
+
+	userID, err := authRepo.GetUserIDByIdentity(s.DB, s.Oidc.Issuer(), claims.Subject)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("no user is linked to this identity"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	token, err := s.generateReauthenticationToken(userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to generate token"))
+	}
+	return &authv1.CompleteOidcLoginResponse{ReauthenticationToken: token}, nil
+}
+
+// Usernames to try for a new user, in order. The names the identity provider
+// suggests must pass the username policy like the ones chosen at signup. If
+// they are taken, a number is appended, and a random name comes last.
+func (s *AuthHandler) externalUsernames(claims *oidc.IDTokenClaims) ([]string, error) {
+	allowed := func(username string) bool {
+		return len(s.Policy.CheckUsername(username)) == 0
+	}
+
+	var usernames []string
+	candidates := []string{claims.PreferredUsername}
+	if local, _, found := strings.Cut(claims.Email, "@"); found {
+		candidates = append(candidates, local)
+	}
+	for _, candidate := range candidates {
+		if candidate == "" || !allowed(candidate) {
+			continue
+		}
+		usernames = append(usernames, candidate)
+		for i := 2; i <= maxUsernameSuffix; i++ {
+			if username := candidate + "-" + strconv.Itoa(i); allowed(username) {
+				usernames = append(usernames, username)
+			}
+		}
+		break
+	}
+
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	if username := "user-" + hex.EncodeToString(random); allowed(username) {
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+
+	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/oidc"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	totpRepo "chart-organizer/backend/internal/repository/totp"
+)
+
+const postLoginRedirect = "http://frontend.test/login"
+
+// A user at the stand-in identity provider
+type identity struct {
+	Subject           string
+	PreferredUsername string
+	Email             string
+	// When the user authenticated, not reported if zero
+	AuthTime time.Time
+}
+
+type authorization struct {
+	identity
+	nonce     string
+	challenge string
+}
+
+// testIdP is a stand-in identity provider that issues codes without a login
+// page and redeems them with PKCE
+type testIdP struct {
+	server *httptest.Server
+	key    ed25519.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, codes: make(map[string]authorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Metadata{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		x := base64.RawURLEncoding.EncodeToString(idp.key.Public().(ed25519.PublicKey))
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "kid": "idp", "use": "sig", "x": x}},
+		})
+	})
+	mux.HandleFunc("POST /token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// Let the identity sign in at the authorization URL. Returns the code and
+// state the identity provider redirects back with.
+func (idp *testIdP) authorize(t *testing.T, authorizationURL string, id identity) (string, string) {
+	t.Helper()
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code challenge method %q", query.Get("code_challenge_method"))
+	}
+
+	code := rand.Text()
+	idp.mu.Lock()
+	idp.codes[code] = authorization{identity: id, nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	idp.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	a, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != a.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := oidc.IDTokenClaims{
+		Nonce:             a.nonce,
+		Email:             a.Email,
+		PreferredUsername: a.PreferredUsername,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   a.Subject,
+			Audience:  jwt.ClaimStrings{"chart-organizer"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	if !a.AuthTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(a.AuthTime)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = "idp"
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func newTestHandler(t *testing.T, idp *testIdP) *AuthHandler {
+	t.Helper()
+	provider, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:      idp.server.URL,
+		ClientID:    "chart-organizer",
+		RedirectURL: "http://backend.test/auth/oidc/callback",
+		Scopes:      []string{"openid"},
+	}, idp.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newPasswordHandler(t)
+	s.Oidc = provider
+	return s
+}
+
+// Start a login in a browser. Returns the URL of the identity provider and the state cookie.
+func startLogin(t *testing.T, s *AuthHandler) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.OidcLoginHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login route: status %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || !cookies[0].HttpOnly {
+		t.Fatalf("login route: cookies %v", cookies)
+	}
+	return w.Header().Get("Location"), cookies[0]
+}
+
+// Follow the redirect back from the identity provider. Returns the fragment
+// the browser is sent on with.
+func callback(t *testing.T, s *AuthHandler, code string, state string, cookie *http.Cookie) url.Values {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.OidcCallbackHandler(postLoginRedirect).ServeHTTP(w, r)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Scheme+"://"+location.Host+location.Path != postLoginRedirect {
+		t.Fatalf("redirected to %s", location)
+	}
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragment
+}
+
+func login(t *testing.T, s *AuthHandler, idp *testIdP, id identity) url.Values {
+	t.Helper()
+	authorizationURL, cookie := startLogin(t, s)
+	code, state := idp.authorize(t, authorizationURL, id)
+	return callback(t, s, code, state, cookie)
+}
+
+// The user the access token in the fragment was issued to
+func loggedInUser(t *testing.T, s *AuthHandler, fragment url.Values) authRepo.User {
+	t.Helper()
+	user, _ := loggedInSession(t, s, fragment)
+	return user
+}
+
+// The user and the session the access token in the fragment was issued for
+func loggedInSession(t *testing.T, s *AuthHandler, fragment url.Values) (authRepo.User, string) {
+	t.Helper()
+	if fragment.Get("error") != "" {
+		t.Fatalf("login failed: %s", fragment.Get("error"))
+	}
+	if fragment.Get("refresh_token") == "" {
+		t.Fatal("no refresh token")
+	}
+	claims := &jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(fragment.Get("jwt_token"), claims, s.Keyring.Keyfunc); err != nil {
+		t.Fatal(err)
+	}
+	user, err := authRepo.GetUser(s.DB, (*claims)["user_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, (*claims)["sid"].(string)
+}
+
+func TestOidcLoginProvisionsAndLinksUsers(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestHandler(t, idp)
+	alice := identity{Subject: "1", PreferredUsername: "alice", Email: "alice@example.com"}
+
+	first := loggedInUser(t, s, login(t, s, idp, alice))
+	if first.Username != "alice" {
+		t.Errorf("username %q, want alice", first.Username)
+	}
+
+	// Renaming at the identity provider doesn't create another user
+	alice.PreferredUsername = "alice.renamed"
+	second := loggedInUser(t, s, login(t, s, idp, alice))
+	if second.ID != first.ID {
+		t.Errorf("second login got user %s, want %s", second.ID, first.ID)
+	}
+}
+
+func TestOidcLoginRequiresStateCookie(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestHandler(t, idp)
+	attacker := identity{Subject: "attacker", PreferredUsername: "mallory"}
+
+	// The attacker starts a login and sends the victim the callback URL of it
+	authorizationURL, attackerCookie := startLogin(t, s)
+	code, state := idp.authorize(t, authorizationURL, attacker)
+
+	_, victimCookie := startLogin(t, s)
+	for name, cookie := range map[string]*http.Cookie{"no cookie": nil, "cookie of another login": victimCookie} {
+		fragment := callback(t, s, code, state, cookie)
+		if fragment.Get("jwt_token") != "" || !strings.Contains(fragment.Get("error"), "not started in this browser") {
+			t.Errorf("%s: got %v", name, fragment)
+		}
+	}
+
+	// The state isn't used up by the rejected attempts
+	loggedInUser(t, s, callback(t, s, code, state, attackerCookie))
+}
+
+func TestOidcLoginChecksUsernamePolicy(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestHandler(t, idp)
+	if err := authRepo.AddNewUser(s.DB, "dave", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		identity identity
+		want     string
+	}{
+		{identity{Subject: "1", PreferredUsername: "carol"}, "^carol$"},
+		{identity{Subject: "2", PreferredUsername: "bad name!", Email: "erin@example.com"}, "^erin$"},
+		{identity{Subject: "3", PreferredUsername: "x", Email: "@example.com"}, "^user-[0-9a-f]{8}$"},
+		{identity{Subject: "4", PreferredUsername: strings.Repeat("a", 40)}, "^user-[0-9a-f]{8}$"},
+		{identity{Subject: "5", PreferredUsername: "DAVE"}, "^DAVE-2$"},
+	}
+	for _, test := range tests {
+		user := loggedInUser(t, s, login(t, s, idp, test.identity))
+		if !regexp.MustCompile(test.want).MatchString(user.Username) {
+			t.Errorf("preferred username %q, email %q: got %q, want %s",
+				test.identity.PreferredUsername, test.identity.Email, user.Username, test.want)
+		}
+	}
+}
+
+func TestOidcLoginRequiresSecondFactor(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestHandler(t, idp)
+	frank := identity{Subject: "1", PreferredUsername: "frank"}
+	user := loggedInUser(t, s, login(t, s, idp, frank))
+
+	if err := totpRepo.AddPendingTotp(s.DB, user.ID, "JBSWY3DPEHPK3PXP", []string{"recovery-code"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := totpRepo.EnableTotp(s.DB, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	fragment := login(t, s, idp, frank)
+	if fragment.Get("totp_required") != "true" || fragment.Get("jwt_token") != "" || fragment.Get("refresh_token") != "" {
+		t.Fatalf("got %v, want a challenge instead of tokens", fragment)
+	}
+
+	res, err := s.VerifyTotpLogin(context.Background(), connect.NewRequest(&authv1.VerifyTotpLoginRequest{
+		ChallengeToken: fragment.Get("challenge_token"),
+		Code:           "recovery-code",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Msg.JwtToken == "" {
+		t.Error("no token after the second factor")
+	}
+}
+
+func TestCompleteOidcLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestHandler(t, idp)
+
+	begin, err := s.BeginOidcLogin(context.Background(), connect.NewRequest(&authv1.BeginOidcLoginRequest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := http.ParseSetCookie(begin.Header().Get("Set-Cookie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := idp.authorize(t, begin.Msg.AuthorizationUrl, identity{Subject: "1", PreferredUsername: "grace"})
+
+	req := connect.NewRequest(&authv1.CompleteOidcLoginRequest{Code: code, State: state})
+	if _, err := s.CompleteOidcLogin(context.Background(), req); connect.CodeOf(err) != connect.CodeInvalidArgument {
+		t.Fatalf("without the cookie: got %v, want InvalidArgument", err)
+	}
+
+	req.Header().Set("Cookie", cookie.Name+"="+cookie.Value)
+	res, err := s.CompleteOidcLogin(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Msg.JwtToken == "" || res.Msg.RefreshToken == "" {
+		t.Errorf("got %v, want tokens", res.Msg)
+	}
+
+	// The state can only be used once
+	if _, err := s.CompleteOidcLogin(context.Background(), req); connect.CodeOf(err) != connect.CodeInvalidArgument {
+		t.Errorf("reused state: got %v, want InvalidArgument", err)
+	}
+}
+
+// Reauthenticate at the identity provider. Returns the fragment of the callback.
+func reauthenticate(t *testing.T, s *AuthHandler, idp *testIdP, id identity) url.Values {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.OidcLoginHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login?reauthenticate=true", nil))
+	authorizationURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := authorizationURL.Query(); query.Get("prompt") != "login" || query.Get("max_age") != "0" {
+		t.Fatalf("authorization URL %s doesn't ask for the login again", authorizationURL)
+	}
+
+	code, state := idp.authorize(t, authorizationURL.String(), id)
+	return callback(t, s, code, state, w.Result().Cookies()[0])
+}
+
+func TestReauthenticationConfirmsChanges(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newTestHandler(t, idp)
+	heidi := identity{Subject: "1", PreferredUsername: "heidi"}
+	ivan := identity{Subject: "2", PreferredUsername: "ivan"}
+
+	user, sessionID := loggedInSession(t, s, login(t, s, idp, heidi))
+	loggedInUser(t, s, login(t, s, idp, ivan))
+	ctx := context.WithValue(context.Background(), interceptors.UserIDKey, user.ID)
+	ctx = context.WithValue(ctx, interceptors.SessionIDKey, sessionID)
+
+	// Users without a password can't confirm with one
+	_, err := s.DeleteAccount(ctx, connect.NewRequest(&authv1.DeleteAccountRequest{Password: "anything"}))
+	if connect.CodeOf(err) != connect.CodeFailedPrecondition {
+		t.Fatalf("with a password: got %v, want FailedPrecondition", err)
+	}
+
+	// The identity provider must have asked for the login again
+	heidi.AuthTime = time.Now().Add(-time.Hour)
+	if fragment := reauthenticate(t, s, idp, heidi); fragment.Get("reauthentication_token") != "" || fragment.Get("error") == "" {
+		t.Errorf("stale authentication: got %v, want an error", fragment)
+	}
+
+	// A reauthentication never starts a session
+	ivan.AuthTime = time.Now()
+	fragment := reauthenticate(t, s, idp, ivan)
+	if fragment.Get("jwt_token") != "" || fragment.Get("refresh_token") != "" {
+		t.Errorf("reauthentication returned tokens of a session: %v", fragment)
+	}
+	_, err = s.DeleteAccount(ctx, connect.NewRequest(&authv1.DeleteAccountRequest{
+		ReauthenticationToken: fragment.Get("reauthentication_token"),
+	}))
+	if connect.CodeOf(err) != connect.CodePermissionDenied {
+		t.Fatalf("token of another user: got %v, want PermissionDenied", err)
+	}
+
+	heidi.AuthTime = time.Now()
+	token := reauthenticate(t, s, idp, heidi).Get("reauthentication_token")
+	if token == "" {
+		t.Fatal("no reauthentication token")
+	}
+
+	_, err = s.ChangePassword(ctx, connect.NewRequest(&authv1.ChangePasswordRequest{
+		NewPassword:           "correct horse battery staple",
+		ReauthenticationToken: token,
+	}))
+	if err != nil {
+		t.Fatalf("setting a password: %v", err)
+	}
+	if valid, err := authRepo.CheckPassword(s.DB, user.ID, "correct horse battery staple"); err != nil || !valid {
+		t.Errorf("password wasn't set: %v %v", valid, err)
+	}
+
+	if _, err = s.DeleteAccount(ctx, connect.NewRequest(&authv1.DeleteAccountRequest{ReauthenticationToken: token})); err != nil {
+		t.Fatalf("deleting the account: %v", err)
+	}
+	if _, err := authRepo.GetUser(s.DB, user.ID); err != sql.ErrNoRows {
+		t.Errorf("user still exists: %v", err)
+	}
+}
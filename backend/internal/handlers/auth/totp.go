@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+
+	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
+	"chart-organizer/backend/internal/interceptors"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	lockoutRepo "chart-organizer/backend/internal/repository/lockout"
+	totpRepo "chart-organizer/backend/internal/repository/totp"
+	"chart-organizer/backend/internal/totp"
+)
+
+// ChallengeTokenTTL defines how long a user has to enter their second factor after the password
+const ChallengeTokenTTL = 5 * time.Minute
+
+// The audience of challenge tokens, so that they can't be used in place of another token.
+// Challenge tokens have no session either, so the auth interceptor ignores them.
+const challengeTokenAudience = "totp-challenge"
+
+const recoveryCodeCount = 10
+
+func getTotpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Chart Organizer"
+}
+
+func (s *AuthHandler) generateChallengeToken(userID string) (string, error) {
+	currentTime := time.Now()
+	claims := &jwt.RegisteredClaims{
+		Subject:   userID,
+		Audience:  jwt.ClaimStrings{challengeTokenAudience},
+		IssuedAt:  jwt.NewNumericDate(currentTime),
+		ExpiresAt: jwt.NewNumericDate(currentTime.Add(ChallengeTokenTTL)),
+	}
+	return s.Keyring.Sign(claims)
+}
+
+// Returns the user ID the challenge token was issued for
+func (s *AuthHandler) parseChallengeToken(tokenString string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, s.Keyring.Keyfunc,
+		jwt.WithAudience(challengeTokenAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// Check a code from the authenticator app or a recovery code.
+// Wrong codes count towards a lockout of the user's second factor.
+func (s *AuthHandler) checkSecondFactor(userID string, code string) error {
+	lockedUntil, err := lockoutRepo.GetLockedUntil(s.DB, lockoutRepo.KeyTypeTotp, userID)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !lockedUntil.IsZero() {
+		return lockedOutError(lockedUntil)
+	}
+
+	t, err := totpRepo.GetTotp(s.DB, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return connect.NewError(connect.CodeFailedPrecondition, errors.New("two-factor authentication is not enabled"))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	isValid := false
+	if step, ok := totp.Validate(t.Secret, code, time.Now()); ok {
+		isValid, err = totpRepo.UseStep(s.DB, userID, step)
+	} else if t.Enabled {
+		isValid, err = totpRepo.UseRecoveryCode(s.DB, userID, code)
+	}
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	if !isValid {
+		lockedUntil, err := lockoutRepo.RecordFailure(s.DB, lockoutRepo.TotpPolicy, lockoutRepo.KeyTypeTotp, userID)
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+		if !lockedUntil.IsZero() {
+			return lockedOutError(lockedUntil)
+		}
+		return connect.NewError(connect.CodeUnauthenticated, errors.New("invalid code"))
+	}
+
+	err = lockoutRepo.ResetFailures(s.DB, lockoutRepo.KeyTypeTotp, userID)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	return nil
+}
+
+// VerifyTotpLogin implements authv1connect.AuthServiceHandler.
+// Completes a login of a user with two-factor authentication.
+func (s *AuthHandler) VerifyTotpLogin(
+	ctx context.Context,
+	req *connect.Request[authv1.VerifyTotpLoginRequest],
+) (*connect.Response[authv1.VerifyTotpLoginResponse], error) {
+	if req.Msg.ChallengeToken == "" || req.Msg.Code == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("challenge token and code are required"))
+	}
+
+	userID, err := s.parseChallengeToken(req.Msg.ChallengeToken)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid or expired challenge token"))
+	}
+
+	if err = s.checkSecondFactor(userID, req.Msg.Code); err != nil {
+		return nil, err
+	}
+
+	token, refreshToken, err := s.startSession(userID, req.Header().Get("User-Agent"))
+	if err != nil {
+		return nil, err
+	}
+
+	res := connect.NewResponse(&authv1.VerifyTotpLoginResponse{
+		JwtToken:     token,
+		RefreshToken: refreshToken,
+	})
+	return res, nil
+}
+
+// EnrollTotp implements authv1connect.AuthServiceHandler.
+// Enrolling again before activating replaces the pending secret.
+func (s *AuthHandler) EnrollTotp(
+	ctx context.Context,
+	req *connect.Request[authv1.EnrollTotpRequest],
+) (*connect.Response[authv1.EnrollTotpResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+
+	enabled, err := totpRepo.IsTotpEnabled(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if enabled {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("two-factor authentication is already enabled"))
+	}
+
+	user, err := authRepo.GetUser(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	recoveryCodes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	err = totpRepo.AddPendingTotp(s.DB, userID, secret, recoveryCodes)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := connect.NewResponse(&authv1.EnrollTotpResponse{
+		OtpauthUri:    totp.URI(getTotpIssuer(), user.Username, secret),
+		Secret:        secret,
+		RecoveryCodes: recoveryCodes,
+	})
+	return res, nil
+}
+
+// ActivateTotp implements authv1connect.AuthServiceHandler.
+func (s *AuthHandler) ActivateTotp(
+	ctx context.Context,
+	req *connect.Request[authv1.ActivateTotpRequest],
+) (*connect.Response[authv1.ActivateTotpResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+
+	t, err := totpRepo.GetTotp(s.DB, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("enroll in two-factor authentication first"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if t.Enabled {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("two-factor authentication is already enabled"))
+	}
+
+	// Only a code from the app proves that enrollment worked, so recovery codes are not accepted here
+	if err = s.checkSecondFactor(userID, req.Msg.Code); err != nil {
+		return nil, err
+	}
+
+	err = totpRepo.EnableTotp(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&authv1.ActivateTotpResponse{}), nil
+}
+
+// DisableTotp implements authv1connect.AuthServiceHandler.
+// Requires both the password, or a reauthentication for users without one,
+// and a code, so a stolen session alone can't turn it off.
+func (s *AuthHandler) DisableTotp(
+	ctx context.Context,
+	req *connect.Request[authv1.DisableTotpRequest],
+) (*connect.Response[authv1.DisableTotpResponse], error) {
+	userID, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.confirmIdentity(userID, req.Msg.Password, req.Msg.ReauthenticationToken); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSecondFactor(userID, req.Msg.Code); err != nil {
+		return nil, err
+	}
+
+	err := totpRepo.DeleteTotp(s.DB, userID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&authv1.DisableTotpResponse{}), nil
+}
@@ -0,0 +1,130 @@
+package dataset
+
+import (
+	"context"
+	"testing"
+
+	"connectrpc.com/connect"
+
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/interceptors"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	"chart-organizer/backend/internal/repository/dataset"
+	organizationRepo "chart-organizer/backend/internal/repository/organization"
+	"chart-organizer/backend/internal/repository/repositorytest"
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
+)
+
+// Datasets of an organization of alice, which bob edits and carol views,
+// and a personal dataset of alice. dave is not a member.
+type accessTest struct {
+	h            *DatasetHandler
+	users        map[string]string
+	orgDataset   string
+	aliceDataset string
+}
+
+func newAccessTest(t *testing.T) *accessTest {
+	t.Helper()
+	db := repositorytest.NewDB(t)
+	a := &accessTest{h: &DatasetHandler{DB: db, Storage: storage.NewLocal(t.TempDir())}, users: make(map[string]string)}
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		if err := authRepo.AddNewUser(db, username, "correct horse battery"); err != nil {
+			t.Fatal(err)
+		}
+		id, err := authRepo.GetUserID(db, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.users[username] = id
+	}
+
+	org, err := organizationRepo.CreateOrganization(db, a.users["alice"], "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for username, role := range map[string]string{"bob": organizationRepo.RoleEditor, "carol": organizationRepo.RoleViewer} {
+		if _, err := organizationRepo.AddMember(db, org.ID, a.users[username], role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datasetSchema := schema.Schema{Columns: []schema.Column{{Name: "x", Type: schema.TypeInteger}}, RowCount: 1}
+	a.orgDataset, err = dataset.AddNewDataset(db, a.h.Storage, a.users["alice"], org.ID, "shared", []byte("x\n1\n"), datasetSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.aliceDataset, err = dataset.AddNewDataset(db, a.h.Storage, a.users["alice"], "", "personal", []byte("x\n1\n"), datasetSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// The context of a request of the user
+func (a *accessTest) as(username string) context.Context {
+	return context.WithValue(context.Background(), interceptors.UserIDKey, a.users[username])
+}
+
+// Try every change to the dataset and check each is refused with the code
+func (a *accessTest) checkRefused(t *testing.T, ctx context.Context, id string, code connect.Code) {
+	t.Helper()
+	_, err := a.h.DeleteDataset(ctx, connect.NewRequest(&datasetv1.DeleteDatasetRequest{Id: id, DeleteDashboards: true}))
+	if connect.CodeOf(err) != code {
+		t.Errorf("DeleteDataset: got %v, want %v", err, code)
+	}
+	_, err = a.h.RenameDataset(ctx, connect.NewRequest(&datasetv1.RenameDatasetRequest{Id: id, Name: "renamed"}))
+	if connect.CodeOf(err) != code {
+		t.Errorf("RenameDataset: got %v, want %v", err, code)
+	}
+	_, err = a.h.UpdateDatasetMetadata(ctx, connect.NewRequest(&datasetv1.UpdateDatasetMetadataRequest{Id: id, Description: "changed", Tags: []string{"changed"}}))
+	if connect.CodeOf(err) != code {
+		t.Errorf("UpdateDatasetMetadata: got %v, want %v", err, code)
+	}
+
+	// The dataset is unchanged
+	info, err := dataset.GetDatasetInfo(a.h.DB, a.users["alice"], id)
+	if err != nil || info.Name == "renamed" {
+		t.Errorf("dataset %+v, %v", info, err)
+	}
+	if tags, err := dataset.GetDatasetTags(a.h.DB, id); err != nil || len(tags[id]) != 0 {
+		t.Errorf("tags %v, %v", tags, err)
+	}
+}
+
+func TestViewersCannotChangeDatasets(t *testing.T) {
+	a := newAccessTest(t)
+	a.checkRefused(t, a.as("carol"), a.orgDataset, connect.CodePermissionDenied)
+}
+
+// Datasets the user can't see are not found rather than refused
+func TestOutsidersCannotChangeDatasets(t *testing.T) {
+	a := newAccessTest(t)
+	a.checkRefused(t, a.as("dave"), a.orgDataset, connect.CodeNotFound)
+	a.checkRefused(t, a.as("bob"), a.aliceDataset, connect.CodeNotFound)
+	a.checkRefused(t, context.Background(), a.aliceDataset, connect.CodeUnauthenticated)
+}
+
+func TestReadOnlyApiKeyCannotChangeDatasets(t *testing.T) {
+	a := newAccessTest(t)
+	ctx := context.WithValue(a.as("alice"), interceptors.ScopesKey, []string{interceptors.ScopeDatasetsRead})
+	a.checkRefused(t, ctx, a.aliceDataset, connect.CodePermissionDenied)
+}
+
+func TestEditorsChangeDatasets(t *testing.T) {
+	a := newAccessTest(t)
+	ctx := a.as("bob")
+	if _, err := a.h.RenameDataset(ctx, connect.NewRequest(&datasetv1.RenameDatasetRequest{Id: a.orgDataset, Name: "renamed"})); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := dataset.GetDatasetInfo(a.h.DB, a.users["carol"], a.orgDataset); err != nil || info.Name != "renamed" {
+		t.Errorf("dataset %+v, %v", info, err)
+	}
+	if _, err := a.h.DeleteDataset(ctx, connect.NewRequest(&datasetv1.DeleteDatasetRequest{Id: a.orgDataset})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataset.GetDatasetRole(a.h.DB, a.users["alice"], a.orgDataset); err == nil {
+		t.Error("the deleted dataset is still there")
+	}
+}
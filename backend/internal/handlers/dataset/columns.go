@@ -0,0 +1,144 @@
+package dataset
+
+import (
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/schema"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+)
+
+const (
+	maxUnitLength = 50
+	// Invalid values returned by UpdateColumnTypes
+	maxInvalidValues = 100
+)
+
+// Apply an override to a column. The date format and unit are replaced.
+func applyOverride(column schema.Column, override *datasetv1.ColumnTypeOverride) (schema.Column, error) {
+	if columnType := strings.ToLower(override.Type); columnType != "" {
+		if !slices.Contains(schema.Types, columnType) {
+			return schema.Column{}, fmt.Errorf("unknown type %q, expected one of %s", columnType, strings.Join(schema.Types, ", "))
+		}
+		column.Type = columnType
+	}
+
+	column.DateFormat = override.DateFormat
+	if column.DateFormat != "" {
+		if column.Type != schema.TypeDatetime {
+			return schema.Column{}, errors.New("only datetime columns have a date format")
+		}
+		if _, err := schema.DatetimeLayout(column.DateFormat); err != nil {
+			return schema.Column{}, err
+		}
+	}
+
+	column.Unit = strings.TrimSpace(override.Unit)
+	if utf8.RuneCountInString(column.Unit) > maxUnitLength {
+		return schema.Column{}, fmt.Errorf("the unit can have at most %d characters", maxUnitLength)
+	}
+	return column, nil
+}
+
+// UpdateColumnTypes implements datasetv1connect.DatasetServiceHandler.
+// The whole file is read to check the values of the changed columns.
+func (h *DatasetHandler) UpdateColumnTypes(
+	ctx context.Context,
+	req *connect.Request[datasetv1.UpdateColumnTypesRequest],
+) (*connect.Response[datasetv1.UpdateColumnTypesResponse], error) {
+	if len(req.Msg.Columns) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("at least one column is required"))
+	}
+	if err := h.requireWriteAccess(ctx, req.Msg.Id); err != nil {
+		return nil, err
+	}
+	userId, _ := interceptors.GetUserId(ctx)
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+	current := info.Version
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return nil, err
+	}
+	columns, err := h.loadColumns(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := slices.Clone(columns)
+	var changed []int
+	for _, override := range req.Msg.Columns {
+		i := slices.IndexFunc(columns, func(c schema.Column) bool { return c.Name == override.Name })
+		if i < 0 {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("column %q does not exist", override.Name))
+		}
+		if slices.Contains(changed, i) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("column %q is given more than once", override.Name))
+		}
+		if updated[i], err = applyOverride(columns[i], override); err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("column %q: %w", override.Name, err))
+		}
+		changed = append(changed, i)
+	}
+
+	file, err := dataset.OpenDatasetFile(h.Storage, info.ID, info.Version)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	invalid, count, err := schema.Validate(file, updated, changed, maxInvalidValues)
+	if err != nil {
+		var parseErr *schema.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("stored file is not a valid CSV file: %w", parseErr))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &datasetv1.UpdateColumnTypesResponse{
+		Applied:           count == 0 || req.Msg.AllowInvalid,
+		InvalidValueCount: count,
+	}
+	for _, v := range invalid {
+		res.InvalidValues = append(res.InvalidValues, &datasetv1.InvalidValue{
+			Line:   int64(v.Line),
+			Column: updated[v.Column].Name,
+			// Protobuf strings must be valid UTF-8
+			Value: strings.ToValidUTF8(v.Value, "\uFFFD"),
+		})
+	}
+
+	if res.Applied {
+		overrides := make([]schema.Column, len(changed))
+		for k, i := range changed {
+			overrides[k] = updated[i]
+		}
+		if err = dataset.UpdateDatasetColumns(h.DB, info.ID, info.Version, overrides); err != nil {
+			return nil, notFoundOrInternal(err)
+		}
+		columns = updated
+
+		// The types were stored even if profiling can't be started, it is retried by ProfileDataset
+		if info.Version == current {
+			if err = h.startProfiling(info.ID, info.Version); err != nil {
+				slog.Error("Failed to start profiling", "dataset", info.ID, "error", err)
+			}
+		}
+	}
+
+	for _, c := range columns {
+		res.Columns = append(res.Columns, columnToProto(c))
+	}
+	return connect.NewResponse(res), nil
+}
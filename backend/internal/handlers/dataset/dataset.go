@@ -1,14 +1,30 @@
 package dataset
 
 import (
+	"bytes"
 	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/ingest"
 	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/profile"
 	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/repository/organization"
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	// "net/http"
 
@@ -16,12 +32,15 @@ import (
 )
 
 type DatasetHandler struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Storage storage.Storage
+	// Largest file that can be uploaded, in bytes
+	MaxUploadSize int64
 }
 
 // GetDataset implements datasetv1connect.DatasetServiceHandler.
 // Get the dataset. Remember to get the userId through the authorization header.
-// If the dataset does not belong to the user, return not found.
+// If the dataset is neither the user's nor in one of the user's organizations, return not found.
 func (h *DatasetHandler) GetDataset(
 	ctx context.Context,
 	req *connect.Request[datasetv1.GetDatasetRequest],
@@ -30,12 +49,20 @@ func (h *DatasetHandler) GetDataset(
 	if !found {
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
 	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
 
-	data, err := dataset.GetDataset(h.DB, userId, req.Msg.Id)
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return nil, err
+	}
+
+	data, err := dataset.ReadDatasetFile(h.Storage, info.ID, info.Version)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
-		}
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
@@ -45,6 +72,171 @@ func (h *DatasetHandler) GetDataset(
 	return connect.NewResponse(res), nil
 }
 
+// Switch info to a version of the dataset, 0 keeps the current version
+func (h *DatasetHandler) selectVersion(info *dataset.DatasetInfo, version int64) error {
+	if version < 0 {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("version can't be negative"))
+	}
+	if version == 0 || version == info.Version {
+		return nil
+	}
+
+	v, err := dataset.GetDatasetVersion(h.DB, info.ID, version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return connect.NewError(connect.CodeNotFound, errors.New("dataset version not found"))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	info.Version = v.Version
+	info.RowCount = v.RowCount
+	info.SizeBytes = v.SizeBytes
+	info.Sha256 = v.Sha256
+	return nil
+}
+
+// DownloadChunkSize is the size of the chunks sent by DownloadDataset
+const DownloadChunkSize = 1 << 20
+
+// Get the checksum of a dataset, computing and storing it for datasets uploaded before checksums were stored
+func (h *DatasetHandler) getChecksum(info dataset.DatasetInfo) (string, error) {
+	if info.Sha256 != "" {
+		return info.Sha256, nil
+	}
+
+	file, err := dataset.OpenDatasetFile(h.Storage, info.ID, info.Version)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	return checksum, dataset.SaveDatasetChecksum(h.DB, info.ID, info.Version, checksum)
+}
+
+// DownloadDataset implements datasetv1connect.DatasetServiceHandler.
+// The file is streamed from the storage in chunks, so that only one chunk is in memory at a time.
+func (h *DatasetHandler) DownloadDataset(
+	ctx context.Context,
+	req *connect.Request[datasetv1.DownloadDatasetRequest],
+	stream *connect.ServerStream[datasetv1.DownloadDatasetResponse],
+) error {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return err
+	}
+	if req.Msg.Offset < 0 || req.Msg.Length < 0 {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("offset and length can't be negative"))
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return err
+	}
+
+	size, err := dataset.GetDatasetFileSize(h.Storage, info.ID, info.Version)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	length := req.Msg.Length
+	if length == 0 {
+		length = size - req.Msg.Offset
+	}
+	if req.Msg.Offset > size || req.Msg.Offset+length > size {
+		return connect.NewError(connect.CodeOutOfRange, fmt.Errorf("the range is outside of the file of %d bytes", size))
+	}
+
+	checksum, err := h.getChecksum(info)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	err = stream.Send(&datasetv1.DownloadDatasetResponse{
+		Payload: &datasetv1.DownloadDatasetResponse_Metadata{Metadata: &datasetv1.DownloadMetadata{
+			Filename:  ingest.CSVFilename(info.Name),
+			SizeBytes: size,
+			Sha256:    checksum,
+			Offset:    req.Msg.Offset,
+			Length:    length,
+			Version:   info.Version,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := dataset.OpenDatasetFileRange(h.Storage, info.ID, info.Version, req.Msg.Offset, length)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	buffer := make([]byte, DownloadChunkSize)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			err := stream.Send(&datasetv1.DownloadDatasetResponse{
+				Payload: &datasetv1.DownloadDatasetResponse_Chunk{Chunk: buffer[:n]},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+	}
+}
+
+// Uploading into an organization requires write access to it, uploading a
+// new version of a dataset write access to the dataset
+func (h *DatasetHandler) checkUploadAccess(userId string, organizationId string, datasetId string) error {
+	if datasetId != "" {
+		if organizationId != "" {
+			return connect.NewError(connect.CodeInvalidArgument, errors.New("a new version is uploaded into the organization of the dataset, organization_id must be empty"))
+		}
+		return h.checkWriteAccess(userId, datasetId)
+	}
+	if organizationId == "" {
+		return nil
+	}
+
+	role, err := organization.GetMemberRole(h.DB, organizationId, userId)
+	if err != nil {
+		if errors.Is(err, organization.ErrNotMember) {
+			return connect.NewError(connect.CodeNotFound, errors.New("organization not found"))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !organization.CanWrite(role) {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("viewers can't upload datasets"))
+	}
+	return nil
+}
+
+func (h *DatasetHandler) uploadTooLargeError() error {
+	return connect.NewError(connect.CodeResourceExhausted, fmt.Errorf("file is larger than the maximum upload size of %d bytes", h.MaxUploadSize))
+}
+
 // UploadDataset implements datasetv1connect.DatasetServiceHandler.
 func (h *DatasetHandler) UploadDataset(
 	ctx context.Context,
@@ -56,14 +248,157 @@ func (h *DatasetHandler) UploadDataset(
 	if !found {
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
 	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsWrite); err != nil {
+		return nil, err
+	}
+
+	if err := h.checkUploadAccess(userId, req.Msg.OrganizationId, req.Msg.DatasetId); err != nil {
+		return nil, err
+	}
+	if int64(len(req.Msg.Data)) > h.MaxUploadSize {
+		return nil, h.uploadTooLargeError()
+	}
+	options, err := importOptionsFromProto(req.Msg.ImportOptions)
+	if err != nil {
+		return nil, err
+	}
 
-	id, err := dataset.AddNewDataset(h.DB, userId, req.Msg.Filename, req.Msg.Data)
+	data, options, err := convertUploadData(req.Msg.Data, req.Msg.Filename, options)
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+		return nil, err
+	}
+	datasetSchema, err := schema.Infer(bytes.NewReader(data))
+	if err != nil {
+		return nil, parseError(err, options.Format)
+	}
+
+	id, version := req.Msg.DatasetId, int64(1)
+	if id != "" {
+		version, err = dataset.AddDatasetVersion(h.DB, h.Storage, userId, id, data, datasetSchema)
+	} else {
+		id, err = dataset.AddNewDataset(h.DB, h.Storage, userId, req.Msg.OrganizationId, req.Msg.Filename, data, datasetSchema)
+	}
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+
+	// The upload succeeded even if profiling can't be started, it is retried by ProfileDataset
+	if err = h.startProfiling(id, version); err != nil {
+		slog.Error("Failed to start profiling", "dataset", id, "error", err)
 	}
 
 	return connect.NewResponse(&datasetv1.UploadDatasetResponse{
-		Id: id,
+		Id:            id,
+		Version:       version,
+		ImportOptions: importOptionsToProto(options),
+	}), nil
+}
+
+// UploadDatasetStream implements datasetv1connect.DatasetServiceHandler.
+// Chunks are written to a temporary file as they arrive, so that large files
+// are never kept in memory. The dataset is only created once the stream is complete.
+func (h *DatasetHandler) UploadDatasetStream(
+	ctx context.Context,
+	stream *connect.ClientStream[datasetv1.UploadDatasetStreamRequest],
+) (*connect.Response[datasetv1.UploadDatasetStreamResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsWrite); err != nil {
+		return nil, err
+	}
+
+	if !stream.Receive() {
+		if err := stream.Err(); err != nil {
+			return nil, err
+		}
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("the stream is empty"))
+	}
+	metadata := stream.Msg().GetMetadata()
+	if metadata == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("the first message must be the metadata"))
+	}
+	if err := h.checkUploadAccess(userId, metadata.OrganizationId, metadata.DatasetId); err != nil {
+		return nil, err
+	}
+	options, err := importOptionsFromProto(metadata.ImportOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := dataset.CreateUploadFile()
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	// The file is copied into the storage once it is complete
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	writer := io.MultiWriter(file, hash)
+	var size int64
+	for stream.Receive() {
+		chunk, ok := stream.Msg().Payload.(*datasetv1.UploadDatasetStreamRequest_Chunk)
+		if !ok {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("every message after the metadata must be a chunk"))
+		}
+
+		size += int64(len(chunk.Chunk))
+		if size > h.MaxUploadSize {
+			return nil, h.uploadTooLargeError()
+		}
+		if _, err = writer.Write(chunk.Chunk); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+	if err = stream.Err(); err != nil {
+		return nil, err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if metadata.Sha256 != "" && !strings.EqualFold(metadata.Sha256, checksum) {
+		return nil, connect.NewError(connect.CodeDataLoss, fmt.Errorf("the received file has the SHA-256 checksum %s, not %s", checksum, metadata.Sha256))
+	}
+
+	converted, options, err := convertUploadFile(file, size, checksum, metadata.Filename, options)
+	if err != nil {
+		return nil, err
+	}
+	if converted.path != file.Name() {
+		defer os.Remove(converted.path)
+	}
+	if err = file.Close(); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	datasetSchema, err := inferFile(converted.path)
+	if err != nil {
+		return nil, parseError(err, options.Format)
+	}
+
+	id, version := metadata.DatasetId, int64(1)
+	if id != "" {
+		version, err = dataset.AddDatasetVersionFromFile(h.DB, h.Storage, userId, id, converted.path, converted.checksum, datasetSchema, converted.size)
+	} else {
+		id, err = dataset.AddNewDatasetFromFile(h.DB, h.Storage, userId, metadata.OrganizationId, metadata.Filename, converted.path, converted.checksum, datasetSchema, converted.size)
+	}
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+
+	// The upload succeeded even if profiling can't be started, it is retried by ProfileDataset
+	if err = h.startProfiling(id, version); err != nil {
+		slog.Error("Failed to start profiling", "dataset", id, "error", err)
+	}
+
+	return connect.NewResponse(&datasetv1.UploadDatasetStreamResponse{
+		Id:            id,
+		Sha256:        converted.checksum,
+		SizeBytes:     converted.size,
+		RowCount:      datasetSchema.RowCount,
+		Version:       version,
+		ImportOptions: importOptionsToProto(options),
 	}), nil
 }
 
@@ -76,17 +411,37 @@ func (h *DatasetHandler) GetAllDatasetsFromUser(
 	if !found {
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
 	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
 
 	datasets, err := dataset.GetAllDatasetsFromUser(h.DB, userId)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
+	var ids []string
+	for _, d := range datasets {
+		ids = append(ids, d.ID)
+	}
+	tags, err := dataset.GetDatasetTags(h.DB, ids...)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
 	var resDatasets []*datasetv1.GetAllDatasetsFromUser_Dataset
 	for _, d := range datasets {
 		resDatasets = append(resDatasets, &datasetv1.GetAllDatasetsFromUser_Dataset{
-			Id:   d.ID,
-			Name: d.Name,
+			Id:             d.ID,
+			Name:           d.Name,
+			OrganizationId: d.OrganizationID,
+			Role:           d.Role,
+			RowCount:       d.RowCount,
+			SizeBytes:      d.SizeBytes,
+			CreatedAt:      d.CreatedAt,
+			Description:    d.Description,
+			Tags:           tags[d.ID],
+			Version:        d.Version,
 		})
 	}
 
@@ -96,3 +451,607 @@ func (h *DatasetHandler) GetAllDatasetsFromUser(
 
 	return connect.NewResponse(res), nil
 }
+
+// Get the columns of the selected version of a dataset the user has access to.
+// Datasets uploaded before schemas were inferred are parsed once and their
+// schema is stored, which also fills in the row count and size of info.
+func (h *DatasetHandler) loadColumns(info *dataset.DatasetInfo) ([]schema.Column, error) {
+	columns, err := dataset.GetDatasetColumns(h.DB, info.ID, info.Version)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if len(columns) > 0 {
+		return columns, nil
+	}
+
+	file, err := dataset.OpenDatasetFile(h.Storage, info.ID, info.Version)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	datasetSchema, err := schema.Infer(counter)
+	if err != nil {
+		var parseErr *schema.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("stored file is not a valid CSV file: %w", parseErr))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	info.SizeBytes = counter.n
+	info.RowCount = datasetSchema.RowCount
+	err = dataset.SaveDatasetSchema(h.DB, info.ID, info.Version, datasetSchema, info.SizeBytes)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return datasetSchema.Columns, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func columnToProto(c schema.Column) *datasetv1.ColumnSchema {
+	return &datasetv1.ColumnSchema{
+		Name:       c.Name,
+		Type:       c.Type,
+		Nullable:   c.NullCount > 0,
+		NullCount:  c.NullCount,
+		DateFormat: c.DateFormat,
+		Unit:       c.Unit,
+	}
+}
+
+// GetDatasetSchema implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) GetDatasetSchema(
+	ctx context.Context,
+	req *connect.Request[datasetv1.GetDatasetSchemaRequest],
+) (*connect.Response[datasetv1.GetDatasetSchemaResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return nil, err
+	}
+
+	columns, err := h.loadColumns(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	var resColumns []*datasetv1.ColumnSchema
+	for _, c := range columns {
+		resColumns = append(resColumns, columnToProto(c))
+	}
+
+	tags, err := dataset.GetDatasetTags(h.DB, info.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &datasetv1.GetDatasetSchemaResponse{
+		Id:             info.ID,
+		Name:           info.Name,
+		Columns:        resColumns,
+		RowCount:       info.RowCount,
+		SizeBytes:      info.SizeBytes,
+		CreatedAt:      info.CreatedAt,
+		OrganizationId: info.OrganizationID,
+		Description:    info.Description,
+		Tags:           tags[info.ID],
+		Version:        info.Version,
+	}
+	return connect.NewResponse(res), nil
+}
+
+// Compute the profile of a version of a dataset in the background,
+// unless it exists or is being computed
+func (h *DatasetHandler) startProfiling(id string, version int64) error {
+	started, err := dataset.StartProfile(h.DB, id, version)
+	if err != nil || !started {
+		return err
+	}
+
+	go h.profileDataset(id, version)
+	return nil
+}
+
+func (h *DatasetHandler) profileDataset(id string, version int64) {
+	profiles, err := func() ([]profile.ColumnProfile, error) {
+		columns, err := dataset.GetDatasetColumns(h.DB, id, version)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := dataset.OpenDatasetFile(h.Storage, id, version)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		return profile.Profile(file, columns)
+	}()
+
+	if err != nil {
+		slog.Error("Failed to profile dataset", "dataset", id, "error", err)
+		err = dataset.FailProfile(h.DB, id, version, err.Error())
+	} else {
+		err = dataset.SaveProfile(h.DB, id, version, profiles)
+	}
+	if err != nil {
+		slog.Error("Failed to store dataset profile", "dataset", id, "error", err)
+	}
+}
+
+func profileToProto(p profile.ColumnProfile) *datasetv1.ColumnProfile {
+	res := &datasetv1.ColumnProfile{
+		Name:                      p.Name,
+		Type:                      p.Type,
+		NullCount:                 p.NullCount,
+		DistinctCount:             p.DistinctCount,
+		DistinctCountIsLowerBound: p.DistinctCountIsLowerBound,
+	}
+	if p.Numeric != nil {
+		res.Numeric = &datasetv1.NumericStats{
+			Min:    p.Numeric.Min,
+			Max:    p.Numeric.Max,
+			Mean:   p.Numeric.Mean,
+			Stddev: p.Numeric.Stddev,
+		}
+		for _, q := range p.Numeric.Quantiles {
+			res.Numeric.Quantiles = append(res.Numeric.Quantiles, &datasetv1.Quantile{Quantile: q.Quantile, Value: q.Value})
+		}
+	}
+	if p.Datetime != nil {
+		res.Datetime = &datasetv1.DatetimeStats{Min: p.Datetime.Min, Max: p.Datetime.Max}
+	}
+	for _, v := range p.TopValues {
+		res.TopValues = append(res.TopValues, &datasetv1.ValueCount{Value: v.Value, Count: v.Count})
+	}
+	for _, b := range p.Histogram {
+		res.Histogram = append(res.Histogram, &datasetv1.HistogramBin{Lower: b.Lower, Upper: b.Upper, Count: b.Count})
+	}
+	return res
+}
+
+// ProfileDataset implements datasetv1connect.DatasetServiceHandler.
+// Profiles are computed in the background, so the first call for a version
+// that was never profiled, e.g. one uploaded before profiling existed, only
+// starts computing it.
+func (h *DatasetHandler) ProfileDataset(
+	ctx context.Context,
+	req *connect.Request[datasetv1.ProfileDatasetRequest],
+) (*connect.Response[datasetv1.ProfileDatasetResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return nil, err
+	}
+
+	if _, err = h.loadColumns(&info); err != nil {
+		return nil, err
+	}
+
+	datasetProfile, err := dataset.GetProfile(h.DB, info.ID, info.Version)
+	if err == sql.ErrNoRows {
+		if err = h.startProfiling(info.ID, info.Version); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		return connect.NewResponse(&datasetv1.ProfileDatasetResponse{Status: dataset.ProfileStatusPending, Version: info.Version}), nil
+	}
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &datasetv1.ProfileDatasetResponse{
+		Status:    datasetProfile.Status,
+		Error:     datasetProfile.Error,
+		UpdatedAt: datasetProfile.UpdatedAt,
+		Version:   datasetProfile.Version,
+	}
+	for _, p := range datasetProfile.Columns {
+		res.Columns = append(res.Columns, profileToProto(p))
+	}
+	return connect.NewResponse(res), nil
+}
+
+const (
+	defaultPageSize = 1000
+	maxPageSize     = 10000
+	// Pages end early once this much of the file has been read,
+	// to stay well below the message size limit for wide rows
+	maxPageBytes = 1 << 20
+)
+
+// Page tokens are the version of the dataset and the byte offset of the next row in its file
+func encodePageToken(version int64, offset int64) string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d:%d", version, offset))
+}
+
+func decodePageToken(token string) (int64, int64, error) {
+	if token == "" {
+		return 0, 0, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		versionText, offsetText, _ := strings.Cut(string(decoded), ":")
+		version, versionErr := strconv.ParseInt(versionText, 10, 64)
+		offset, offsetErr := strconv.ParseInt(offsetText, 10, 64)
+		if versionErr == nil && offsetErr == nil && version > 0 && offset > 0 {
+			return version, offset, nil
+		}
+	}
+	return 0, 0, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid page token"))
+}
+
+// Convert a value to the type of its column. Values that don't have the type are returned as text.
+func valueToProto(column schema.Column, value string) *datasetv1.Value {
+	parsed, _ := column.ParseValue(value)
+	return typedValueToProto(parsed)
+}
+
+// Convert a value of one of the Go types of schema.Column.ParseValue
+func typedValueToProto(value any) *datasetv1.Value {
+	switch v := value.(type) {
+	case int64:
+		return &datasetv1.Value{Kind: &datasetv1.Value_Integer{Integer: v}}
+	case float64:
+		return &datasetv1.Value{Kind: &datasetv1.Value_Float{Float: v}}
+	case bool:
+		return &datasetv1.Value{Kind: &datasetv1.Value_Boolean{Boolean: v}}
+	case time.Time:
+		return &datasetv1.Value{Kind: &datasetv1.Value_Datetime{Datetime: v.Format(time.RFC3339Nano)}}
+	case string:
+		// Protobuf strings must be valid UTF-8
+		return &datasetv1.Value{Kind: &datasetv1.Value_Text{Text: strings.ToValidUTF8(v, "\uFFFD")}}
+	}
+	return &datasetv1.Value{Kind: &datasetv1.Value_Null{Null: true}}
+}
+
+// Indices of the named columns in the file, of every column if there are no names
+func columnIndices(columns []schema.Column, names []string) ([]int, error) {
+	var indices []int
+	if len(names) == 0 {
+		for i := range columns {
+			indices = append(indices, i)
+		}
+	}
+	for _, name := range names {
+		i := slices.IndexFunc(columns, func(c schema.Column) bool { return c.Name == name })
+		if i < 0 {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("column %q does not exist", name))
+		}
+		indices = append(indices, i)
+	}
+	return indices, nil
+}
+
+// GetDatasetRows implements datasetv1connect.DatasetServiceHandler.
+// Rows are read page by page straight from the file, so only the requested page is kept in memory.
+func (h *DatasetHandler) GetDatasetRows(
+	ctx context.Context,
+	req *connect.Request[datasetv1.GetDatasetRowsRequest],
+) (*connect.Response[datasetv1.GetDatasetRowsResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
+
+	pageSize := int(req.Msg.PageSize)
+	if pageSize < 0 || pageSize > maxPageSize {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("page size must be between 1 and %d", maxPageSize))
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	version, offset, err := decodePageToken(req.Msg.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	if req.Msg.Version != 0 && version != 0 && req.Msg.Version != version {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("the page token is for another version"))
+	}
+	if version == 0 {
+		version = req.Msg.Version
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if err = h.selectVersion(&info, version); err != nil {
+		return nil, err
+	}
+
+	columns, err := h.loadColumns(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	indices, err := columnIndices(columns, req.Msg.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > info.SizeBytes {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid page token"))
+	}
+	file, err := dataset.OpenDatasetFileRange(h.Storage, info.ID, info.Version, offset, -1)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	reader, err := schema.NewRowReader(file, offset, len(columns))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &datasetv1.GetDatasetRowsResponse{}
+	for _, i := range indices {
+		res.Columns = append(res.Columns, columnToProto(columns[i]))
+	}
+
+	start := reader.Offset()
+	for len(res.Rows) < pageSize && reader.Offset()-start < maxPageBytes {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if offset > 0 {
+				return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("invalid page token"))
+			}
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+
+		row := &datasetv1.Row{}
+		for _, i := range indices {
+			row.Values = append(row.Values, valueToProto(columns[i], record[i]))
+		}
+		res.Rows = append(res.Rows, row)
+	}
+
+	if next := reader.Offset(); next < info.SizeBytes {
+		res.NextPageToken = encodePageToken(info.Version, next)
+	}
+	return connect.NewResponse(res), nil
+}
+
+const (
+	maxNameLength        = 255
+	maxDescriptionLength = 2000
+	maxTags              = 20
+	maxTagLength         = 50
+)
+
+// Changing a dataset requires the editor or owner role for organization datasets.
+// Datasets the user can't access are not found.
+func (h *DatasetHandler) requireWriteAccess(ctx context.Context, id string) error {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsWrite); err != nil {
+		return err
+	}
+	return h.checkWriteAccess(userId, id)
+}
+
+func (h *DatasetHandler) checkWriteAccess(userId string, id string) error {
+	role, err := dataset.GetDatasetRole(h.DB, userId, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !organization.CanWrite(role) {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("viewers can't change datasets"))
+	}
+	return nil
+}
+
+func notFoundOrInternal(err error) error {
+	if err == sql.ErrNoRows {
+		return connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
+
+// DeleteDataset implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) DeleteDataset(
+	ctx context.Context,
+	req *connect.Request[datasetv1.DeleteDatasetRequest],
+) (*connect.Response[datasetv1.DeleteDatasetResponse], error) {
+	if err := h.requireWriteAccess(ctx, req.Msg.Id); err != nil {
+		return nil, err
+	}
+
+	err := dataset.DeleteDataset(h.DB, h.Storage, req.Msg.Id, req.Msg.DeleteDashboards)
+	var inUse *dataset.DatasetInUseError
+	if errors.As(err, &inUse) {
+		connectErr := connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("%w, delete them first or set delete_dashboards", inUse))
+		if detail, err := connect.NewErrorDetail(&datasetv1.DatasetInUse{DashboardCount: int64(inUse.Dashboards)}); err == nil {
+			connectErr.AddDetail(detail)
+		}
+		return nil, connectErr
+	}
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+
+	return connect.NewResponse(&datasetv1.DeleteDatasetResponse{}), nil
+}
+
+// RenameDataset implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) RenameDataset(
+	ctx context.Context,
+	req *connect.Request[datasetv1.RenameDatasetRequest],
+) (*connect.Response[datasetv1.RenameDatasetResponse], error) {
+	name := strings.TrimSpace(req.Msg.Name)
+	if name == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("name is required"))
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("name can have at most %d characters", maxNameLength))
+	}
+
+	if err := h.requireWriteAccess(ctx, req.Msg.Id); err != nil {
+		return nil, err
+	}
+
+	if err := dataset.RenameDataset(h.DB, req.Msg.Id, name); err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+
+	return connect.NewResponse(&datasetv1.RenameDatasetResponse{}), nil
+}
+
+// UpdateDatasetMetadata implements datasetv1connect.DatasetServiceHandler.
+// Tags are trimmed and lowercased, so that "Sensor" and "sensor " are the same tag.
+func (h *DatasetHandler) UpdateDatasetMetadata(
+	ctx context.Context,
+	req *connect.Request[datasetv1.UpdateDatasetMetadataRequest],
+) (*connect.Response[datasetv1.UpdateDatasetMetadataResponse], error) {
+	description := strings.TrimSpace(req.Msg.Description)
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("description can have at most %d characters", maxDescriptionLength))
+	}
+
+	var tags []string
+	for _, tag := range req.Msg.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("tags can't be empty"))
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("tags can have at most %d characters", maxTagLength))
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("a dataset can have at most %d tags", maxTags))
+	}
+	slices.Sort(tags)
+
+	if err := h.requireWriteAccess(ctx, req.Msg.Id); err != nil {
+		return nil, err
+	}
+
+	if err := dataset.UpdateDatasetMetadata(h.DB, req.Msg.Id, description, tags); err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+
+	return connect.NewResponse(&datasetv1.UpdateDatasetMetadataResponse{
+		Description: description,
+		Tags:        tags,
+	}), nil
+}
+
+// ListDatasetVersions implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) ListDatasetVersions(
+	ctx context.Context,
+	req *connect.Request[datasetv1.ListDatasetVersionsRequest],
+) (*connect.Response[datasetv1.ListDatasetVersionsResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+
+	versions, err := dataset.GetDatasetVersions(h.DB, info.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &datasetv1.ListDatasetVersionsResponse{}
+	for _, v := range versions {
+		res.Versions = append(res.Versions, &datasetv1.DatasetVersion{
+			Version:    v.Version,
+			UploadedBy: v.Username,
+			RowCount:   v.RowCount,
+			SizeBytes:  v.SizeBytes,
+			Sha256:     v.Sha256,
+			CreatedAt:  v.CreatedAt,
+			Current:    v.Version == info.Version,
+		})
+	}
+	return connect.NewResponse(res), nil
+}
+
+// RestoreDatasetVersion implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) RestoreDatasetVersion(
+	ctx context.Context,
+	req *connect.Request[datasetv1.RestoreDatasetVersionRequest],
+) (*connect.Response[datasetv1.RestoreDatasetVersionResponse], error) {
+	if err := h.requireWriteAccess(ctx, req.Msg.Id); err != nil {
+		return nil, err
+	}
+
+	err := dataset.RestoreDatasetVersion(h.DB, req.Msg.Id, req.Msg.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dataset version not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	// The restore succeeded even if profiling can't be started, it is retried by ProfileDataset
+	if err = h.startProfiling(req.Msg.Id, req.Msg.Version); err != nil {
+		slog.Error("Failed to start profiling", "dataset", req.Msg.Id, "error", err)
+	}
+
+	return connect.NewResponse(&datasetv1.RestoreDatasetVersionResponse{}), nil
+}
@@ -0,0 +1,145 @@
+package dataset
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/gen/contracts/dataset/v1/datasetv1connect"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/repository/repositorytest"
+	"chart-organizer/backend/internal/storage"
+)
+
+// The user every request of the test server is made by
+const testUser = "user"
+
+type testServer struct {
+	db     *sql.DB
+	client datasetv1connect.DatasetServiceClient
+}
+
+// Start the dataset service for testUser, without the authentication of the real server
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	db := repositorytest.NewDB(t)
+	_, err := db.Exec("INSERT INTO users (id, username, password_hash, created_at) VALUES (?, ?, '', '2024-01-01T00:00:00Z')", testUser, testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads are written to temporary files next to the local storage
+	dir := t.TempDir()
+	t.Setenv("DATASET_STORAGE_PATH", dir)
+	handler := &DatasetHandler{DB: db, Storage: storage.NewLocal(dir), MaxUploadSize: 1 << 20}
+	mux := http.NewServeMux()
+	mux.Handle(datasetv1connect.NewDatasetServiceHandler(handler, connect.WithInterceptors(asTestUser{})))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return &testServer{db: db, client: datasetv1connect.NewDatasetServiceClient(server.Client(), server.URL)}
+}
+
+// asTestUser authenticates every request as testUser
+type asTestUser struct{}
+
+func (asTestUser) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		return next(context.WithValue(ctx, interceptors.UserIDKey, testUser), req)
+	}
+}
+
+func (asTestUser) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (asTestUser) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		return next(context.WithValue(ctx, interceptors.UserIDKey, testUser), conn)
+	}
+}
+
+// Upload a file through UploadDatasetStream and wait until it is profiled,
+// so no profiling is left running when the test ends
+func (s *testServer) upload(t *testing.T, filename string, content []byte) *datasetv1.UploadDatasetStreamResponse {
+	t.Helper()
+	stream := s.client.UploadDatasetStream(context.Background())
+	err := stream.Send(&datasetv1.UploadDatasetStreamRequest{Payload: &datasetv1.UploadDatasetStreamRequest_Metadata{
+		Metadata: &datasetv1.UploadDatasetMetadata{Filename: filename},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Send(&datasetv1.UploadDatasetStreamRequest{Payload: &datasetv1.UploadDatasetStreamRequest_Chunk{Chunk: content}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.CloseAndReceive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		p, err := dataset.GetProfile(s.db, res.Msg.Id, res.Msg.Version)
+		if err == nil && p.Status != dataset.ProfileStatusPending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the dataset is still being profiled: %v", err)
+		}
+	}
+	return res.Msg
+}
+
+func TestUploadReturnsChecksumOfStoredFile(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, tt := range []struct {
+		filename string
+		content  string
+	}{
+		{"data.csv", "a,b\n1,x\n2,y\n"},
+		{"data.ndjson", "{\"a\": 1, \"b\": \"x\"}\n{\"a\": 2, \"b\": \"y\"}\n"},
+	} {
+		t.Run(tt.filename, func(t *testing.T) {
+			uploaded := sha256.Sum256([]byte(tt.content))
+			res := s.upload(t, tt.filename, []byte(tt.content))
+
+			download, err := s.client.DownloadDataset(context.Background(), connect.NewRequest(&datasetv1.DownloadDatasetRequest{Id: res.Id}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer download.Close()
+			if !download.Receive() {
+				t.Fatal(download.Err())
+			}
+			metadata := download.Msg().GetMetadata()
+			var stored []byte
+			for download.Receive() {
+				stored = append(stored, download.Msg().GetChunk()...)
+			}
+			if err := download.Err(); err != nil {
+				t.Fatal(err)
+			}
+			storedChecksum := sha256.Sum256(stored)
+
+			if res.Sha256 != hex.EncodeToString(storedChecksum[:]) || res.Sha256 != metadata.Sha256 {
+				t.Errorf("got checksum %s, the stored file has %x and the download reports %s", res.Sha256, storedChecksum, metadata.Sha256)
+			}
+			if res.SizeBytes != int64(len(stored)) || res.SizeBytes != metadata.SizeBytes {
+				t.Errorf("got size %d, the stored file has %d bytes and the download reports %d", res.SizeBytes, len(stored), metadata.SizeBytes)
+			}
+			if converted := tt.filename != "data.csv"; converted == (res.Sha256 == hex.EncodeToString(uploaded[:])) {
+				t.Errorf("checksum of the upload %x, of the stored file %s", uploaded, res.Sha256)
+			}
+		})
+	}
+}
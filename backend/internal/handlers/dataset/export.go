@@ -0,0 +1,202 @@
+package dataset
+
+import (
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/export"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/query"
+	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/schema"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+)
+
+func exportOptionsFromProto(req *datasetv1.ExportDatasetRequest) (export.Options, error) {
+	options := export.Options{
+		Format:  strings.ToLower(req.Format),
+		Quoting: strings.ToLower(req.Csv.GetQuoting()),
+	}
+	if delimiter := req.Csv.GetDelimiter(); delimiter != "" {
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) {
+			return export.Options{}, connect.NewError(connect.CodeInvalidArgument, errors.New("the delimiter must be a single character"))
+		}
+		options.Delimiter = r
+	}
+	if err := options.Validate(); err != nil {
+		return export.Options{}, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return options, nil
+}
+
+// A nil filter matches every row
+func filterFromProto(f *datasetv1.Filter) *query.Filter {
+	if f == nil {
+		return nil
+	}
+
+	filter := &query.Filter{}
+	switch kind := f.Kind.(type) {
+	case *datasetv1.Filter_Predicate:
+		filter.Predicate = &query.Predicate{
+			Column:   kind.Predicate.GetColumn(),
+			Operator: strings.ToLower(kind.Predicate.GetOperator()),
+			Values:   kind.Predicate.GetValues(),
+		}
+	case *datasetv1.Filter_All:
+		filter.All = filterListFromProto(kind.All)
+	case *datasetv1.Filter_Any:
+		filter.Any = filterListFromProto(kind.Any)
+	}
+	return filter
+}
+
+// Never nil, so that empty lists are reported as such
+func filterListFromProto(list *datasetv1.FilterList) []query.Filter {
+	filters := make([]query.Filter, 0, len(list.GetFilters()))
+	for _, f := range list.GetFilters() {
+		filters = append(filters, *filterFromProto(f))
+	}
+	return filters
+}
+
+// Sends what is written to it as chunks of the stream
+type chunkWriter struct {
+	stream *connect.ServerStream[datasetv1.ExportDatasetResponse]
+	buffer []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), DownloadChunkSize-len(c.buffer))
+		c.buffer = append(c.buffer, p[:n]...)
+		p = p[n:]
+		if len(c.buffer) == DownloadChunkSize {
+			if err := c.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush sends the buffered bytes
+func (c *chunkWriter) Flush() error {
+	if len(c.buffer) == 0 {
+		return nil
+	}
+	err := c.stream.Send(&datasetv1.ExportDatasetResponse{
+		Payload: &datasetv1.ExportDatasetResponse_Chunk{Chunk: c.buffer},
+	})
+	c.buffer = make([]byte, 0, DownloadChunkSize)
+	return err
+}
+
+// ExportDataset implements datasetv1connect.DatasetServiceHandler.
+// Rows are converted while the file is read from the storage, only Parquet and
+// Arrow keep a row group or record batch in memory.
+func (h *DatasetHandler) ExportDataset(
+	ctx context.Context,
+	req *connect.Request[datasetv1.ExportDatasetRequest],
+	stream *connect.ServerStream[datasetv1.ExportDatasetResponse],
+) error {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return err
+	}
+	options, err := exportOptionsFromProto(req.Msg)
+	if err != nil {
+		return err
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		return notFoundOrInternal(err)
+	}
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return err
+	}
+
+	columns, err := h.loadColumns(&info)
+	if err != nil {
+		return err
+	}
+	indices, err := columnIndices(columns, req.Msg.Columns)
+	if err != nil {
+		return err
+	}
+	matches, err := query.Compile(filterFromProto(req.Msg.Filter), columns)
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	exported := make([]schema.Column, len(indices))
+	metadata := &datasetv1.ExportMetadata{
+		Filename:    export.Filename(info.Name, options.Format),
+		Format:      options.Format,
+		ContentType: export.ContentType(options.Format),
+		Version:     info.Version,
+	}
+	for k, i := range indices {
+		exported[k] = columns[i]
+		metadata.Columns = append(metadata.Columns, columnToProto(columns[i]))
+	}
+	err = stream.Send(&datasetv1.ExportDatasetResponse{
+		Payload: &datasetv1.ExportDatasetResponse_Metadata{Metadata: metadata},
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := dataset.OpenDatasetFile(h.Storage, info.ID, info.Version)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	reader, err := schema.NewRowReader(file, 0, len(columns))
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	chunks := &chunkWriter{stream: stream}
+	writer, err := export.NewWriter(chunks, exported, options)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	row := make([]string, len(indices))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+		if !matches(record) {
+			continue
+		}
+
+		for k, i := range indices {
+			row[k] = record[i]
+		}
+		if err = writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return chunks.Flush()
+}
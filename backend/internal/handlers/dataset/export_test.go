@@ -0,0 +1,191 @@
+package dataset
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+)
+
+const exportedCSV = "city,population,area,capital\n" +
+	"Oslo,709037,454.12,true\n" +
+	"Bergen,291940,465.3,false\n" +
+	"\"Zürich, ZH\",421878,87.88,false\n" +
+	"Geneva,,15.93,\n"
+
+// Export a dataset, returns the metadata and the file
+func (s *testServer) export(t *testing.T, req *datasetv1.ExportDatasetRequest) (*datasetv1.ExportMetadata, []byte, error) {
+	t.Helper()
+	stream, err := s.client.ExportDataset(context.Background(), connect.NewRequest(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stream.Close()
+
+	var metadata *datasetv1.ExportMetadata
+	var file []byte
+	for stream.Receive() {
+		if m := stream.Msg().GetMetadata(); m != nil {
+			metadata = m
+		}
+		file = append(file, stream.Msg().GetChunk()...)
+	}
+	return metadata, file, stream.Err()
+}
+
+func predicate(column string, operator string, values ...string) *datasetv1.Filter {
+	return &datasetv1.Filter{Kind: &datasetv1.Filter_Predicate{Predicate: &datasetv1.Predicate{Column: column, Operator: operator, Values: values}}}
+}
+
+func TestExportDataset(t *testing.T) {
+	s := newTestServer(t)
+	id := s.upload(t, "cities.csv", []byte(exportedCSV)).Id
+
+	for _, tt := range []struct {
+		name string
+		req  *datasetv1.ExportDatasetRequest
+		want string
+	}{
+		{"everything", &datasetv1.ExportDatasetRequest{}, exportedCSV},
+		{"columns in another order", &datasetv1.ExportDatasetRequest{Columns: []string{"area", "city"}},
+			"area,city\n454.12,Oslo\n465.3,Bergen\n87.88,\"Zürich, ZH\"\n15.93,Geneva\n"},
+		{"predicate", &datasetv1.ExportDatasetRequest{Filter: predicate("population", "GT", "400000")},
+			"city,population,area,capital\nOslo,709037,454.12,true\n\"Zürich, ZH\",421878,87.88,false\n"},
+		{"no matching rows", &datasetv1.ExportDatasetRequest{Filter: predicate("city", "eq", "Bern")},
+			"city,population,area,capital\n"},
+		{"filter on a column that isn't exported", &datasetv1.ExportDatasetRequest{
+			Columns: []string{"city"},
+			Filter: &datasetv1.Filter{Kind: &datasetv1.Filter_Any{Any: &datasetv1.FilterList{Filters: []*datasetv1.Filter{
+				predicate("population", "is_null"),
+				{Kind: &datasetv1.Filter_All{All: &datasetv1.FilterList{Filters: []*datasetv1.Filter{
+					predicate("capital", "eq", "false"),
+					predicate("area", "lt", "100"),
+				}}}},
+			}}}},
+		}, "city\n\"Zürich, ZH\"\nGeneva\n"},
+		{"quoting all", &datasetv1.ExportDatasetRequest{
+			Columns: []string{"city", "area"},
+			Filter:  predicate("city", "in", "Oslo", "Geneva"),
+			Csv:     &datasetv1.CsvExportOptions{Quoting: "all"},
+		}, "\"city\",\"area\"\n\"Oslo\",\"454.12\"\n\"Geneva\",\"15.93\"\n"},
+		{"quoting nonnumeric", &datasetv1.ExportDatasetRequest{
+			Columns: []string{"city", "area", "capital"},
+			Filter:  predicate("city", "contains", "R"),
+			Csv:     &datasetv1.CsvExportOptions{Quoting: "nonnumeric", Delimiter: ";"},
+		}, "\"city\";\"area\";\"capital\"\n\"Bergen\";465.3;\"false\"\n\"Zürich, ZH\";87.88;\"false\"\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Id = id
+			metadata, file, err := s.export(t, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(file) != tt.want {
+				t.Errorf("exported\n%s\nwant\n%s", file, tt.want)
+			}
+			if metadata.Filename != "cities.csv" || metadata.ContentType != "text/csv" || metadata.Version != 1 {
+				t.Errorf("metadata %v", metadata)
+			}
+		})
+	}
+}
+
+func TestExportDatasetTyped(t *testing.T) {
+	s := newTestServer(t)
+	id := s.upload(t, "cities.csv", []byte(exportedCSV)).Id
+	req := &datasetv1.ExportDatasetRequest{
+		Id:      id,
+		Columns: []string{"population", "city"},
+		Filter:  predicate("area", "ge", "400"),
+	}
+	want := [][]string{{"709037", "Oslo"}, {"291940", "Bergen"}}
+
+	req.Format = "parquet"
+	metadata, data, err := s.export(t, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Filename != "cities.parquet" || len(metadata.Columns) != 2 || metadata.Columns[0].Name != "population" {
+		t.Errorf("metadata %v", metadata)
+	}
+	table, err := pqarrow.ReadTable(context.Background(), bytes.NewReader(data), nil, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+	var rows [][]string
+	tableReader := array.NewTableReader(table, -1)
+	defer tableReader.Release()
+	for tableReader.Next() {
+		record := tableReader.RecordBatch()
+		for r := range int(record.NumRows()) {
+			rows = append(rows, []string{record.Column(0).ValueStr(r), record.Column(1).ValueStr(r)})
+		}
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Parquet rows %q, want %q", rows, want)
+	}
+
+	req.Format = "arrow"
+	if _, data, err = s.export(t, req); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := ipc.NewFileReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if fields := reader.Schema().Fields(); fields[0].Type.String() != "int64" || fields[1].Type.String() != "utf8" {
+		t.Errorf("Arrow schema %s", reader.Schema())
+	}
+	rows = nil
+	for i := range reader.NumRecords() {
+		record, err := reader.Record(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r := range int(record.NumRows()) {
+			rows = append(rows, []string{record.Column(0).ValueStr(r), record.Column(1).ValueStr(r)})
+		}
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Arrow rows %q, want %q", rows, want)
+	}
+}
+
+func TestExportDatasetInvalid(t *testing.T) {
+	s := newTestServer(t)
+	id := s.upload(t, "cities.csv", []byte(exportedCSV)).Id
+
+	for _, tt := range []struct {
+		name string
+		req  *datasetv1.ExportDatasetRequest
+		code connect.Code
+	}{
+		{"unknown column", &datasetv1.ExportDatasetRequest{Id: id, Columns: []string{"country"}}, connect.CodeInvalidArgument},
+		{"filter on an unknown column", &datasetv1.ExportDatasetRequest{Id: id, Filter: predicate("country", "eq", "NO")}, connect.CodeInvalidArgument},
+		{"unknown operator", &datasetv1.ExportDatasetRequest{Id: id, Filter: predicate("city", "like", "O%")}, connect.CodeInvalidArgument},
+		{"empty filter list", &datasetv1.ExportDatasetRequest{Id: id, Filter: &datasetv1.Filter{Kind: &datasetv1.Filter_All{All: &datasetv1.FilterList{}}}}, connect.CodeInvalidArgument},
+		{"unknown format", &datasetv1.ExportDatasetRequest{Id: id, Format: "xlsx"}, connect.CodeInvalidArgument},
+		{"csv options of another format", &datasetv1.ExportDatasetRequest{Id: id, Format: "json", Csv: &datasetv1.CsvExportOptions{Delimiter: ";"}}, connect.CodeInvalidArgument},
+		{"long delimiter", &datasetv1.ExportDatasetRequest{Id: id, Csv: &datasetv1.CsvExportOptions{Delimiter: ";;"}}, connect.CodeInvalidArgument},
+		{"unknown dataset", &datasetv1.ExportDatasetRequest{Id: "missing"}, connect.CodeNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := s.export(t, tt.req)
+			var connectErr *connect.Error
+			if !errors.As(err, &connectErr) || connectErr.Code() != tt.code {
+				t.Errorf("got %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package dataset
+
+import (
+	"bytes"
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/ingest"
+	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/schema"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+)
+
+// Settings that are not set are detected, see ingest.Detect
+func importOptionsFromProto(options *datasetv1.ImportOptions) (ingest.Options, error) {
+	o := ingest.Options{
+		Format:    strings.ToLower(options.GetFormat()),
+		Sheet:     options.GetSheet(),
+		Encoding:  options.GetEncoding(),
+		SkipRows:  int(options.GetSkipRows()),
+		HeaderRow: int(options.GetHeaderRow()),
+	}
+	if tokens := options.GetNullTokens(); len(tokens) > 0 {
+		o.NullTokens = tokens
+	}
+	characters := []struct {
+		name  string
+		value string
+		r     *rune
+	}{
+		{"delimiter", options.GetDelimiter(), &o.Delimiter},
+		{"quote", options.GetQuote(), &o.Quote},
+		{"decimal separator", options.GetDecimalSeparator(), &o.DecimalSeparator},
+	}
+	for _, c := range characters {
+		if c.value == "" {
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(c.value)
+		if size != len(c.value) {
+			return ingest.Options{}, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("the %s must be a single character", c.name))
+		}
+		*c.r = r
+	}
+
+	if err := o.Validate(); err != nil {
+		return ingest.Options{}, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return o, nil
+}
+
+func importOptionsToProto(o ingest.Options) *datasetv1.ImportOptions {
+	character := func(r rune) string {
+		if r == 0 {
+			return ""
+		}
+		return string(r)
+	}
+	return &datasetv1.ImportOptions{
+		Format:           o.Format,
+		Sheet:            o.Sheet,
+		Delimiter:        character(o.Delimiter),
+		Quote:            character(o.Quote),
+		Encoding:         o.Encoding,
+		SkipRows:         int32(o.SkipRows),
+		HeaderRow:        int32(o.HeaderRow),
+		DecimalSeparator: character(o.DecimalSeparator),
+		NullTokens:       o.NullTokens,
+	}
+}
+
+// Turn a file that can't be read in its format into an invalid argument
+// error, with a CsvParseError detail if the problem is at a line
+func parseError(err error, format string) error {
+	var detail *datasetv1.CsvParseError
+	var parseErr *schema.ParseError
+	var ingestErr *ingest.Error
+	switch {
+	case errors.As(err, &parseErr):
+		err = fmt.Errorf("invalid %s file: %w", strings.ToUpper(format), parseErr)
+		detail = &datasetv1.CsvParseError{
+			Line:    int64(parseErr.Line),
+			Column:  int64(parseErr.Column),
+			Problem: parseErr.Problem,
+		}
+	case errors.As(err, &ingestErr):
+		if ingestErr.Line > 0 {
+			detail = &datasetv1.CsvParseError{
+				Line:    int64(ingestErr.Line),
+				Problem: ingestErr.Problem,
+			}
+		}
+	case errors.Is(err, ingest.ErrUnknownFormat):
+	default:
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	connectErr := connect.NewError(connect.CodeInvalidArgument, err)
+	if detail != nil {
+		if d, err := connect.NewErrorDetail(detail); err == nil {
+			connectErr.AddDetail(d)
+		}
+	}
+	return connectErr
+}
+
+// Convert the data of an upload to CSV, unless it already is
+func convertUploadData(data []byte, filename string, requested ingest.Options) ([]byte, ingest.Options, error) {
+	reader := bytes.NewReader(data)
+	options, err := ingest.Detect(reader, int64(len(data)), filename, requested)
+	if err != nil {
+		return nil, ingest.Options{}, parseError(err, requested.Format)
+	}
+	if options.IsCSV() {
+		return data, options, nil
+	}
+
+	var converted bytes.Buffer
+	if err = ingest.Convert(reader, int64(len(data)), options, &converted); err != nil {
+		return nil, ingest.Options{}, parseError(err, options.Format)
+	}
+	return converted.Bytes(), options, nil
+}
+
+// An uploaded file converted to CSV
+type csvFile struct {
+	path string
+	size int64
+	// Hex-encoded SHA-256
+	checksum string
+}
+
+// Convert an uploaded file to a temporary CSV file, unless it already is
+// CSV. The caller removes the converted file if it isn't the uploaded one.
+func convertUploadFile(upload *os.File, size int64, checksum string, filename string, requested ingest.Options) (csvFile, ingest.Options, error) {
+	options, err := ingest.Detect(upload, size, filename, requested)
+	if err != nil {
+		return csvFile{}, ingest.Options{}, parseError(err, requested.Format)
+	}
+	if options.IsCSV() {
+		return csvFile{path: upload.Name(), size: size, checksum: checksum}, options, nil
+	}
+
+	converted, err := dataset.CreateUploadFile()
+	if err != nil {
+		return csvFile{}, ingest.Options{}, connect.NewError(connect.CodeInternal, err)
+	}
+	defer converted.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(converted, hash)}
+	err = ingest.Convert(upload, size, options, counter)
+	if err == nil {
+		err = converted.Close()
+	}
+	if err != nil {
+		os.Remove(converted.Name())
+		return csvFile{}, ingest.Options{}, parseError(err, options.Format)
+	}
+
+	return csvFile{
+		path:     converted.Name(),
+		size:     counter.n,
+		checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, options, nil
+}
+
+func inferFile(path string) (schema.Schema, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return schema.Schema{}, err
+	}
+	defer file.Close()
+	return schema.Infer(file)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,121 @@
+package dataset
+
+import (
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/query"
+	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/schema"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"connectrpc.com/connect"
+)
+
+func queryFromProto(req *datasetv1.QueryDatasetRequest, limit int) query.Query {
+	q := query.Query{
+		Columns: req.Columns,
+		Filter:  filterFromProto(req.Filter),
+		GroupBy: req.GroupBy,
+		Limit:   limit,
+	}
+	for _, a := range req.Aggregates {
+		q.Aggregates = append(q.Aggregates, query.Aggregate{
+			Function: strings.ToLower(a.Function),
+			Column:   a.Column,
+			Alias:    a.Alias,
+		})
+	}
+	for _, o := range req.OrderBy {
+		q.OrderBy = append(q.OrderBy, query.Order{Column: o.Column, Descending: o.Descending})
+	}
+	return q
+}
+
+// QueryDataset implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) QueryDataset(
+	ctx context.Context,
+	req *connect.Request[datasetv1.QueryDatasetRequest],
+) (*connect.Response[datasetv1.QueryDatasetResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsRead); err != nil {
+		return nil, err
+	}
+
+	limit := int(req.Msg.Limit)
+	if limit < 0 || limit > maxPageSize {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+	}
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+
+	info, err := dataset.GetDatasetInfo(h.DB, userId, req.Msg.Id)
+	if err != nil {
+		return nil, notFoundOrInternal(err)
+	}
+	if err = h.selectVersion(&info, req.Msg.Version); err != nil {
+		return nil, err
+	}
+	columns, err := h.loadColumns(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	executor, err := query.NewExecutor(queryFromProto(req.Msg, limit), columns)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	file, err := dataset.OpenDatasetFile(h.Storage, info.ID, info.Version)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	defer file.Close()
+
+	reader, err := schema.NewRowReader(file, 0, len(columns))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	for !executor.Done() {
+		if err = ctx.Err(); err != nil {
+			return nil, connect.NewError(connect.CodeCanceled, err)
+		}
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		if err = executor.Add(record); err != nil {
+			if errors.Is(err, query.ErrTooManyGroups) {
+				return nil, connect.NewError(connect.CodeResourceExhausted, err)
+			}
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+
+	result := executor.Result()
+	res := &datasetv1.QueryDatasetResponse{
+		Truncated: result.Truncated,
+		Version:   info.Version,
+	}
+	for _, c := range result.Columns {
+		res.Columns = append(res.Columns, columnToProto(c))
+	}
+	for _, values := range result.Rows {
+		row := &datasetv1.Row{}
+		for _, v := range values {
+			row.Values = append(row.Values, typedValueToProto(v))
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	return connect.NewResponse(res), nil
+}
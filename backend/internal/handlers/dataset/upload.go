@@ -0,0 +1,249 @@
+package dataset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"connectrpc.com/connect"
+
+	datasetv1 "chart-organizer/backend/gen/contracts/dataset/v1"
+	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/repository/dataset"
+)
+
+// MaxChunkSize is the largest chunk accepted by UploadChunk
+const MaxChunkSize = 4 << 20
+
+func getUploaderId(ctx context.Context) (string, error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return "", connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDatasetsWrite); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// Get an upload session of the user, sessions of other users are not found
+func (h *DatasetHandler) getUploadSession(userId string, id string) (dataset.UploadSession, error) {
+	session, err := dataset.GetUploadSession(h.DB, userId, id)
+	if err != nil {
+		if errors.Is(err, dataset.ErrUploadSessionNotFound) {
+			return dataset.UploadSession{}, connect.NewError(connect.CodeNotFound, err)
+		}
+		return dataset.UploadSession{}, connect.NewError(connect.CodeInternal, err)
+	}
+	return session, nil
+}
+
+func receivedBytes(ranges []dataset.ByteRange) int64 {
+	var received int64
+	for _, r := range ranges {
+		received += r.End - r.Start
+	}
+	return received
+}
+
+// BeginUpload implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) BeginUpload(
+	ctx context.Context,
+	req *connect.Request[datasetv1.BeginUploadRequest],
+) (*connect.Response[datasetv1.BeginUploadResponse], error) {
+	userId, err := getUploaderId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.checkUploadAccess(userId, req.Msg.OrganizationId, req.Msg.DatasetId); err != nil {
+		return nil, err
+	}
+
+	if req.Msg.SizeBytes <= 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("size must be positive"))
+	}
+	if req.Msg.SizeBytes > h.MaxUploadSize {
+		return nil, h.uploadTooLargeError()
+	}
+	options, err := importOptionsFromProto(req.Msg.ImportOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := dataset.CreateUploadSession(h.DB, userId, req.Msg.OrganizationId, req.Msg.DatasetId, req.Msg.Filename, req.Msg.SizeBytes, options)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&datasetv1.BeginUploadResponse{
+		UploadId:  session.ID,
+		ExpiresAt: session.ExpiresAt,
+	}), nil
+}
+
+// UploadChunk implements datasetv1connect.DatasetServiceHandler.
+func (h *DatasetHandler) UploadChunk(
+	ctx context.Context,
+	req *connect.Request[datasetv1.UploadChunkRequest],
+) (*connect.Response[datasetv1.UploadChunkResponse], error) {
+	userId, err := getUploaderId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := h.getUploadSession(userId, req.Msg.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(req.Msg.Data))
+	if size == 0 || size > MaxChunkSize {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("chunks must have between 1 and %d bytes", MaxChunkSize))
+	}
+	if req.Msg.Offset < 0 || req.Msg.Offset+size > session.SizeBytes {
+		return nil, connect.NewError(connect.CodeOutOfRange, fmt.Errorf("chunk is outside of the file of %d bytes", session.SizeBytes))
+	}
+
+	expiresAt, err := dataset.WriteUploadChunk(h.DB, h.Storage, session.ID, req.Msg.Offset, req.Msg.Data)
+	if err != nil {
+		if errors.Is(err, dataset.ErrUploadSessionNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	ranges, err := dataset.GetReceivedRanges(h.DB, session.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&datasetv1.UploadChunkResponse{
+		ReceivedBytes: receivedBytes(ranges),
+		ExpiresAt:     expiresAt,
+	}), nil
+}
+
+// GetUploadStatus implements datasetv1connect.DatasetServiceHandler.
+// Clients resume an interrupted upload by sending the missing ranges.
+func (h *DatasetHandler) GetUploadStatus(
+	ctx context.Context,
+	req *connect.Request[datasetv1.GetUploadStatusRequest],
+) (*connect.Response[datasetv1.GetUploadStatusResponse], error) {
+	userId, err := getUploaderId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := h.getUploadSession(userId, req.Msg.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges, err := dataset.GetReceivedRanges(h.DB, session.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &datasetv1.GetUploadStatusResponse{
+		Filename:      session.Filename,
+		SizeBytes:     session.SizeBytes,
+		ReceivedBytes: receivedBytes(ranges),
+		ExpiresAt:     session.ExpiresAt,
+	}
+	for _, r := range ranges {
+		res.ReceivedRanges = append(res.ReceivedRanges, &datasetv1.ByteRange{Start: r.Start, End: r.End})
+	}
+	return connect.NewResponse(res), nil
+}
+
+// CommitUpload implements datasetv1connect.DatasetServiceHandler.
+// The session stays open if the file is incomplete or its checksum doesn't
+// match, so that the client can send the missing or corrupted chunks again.
+func (h *DatasetHandler) CommitUpload(
+	ctx context.Context,
+	req *connect.Request[datasetv1.CommitUploadRequest],
+) (*connect.Response[datasetv1.CommitUploadResponse], error) {
+	userId, err := getUploaderId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Msg.Sha256 == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("the SHA-256 checksum of the file is required"))
+	}
+
+	session, err := h.getUploadSession(userId, req.Msg.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	// The role of the user may have changed since the upload began
+	if err = h.checkUploadAccess(userId, session.OrganizationID, session.DatasetID); err != nil {
+		return nil, err
+	}
+
+	ranges, err := dataset.GetReceivedRanges(h.DB, session.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if received := receivedBytes(ranges); received != session.SizeBytes {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("only %d of %d bytes have been received", received, session.SizeBytes))
+	}
+
+	file, err := dataset.AssembleUploadSession(h.DB, h.Storage, session)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(req.Msg.Sha256, checksum) {
+		return nil, connect.NewError(connect.CodeDataLoss, fmt.Errorf("the received file has the SHA-256 checksum %s, not %s", checksum, req.Msg.Sha256))
+	}
+
+	converted, options, err := convertUploadFile(file, session.SizeBytes, checksum, session.Filename, session.ImportOptions)
+	if err != nil {
+		return nil, err
+	}
+	if converted.path != file.Name() {
+		defer os.Remove(converted.path)
+	}
+	if err = file.Close(); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	datasetSchema, err := inferFile(converted.path)
+	if err != nil {
+		return nil, parseError(err, options.Format)
+	}
+
+	id, version, err := dataset.CommitUploadSession(h.DB, h.Storage, session, converted.path, converted.checksum, datasetSchema, converted.size)
+	if err != nil {
+		if errors.Is(err, dataset.ErrUploadSessionNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, notFoundOrInternal(err)
+	}
+
+	// The upload succeeded even if profiling can't be started, it is retried by ProfileDataset
+	if err = h.startProfiling(id, version); err != nil {
+		slog.Error("Failed to start profiling", "dataset", id, "error", err)
+	}
+
+	return connect.NewResponse(&datasetv1.CommitUploadResponse{
+		Id:            id,
+		SizeBytes:     converted.size,
+		RowCount:      datasetSchema.RowCount,
+		Version:       version,
+		ImportOptions: importOptionsToProto(options),
+	}), nil
+}
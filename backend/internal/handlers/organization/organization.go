@@ -0,0 +1,295 @@
+package organization
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+
+	"connectrpc.com/connect"
+
+	organizationv1 "chart-organizer/backend/gen/contracts/organization/v1"
+	"chart-organizer/backend/internal/interceptors"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	datasetRepo "chart-organizer/backend/internal/repository/dataset"
+	organizationRepo "chart-organizer/backend/internal/repository/organization"
+	"chart-organizer/backend/internal/storage"
+)
+
+type OrganizationHandler struct {
+	DB      *sql.DB
+	Storage storage.Storage
+}
+
+var errOrganizationNotFound = connect.NewError(connect.CodeNotFound, errors.New("organization not found"))
+
+// Organizations can only be managed by a user logged in with a session
+func getSessionUserId(ctx context.Context) (string, error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return "", connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireSession(ctx); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// Get the role of the user in the organization. Non-members get not found,
+// so that they can't tell which organizations exist.
+func (h *OrganizationHandler) getRole(organizationId string, userId string) (string, error) {
+	role, err := organizationRepo.GetMemberRole(h.DB, organizationId, userId)
+	if err != nil {
+		if errors.Is(err, organizationRepo.ErrNotMember) {
+			return "", errOrganizationNotFound
+		}
+		return "", connect.NewError(connect.CodeInternal, err)
+	}
+	return role, nil
+}
+
+func (h *OrganizationHandler) requireOwner(organizationId string, userId string) error {
+	role, err := h.getRole(organizationId, userId)
+	if err != nil {
+		return err
+	}
+	if role != organizationRepo.RoleOwner {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("only owners can manage the organization"))
+	}
+	return nil
+}
+
+func validateRole(role string) error {
+	if !slices.Contains(organizationRepo.Roles, role) {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("role must be owner, editor or viewer"))
+	}
+	return nil
+}
+
+func memberError(err error) error {
+	switch {
+	case errors.Is(err, organizationRepo.ErrNotMember):
+		return connect.NewError(connect.CodeNotFound, errors.New("member not found"))
+	case errors.Is(err, organizationRepo.ErrLastOwner):
+		return connect.NewError(connect.CodeFailedPrecondition, err)
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
+
+func toProto(o organizationRepo.Organization) *organizationv1.Organization {
+	return &organizationv1.Organization{
+		Id:        o.ID,
+		Name:      o.Name,
+		CreatedAt: o.CreatedAt,
+		Role:      o.Role,
+	}
+}
+
+// CreateOrganization implements organizationv1connect.OrganizationServiceHandler.
+func (h *OrganizationHandler) CreateOrganization(
+	ctx context.Context,
+	req *connect.Request[organizationv1.CreateOrganizationRequest],
+) (*connect.Response[organizationv1.CreateOrganizationResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(req.Msg.Name)
+	if name == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("name is required"))
+	}
+
+	org, err := organizationRepo.CreateOrganization(h.DB, userId, name)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &organizationv1.CreateOrganizationResponse{
+		Organization: toProto(org),
+	}
+	return connect.NewResponse(res), nil
+}
+
+// ListOrganizations implements organizationv1connect.OrganizationServiceHandler.
+func (h *OrganizationHandler) ListOrganizations(
+	ctx context.Context,
+	req *connect.Request[organizationv1.ListOrganizationsRequest],
+) (*connect.Response[organizationv1.ListOrganizationsResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs, err := organizationRepo.GetOrganizationsOfUser(h.DB, userId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var resOrgs []*organizationv1.Organization
+	for _, o := range orgs {
+		resOrgs = append(resOrgs, toProto(o))
+	}
+
+	res := &organizationv1.ListOrganizationsResponse{
+		Organizations: resOrgs,
+	}
+	return connect.NewResponse(res), nil
+}
+
+// DeleteOrganization implements organizationv1connect.OrganizationServiceHandler.
+func (h *OrganizationHandler) DeleteOrganization(
+	ctx context.Context,
+	req *connect.Request[organizationv1.DeleteOrganizationRequest],
+) (*connect.Response[organizationv1.DeleteOrganizationResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.requireOwner(req.Msg.OrganizationId, userId); err != nil {
+		return nil, err
+	}
+
+	err = datasetRepo.DeleteAllDatasetsFromOrganization(h.DB, h.Storage, req.Msg.OrganizationId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, errors.New("failed to delete datasets: "+err.Error()))
+	}
+
+	err = organizationRepo.DeleteOrganization(h.DB, req.Msg.OrganizationId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&organizationv1.DeleteOrganizationResponse{}), nil
+}
+
+// ListMembers implements organizationv1connect.OrganizationServiceHandler.
+// Every member can see who else is in the organization.
+func (h *OrganizationHandler) ListMembers(
+	ctx context.Context,
+	req *connect.Request[organizationv1.ListMembersRequest],
+) (*connect.Response[organizationv1.ListMembersResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = h.getRole(req.Msg.OrganizationId, userId); err != nil {
+		return nil, err
+	}
+
+	members, err := organizationRepo.GetMembers(h.DB, req.Msg.OrganizationId)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	var resMembers []*organizationv1.Member
+	for _, m := range members {
+		resMembers = append(resMembers, &organizationv1.Member{
+			UserId:    m.UserID,
+			Username:  m.Username,
+			Role:      m.Role,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+
+	res := &organizationv1.ListMembersResponse{
+		Members: resMembers,
+	}
+	return connect.NewResponse(res), nil
+}
+
+// AddMember implements organizationv1connect.OrganizationServiceHandler.
+func (h *OrganizationHandler) AddMember(
+	ctx context.Context,
+	req *connect.Request[organizationv1.AddMemberRequest],
+) (*connect.Response[organizationv1.AddMemberResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateRole(req.Msg.Role); err != nil {
+		return nil, err
+	}
+	if err = h.requireOwner(req.Msg.OrganizationId, userId); err != nil {
+		return nil, err
+	}
+
+	memberId, err := authRepo.GetUserID(h.DB, req.Msg.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("user not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	createdAt, err := organizationRepo.AddMember(h.DB, req.Msg.OrganizationId, memberId, req.Msg.Role)
+	if err != nil {
+		if errors.Is(err, organizationRepo.ErrAlreadyMember) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	res := &organizationv1.AddMemberResponse{
+		Member: &organizationv1.Member{
+			UserId:    memberId,
+			Username:  req.Msg.Username,
+			Role:      req.Msg.Role,
+			CreatedAt: createdAt,
+		},
+	}
+	return connect.NewResponse(res), nil
+}
+
+// UpdateMemberRole implements organizationv1connect.OrganizationServiceHandler.
+func (h *OrganizationHandler) UpdateMemberRole(
+	ctx context.Context,
+	req *connect.Request[organizationv1.UpdateMemberRoleRequest],
+) (*connect.Response[organizationv1.UpdateMemberRoleResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateRole(req.Msg.Role); err != nil {
+		return nil, err
+	}
+	if err = h.requireOwner(req.Msg.OrganizationId, userId); err != nil {
+		return nil, err
+	}
+
+	err = organizationRepo.SetMemberRole(h.DB, req.Msg.OrganizationId, req.Msg.UserId, req.Msg.Role)
+	if err != nil {
+		return nil, memberError(err)
+	}
+
+	return connect.NewResponse(&organizationv1.UpdateMemberRoleResponse{}), nil
+}
+
+// RemoveMember implements organizationv1connect.OrganizationServiceHandler.
+// Owners can remove anyone, other members only themselves.
+func (h *OrganizationHandler) RemoveMember(
+	ctx context.Context,
+	req *connect.Request[organizationv1.RemoveMemberRequest],
+) (*connect.Response[organizationv1.RemoveMemberResponse], error) {
+	userId, err := getSessionUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Msg.UserId == userId {
+		_, err = h.getRole(req.Msg.OrganizationId, userId)
+	} else {
+		err = h.requireOwner(req.Msg.OrganizationId, userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = organizationRepo.RemoveMember(h.DB, req.Msg.OrganizationId, req.Msg.UserId)
+	if err != nil {
+		return nil, memberError(err)
+	}
+
+	return connect.NewResponse(&organizationv1.RemoveMemberResponse{}), nil
+}
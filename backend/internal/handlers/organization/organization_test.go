@@ -0,0 +1,140 @@
+package organization
+
+import (
+	"context"
+	"testing"
+
+	"connectrpc.com/connect"
+
+	organizationv1 "chart-organizer/backend/gen/contracts/organization/v1"
+	"chart-organizer/backend/internal/interceptors"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	organizationRepo "chart-organizer/backend/internal/repository/organization"
+	"chart-organizer/backend/internal/repository/repositorytest"
+)
+
+// An organization of alice, which bob edits and carol views.
+// dave is not a member.
+type testOrganization struct {
+	h     *OrganizationHandler
+	id    string
+	users map[string]string
+}
+
+func newTestOrganization(t *testing.T) *testOrganization {
+	t.Helper()
+	db := repositorytest.NewDB(t)
+	users := make(map[string]string)
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		if err := authRepo.AddNewUser(db, username, "correct horse battery"); err != nil {
+			t.Fatal(err)
+		}
+		id, err := authRepo.GetUserID(db, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[username] = id
+	}
+
+	org, err := organizationRepo.CreateOrganization(db, users["alice"], "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for username, role := range map[string]string{"bob": organizationRepo.RoleEditor, "carol": organizationRepo.RoleViewer} {
+		if _, err := organizationRepo.AddMember(db, org.ID, users[username], role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testOrganization{h: &OrganizationHandler{DB: db}, id: org.ID, users: users}
+}
+
+// The context of a request of the user logged in with a session
+func (o *testOrganization) as(username string) context.Context {
+	ctx := context.WithValue(context.Background(), interceptors.UserIDKey, o.users[username])
+	return context.WithValue(ctx, interceptors.SessionIDKey, "session of "+username)
+}
+
+func TestOnlyOwnersManageMembers(t *testing.T) {
+	for _, tt := range []struct {
+		username string
+		code     connect.Code
+	}{
+		{"bob", connect.CodePermissionDenied},
+		{"carol", connect.CodePermissionDenied},
+		// Non-members can't tell whether the organization exists
+		{"dave", connect.CodeNotFound},
+	} {
+		t.Run(tt.username, func(t *testing.T) {
+			o := newTestOrganization(t)
+			ctx := o.as(tt.username)
+
+			_, err := o.h.AddMember(ctx, connect.NewRequest(&organizationv1.AddMemberRequest{OrganizationId: o.id, Username: "dave", Role: organizationRepo.RoleOwner}))
+			if connect.CodeOf(err) != tt.code {
+				t.Errorf("AddMember: got %v, want %v", err, tt.code)
+			}
+			_, err = o.h.UpdateMemberRole(ctx, connect.NewRequest(&organizationv1.UpdateMemberRoleRequest{OrganizationId: o.id, UserId: o.users[tt.username], Role: organizationRepo.RoleOwner}))
+			if connect.CodeOf(err) != tt.code {
+				t.Errorf("UpdateMemberRole of themselves: got %v, want %v", err, tt.code)
+			}
+			_, err = o.h.RemoveMember(ctx, connect.NewRequest(&organizationv1.RemoveMemberRequest{OrganizationId: o.id, UserId: o.users["alice"]}))
+			if connect.CodeOf(err) != tt.code {
+				t.Errorf("RemoveMember of the owner: got %v, want %v", err, tt.code)
+			}
+			_, err = o.h.DeleteOrganization(ctx, connect.NewRequest(&organizationv1.DeleteOrganizationRequest{OrganizationId: o.id}))
+			if connect.CodeOf(err) != tt.code {
+				t.Errorf("DeleteOrganization: got %v, want %v", err, tt.code)
+			}
+
+			// Nothing changed
+			members, err := organizationRepo.GetMembers(o.h.DB, o.id)
+			if err != nil || len(members) != 3 || members[0].Role != organizationRepo.RoleOwner {
+				t.Errorf("members %+v, %v", members, err)
+			}
+		})
+	}
+}
+
+func TestListMembersRequiresMembership(t *testing.T) {
+	o := newTestOrganization(t)
+	req := connect.NewRequest(&organizationv1.ListMembersRequest{OrganizationId: o.id})
+	if _, err := o.h.ListMembers(o.as("carol"), req); err != nil {
+		t.Errorf("viewer: %v", err)
+	}
+	if _, err := o.h.ListMembers(o.as("dave"), req); connect.CodeOf(err) != connect.CodeNotFound {
+		t.Errorf("non-member: got %v, want not found", err)
+	}
+}
+
+// Organizations can't be managed with an API key
+func TestOrganizationsRequireSession(t *testing.T) {
+	o := newTestOrganization(t)
+	ctx := context.WithValue(context.Background(), interceptors.UserIDKey, o.users["alice"])
+	ctx = context.WithValue(ctx, interceptors.ScopesKey, interceptors.Scopes)
+
+	_, err := o.h.AddMember(ctx, connect.NewRequest(&organizationv1.AddMemberRequest{OrganizationId: o.id, Username: "dave", Role: organizationRepo.RoleViewer}))
+	if connect.CodeOf(err) != connect.CodePermissionDenied {
+		t.Errorf("AddMember: got %v, want permission denied", err)
+	}
+	if _, err := o.h.ListOrganizations(ctx, connect.NewRequest(&organizationv1.ListOrganizationsRequest{})); connect.CodeOf(err) != connect.CodePermissionDenied {
+		t.Errorf("ListOrganizations: got %v, want permission denied", err)
+	}
+	if _, err := o.h.ListOrganizations(context.Background(), connect.NewRequest(&organizationv1.ListOrganizationsRequest{})); connect.CodeOf(err) != connect.CodeUnauthenticated {
+		t.Errorf("ListOrganizations anonymously: got %v, want unauthenticated", err)
+	}
+}
+
+func TestMembersCanLeave(t *testing.T) {
+	o := newTestOrganization(t)
+	for _, username := range []string{"bob", "carol"} {
+		req := connect.NewRequest(&organizationv1.RemoveMemberRequest{OrganizationId: o.id, UserId: o.users[username]})
+		if _, err := o.h.RemoveMember(o.as(username), req); err != nil {
+			t.Errorf("%s: %v", username, err)
+		}
+	}
+
+	// The last owner must stay
+	req := connect.NewRequest(&organizationv1.RemoveMemberRequest{OrganizationId: o.id, UserId: o.users["alice"]})
+	if _, err := o.h.RemoveMember(o.as("alice"), req); connect.CodeOf(err) != connect.CodeFailedPrecondition {
+		t.Errorf("last owner: got %v, want failed precondition", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 
 	vizv1 "chart-organizer/backend/gen/contracts/viz/v1"
 	"chart-organizer/backend/internal/interceptors"
+	"chart-organizer/backend/internal/repository/dataset"
+	"chart-organizer/backend/internal/repository/organization"
 	"chart-organizer/backend/internal/repository/viz"
 )
 
@@ -16,6 +18,34 @@ type VisualizationHandler struct {
 	DB *sql.DB
 }
 
+// Dashboards can only be built on datasets the user may write to.
+// A version of 0 stands for the current version.
+func (h *VisualizationHandler) checkDataset(userId string, datasetId string, version int64) error {
+	role, err := dataset.GetDatasetRole(h.DB, userId, datasetId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return connect.NewError(connect.CodeNotFound, errors.New("dataset not found"))
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !organization.CanWrite(role) {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("viewers can't create or change dashboards"))
+	}
+
+	if version < 0 {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("dataset version can't be negative"))
+	}
+	if version > 0 {
+		if _, err = dataset.GetDatasetVersion(h.DB, datasetId, version); err != nil {
+			if err == sql.ErrNoRows {
+				return connect.NewError(connect.CodeNotFound, errors.New("dataset version not found"))
+			}
+			return connect.NewError(connect.CodeInternal, err)
+		}
+	}
+	return nil
+}
+
 // CreateDashboard implements vizv1connect.DashboardServiceHandler.
 func (h *VisualizationHandler) CreateDashboard(
 	ctx context.Context,
@@ -25,8 +55,15 @@ func (h *VisualizationHandler) CreateDashboard(
 	if !found {
 		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
 	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDashboardsWrite); err != nil {
+		return nil, err
+	}
+
+	if err := h.checkDataset(userId, req.Msg.DatasetId, req.Msg.DatasetVersion); err != nil {
+		return nil, err
+	}
 
-	id, err := viz.AddNewDashboard(h.DB, userId, req.Msg.DatasetId, req.Msg.Visualizations)
+	id, err := viz.AddNewDashboard(h.DB, userId, req.Msg.DatasetId, req.Msg.DatasetVersion, req.Msg.Visualizations)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
@@ -38,22 +75,78 @@ func (h *VisualizationHandler) CreateDashboard(
 }
 
 // GetDashboard implements vizv1connect.DashboardServiceHandler.
+// Dashboards of personal datasets are public, those of an organization can
+// only be read by its members.
 func (h *VisualizationHandler) GetDashboard(
 	ctx context.Context,
 	req *connect.Request[vizv1.GetDashboardRequest],
 ) (*connect.Response[vizv1.GetDashboardResponse], error) {
-	visualizations, datasetId, err := viz.GetDashboard(h.DB, req.Msg.Id)
+	dashboard, err := viz.GetDashboard(h.DB, req.Msg.Id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dashboard not found"))
+		}
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
-	if visualizations == nil {
-		return nil, connect.NewError(connect.CodeNotFound, errors.New("dashboard not found"))
+	if dashboard.OrganizationID != "" {
+		userId, found := interceptors.GetUserId(ctx)
+		if !found {
+			return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+		}
+		if err := interceptors.RequireScope(ctx, interceptors.ScopeDashboardsRead); err != nil {
+			return nil, err
+		}
+		_, err = organization.GetMemberRole(h.DB, dashboard.OrganizationID, userId)
+		if err != nil {
+			if errors.Is(err, organization.ErrNotMember) {
+				return nil, connect.NewError(connect.CodeNotFound, errors.New("dashboard not found"))
+			}
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
 	}
 
 	res := &vizv1.GetDashboardResponse{
-		Visualizations: visualizations,
-		DatasetId:      datasetId,
+		Visualizations: dashboard.Visualizations,
+		DatasetId:      dashboard.DatasetID,
+		OrganizationId: dashboard.OrganizationID,
+		DatasetVersion: dashboard.DatasetVersion,
 	}
 	return connect.NewResponse(res), nil
 }
+
+// SetDashboardDatasetVersion implements vizv1connect.DashboardServiceHandler.
+func (h *VisualizationHandler) SetDashboardDatasetVersion(
+	ctx context.Context,
+	req *connect.Request[vizv1.SetDashboardDatasetVersionRequest],
+) (*connect.Response[vizv1.SetDashboardDatasetVersionResponse], error) {
+	userId, found := interceptors.GetUserId(ctx)
+	if !found {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+	}
+	if err := interceptors.RequireScope(ctx, interceptors.ScopeDashboardsWrite); err != nil {
+		return nil, err
+	}
+
+	dashboard, err := viz.GetDashboard(h.DB, req.Msg.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dashboard not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	if err = h.checkDataset(userId, dashboard.DatasetID, req.Msg.DatasetVersion); err != nil {
+		return nil, err
+	}
+
+	err = viz.SetDashboardDatasetVersion(h.DB, req.Msg.Id, req.Msg.DatasetVersion)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, connect.NewError(connect.CodeNotFound, errors.New("dashboard not found"))
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&vizv1.SetDashboardDatasetVersionResponse{}), nil
+}
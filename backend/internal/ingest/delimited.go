@@ -0,0 +1,548 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+// Delimiters that are detected, in order of preference
+var delimiters = []rune{',', '\t', ';', '|'}
+
+// Fields that are detected as missing values when they appear in a column of
+// numbers or dates. The values of schema.IsMissing always are.
+var nullCandidates = []string{"-", "--", "?", "#N/A", "#NV", "None", "nil"}
+
+// Reads records of delimited text. Quotes in quoted fields are doubled,
+// empty lines are skipped.
+type recordReader struct {
+	r         *bufio.Reader
+	format    string
+	delimiter string
+	quote     string
+	// Lines that have been read, and the line of the last record
+	line       int
+	recordLine int
+	fields     []string
+}
+
+func newRecordReader(r io.Reader, format string, delimiter rune, quote rune) *recordReader {
+	return &recordReader{
+		r:         bufio.NewReader(r),
+		format:    format,
+		delimiter: string(delimiter),
+		quote:     string(quote),
+	}
+}
+
+// Lines end with a single \n, also the last one
+func (d *recordReader) readLine() (string, error) {
+	line, err := d.r.ReadString('\n')
+	if line == "" {
+		return "", err
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	d.line++
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	return line + "\n", nil
+}
+
+// Read returns the fields of the next record, which are reused by the next
+// call. Records that can't be read are reported with an Error, the next call
+// reads the line after.
+func (d *recordReader) Read() ([]string, error) {
+	var line string
+	for line == "" || line == "\n" {
+		var err error
+		if line, err = d.readLine(); err != nil {
+			return nil, err
+		}
+	}
+	d.recordLine = d.line
+	d.fields = d.fields[:0]
+
+	var field strings.Builder
+	for {
+		if !strings.HasPrefix(line, d.quote) {
+			end := strings.Index(line, d.delimiter)
+			last := end < 0
+			if last {
+				end = len(line) - 1
+			}
+			if strings.Contains(line[:end], d.quote) {
+				return nil, d.error(`bare quote in non-quoted field`)
+			}
+			d.fields = append(d.fields, line[:end])
+			if last {
+				return d.fields, nil
+			}
+			line = line[end+len(d.delimiter):]
+			continue
+		}
+
+		line = line[len(d.quote):]
+		field.Reset()
+		for {
+			i := strings.Index(line, d.quote)
+			if i < 0 {
+				// The field goes on on the next line
+				field.WriteString(line)
+				next, err := d.readLine()
+				if err == io.EOF {
+					return nil, d.error(`extraneous or missing quote in quoted field`)
+				}
+				if err != nil {
+					return nil, err
+				}
+				line = next
+				continue
+			}
+
+			field.WriteString(line[:i])
+			line = line[i+len(d.quote):]
+			if strings.HasPrefix(line, d.quote) {
+				field.WriteString(d.quote)
+				line = line[len(d.quote):]
+				continue
+			}
+			break
+		}
+		d.fields = append(d.fields, field.String())
+
+		switch {
+		case line == "\n":
+			return d.fields, nil
+		case strings.HasPrefix(line, d.delimiter):
+			line = line[len(d.delimiter):]
+		default:
+			return nil, d.error(`extraneous or missing quote in quoted field`)
+		}
+	}
+}
+
+func (d *recordReader) error(problem string) *Error {
+	return &Error{Format: d.format, Line: d.line, Problem: problem}
+}
+
+// A record of the start of a file and the line it starts at. Records that
+// can't be read have no fields.
+type headRecord struct {
+	line   int
+	fields []string
+}
+
+func readHead(text string, delimiter rune, quote rune, truncated bool) []headRecord {
+	reader := newRecordReader(strings.NewReader(text), "", delimiter, quote)
+	var records []headRecord
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		record := headRecord{line: reader.recordLine}
+		if err == nil {
+			record.fields = slices.Clone(fields)
+		}
+		records = append(records, record)
+	}
+	// The last record may be cut off
+	if truncated && len(records) > 1 {
+		records = records[:len(records)-1]
+	}
+	return records
+}
+
+// The number of fields of most records and the first record with that many.
+// The layout is consistent if every later record has as many fields.
+func fieldLayout(records []headRecord) (fields int, start int, consistent bool) {
+	counts := make(map[int]int)
+	for _, r := range records {
+		counts[len(r.fields)]++
+	}
+	best := 0
+	for n, count := range counts {
+		if n > 0 && (count > best || count == best && n > fields) {
+			fields, best = n, count
+		}
+	}
+	if best == 0 {
+		return 0, 0, false
+	}
+
+	start = slices.IndexFunc(records, func(r headRecord) bool { return len(r.fields) == fields })
+	for _, r := range records[start:] {
+		if len(r.fields) != fields {
+			return fields, start, false
+		}
+	}
+	return fields, start, true
+}
+
+// The delimiter that splits the records after a preamble into the same
+// number of fields, and into the most fields. Commas if no delimiter splits
+// the records. Returns the records read with the delimiter.
+func sniffDelimiter(text string, candidates []rune, quote rune, truncated bool) (rune, []headRecord) {
+	best, bestFields := candidates[0], 1
+	var bestRecords []headRecord
+	for _, delimiter := range candidates {
+		records := readHead(text, delimiter, quote, truncated)
+		if bestRecords == nil {
+			bestRecords = records
+		}
+		fields, _, consistent := fieldLayout(records)
+		if consistent && fields > bestFields {
+			best, bestFields, bestRecords = delimiter, fields, records
+		}
+	}
+	return best, bestRecords
+}
+
+// Single quotes are only taken if more fields are quoted with them than with
+// double quotes
+func sniffQuote(text string) rune {
+	if quotedFields(text, '\'') > quotedFields(text, '"') {
+		return '\''
+	}
+	return '"'
+}
+
+// Counts the quotes at the start or the end of a field delimited by any of
+// the detected delimiters, apostrophes in words are not counted
+func quotedFields(text string, quote rune) int {
+	isBoundary := func(r rune) bool {
+		return r == '\n' || r == '\r' || slices.Contains(delimiters, r)
+	}
+	count := 0
+	previous := '\n'
+	for i, r := range text {
+		if r == quote {
+			next, _ := utf8.DecodeRuneInString(text[i+utf8.RuneLen(r):])
+			if isBoundary(previous) || isBoundary(next) || next == utf8.RuneError {
+				count++
+			}
+		}
+		previous = r
+	}
+	return count
+}
+
+// Numbers with a decimal comma, and with dots between groups of thousands,
+// are more common than numbers with a decimal point. Numbers like 1.234
+// could be either and are not counted.
+func sniffDecimalSeparator(records []headRecord) rune {
+	var commas, points int
+	for _, r := range records {
+		for _, field := range r.fields {
+			digits := strings.TrimLeft(field, "+-")
+			_, groupedByCommas := ungroup(digits, ',')
+			_, groupedByDots := ungroup(digits, '.')
+			if groupedByCommas || groupedByDots {
+				continue
+			}
+			if _, ok := decimalCommaNumber(field); ok && strings.Contains(field, ",") {
+				commas++
+			}
+			if isDecimalPointNumber(field) {
+				points++
+			}
+		}
+	}
+	if commas > points {
+		return ','
+	}
+	return '.'
+}
+
+// Converts a number with a decimal comma, such as -1.234,5 or 12,5, to one
+// with a decimal point
+func decimalCommaNumber(field string) (string, bool) {
+	sign := ""
+	if len(field) > 0 && (field[0] == '-' || field[0] == '+') {
+		sign, field = field[:1], field[1:]
+	}
+	integer, fraction, hasFraction := strings.Cut(field, ",")
+	if hasFraction && !isDigits(fraction) {
+		return "", false
+	}
+	integer, ok := ungroup(integer, '.')
+	if !ok {
+		return "", false
+	}
+	if hasFraction {
+		return sign + integer + "." + fraction, true
+	}
+	return sign + integer, true
+}
+
+// A number with a decimal point and a fraction, with or without commas
+// between groups of thousands
+func isDecimalPointNumber(field string) bool {
+	field = strings.TrimLeft(field, "+-")
+	integer, fraction, ok := strings.Cut(field, ".")
+	if !ok || !isDigits(fraction) {
+		return false
+	}
+	_, ok = ungroup(integer, ',')
+	return ok
+}
+
+// Digits, or groups of three digits after the first separated by the separator
+func ungroup(integer string, separator byte) (string, bool) {
+	groups := strings.Split(integer, string(separator))
+	if len(groups) == 1 {
+		return integer, isDigits(integer)
+	}
+	if len(groups[0]) == 0 || len(groups[0]) > 3 || !isDigits(groups[0]) {
+		return "", false
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 || !isDigits(group) {
+			return "", false
+		}
+	}
+	return strings.Join(groups, ""), true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// The first record is the header, unless every column whose other values
+// are all numbers, dates or booleans has a value of that type in it too
+func sniffHeader(records []headRecord, decimal rune) int {
+	if len(records) < 2 {
+		return 1
+	}
+	first := records[0].fields
+	dataVotes := 0
+	for i, value := range first {
+		parse := columnParser(records[1:], i, decimal)
+		if parse == nil || schema.IsMissing(value) || slices.Contains(nullCandidates, value) {
+			continue
+		}
+		if !parse(normalizeNumber(value, decimal)) {
+			return 1
+		}
+		dataVotes++
+	}
+	if dataVotes > 0 {
+		return NoHeader
+	}
+	return 1
+}
+
+// The parser that accepts every present value of a column, nil if no typed
+// parser does
+func columnParser(records []headRecord, column int, decimal rune) func(string) bool {
+	parsers := []func(string) bool{
+		func(v string) bool { _, ok := schema.ParseFloat(v); return ok },
+		func(v string) bool { _, ok := schema.ParseDatetime(v); return ok },
+		func(v string) bool { _, ok := schema.ParseBoolean(v); return ok },
+	}
+	for _, parse := range parsers {
+		present := 0
+		for _, r := range records {
+			if column >= len(r.fields) {
+				continue
+			}
+			value := normalizeNumber(r.fields[column], decimal)
+			if schema.IsMissing(value) || slices.Contains(nullCandidates, value) {
+				continue
+			}
+			if !parse(value) {
+				present = -1
+				break
+			}
+			present++
+		}
+		if present > 0 {
+			return parse
+		}
+	}
+	return nil
+}
+
+// The candidates that appear in columns of numbers or dates
+func sniffNullTokens(records []headRecord, decimal rune) []string {
+	tokens := []string{}
+	columns := 0
+	for _, r := range records {
+		columns = max(columns, len(r.fields))
+	}
+	for column := range columns {
+		if columnParser(records, column, decimal) == nil {
+			continue
+		}
+		for _, r := range records {
+			if column < len(r.fields) && slices.Contains(nullCandidates, r.fields[column]) && !slices.Contains(tokens, r.fields[column]) {
+				tokens = append(tokens, r.fields[column])
+			}
+		}
+	}
+	return tokens
+}
+
+func normalizeNumber(field string, decimal rune) string {
+	if decimal != ',' {
+		return field
+	}
+	if number, ok := decimalCommaNumber(field); ok {
+		return number
+	}
+	return field
+}
+
+// Detect the settings of delimited text from the start of a file
+func detectDelimited(head []byte, truncated bool, options Options) (Options, error) {
+	if options.Encoding == "" {
+		options.Encoding = detectEncoding(head, truncated)
+	}
+	e, name, err := lookupEncoding(options.Encoding)
+	if err != nil {
+		return Options{}, err
+	}
+	options.Encoding = name
+	decoded, err := io.ReadAll(decodeReader(bytes.NewReader(head), e, name))
+	if err != nil {
+		return Options{}, err
+	}
+	text := string(decoded)
+	// The last line may be cut off
+	if truncated {
+		if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+			text = text[:i+1]
+		}
+	}
+
+	// The lines before the header are skipped if either is set
+	detectSkip := options.SkipRows == 0 && options.HeaderRow == 0
+	if !detectSkip {
+		for range options.SkipRows {
+			_, text, _ = strings.Cut(text, "\n")
+		}
+	}
+	if options.Quote == 0 {
+		options.Quote = sniffQuote(text)
+	}
+	candidates := delimiters
+	if options.Delimiter != 0 {
+		candidates = []rune{options.Delimiter}
+	}
+	var records []headRecord
+	options.Delimiter, records = sniffDelimiter(text, candidates, options.Quote, truncated)
+
+	if detectSkip {
+		if _, start, _ := fieldLayout(records); start < len(records) {
+			options.SkipRows = records[start].line - 1
+			records = records[start:]
+		}
+	} else if options.HeaderRow > 1 {
+		records = records[min(options.HeaderRow-1, len(records)):]
+	}
+
+	if options.DecimalSeparator == 0 {
+		options.DecimalSeparator = sniffDecimalSeparator(records)
+	}
+	if options.HeaderRow == 0 {
+		options.HeaderRow = sniffHeader(records, options.DecimalSeparator)
+	}
+	if options.HeaderRow != NoHeader && len(records) > 0 {
+		records = records[1:]
+	}
+	if options.NullTokens == nil {
+		options.NullTokens = sniffNullTokens(records, options.DecimalSeparator)
+	}
+	return options, nil
+}
+
+// Names of the columns of files without a header row
+func generatedHeader(columns int) []string {
+	header := make([]string, columns)
+	for i := range header {
+		header[i] = fmt.Sprintf("column_%d", i+1)
+	}
+	return header
+}
+
+func convertDelimited(r io.Reader, options Options, writer *csv.Writer) error {
+	e, name, err := lookupEncoding(options.Encoding)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(decodeReader(r, e, name))
+	for range options.SkipRows {
+		if _, err = br.ReadString('\n'); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	nulls := make(map[string]bool)
+	for _, token := range options.NullTokens {
+		nulls[token] = true
+	}
+
+	reader := newRecordReader(br, options.Format, options.Delimiter, options.Quote)
+	// Lines are counted from the start of the file
+	reader.line = options.SkipRows
+	rows, columns := 0, -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rows++
+		if rows < options.HeaderRow {
+			continue
+		}
+
+		if columns < 0 {
+			columns = len(record)
+			if options.HeaderRow != NoHeader {
+				if err = writer.Write(record); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = writer.Write(generatedHeader(columns)); err != nil {
+				return err
+			}
+		}
+		if len(record) != columns {
+			return &Error{Format: options.Format, Line: reader.recordLine, Problem: "row has a different number of fields than the header"}
+		}
+
+		for i, field := range record {
+			if nulls[field] {
+				record[i] = ""
+			} else {
+				record[i] = normalizeNumber(field, options.DecimalSeparator)
+			}
+		}
+		if err = writer.Write(record); err != nil {
+			return err
+		}
+	}
+}
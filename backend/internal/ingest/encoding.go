@@ -0,0 +1,102 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// Names of the encodings that are detected
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingWindows1252 = "windows-1252"
+)
+
+var (
+	utf16LEMark = []byte{0xFF, 0xFE}
+	utf16BEMark = []byte{0xFE, 0xFF}
+)
+
+// Encodings are looked up by their names and labels in the WHATWG Encoding
+// Standard, such as utf-8, windows-1252, latin1 or iso-8859-2. The canonical
+// name is returned with the encoding.
+func lookupEncoding(name string) (encoding.Encoding, string, error) {
+	e, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown encoding %q", name)
+	}
+	canonical, err := htmlindex.Name(e)
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown encoding %q", name)
+	}
+	return e, canonical, nil
+}
+
+// A byte order mark tells UTF-16, UTF-16 without one has a zero byte in most
+// characters of Latin text. Text that isn't UTF-8 is taken to be
+// Windows-1252, which spreadsheets in Western Europe export, sometimes with
+// a UTF-8 byte order mark in front.
+func detectEncoding(head []byte, truncated bool) string {
+	switch {
+	case bytes.HasPrefix(head, utf16LEMark):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(head, utf16BEMark):
+		return EncodingUTF16BE
+	}
+	head = bytes.TrimPrefix(head, byteOrderMark)
+
+	var evenZeros, oddZeros int
+	for i, b := range head {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	switch {
+	case oddZeros > len(head)/4 && evenZeros == 0:
+		return EncodingUTF16LE
+	case evenZeros > len(head)/4 && oddZeros == 0:
+		return EncodingUTF16BE
+	}
+
+	// The last character may be cut off
+	for cut := 0; cut < utf8.UTFMax && cut <= len(head); cut++ {
+		if utf8.Valid(head[:len(head)-cut]) {
+			return EncodingUTF8
+		}
+		if !truncated {
+			break
+		}
+	}
+	return EncodingWindows1252
+}
+
+// Decode text to UTF-8 without a byte order mark. A UTF-8 byte order mark is
+// dropped whatever the encoding is. UTF-8 is read as it is.
+func decodeReader(r io.Reader, e encoding.Encoding, name string) io.Reader {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(len(byteOrderMark)); err == nil && bytes.Equal(bom, byteOrderMark) {
+		br.Discard(len(byteOrderMark))
+	}
+	if name == EncodingUTF8 {
+		return br
+	}
+
+	decoded := bufio.NewReader(transform.NewReader(br, e.NewDecoder()))
+	if r, _, err := decoded.ReadRune(); err == nil && r != '\uFEFF' {
+		decoded.UnreadRune()
+	}
+	return decoded
+}
@@ -0,0 +1,277 @@
+// Package ingest reads uploaded files of the supported formats and converts
+// them to CSV, the format every dataset is stored and read in
+package ingest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formats of uploaded files
+const (
+	// Delimited text, by default separated by commas
+	FormatCSV = "csv"
+	// Delimited text separated by tabs
+	FormatTSV     = "tsv"
+	FormatJSON    = "json"
+	FormatNDJSON  = "ndjson"
+	FormatXLSX    = "xlsx"
+	FormatParquet = "parquet"
+)
+
+var Formats = []string{FormatCSV, FormatTSV, FormatJSON, FormatNDJSON, FormatXLSX, FormatParquet}
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+// Options of how an uploaded file is read. Settings that are not set are
+// detected from the file name and the content.
+type Options struct {
+	// One of Formats
+	Format string `json:"format,omitempty"`
+	// Worksheet of xlsx files, the first one by default
+	Sheet string `json:"sheet,omitempty"`
+	// The following settings are of delimited text
+
+	// Field delimiter of csv files
+	Delimiter rune `json:"delimiter,omitempty"`
+	// Quote character, a double quote by default
+	Quote rune `json:"quote,omitempty"`
+	// Character encoding, a name or label of the WHATWG Encoding Standard
+	Encoding string `json:"encoding,omitempty"`
+	// Lines at the start of the file that are skipped, such as a title
+	SkipRows int `json:"skipRows,omitempty"`
+	// Row of the header among the rows after the skipped lines, starting at
+	// 1. The rows before it are dropped. NoHeader if the file has none.
+	HeaderRow int `json:"headerRow,omitempty"`
+	// '.' or ','. Numbers with a decimal comma are stored with a decimal point.
+	DecimalSeparator rune `json:"decimalSeparator,omitempty"`
+	// Fields that are missing values, besides the ones every dataset has.
+	// Detected if nil.
+	NullTokens []string `json:"nullTokens,omitempty"`
+}
+
+// HeaderRow of files without a header row. Their columns are named
+// column_1, column_2 and so on.
+const NoHeader = -1
+
+// Validate checks the settings that are set
+func (o Options) Validate() error {
+	if o.Format != "" && !slices.Contains(Formats, o.Format) {
+		return fmt.Errorf("%w %q, expected one of %s", ErrUnknownFormat, o.Format, strings.Join(Formats, ", "))
+	}
+	for _, r := range []rune{o.Delimiter, o.Quote} {
+		if r == '\r' || r == '\n' || r == utf8.RuneError {
+			return fmt.Errorf("%q can't be the delimiter or quote", r)
+		}
+	}
+	if o.Delimiter != 0 && o.Delimiter == o.Quote {
+		return errors.New("the delimiter and quote must be different")
+	}
+	if o.Encoding != "" {
+		if _, _, err := lookupEncoding(o.Encoding); err != nil {
+			return err
+		}
+	}
+	if o.SkipRows < 0 {
+		return errors.New("the rows to skip can't be negative")
+	}
+	if o.HeaderRow < NoHeader {
+		return fmt.Errorf("the header row must be at least 1, or %d for no header", NoHeader)
+	}
+	if o.DecimalSeparator != 0 && o.DecimalSeparator != '.' && o.DecimalSeparator != ',' {
+		return fmt.Errorf("the decimal separator must be '.' or ',', not %q", o.DecimalSeparator)
+	}
+	return nil
+}
+
+// Error is a file that can't be read in its format.
+// Line is the line of text files or the row of spreadsheets, 0 if unknown.
+type Error struct {
+	Format  string
+	Line    int
+	Problem string
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("invalid %s file: line %d: %s", strings.ToUpper(e.Format), e.Line, e.Problem)
+	}
+	return fmt.Sprintf("invalid %s file: %s", strings.ToUpper(e.Format), e.Problem)
+}
+
+// Compressed formats are converted to at most maxExpansion times their size
+// in CSV, and small files to minConvertedSize, so that a small file can't
+// exhaust memory or disk. Variables for tests.
+var (
+	maxExpansion     int64 = 100
+	minConvertedSize int64 = 256 << 20
+)
+
+// What is left of the CSV that a file may be converted to
+type conversionLimit struct {
+	max       int64
+	remaining int64
+}
+
+func newConversionLimit(size int64) *conversionLimit {
+	limit := max(size*maxExpansion, minConvertedSize)
+	return &conversionLimit{max: limit, remaining: limit}
+}
+
+// fits reports whether rows of the decoded size may be read. Every row takes
+// at least its line break.
+func (l *conversionLimit) fits(rows int64, size int64) bool {
+	return rows <= l.remaining && size <= l.remaining
+}
+
+// spend takes the row, with its delimiters, from the limit and reports
+// whether it fits
+func (l *conversionLimit) spend(row []string) bool {
+	l.remaining -= int64(max(len(row), 1))
+	for _, field := range row {
+		l.remaining -= int64(len(field))
+	}
+	return l.remaining >= 0
+}
+
+func (l *conversionLimit) exceeded(format string) error {
+	return &Error{Format: format, Problem: fmt.Sprintf("the file expands to more than %d bytes", l.max)}
+}
+
+// Enough of a file to tell its format and the settings of delimited text
+const sniffSize = 64 << 10
+
+var (
+	byteOrderMark = []byte{0xEF, 0xBB, 0xBF}
+	parquetMagic  = []byte("PAR1")
+	zipMagic      = []byte("PK\x03\x04")
+)
+
+// Detect returns the options with the format, and the settings of the
+// format, filled in. The format is detected from the content for binary
+// formats, and otherwise from the extension of the file name or the content.
+func Detect(r io.ReaderAt, size int64, filename string, options Options) (Options, error) {
+	if err := options.Validate(); err != nil {
+		return Options{}, err
+	}
+
+	head := make([]byte, min(size, sniffSize))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return Options{}, err
+	}
+
+	if options.Format == "" {
+		options.Format = detectFormat(head, filename)
+	}
+
+	switch options.Format {
+	case FormatCSV, FormatTSV:
+		if options.Format == FormatTSV {
+			options.Delimiter = '\t'
+		}
+		var err error
+		if options, err = detectDelimited(head, int64(len(head)) < size, options); err != nil {
+			return Options{}, err
+		}
+	case FormatXLSX:
+		if options.Sheet == "" {
+			workbook, err := openWorkbook(r, size, newConversionLimit(size))
+			if err != nil {
+				return Options{}, err
+			}
+			options.Sheet = workbook.GetSheetList()[0]
+			workbook.Close()
+		}
+	}
+	if options.Format != FormatCSV && options.Format != FormatTSV {
+		options = Options{Format: options.Format, Sheet: options.Sheet}
+	}
+	if options.Format != FormatXLSX {
+		options.Sheet = ""
+	}
+	return options, nil
+}
+
+func detectFormat(head []byte, filename string) string {
+	switch {
+	case bytes.HasPrefix(head, parquetMagic):
+		return FormatParquet
+	case bytes.HasPrefix(head, zipMagic):
+		return FormatXLSX
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return FormatCSV
+	case ".tsv", ".tab":
+		return FormatTSV
+	case ".json":
+		return FormatJSON
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	case ".xlsx":
+		return FormatXLSX
+	case ".parquet":
+		return FormatParquet
+	}
+
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, byteOrderMark), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("[")):
+		return FormatJSON
+	case bytes.HasPrefix(text, []byte("{")):
+		return FormatNDJSON
+	}
+	return FormatCSV
+}
+
+// CSVFilename replaces the extension of a file name of another format with .csv
+func CSVFilename(filename string) string {
+	extension := filepath.Ext(filename)
+	switch strings.ToLower(extension) {
+	case ".tsv", ".tab", ".json", ".ndjson", ".jsonl", ".xlsx", ".parquet":
+		return strings.TrimSuffix(filename, extension) + ".csv"
+	}
+	return filename
+}
+
+// IsCSV reports whether files read with the options are stored as they are
+func (o Options) IsCSV() bool {
+	return o.Format == FormatCSV && o.Delimiter == ',' && o.Quote == '"' &&
+		o.Encoding == EncodingUTF8 && o.SkipRows == 0 && o.HeaderRow == 1 &&
+		o.DecimalSeparator == '.' && len(o.NullTokens) == 0
+}
+
+// Convert writes the file as CSV with a header row, read with options
+// returned by Detect. Files that can't be read are reported with an Error.
+func Convert(r io.ReaderAt, size int64, options Options, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	var err error
+	switch options.Format {
+	case FormatCSV, FormatTSV:
+		err = convertDelimited(io.NewSectionReader(r, 0, size), options, writer)
+	case FormatJSON:
+		err = convertJSON(io.NewSectionReader(r, 0, size), writer)
+	case FormatNDJSON:
+		err = convertNDJSON(io.NewSectionReader(r, 0, size), writer)
+	case FormatXLSX:
+		err = convertXLSX(r, size, options, writer)
+	case FormatParquet:
+		err = convertParquet(r, size, writer)
+	default:
+		err = fmt.Errorf("unknown format %q", options.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
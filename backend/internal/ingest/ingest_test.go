@@ -0,0 +1,511 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+func readFixture(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Detect the options of a file and convert it with them
+func detectAndConvert(t *testing.T, data []byte, filename string, options Options) (Options, string, error) {
+	t.Helper()
+	detected, err := Detect(bytes.NewReader(data), int64(len(data)), filename, options)
+	if err != nil {
+		return detected, "", err
+	}
+	var out bytes.Buffer
+	err = Convert(bytes.NewReader(data), int64(len(data)), detected, &out)
+	return detected, out.String(), err
+}
+
+const plainCSV = "city,population,area,founded\n" +
+	"Zürich,421878,87.88,1218-01-01\n" +
+	"\"São Paulo, SP\",12325232,1521.11,1554-01-25\n" +
+	"Oslo,709037,454.12,\n"
+
+// The rows of the Parquet fixtures, which were written by Apache Arrow
+const parquetCSV = "id,name,price,day,at,paid,ratio,count\n" +
+	"1,Zürich,-12.50,2024-01-01,2024-01-01T12:00:00Z,true,0.25,4000000000\n" +
+	"2,Oslo,988.00,2024-01-02,2024-01-01T12:00:01.5Z,,1.25,4000000001\n" +
+	"3,,1988.50,2024-01-03,2024-01-01T12:00:03Z,true,2.25,4000000002\n" +
+	"4,São Paulo,2989.00,2024-01-04,2024-01-01T12:00:04.5Z,false,,4000000003\n" +
+	"5,Oslo,3989.50,2024-01-05,2024-01-01T12:00:06Z,true,4.25,4000000004\n"
+
+func TestConvertFixtures(t *testing.T) {
+	utf8Options := Options{Format: FormatCSV, Delimiter: ',', Quote: '"', Encoding: EncodingUTF8, HeaderRow: 1, DecimalSeparator: '.', NullTokens: []string{}}
+	utf16LE, utf16BE := utf8Options, utf8Options
+	utf16LE.Encoding = EncodingUTF16LE
+	utf16BE.Encoding = EncodingUTF16BE
+
+	for _, tt := range []struct {
+		file    string
+		options Options
+		csv     string
+	}{
+		{"plain.csv", utf8Options, plainCSV},
+		{"empty.csv", utf8Options, ""},
+		// With a byte order mark
+		{"utf16le.csv", utf16LE, plainCSV},
+		// Without one
+		{"utf16be.csv", utf16BE, plainCSV},
+		{"windows1252.csv",
+			Options{Format: FormatCSV, Delimiter: ';', Quote: '"', Encoding: EncodingWindows1252, HeaderRow: 1, DecimalSeparator: ',', NullTokens: []string{}},
+			"Stadt,Größe,Café\nKöln,405.02,Früh\nMünchen,310.7,Ça va\n"},
+		// A title before the header, thousands separators and a null token
+		{"decimal_comma.csv",
+			Options{Format: FormatCSV, Delimiter: ';', Quote: '"', Encoding: EncodingUTF8, SkipRows: 2, HeaderRow: 1, DecimalSeparator: ',', NullTokens: []string{"-"}},
+			"Region,Umsatz,Anteil,Datum\nNord,1234.56,12.5,2024-01-31\nSüd,-987.5,,2024-02-29\nWest,10,7.25,\n"},
+		{"data.tsv",
+			Options{Format: FormatTSV, Delimiter: '\t', Quote: '"', Encoding: EncodingUTF8, HeaderRow: 1, DecimalSeparator: '.', NullTokens: []string{}},
+			"a,b\n1,x y\n2,q\tr\n"},
+		// Nested values are kept as JSON, missing keys are empty
+		{"data.json", Options{Format: FormatJSON},
+			"id,name,tags,meta,extra\n1,Zürich,\"[\"\"a\"\",\"\"b\"\"]\",\"{\"\"x\"\":1}\",\n2.5,,,,true\n"},
+		{"data.ndjson", Options{Format: FormatNDJSON}, "id,name,extra\n1,Zürich,\n2,,false\n"},
+		// Read from the first sheet
+		{"workbook.xlsx", Options{Format: FormatXLSX, Sheet: "Sales"},
+			"Region,Date,At,Amount,Share,Paid,Note\n" +
+				"North,2024-01-01,2024-01-01T12:00:00,1250.5,0.25,true,first\n" +
+				"South,2024-01-02,2024-01-02T18:00:00,-3,0.5,false,rich text\n" +
+				"Zürich,2024-01-03,2024-01-03T00:00:01,0.125,1,true,\"line\nbreak, \"\"quoted\"\"\"\n" +
+				"West,,,7,,,\n"},
+		// The same rows in different encodings: dictionary encoded data
+		// pages v1 compressed with snappy in two row groups, delta and byte
+		// stream split encoded data pages v2 compressed with zstd, and plain
+		// and delta length encoded data pages v1 compressed with gzip
+		{"plain.parquet", Options{Format: FormatParquet}, parquetCSV},
+		{"delta.parquet", Options{Format: FormatParquet}, parquetCSV},
+		{"gzip.parquet", Options{Format: FormatParquet}, parquetCSV},
+		{"no_rows.parquet", Options{Format: FormatParquet}, "id,name,price,day,at,paid,ratio,count\n"},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			options, csv, err := detectAndConvert(t, readFixture(t, path), filepath.Base(path), Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.Format == FormatJSON || options.Format == FormatNDJSON {
+				options.NullTokens = nil
+			}
+			if !reflect.DeepEqual(options, tt.options) {
+				t.Errorf("options %+v, want %+v", options, tt.options)
+			}
+			if csv != tt.csv {
+				t.Errorf("converted to\n%s\nwant\n%s", csv, tt.csv)
+			}
+		})
+	}
+}
+
+func TestConvertInvalidFixtures(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		err  Error
+	}{
+		{"truncated.csv", Error{Format: FormatCSV, Line: 3, Problem: "extraneous or missing quote in quoted field"}},
+		{"empty.json", Error{Format: FormatJSON, Problem: "file is empty"}},
+		{"truncated.json", Error{Format: FormatJSON, Problem: "unexpected end of the file"}},
+		{"truncated.ndjson", Error{Format: FormatNDJSON, Line: 2, Problem: "unexpected end of the object"}},
+		{"empty.xlsx", Error{Format: FormatXLSX, Problem: "not an xlsx file: zip: not a valid zip file"}},
+		{"truncated.xlsx", Error{Format: FormatXLSX, Problem: "not an xlsx file: zip: not a valid zip file"}},
+		{"empty.parquet", Error{Format: FormatParquet, Problem: "not a parquet file: parquet: file too small (size=0)"}},
+		{"truncated.parquet", Error{Format: FormatParquet, Problem: "not a parquet file: parquet: file is smaller than indicated metadata size"}},
+		{"nested.parquet", Error{Format: FormatParquet, Problem: `column "address" is nested, only flat schemas are supported`}},
+		{"repeated.parquet", Error{Format: FormatParquet, Problem: `column "tags" is nested, only flat schemas are supported`}},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			_, _, err := detectAndConvert(t, readFixture(t, path), filepath.Base(path), Options{})
+			var ingestErr *Error
+			if !errors.As(err, &ingestErr) || *ingestErr != tt.err {
+				t.Errorf("got %v, want %v", err, &tt.err)
+			}
+		})
+	}
+}
+
+func TestConvertSheet(t *testing.T) {
+	data := readFixture(t, "testdata/workbook.xlsx")
+
+	_, csv, err := detectAndConvert(t, data, "workbook.xlsx", Options{Sheet: "Notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ",only note\n"; csv != want {
+		t.Errorf("converted to %q, want %q", csv, want)
+	}
+
+	_, _, err = detectAndConvert(t, data, "workbook.xlsx", Options{Sheet: "Missing"})
+	if err == nil || !strings.Contains(err.Error(), `there is no sheet "Missing"`) {
+		t.Errorf("got %v, want an error for the missing sheet", err)
+	}
+}
+
+// A workbook with the parts of the archive
+func buildWorkbook(t *testing.T, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range parts {
+		f, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvertXLSXCellTypes(t *testing.T) {
+	data := buildWorkbook(t, map[string]string{
+		"_rels/.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`,
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<workbookPr date1904="1"/><sheets><sheet name="Data" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/styles.xml": `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts><numFmt numFmtId="164" formatCode="[h]:mm"/>` +
+			`<numFmt numFmtId="165" formatCode="&quot;day&quot; 0.0"/></numFmts>` +
+			`<cellXfs><xf numFmtId="0"/><xf numFmtId="164"/><xf numFmtId="165"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			`<row r="1"><c r="A1" t="inlineStr"><is><t>inline</t></is></c><c r="B1" t="str"><f>A1</f><v>formula</v></c><c r="C1" t="e"><v>#DIV/0!</v></c><c r="D1"><v>1</v></c></row>` +
+			`<row r="2"><c r="A2" t="d"><v>2024-01-02T03:04:05</v></c><c r="B2" s="1"><v>1.5</v></c><c r="C2" s="2"><v>1.5</v></c><c r="D2" t="b"><v>0</v></c></row>` +
+			`</sheetData></worksheet>`,
+	})
+
+	_, csv, err := detectAndConvert(t, data, "data.xlsx", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Serial dates of the 1904 date system
+	if want := "inline,formula,#DIV/0!,1\n2024-01-02T03:04:05,1904-01-02T12:00:00,1.5,false\n"; csv != want {
+		t.Errorf("converted to %q, want %q", csv, want)
+	}
+}
+
+func TestIsDateFormat(t *testing.T) {
+	for code, want := range map[string]bool{
+		"yyyy-mm-dd":              true,
+		"dd/mm/yyyy hh:mm":        true,
+		"[h]:mm:ss":               true,
+		"[$-409]mmm d, yyyy":      true,
+		"0.00":                    false,
+		"#,##0":                   false,
+		"0%":                      false,
+		`"days" 0`:                false,
+		`0\d`:                     false,
+		"[Red]0.00":               false,
+		"0.00;[Red]-0.00":         false,
+		"General":                 false,
+		`_(* #,##0_);_(* (#,##0)`: false,
+	} {
+		if got := isDateFormat(code); got != want {
+			t.Errorf("isDateFormat(%q) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+// Damaged files fail with an error rather than a panic or wrong rows
+func TestConvertDamagedParquet(t *testing.T) {
+	plain := readFixture(t, "testdata/plain.parquet")
+	convert := func(data []byte) (string, error) {
+		var out bytes.Buffer
+		err := Convert(bytes.NewReader(data), int64(len(data)), Options{Format: FormatParquet}, &out)
+		return out.String(), err
+	}
+
+	for size := range len(plain) {
+		if _, err := convert(plain[:size]); err == nil {
+			t.Fatalf("the first %d bytes were converted without an error", size)
+		}
+	}
+
+	// The pages are overwritten, the metadata in the footer is intact
+	damaged := bytes.Clone(plain)
+	for i := len(parquetMagic); i < len(plain)/2; i++ {
+		damaged[i] = 0xFF
+	}
+	if csv, err := convert(damaged); err == nil {
+		t.Errorf("damaged pages were converted to %q", csv)
+	}
+}
+
+// A file of repetitions of a long text, which the dictionary encoding
+// stores once
+func repeatedTextParquet(t *testing.T, rows int) []byte {
+	t.Helper()
+	schema := arrow.NewSchema([]arrow.Field{{Name: "text", Type: arrow.BinaryTypes.String}}, nil)
+	builder := array.NewStringBuilder(memory.DefaultAllocator)
+	defer builder.Release()
+	text := strings.Repeat("x", 1000)
+	for range rows {
+		builder.Append(text)
+	}
+	column := builder.NewArray()
+	defer column.Release()
+	record := array.NewRecordBatch(schema, []arrow.Array{column}, int64(rows))
+	defer record.Release()
+
+	var buf bytes.Buffer
+	writer, err := pqarrow.NewFileWriter(schema, &buf, parquet.NewWriterProperties(parquet.WithDictionaryDefault(true)), pqarrow.DefaultWriterProps())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvertLimit(t *testing.T) {
+	defer func(expansion, size int64) { maxExpansion, minConvertedSize = expansion, size }(maxExpansion, minConvertedSize)
+	maxExpansion = 0
+
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		limit int64
+		err   string
+	}{
+		// Before the first row group, whose decoded size is more than what
+		// is left after the header
+		{"plain.parquet", readFixture(t, "testdata/plain.parquet"), 100, "the file expands to more than 100 bytes"},
+		// In the rows, as the decoded row group is small
+		{"repeated.parquet", repeatedTextParquet(t, 10000), 1 << 20, "the file expands to more than 1048576 bytes"},
+		// When the workbook is unzipped
+		{"workbook.xlsx", readFixture(t, "testdata/workbook.xlsx"), 100, "unzip size exceeds the 100 bytes limit"},
+	} {
+		minConvertedSize = tt.limit
+		_, _, err := detectAndConvert(t, tt.data, tt.name, Options{})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s with a limit of %d bytes: got %v, want %q", tt.name, tt.limit, err, tt.err)
+		}
+	}
+
+	// Within the limit
+	minConvertedSize = 20 << 20
+	if _, _, err := detectAndConvert(t, repeatedTextParquet(t, 10000), "repeated.parquet", Options{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, tt := range []struct {
+		filename string
+		content  string
+		format   string
+	}{
+		{"data.csv", "a,b\n", FormatCSV},
+		{"data.TSV", "a\tb\n", FormatTSV},
+		{"data.tab", "a\tb\n", FormatTSV},
+		{"data.jsonl", "{}\n", FormatNDJSON},
+		// The content of binary formats wins over the extension
+		{"data.csv", "PAR1", FormatParquet},
+		{"data.csv", "PK\x03\x04", FormatXLSX},
+		// Without a known extension
+		{"data", "\xEF\xBB\xBF \n[{}]", FormatJSON},
+		{"data.txt", "{\"a\": 1}\n", FormatNDJSON},
+		{"data.txt", "a;b\n", FormatCSV},
+	} {
+		if format := detectFormat([]byte(tt.content), tt.filename); format != tt.format {
+			t.Errorf("detectFormat(%q, %q) = %s, want %s", tt.content, tt.filename, format, tt.format)
+		}
+	}
+}
+
+func TestDetectDelimited(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		options Options
+		want    Options
+	}{
+		{"semicolons", "a;b;c\n1;2;3\n", Options{},
+			Options{Delimiter: ';', Quote: '"', HeaderRow: 1, DecimalSeparator: '.'}},
+		{"pipes and single quotes", "'a'|'b'\n'x|y'|2\n", Options{},
+			Options{Delimiter: '|', Quote: '\'', HeaderRow: 1, DecimalSeparator: '.'}},
+		{"apostrophes are not quotes", "name,note\nO'Brien,it's\n", Options{},
+			Options{Delimiter: ',', Quote: '"', HeaderRow: 1, DecimalSeparator: '.'}},
+		{"no header", "1,2024-01-01,true\n2,2024-01-02,false\n", Options{},
+			Options{Delimiter: ',', Quote: '"', HeaderRow: NoHeader, DecimalSeparator: '.'}},
+		{"header of numbers over text", "2023,2024\nx,y\n", Options{},
+			Options{Delimiter: ',', Quote: '"', HeaderRow: 1, DecimalSeparator: '.'}},
+		{"null tokens of number columns only", "a,b\n1,-\n-,x\nn/a,2\n", Options{},
+			Options{Delimiter: ',', Quote: '"', HeaderRow: 1, DecimalSeparator: '.', NullTokens: []string{"-"}}},
+		{"thousands separators are ambiguous", "a;b\n1.234;2.345\n", Options{},
+			Options{Delimiter: ';', Quote: '"', HeaderRow: 1, DecimalSeparator: '.'}},
+		{"decimal points", "a,b\n\"1,234.5\",2.5\n", Options{},
+			Options{Delimiter: ',', Quote: '"', HeaderRow: 1, DecimalSeparator: '.'}},
+		{"preamble", "Report\nexported 2024-01-01\n\na,b\n1,2\n", Options{},
+			Options{Delimiter: ',', Quote: '"', SkipRows: 3, HeaderRow: 1, DecimalSeparator: '.'}},
+		{"given settings are kept", "x\na;b\n1,5;2\n", Options{Delimiter: ';', SkipRows: 1, DecimalSeparator: '.', NullTokens: []string{"NA"}},
+			Options{Delimiter: ';', Quote: '"', SkipRows: 1, HeaderRow: 1, DecimalSeparator: '.', NullTokens: []string{"NA"}}},
+		{"given header row", "title\nunits\na,b\n1,2\n", Options{HeaderRow: 3},
+			Options{Delimiter: ',', Quote: '"', HeaderRow: 3, DecimalSeparator: '.'}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Format = FormatCSV
+			tt.want.Encoding = EncodingUTF8
+			if tt.want.NullTokens == nil {
+				tt.want.NullTokens = []string{}
+			}
+			options, err := Detect(strings.NewReader(tt.content), int64(len(tt.content)), "data.csv", tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(options, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", options, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertDelimited(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		options Options
+		csv     string
+		err     string
+	}{
+		{"no header", "1,2\n3,4\n", Options{HeaderRow: NoHeader}, "column_1,column_2\n1,2\n3,4\n", ""},
+		{"header row", "title\n\nunits,units\na,b\n1,2\n", Options{SkipRows: 1, HeaderRow: 2}, "a,b\n1,2\n", ""},
+		{"quoted line breaks and quotes", "a,b\n\"x\ny\",\"say \"\"hi\"\"\"\r\n", Options{}, "a,b\n\"x\ny\",\"say \"\"hi\"\"\"\n", ""},
+		{"empty lines", "a,b\n\n1,2\n\n", Options{}, "a,b\n1,2\n", ""},
+		{"no final line break", "a,b\n1,2", Options{}, "a,b\n1,2\n", ""},
+		{"missing field", "a,b\n1,2\n3\n", Options{}, "", "invalid CSV file: line 3: row has a different number of fields than the header"},
+		{"bare quote", "a,b\n1,x\"y\n", Options{}, "", "invalid CSV file: line 2: bare quote in non-quoted field"},
+		{"text after a quoted field", "a,b\n\"x\"y,2\n", Options{}, "", "invalid CSV file: line 2: extraneous or missing quote in quoted field"},
+		{"windows-1252 by name", "a\nstra\xDFe\n", Options{Encoding: "latin1"}, "a\nstraße\n", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, csv, err := detectAndConvert(t, []byte(tt.content), "data.csv", tt.options)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("got %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if csv != tt.csv {
+				t.Errorf("converted to %q, want %q", csv, tt.csv)
+			}
+		})
+	}
+}
+
+func TestDetectEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		head      string
+		truncated bool
+		encoding  string
+	}{
+		{"ascii", "a,b\n", false, EncodingUTF8},
+		{"utf-8 with a byte order mark", "\xEF\xBB\xBFä,b\n", false, EncodingUTF8},
+		{"utf-8 cut in a character", "a,\xC3\xA4\xC3", true, EncodingUTF8},
+		{"incomplete character at the end of the file", "a,\xC3\xA4\xC3", false, EncodingWindows1252},
+		{"windows-1252", "caf\xE9\n", false, EncodingWindows1252},
+		{"windows-1252 after a utf-8 byte order mark", "\xEF\xBB\xBFcaf\xE9\n", false, EncodingWindows1252},
+		{"utf-16le mark", "\xFF\xFEa\x00", false, EncodingUTF16LE},
+		{"utf-16be mark", "\xFE\xFF\x00a", false, EncodingUTF16BE},
+		{"utf-16le without a mark", "a\x00,\x00b\x00", false, EncodingUTF16LE},
+		{"utf-16be without a mark", "\x00a\x00,\x00b", false, EncodingUTF16BE},
+	} {
+		if encoding := detectEncoding([]byte(tt.head), tt.truncated); encoding != tt.encoding {
+			t.Errorf("%s: got %s, want %s", tt.name, encoding, tt.encoding)
+		}
+	}
+}
+
+func TestDecimalCommaNumber(t *testing.T) {
+	for _, tt := range []struct {
+		field  string
+		number string
+		ok     bool
+	}{
+		{"12,5", "12.5", true},
+		{"-1.234,5", "-1234.5", true},
+		{"+1.234.567", "+1234567", true},
+		{"1234", "1234", true},
+		{"1.23,4", "", false},
+		{"1,2,3", "", false},
+		{"12,", "", false},
+		{"abc", "", false},
+	} {
+		number, ok := decimalCommaNumber(tt.field)
+		if number != tt.number || ok != tt.ok {
+			t.Errorf("decimalCommaNumber(%q) = %q, %v, want %q, %v", tt.field, number, ok, tt.number, tt.ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		options Options
+		err     string
+	}{
+		{Options{}, ""},
+		{Options{Format: FormatCSV, Delimiter: ';', Quote: '\'', Encoding: "latin1", DecimalSeparator: ','}, ""},
+		{Options{Format: "xls"}, `unknown format "xls"`},
+		{Options{Delimiter: '\n'}, "can't be the delimiter or quote"},
+		{Options{Delimiter: '"', Quote: '"'}, "the delimiter and quote must be different"},
+		{Options{Encoding: "klingon"}, `unknown encoding "klingon"`},
+		{Options{SkipRows: -1}, "the rows to skip can't be negative"},
+		{Options{HeaderRow: -2}, "the header row must be at least 1"},
+		{Options{DecimalSeparator: ';'}, "the decimal separator must be '.' or ','"},
+	} {
+		err := tt.options.Validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: got %v, want %q", tt.options, err, tt.err)
+		}
+	}
+	if err := (Options{Format: "xls"}).Validate(); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("got %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestCSVFilename(t *testing.T) {
+	for filename, want := range map[string]string{
+		"data.csv":     "data.csv",
+		"data.XLSX":    "data.csv",
+		"data.parquet": "data.csv",
+		"data.jsonl":   "data.csv",
+		"data.txt":     "data.txt",
+		"data":         "data",
+	} {
+		if got := CSVFilename(filename); got != want {
+			t.Errorf("CSVFilename(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type field struct {
+	key   string
+	value json.RawMessage
+}
+
+// Calls fn with the fields of every object of a file
+type objectWalker func(r io.Reader, fn func(object []field) error) error
+
+// Every key of any object is a column, in the order the keys first appear.
+// Objects are read twice, to find the columns and then to write the rows.
+func convertObjects(format string, r io.ReadSeeker, walk objectWalker, writer *csv.Writer) error {
+	var columns []string
+	index := make(map[string]int)
+	err := walk(r, func(object []field) error {
+		for _, f := range object {
+			if _, ok := index[f.key]; !ok {
+				index[f.key] = len(columns)
+				columns = append(columns, f.key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return &Error{Format: format, Problem: "there are no objects with fields"}
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = writer.Write(columns); err != nil {
+		return err
+	}
+	row := make([]string, len(columns))
+	return walk(r, func(object []field) error {
+		clear(row)
+		for _, f := range object {
+			row[index[f.key]] = jsonText(f.value)
+		}
+		return writer.Write(row)
+	})
+}
+
+// Strings are unquoted and null is missing. Numbers and booleans are kept
+// as they are written, nested objects and arrays as JSON.
+func jsonText(value json.RawMessage) string {
+	switch value[0] {
+	case '"':
+		var s string
+		json.Unmarshal(value, &s)
+		return s
+	case 'n':
+		return ""
+	case '{', '[':
+		var b bytes.Buffer
+		json.Compact(&b, value)
+		return b.String()
+	}
+	return string(value)
+}
+
+var errNotObject = errors.New("expected an object")
+
+// Read an object of a decoder and its fields
+func readObject(decoder *json.Decoder, fields []field) ([]field, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('{') {
+		return nil, errNotObject
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err = decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{key: token.(string), value: value})
+	}
+	// The closing brace
+	_, err = decoder.Token()
+	return fields, err
+}
+
+func convertJSON(r io.ReadSeeker, writer *csv.Writer) error {
+	err := convertObjects(FormatJSON, r, walkJSONArray, writer)
+	// Syntax errors only know their offset
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		if _, seekErr := r.Seek(0, io.SeekStart); seekErr == nil {
+			return &Error{Format: FormatJSON, Line: lineAt(r, syntaxErr.Offset), Problem: syntaxErr.Error()}
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &Error{Format: FormatJSON, Problem: "unexpected end of the file"}
+	}
+	return err
+}
+
+// The line of a byte offset, starting at 1
+func lineAt(r io.Reader, offset int64) int {
+	line := 1
+	br := bufio.NewReader(io.LimitReader(r, offset))
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return line
+		}
+		if b == '\n' {
+			line++
+		}
+	}
+}
+
+// A JSON file is an array of objects
+func walkJSONArray(r io.Reader, fn func(object []field) error) error {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(len(byteOrderMark)); err == nil && bytes.Equal(bom, byteOrderMark) {
+		br.Discard(len(byteOrderMark))
+	}
+	decoder := json.NewDecoder(br)
+
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return &Error{Format: FormatJSON, Problem: "file is empty"}
+	}
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('[') {
+		return &Error{Format: FormatJSON, Problem: "expected an array of objects"}
+	}
+
+	var object []field
+	for i := 1; decoder.More(); i++ {
+		object, err = readObject(decoder, object[:0])
+		if err == errNotObject {
+			return &Error{Format: FormatJSON, Problem: fmt.Sprintf("element %d of the array is not an object", i)}
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(object); err != nil {
+			return err
+		}
+	}
+
+	// The closing bracket, nothing may follow
+	if _, err = decoder.Token(); err != nil {
+		return err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return &Error{Format: FormatJSON, Problem: "unexpected data after the array"}
+	}
+	return nil
+}
+
+func convertNDJSON(r io.ReadSeeker, writer *csv.Writer) error {
+	return convertObjects(FormatNDJSON, r, walkNDJSON, writer)
+}
+
+// An NDJSON file has an object on every line. Empty lines are skipped.
+func walkNDJSON(r io.Reader, fn func(object []field) error) error {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(len(byteOrderMark)); err == nil && bytes.Equal(bom, byteOrderMark) {
+		br.Discard(len(byteOrderMark))
+	}
+
+	var object []field
+	for line := 1; ; line++ {
+		text, readErr := br.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if trimmed := bytes.TrimSpace(text); len(trimmed) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(trimmed))
+			var err error
+			object, err = readObject(decoder, object[:0])
+			if err == nil && decoder.More() {
+				err = errors.New("unexpected data after the object")
+			}
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					err = errors.New("unexpected end of the object")
+				}
+				return &Error{Format: FormatNDJSON, Line: line, Problem: err.Error()}
+			}
+			if err = fn(object); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
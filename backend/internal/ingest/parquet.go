@@ -0,0 +1,135 @@
+package ingest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+// Rows decoded at a time from a row group
+const parquetBatchRows = 4096
+
+func convertParquet(r io.ReaderAt, size int64, writer *csv.Writer) error {
+	reader, err := file.NewParquetReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return &Error{Format: FormatParquet, Problem: "not a parquet file: " + err.Error()}
+	}
+	defer reader.Close()
+
+	arrowReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{BatchSize: parquetBatchRows}, memory.DefaultAllocator)
+	if err != nil {
+		return &Error{Format: FormatParquet, Problem: err.Error()}
+	}
+	schema, err := arrowReader.Schema()
+	if err != nil {
+		return &Error{Format: FormatParquet, Problem: err.Error()}
+	}
+	header := make([]string, schema.NumFields())
+	for i, f := range schema.Fields() {
+		if arrow.IsNested(f.Type.ID()) {
+			return &Error{Format: FormatParquet, Problem: fmt.Sprintf("column %q is nested, only flat schemas are supported", f.Name)}
+		}
+		header[i] = f.Name
+	}
+	// Row groups are read one at a time, and only if what the footer says
+	// about their size fits in what is left of the limit
+	limit := newConversionLimit(size)
+	if !limit.spend(header) {
+		return limit.exceeded(FormatParquet)
+	}
+	if err = writer.Write(header); err != nil {
+		return err
+	}
+	row := make([]string, len(header))
+	for group := range reader.NumRowGroups() {
+		metadata := reader.MetaData().RowGroup(group)
+		if !limit.fits(metadata.NumRows(), metadata.TotalByteSize()) {
+			return limit.exceeded(FormatParquet)
+		}
+
+		records, err := arrowReader.GetRecordReader(context.Background(), nil, []int{group})
+		if err != nil {
+			return &Error{Format: FormatParquet, Problem: err.Error()}
+		}
+		err = writeRecords(records, row, limit, writer)
+		records.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRecords(records pqarrow.RecordReader, row []string, limit *conversionLimit, writer *csv.Writer) error {
+	for records.Next() {
+		record := records.RecordBatch()
+		for i := range int(record.NumRows()) {
+			for c, column := range record.Columns() {
+				row[c] = formatArrowValue(column, i)
+			}
+			if !limit.spend(row) {
+				return limit.exceeded(FormatParquet)
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	if err := records.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return &Error{Format: FormatParquet, Problem: err.Error()}
+	}
+	return nil
+}
+
+// Values are formatted in the forms that the schema inference recognizes.
+// Nulls are empty.
+func formatArrowValue(column arrow.Array, i int) string {
+	if column.IsNull(i) {
+		return ""
+	}
+	switch values := column.(type) {
+	case *array.Boolean:
+		return strconv.FormatBool(values.Value(i))
+	case *array.Float32:
+		return strconv.FormatFloat(float64(values.Value(i)), 'g', -1, 32)
+	case *array.Float64:
+		return strconv.FormatFloat(values.Value(i), 'g', -1, 64)
+	case *array.Decimal128:
+		return values.Value(i).ToString(values.DataType().(arrow.DecimalType).GetScale())
+	case *array.Decimal256:
+		return values.Value(i).ToString(values.DataType().(arrow.DecimalType).GetScale())
+	case *array.Timestamp:
+		timestamp := values.DataType().(*arrow.TimestampType)
+		t := values.Value(i).ToTime(timestamp.Unit)
+		// Instants get a Z suffix, local date and times no zone
+		if timestamp.TimeZone != "" {
+			return t.Format(time.RFC3339Nano)
+		}
+		return t.Format("2006-01-02T15:04:05.999999999")
+	case *array.Time32:
+		return values.Value(i).ToTime(values.DataType().(*arrow.Time32Type).Unit).Format("15:04:05.999999999")
+	case *array.Time64:
+		return values.Value(i).ToTime(values.DataType().(*arrow.Time64Type).Unit).Format("15:04:05.999999999")
+	case *array.String:
+		return values.Value(i)
+	case *array.Binary:
+		// Binary data that isn't text is kept as base64
+		if b := values.Value(i); !utf8.Valid(b) {
+			return base64.StdEncoding.EncodeToString(b)
+		}
+		return values.ValueString(i)
+	}
+	return column.ValueStr(i)
+}
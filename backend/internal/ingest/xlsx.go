@@ -0,0 +1,183 @@
+package ingest
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"github.com/xuri/nfp"
+)
+
+func openWorkbook(r io.ReaderAt, size int64, limit *conversionLimit) (*excelize.File, error) {
+	workbook, err := excelize.OpenReader(io.NewSectionReader(r, 0, size), excelize.Options{UnzipSizeLimit: limit.max})
+	if err != nil {
+		return nil, &Error{Format: FormatXLSX, Problem: "not an xlsx file: " + err.Error()}
+	}
+	if len(workbook.GetSheetList()) == 0 {
+		workbook.Close()
+		return nil, &Error{Format: FormatXLSX, Problem: "the workbook has no sheets"}
+	}
+	return workbook, nil
+}
+
+// Reads the cell values of a sheet. Dates are formatted as 2006-01-02 or
+// 2006-01-02T15:04:05, booleans as true or false and errors such as #DIV/0!
+// as they are shown.
+type sheetReader struct {
+	workbook *excelize.File
+	sheet    string
+	date1904 bool
+	// Whether the cell styles format dates, by style index
+	dateStyles map[int]bool
+}
+
+func convertXLSX(r io.ReaderAt, size int64, options Options, writer *csv.Writer) error {
+	limit := newConversionLimit(size)
+	workbook, err := openWorkbook(r, size, limit)
+	if err != nil {
+		return err
+	}
+	defer workbook.Close()
+	if sheets := workbook.GetSheetList(); !slices.Contains(sheets, options.Sheet) {
+		return &Error{Format: FormatXLSX, Problem: fmt.Sprintf("there is no sheet %q, the workbook has %q", options.Sheet, sheets)}
+	}
+
+	reader := &sheetReader{workbook: workbook, sheet: options.Sheet, dateStyles: make(map[int]bool)}
+	if properties, err := workbook.GetWorkbookProps(); err == nil && properties.Date1904 != nil {
+		reader.date1904 = *properties.Date1904
+	}
+	rows, err := workbook.Rows(options.Sheet)
+	if err != nil {
+		return &Error{Format: FormatXLSX, Problem: err.Error()}
+	}
+	defer rows.Close()
+
+	// Every row of the sheet is visited, the first row with a value is the header
+	var columns int
+	for number := 1; rows.Next(); number++ {
+		row, err := rows.Columns(excelize.Options{RawCellValue: true})
+		if err != nil {
+			return &Error{Format: FormatXLSX, Line: number, Problem: err.Error()}
+		}
+		empty := true
+		for i, value := range row {
+			if row[i], err = reader.cellValue(i, number, value); err != nil {
+				return &Error{Format: FormatXLSX, Line: number, Problem: err.Error()}
+			}
+			empty = empty && row[i] == ""
+		}
+		if empty {
+			continue
+		}
+
+		if columns == 0 {
+			columns = len(row)
+		}
+		if len(row) > columns {
+			return &Error{Format: FormatXLSX, Line: number, Problem: fmt.Sprintf("the row has %d columns, but the header only %d", len(row), columns)}
+		}
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		if !limit.spend(row) {
+			return limit.exceeded(FormatXLSX)
+		}
+		if err = writer.Write(row); err != nil {
+			return err
+		}
+	}
+	if err = rows.Error(); err != nil {
+		return &Error{Format: FormatXLSX, Problem: err.Error()}
+	}
+	return nil
+}
+
+// Rows are read without number formats, as the stored values. Only the
+// numbers of boolean and date cells are looked up and formatted.
+func (s *sheetReader) cellValue(column int, number int, value string) (string, error) {
+	serial, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value, nil
+	}
+	cell, err := excelize.CoordinatesToCellName(column+1, number)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "0" || value == "1" {
+		cellType, err := s.workbook.GetCellType(s.sheet, cell)
+		if err != nil {
+			return "", err
+		}
+		if cellType == excelize.CellTypeBool {
+			return strconv.FormatBool(value == "1"), nil
+		}
+	}
+
+	style, err := s.workbook.GetCellStyle(s.sheet, cell)
+	if err != nil {
+		return "", err
+	}
+	if !s.isDateStyle(style) {
+		return value, nil
+	}
+	t, err := excelize.ExcelDateToTime(serial, s.date1904)
+	if err != nil {
+		return "", err
+	}
+	return formatDate(t), nil
+}
+
+func (s *sheetReader) isDateStyle(index int) bool {
+	isDate, ok := s.dateStyles[index]
+	if ok {
+		return isDate
+	}
+	if style, err := s.workbook.GetStyle(index); err == nil {
+		if style.CustomNumFmt != nil {
+			isDate = isDateFormat(*style.CustomNumFmt)
+		} else {
+			isDate = isBuiltinDateFormat(style.NumFmt)
+		}
+	}
+	s.dateStyles[index] = isDate
+	return isDate
+}
+
+// Built-in formats are not listed in styles.xml, see ECMA-376 part 1, 18.8.30
+func isBuiltinDateFormat(id int) bool {
+	return 14 <= id && id <= 22 || 27 <= id && id <= 36 || 45 <= id && id <= 47 || 50 <= id && id <= 58
+}
+
+// A format code formats dates if the format of positive numbers has a date
+// or time part
+func isDateFormat(code string) bool {
+	parser := nfp.NumberFormatParser()
+	sections := parser.Parse(code)
+	if len(sections) == 0 {
+		return false
+	}
+	for _, token := range sections[0].Items {
+		if token.TType == nfp.TokenTypeDateTimes || token.TType == nfp.TokenTypeElapsedDateTimes {
+			return true
+		}
+	}
+	return false
+}
+
+// Rounded to the millisecond, as Excel stores times imprecisely
+func formatDate(t time.Time) string {
+	t = t.Round(time.Millisecond)
+	switch {
+	case t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0:
+		return t.Format("2006-01-02")
+	case t.Nanosecond() == 0:
+		return t.Format("2006-01-02T15:04:05")
+	default:
+		return t.Format("2006-01-02T15:04:05.000")
+	}
+}
@@ -0,0 +1,32 @@
+package interceptors
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+
+	authRepo "chart-organizer/backend/internal/repository/auth"
+)
+
+// NewAdminInterceptor creates a Connect interceptor that only lets administrators through.
+// It must run after the auth interceptor, which puts the role into the context.
+func NewAdminInterceptor() connect.UnaryInterceptorFunc {
+	interceptor := func(next connect.UnaryFunc) connect.UnaryFunc {
+		return connect.UnaryFunc(func(
+			ctx context.Context,
+			req connect.AnyRequest,
+		) (connect.AnyResponse, error) {
+			if _, found := GetUserId(ctx); !found {
+				return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unauthenticated"))
+			}
+
+			if role, _ := GetRole(ctx); role != authRepo.RoleAdmin {
+				return nil, connect.NewError(connect.CodePermissionDenied, errors.New("administrator role required"))
+			}
+
+			return next(ctx, req)
+		})
+	}
+	return connect.UnaryInterceptorFunc(interceptor)
+}
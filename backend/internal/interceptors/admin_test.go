@@ -0,0 +1,49 @@
+package interceptors
+
+import (
+	"context"
+	"testing"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestAdminInterceptor(t *testing.T) {
+	called := false
+	next := func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		called = true
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	}
+	handler := NewAdminInterceptor()(next)
+
+	withUser := func(role string) context.Context {
+		ctx := context.WithValue(context.Background(), UserIDKey, "user")
+		if role != "" {
+			ctx = context.WithValue(ctx, RoleKey, role)
+		}
+		return ctx
+	}
+	for _, tt := range []struct {
+		name string
+		ctx  context.Context
+		code connect.Code
+	}{
+		{"anonymous", context.Background(), connect.CodeUnauthenticated},
+		{"user", withUser("user"), connect.CodePermissionDenied},
+		// API keys never carry a role, not even those of administrators
+		{"API key", withUser(""), connect.CodePermissionDenied},
+		{"unknown role", withUser("superuser"), connect.CodePermissionDenied},
+		{"admin", withUser("admin"), 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			_, err := handler(tt.ctx, connect.NewRequest(&emptypb.Empty{}))
+			if connect.CodeOf(err) != tt.code && (tt.code != 0 || err != nil) {
+				t.Errorf("got %v, want %v", err, tt.code)
+			}
+			if called != (tt.code == 0) {
+				t.Errorf("the procedure was called: %t", called)
+			}
+		})
+	}
+}
@@ -2,14 +2,21 @@ package interceptors
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"connectrpc.com/connect"
 	"github.com/golang-jwt/jwt/v5"
-)
 
-var JwtKey []byte
+	"chart-organizer/backend/internal/keyring"
+	"chart-organizer/backend/internal/repository/apikey"
+	"chart-organizer/backend/internal/repository/session"
+)
 
 // MaxTokenAgeMonths defines the maximum age of a JWT token in months
 const MaxTokenAgeMonths = 3
@@ -21,53 +28,174 @@ var maxTokenAge = time.Duration(MaxTokenAgeMonths) * 30 * 24 * time.Hour
 type ContextKey string
 
 const UserIDKey ContextKey = "userId"
+const SessionIDKey ContextKey = "sessionId"
+const ScopesKey ContextKey = "scopes"
+const RoleKey ContextKey = "role"
+
+// Scopes that can be granted to an API key.
+// Users logged in with a session have every scope.
+const (
+	ScopeDatasetsRead    = "datasets:read"
+	ScopeDatasetsWrite   = "datasets:write"
+	ScopeDashboardsRead  = "dashboards:read"
+	ScopeDashboardsWrite = "dashboards:write"
+)
+
+var Scopes = []string{ScopeDatasetsRead, ScopeDatasetsWrite, ScopeDashboardsRead, ScopeDashboardsWrite}
 
 type Claims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
+type authInterceptor struct {
+	db   *sql.DB
+	keys *keyring.Keyring
+}
+
 // NewAuthInterceptor creates a Connect interceptor that validates JWT tokens
-// and adds user info to the request context.
-func NewAuthInterceptor() connect.UnaryInterceptorFunc {
-	interceptor := func(next connect.UnaryFunc) connect.UnaryFunc {
-		return connect.UnaryFunc(func(
-			ctx context.Context,
-			req connect.AnyRequest,
-		) (connect.AnyResponse, error) {
-			// Extract Authorization header
-			tokenString := req.Header().Get("Authorization")
-
-			if tokenString != "" && len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-				tokenString = tokenString[7:]
-
-				claims := &Claims{}
-
-				token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-					if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-						return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-					}
-					return JwtKey, nil
-				})
-
-				isValid := err == nil && token.Valid
-				if isValid && claims.IssuedAt != nil {
-					isValid = time.Since(claims.IssuedAt.Time) <= maxTokenAge
-				}
-
-				if isValid {
-					ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
-				}
-			}
-
-			return next(ctx, req)
-		})
+// and API keys and adds user info to the request context.
+// Unknown API keys are rejected. Tokens whose session has been revoked are
+// ignored like invalid ones, which leaves the request unauthenticated.
+// It covers streaming procedures as well as unary ones.
+func NewAuthInterceptor(db *sql.DB, keys *keyring.Keyring) connect.Interceptor {
+	return &authInterceptor{db: db, keys: keys}
+}
+
+func (i *authInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return connect.UnaryFunc(func(
+		ctx context.Context,
+		req connect.AnyRequest,
+	) (connect.AnyResponse, error) {
+		ctx, err := i.authenticate(ctx, req.Header())
+		if err != nil {
+			return nil, err
+		}
+
+		return next(ctx, req)
+	})
+}
+
+// Outgoing streams are not authenticated by the server
+func (i *authInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *authInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return connect.StreamingHandlerFunc(func(
+		ctx context.Context,
+		conn connect.StreamingHandlerConn,
+	) error {
+		ctx, err := i.authenticate(ctx, conn.RequestHeader())
+		if err != nil {
+			return err
+		}
+
+		return next(ctx, conn)
+	})
+}
+
+func (i *authInterceptor) authenticate(ctx context.Context, header http.Header) (context.Context, error) {
+	// Extract Authorization header
+	authorization := header.Get("Authorization")
+
+	if tokenString, ok := strings.CutPrefix(authorization, "Bearer "); ok && tokenString != "" {
+		return authenticateToken(ctx, i.db, i.keys, tokenString)
+	}
+	if key, ok := strings.CutPrefix(authorization, "ApiKey "); ok && key != "" {
+		return authenticateApiKey(ctx, i.db, key)
 	}
-	return connect.UnaryInterceptorFunc(interceptor)
+	return ctx, nil
+}
+
+// Invalid tokens and tokens of revoked sessions are ignored so that public
+// procedures such as Login and RefreshToken keep working. Procedures that
+// need a user refuse the request as it carries none.
+func authenticateToken(ctx context.Context, db *sql.DB, keys *keyring.Keyring, tokenString string) (context.Context, error) {
+	claims := &Claims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc)
+
+	isValid := err == nil && token.Valid && claims.SessionID != ""
+	if isValid && claims.IssuedAt != nil {
+		isValid = time.Since(claims.IssuedAt.Time) <= maxTokenAge
+	}
+	if !isValid {
+		return ctx, nil
+	}
+
+	active, err := session.IsSessionActive(db, claims.UserID, claims.SessionID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if !active {
+		return ctx, nil
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+	ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
+	ctx = context.WithValue(ctx, RoleKey, claims.Role)
+	return ctx, nil
+}
+
+func authenticateApiKey(ctx context.Context, db *sql.DB, key string) (context.Context, error) {
+	userID, scopes, err := apikey.Authenticate(db, key)
+	if err != nil {
+		if errors.Is(err, apikey.ErrInvalidApiKey) {
+			return nil, connect.NewError(connect.CodeUnauthenticated, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	ctx = context.WithValue(ctx, UserIDKey, userID)
+	ctx = context.WithValue(ctx, ScopesKey, scopes)
+	return ctx, nil
 }
 
 func GetUserId(ctx context.Context) (string, bool) {
 	userID, ok := ctx.Value(UserIDKey).(string)
 	return userID, ok
 }
+
+// GetSessionId returns the session of the user. It is not found when the
+// request was authenticated with an API key.
+func GetSessionId(ctx context.Context) (string, bool) {
+	sessionID, ok := ctx.Value(SessionIDKey).(string)
+	return sessionID, ok
+}
+
+// GetRole returns the role of the user. It is not found when the request was
+// authenticated with an API key, as API keys never carry a role.
+func GetRole(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(RoleKey).(string)
+	return role, ok
+}
+
+// HasScope reports whether the request may act with the given scope.
+func HasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value(ScopesKey).([]string)
+	if !ok {
+		return true
+	}
+	return slices.Contains(scopes, scope)
+}
+
+// RequireScope returns a permission denied error if the request lacks the given scope.
+func RequireScope(ctx context.Context, scope string) error {
+	if !HasScope(ctx, scope) {
+		return connect.NewError(connect.CodePermissionDenied, fmt.Errorf("API key is missing the %s scope", scope))
+	}
+	return nil
+}
+
+// RequireSession returns a permission denied error if the request was not made
+// with a login session, e.g. because it was authenticated with an API key.
+func RequireSession(ctx context.Context) error {
+	if _, found := GetSessionId(ctx); !found {
+		return connect.NewError(connect.CodePermissionDenied, errors.New("this procedure requires a login session"))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package interceptors
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"chart-organizer/backend/internal/keyring"
+	"chart-organizer/backend/internal/repository/apikey"
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	"chart-organizer/backend/internal/repository/repositorytest"
+	"chart-organizer/backend/internal/repository/session"
+)
+
+func newTestUser(t *testing.T, db *sql.DB, username string) string {
+	t.Helper()
+	if err := authRepo.AddNewUser(db, username, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := authRepo.GetUserID(db, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	userID := newTestUser(t, db, "alice")
+	_, key, err := apikey.CreateApiKey(db, userID, "script", []string{ScopeDatasetsRead}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := authenticateApiKey(context.Background(), db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, found := GetUserId(ctx); !found || got != userID {
+		t.Errorf("user %q, %t", got, found)
+	}
+	if err := RequireScope(ctx, ScopeDatasetsRead); err != nil {
+		t.Errorf("granted scope: %v", err)
+	}
+	for _, scope := range []string{ScopeDatasetsWrite, ScopeDashboardsRead, ScopeDashboardsWrite} {
+		if err := RequireScope(ctx, scope); connect.CodeOf(err) != connect.CodePermissionDenied {
+			t.Errorf("%s: got %v, want permission denied", scope, err)
+		}
+	}
+	// Sessions can't be managed with an API key
+	if err := RequireSession(ctx); connect.CodeOf(err) != connect.CodePermissionDenied {
+		t.Errorf("RequireSession: got %v, want permission denied", err)
+	}
+}
+
+// Users logged in with a session have every scope
+func TestSessionScopes(t *testing.T) {
+	ctx := context.WithValue(context.Background(), UserIDKey, "user")
+	ctx = context.WithValue(ctx, SessionIDKey, "session")
+	for _, scope := range Scopes {
+		if err := RequireScope(ctx, scope); err != nil {
+			t.Errorf("%s: %v", scope, err)
+		}
+	}
+	if err := RequireSession(ctx); err != nil {
+		t.Errorf("RequireSession: %v", err)
+	}
+}
+
+func TestApiKeyRefused(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	userID := newTestUser(t, db, "alice")
+	revoked, key, err := apikey.CreateApiKey(db, userID, "script", Scopes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apikey.RevokeApiKey(db, userID, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{key, apikey.KeyPrefix + "unknown"} {
+		ctx, err := authenticateApiKey(context.Background(), db, key)
+		if connect.CodeOf(err) != connect.CodeUnauthenticated || ctx != nil {
+			t.Errorf("%q: got %v, want unauthenticated", key, err)
+		}
+	}
+}
+
+// Tokens of revoked sessions carry no identity, but don't keep the client
+// from calling public procedures such as Login either
+func TestRevokedSessionToken(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	userID := newTestUser(t, db, "alice")
+	keys, err := keyring.New([]*keyring.Key{keyring.NewHMACKey("test", []byte("0123456789abcdef0123456789abcdef"))}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID, _, err := session.CreateSession(db, userID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := keys.Sign(&Claims{
+		UserID:           userID,
+		Username:         "alice",
+		Role:             "user",
+		SessionID:        sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotUserID string
+	var found bool
+	handler := NewAuthInterceptor(db, keys).WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		gotUserID, found = GetUserId(ctx)
+		return connect.NewResponse(&emptypb.Empty{}), nil
+	})
+	call := func() error {
+		req := connect.NewRequest(&emptypb.Empty{})
+		req.Header().Set("Authorization", "Bearer "+token)
+		_, err := handler(context.Background(), req)
+		return err
+	}
+
+	if err := call(); err != nil || !found || gotUserID != userID {
+		t.Fatalf("active session: user %q, %t, %v", gotUserID, found, err)
+	}
+	if err := session.RevokeSession(db, userID, sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(); err != nil || found {
+		t.Errorf("revoked session: user %q, %t, %v", gotUserID, found, err)
+	}
+}
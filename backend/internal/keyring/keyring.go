@@ -0,0 +1,333 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// LegacyKeyID is the ID of the key built from JWT_KEY.
+// Tokens issued before key IDs were introduced carry no kid and are verified with it.
+const LegacyKeyID = "default"
+
+// Key is a single signing key.
+// Verification-only keys have no signing key, e.g. when only a public key is configured.
+type Key struct {
+	ID              string
+	Algorithm       string
+	Retired         bool
+	signingKey      any
+	verificationKey any
+}
+
+func (k *Key) signingMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// Keyring holds every key tokens can be signed or verified with.
+// New tokens are signed with the active key. Tokens are accepted if they were
+// signed with any key that has not been retired.
+type Keyring struct {
+	keys   map[string]*Key
+	active *Key
+}
+
+func New(keys []*Key, activeID string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*Key)}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("every key needs an ID")
+		}
+		if _, exists := k.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		if key.signingMethod() == nil {
+			return nil, fmt.Errorf("key %q: unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		k.keys[key.ID] = key
+	}
+
+	active, ok := k.keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active key %q not found", activeID)
+	}
+	if active.Retired {
+		return nil, fmt.Errorf("active key %q is retired", activeID)
+	}
+	if active.signingKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key", activeID)
+	}
+	k.active = active
+
+	return k, nil
+}
+
+// NewHMACKey creates an HS256 key from a shared secret
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{ID: id, Algorithm: AlgorithmHS256, signingKey: secret, verificationKey: secret}
+}
+
+// Sign the claims with the active key. The key ID is put in the kid header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.signingMethod(), claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.signingKey)
+}
+
+// Keyfunc looks up the key a token was signed with, for use with jwt.Parse.
+// Retired keys and keys used with another algorithm are refused.
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyKeyID
+	}
+
+	key, ok := k.keys[kid]
+	if !ok || key.Retired {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.verificationKey, nil
+}
+
+// JWK is a public key as published in the JWKS
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS returns the public keys of every key that has not been retired.
+// HMAC keys are secret and therefore never published.
+func (k *Keyring) JWKS() []JWK {
+	var ids []string
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jwks := []JWK{}
+	for _, id := range ids {
+		key := k.keys[id]
+		if key.Retired {
+			continue
+		}
+
+		switch pub := key.verificationKey.(type) {
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				KeyType:   "OKP",
+				KeyID:     key.ID,
+				Algorithm: key.Algorithm,
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(pub),
+			})
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				KeyType:   "RSA",
+				KeyID:     key.ID,
+				Algorithm: key.Algorithm,
+				Use:       "sig",
+				N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		}
+	}
+	return jwks
+}
+
+// JWKSHandler serves the public keys so that other services can verify our tokens
+func (k *Keyring) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(map[string][]JWK{"keys": k.JWKS()})
+	})
+}
+
+// Config is the keyring file format.
+//
+//	{
+//	  "active": "2026-10",
+//	  "keys": [
+//	    {"kid": "2026-10", "alg": "EdDSA", "private_key_file": "jwt-2026-10.pem"},
+//	    {"kid": "default", "alg": "HS256", "secret_env": "JWT_KEY", "retired": true}
+//	  ]
+//	}
+//
+// Relative key file paths are resolved from the directory of the keyring file.
+type Config struct {
+	Active string      `json:"active"`
+	Keys   []KeyConfig `json:"keys"`
+}
+
+type KeyConfig struct {
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Retired   bool   `json:"retired"`
+	// For HS256 keys, the name of the environment variable holding the secret
+	SecretEnv string `json:"secret_env"`
+	// For EdDSA and RS256 keys, a PKCS #8 private key or a PKIX public key in PEM format
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+// Load reads the keyring file at path.
+// JWT_ACTIVE_KID, if set, overrides the active key of the file.
+func Load(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse keyring: %w", err)
+	}
+	if activeID := os.Getenv("JWT_ACTIVE_KID"); activeID != "" {
+		config.Active = activeID
+	}
+
+	dir := filepath.Dir(path)
+	var keys []*Key
+	for _, keyConfig := range config.Keys {
+		key, err := loadKey(dir, keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", keyConfig.ID, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return New(keys, config.Active)
+}
+
+func loadKey(dir string, config KeyConfig) (*Key, error) {
+	key := &Key{ID: config.ID, Algorithm: config.Algorithm, Retired: config.Retired}
+
+	if config.Algorithm == AlgorithmHS256 {
+		secret := os.Getenv(config.SecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("secret_env %q is empty", config.SecretEnv)
+		}
+		key.signingKey = []byte(secret)
+		key.verificationKey = []byte(secret)
+		return key, nil
+	}
+
+	if config.PrivateKeyFile != "" {
+		block, err := readPEM(dir, config.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch private := private.(type) {
+		case ed25519.PrivateKey:
+			key.signingKey = private
+			key.verificationKey = private.Public()
+		case *rsa.PrivateKey:
+			key.signingKey = private
+			key.verificationKey = &private.PublicKey
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", private)
+		}
+	} else if config.PublicKeyFile != "" {
+		block, err := readPEM(dir, config.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.verificationKey = public
+	} else {
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+
+	// Make sure the key matches the algorithm so that keyfunc can't be confused
+	switch key.verificationKey.(type) {
+	case ed25519.PublicKey:
+		if config.Algorithm != AlgorithmEdDSA {
+			return nil, fmt.Errorf("Ed25519 key can't be used with %s", config.Algorithm)
+		}
+	case *rsa.PublicKey:
+		if config.Algorithm != AlgorithmRS256 {
+			return nil, fmt.Errorf("RSA key can't be used with %s", config.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key.verificationKey)
+	}
+
+	return key, nil
+}
+
+func readPEM(dir string, path string) (*pem.Block, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	return block, nil
+}
+
+// FromEnv builds the keyring from the environment.
+// JWT_KEYRING points to a keyring file. Otherwise JWT_KEY is used as a single
+// HS256 key, and if that is not set either, a random key is generated, so
+// tokens won't survive a restart.
+func FromEnv() (*Keyring, bool, error) {
+	if path := os.Getenv("JWT_KEYRING"); path != "" {
+		k, err := Load(path)
+		return k, false, err
+	}
+
+	secret := []byte(os.Getenv("JWT_KEY"))
+	generated := len(secret) == 0
+	if generated {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, false, err
+		}
+	}
+
+	k, err := New([]*Key{NewHMACKey(LegacyKeyID, secret)}, LegacyKeyID)
+	return k, generated, err
+}
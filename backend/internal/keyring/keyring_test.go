@@ -0,0 +1,337 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type testKeys struct {
+	ed25519 ed25519.PrivateKey
+	rsa     *rsa.PrivateKey
+}
+
+// Write an Ed25519 and an RSA key in PEM files to dir: ed25519.pem, rsa.pem
+// and their public keys ed25519.pub.pem and rsa.pub.pem
+func writeKeys(t *testing.T, dir string) testKeys {
+	t.Helper()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]crypto.Signer{"ed25519": edKey, "rsa": rsaKey} {
+		private, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, filepath.Join(dir, name+".pem"), "PRIVATE KEY", private)
+		writePEM(t, filepath.Join(dir, name+".pub.pem"), "PUBLIC KEY", public)
+	}
+	return testKeys{ed25519: edKey, rsa: rsaKey}
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeConfig(t *testing.T, dir string, config Config) string {
+	t.Helper()
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keyring.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func claims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{Subject: "user", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+}
+
+// Sign a token with the key, with the given kid or without one if it is empty
+func signWith(t *testing.T, method jwt.SigningMethod, key any, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims())
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestKeyfunc(t *testing.T) {
+	dir := t.TempDir()
+	keys := writeKeys(t, dir)
+	t.Setenv("TEST_JWT_KEY", "legacy secret")
+	t.Setenv("TEST_OLD_JWT_KEY", "old secret")
+	k, err := Load(writeConfig(t, dir, Config{
+		Active: "ed",
+		Keys: []KeyConfig{
+			{ID: "ed", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "ed25519.pem"},
+			// Absolute paths are kept
+			{ID: "rsa", Algorithm: AlgorithmRS256, PublicKeyFile: filepath.Join(dir, "rsa.pub.pem")},
+			{ID: LegacyKeyID, Algorithm: AlgorithmHS256, SecretEnv: "TEST_JWT_KEY"},
+			{ID: "old", Algorithm: AlgorithmHS256, SecretEnv: "TEST_OLD_JWT_KEY", Retired: true},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := k.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"active key", signed, ""},
+		{"Ed25519 key of the keyring", signWith(t, jwt.SigningMethodEdDSA, keys.ed25519, "ed"), ""},
+		{"verification-only key", signWith(t, jwt.SigningMethodRS256, keys.rsa, "rsa"), ""},
+		{"legacy key", signWith(t, jwt.SigningMethodHS256, []byte("legacy secret"), LegacyKeyID), ""},
+		{"token without a kid", signWith(t, jwt.SigningMethodHS256, []byte("legacy secret"), ""), ""},
+		{"retired key", signWith(t, jwt.SigningMethodHS256, []byte("old secret"), "old"), `unknown key "old"`},
+		{"unknown key", signWith(t, jwt.SigningMethodHS256, []byte("legacy secret"), "new"), `unknown key "new"`},
+		{"another secret", signWith(t, jwt.SigningMethodHS256, []byte("guessed"), LegacyKeyID), "signature is invalid"},
+		{"another Ed25519 key", signWith(t, jwt.SigningMethodEdDSA, ed25519.NewKeyFromSeed(make([]byte, 32)), "ed"), "signature is invalid"},
+		// The public key used as an HMAC secret
+		{"algorithm of another key", signWith(t, jwt.SigningMethodHS256, rsaPublic, "rsa"), "unexpected signing method: HS256"},
+		{"algorithm none", signWith(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, LegacyKeyID), "unexpected signing method: none"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := jwt.Parse(tt.token, k.Keyfunc)
+			if tt.err == "" {
+				if err != nil || !token.Valid {
+					t.Errorf("got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	token, _, err := jwt.NewParser().ParseUnverified(signed, &jwt.RegisteredClaims{})
+	if err != nil || token.Header["kid"] != "ed" || token.Header["alg"] != AlgorithmEdDSA {
+		t.Errorf("header %v, %v", token.Header, err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	keys := writeKeys(t, dir)
+	t.Setenv("TEST_JWT_KEY", "secret")
+	k, err := Load(writeConfig(t, dir, Config{
+		Active: "b-rsa",
+		Keys: []KeyConfig{
+			{ID: "c-hmac", Algorithm: AlgorithmHS256, SecretEnv: "TEST_JWT_KEY"},
+			{ID: "b-rsa", Algorithm: AlgorithmRS256, PrivateKeyFile: "rsa.pem"},
+			{ID: "a-ed", Algorithm: AlgorithmEdDSA, PublicKeyFile: "ed25519.pub.pem"},
+			{ID: "d-retired", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "ed25519.pem", Retired: true},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sorted by key ID, without the HMAC and the retired key
+	want := []JWK{
+		{
+			KeyType: "OKP", KeyID: "a-ed", Algorithm: AlgorithmEdDSA, Use: "sig", Curve: "Ed25519",
+			X: base64.RawURLEncoding.EncodeToString(keys.ed25519.Public().(ed25519.PublicKey)),
+		},
+		{
+			KeyType: "RSA", KeyID: "b-rsa", Algorithm: AlgorithmRS256, Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(keys.rsa.N.Bytes()), E: "AQAB",
+		},
+	}
+	if got := k.JWKS(); !reflect.DeepEqual(got, want) {
+		t.Errorf("JWKS\n%+v\nwant\n%+v", got, want)
+	}
+
+	recorder := httptest.NewRecorder()
+	k.JWKSHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var body struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Header().Get("Content-Type") != "application/json" || !reflect.DeepEqual(body.Keys, want) {
+		t.Errorf("response %s %s", recorder.Header(), recorder.Body)
+	}
+
+	// HMAC keys alone publish an empty list rather than null
+	hmac, err := New([]*Key{NewHMACKey("a", []byte("secret"))}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	hmac.JWKSHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if got := strings.TrimSpace(recorder.Body.String()); got != `{"keys":[]}` {
+		t.Errorf("JWKS of HMAC keys %s", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	public := &Key{ID: "public", Algorithm: AlgorithmEdDSA, verificationKey: ed25519.PublicKey(make([]byte, 32))}
+	for _, tt := range []struct {
+		name   string
+		keys   []*Key
+		active string
+		err    string
+	}{
+		{"no ID", []*Key{NewHMACKey("", []byte("secret"))}, "", "every key needs an ID"},
+		{"duplicate ID", []*Key{NewHMACKey("a", []byte("secret")), NewHMACKey("a", []byte("other"))}, "a", `duplicate key ID "a"`},
+		{"unknown algorithm", []*Key{{ID: "a", Algorithm: "HS1"}}, "a", `key "a": unsupported algorithm "HS1"`},
+		{"unknown active key", []*Key{NewHMACKey("a", []byte("secret"))}, "b", `active key "b" not found`},
+		{"retired active key", []*Key{{ID: "a", Algorithm: AlgorithmHS256, Retired: true, signingKey: []byte("s"), verificationKey: []byte("s")}}, "a", `active key "a" is retired`},
+		{"active key without a private key", []*Key{public}, "public", `active key "public" has no private key`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.keys, tt.active); err == nil || err.Error() != tt.err {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeKeys(t, dir)
+	if err := os.WriteFile(filepath.Join(dir, "not.pem"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_JWT_KEY", "secret")
+
+	for _, tt := range []struct {
+		name string
+		key  KeyConfig
+		err  string
+	}{
+		{"empty secret", KeyConfig{ID: "k", Algorithm: AlgorithmHS256, SecretEnv: "TEST_UNSET_JWT_KEY"}, `key "k": secret_env "TEST_UNSET_JWT_KEY" is empty`},
+		{"no key file", KeyConfig{ID: "k", Algorithm: AlgorithmEdDSA}, `key "k": private_key_file or public_key_file is required`},
+		{"missing key file", KeyConfig{ID: "k", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "missing.pem"}, "no such file or directory"},
+		{"not PEM", KeyConfig{ID: "k", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "not.pem"}, "not.pem is not a PEM file"},
+		{"public key as the private key", KeyConfig{ID: "k", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "ed25519.pub.pem"}, `key "k": asn1: structure error`},
+		{"Ed25519 key for RS256", KeyConfig{ID: "k", Algorithm: AlgorithmRS256, PrivateKeyFile: "ed25519.pem"}, `key "k": Ed25519 key can't be used with RS256`},
+		{"RSA key for EdDSA", KeyConfig{ID: "k", Algorithm: AlgorithmEdDSA, PublicKeyFile: "rsa.pub.pem"}, `key "k": RSA key can't be used with EdDSA`},
+		{"RSA key for HS256", KeyConfig{ID: "k", Algorithm: AlgorithmHS256, PrivateKeyFile: "rsa.pem"}, `key "k": secret_env "" is empty`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, dir, Config{Active: "k", Keys: []KeyConfig{tt.key}})
+			if _, err := Load(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "keyring.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filepath.Join(dir, "keyring.json")); err == nil || !strings.HasPrefix(err.Error(), "parse keyring: ") {
+		t.Errorf("got %v for a malformed file", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Run("JWT_KEY", func(t *testing.T) {
+		t.Setenv("JWT_KEYRING", "")
+		t.Setenv("JWT_KEY", "secret")
+		k, generated, err := FromEnv()
+		if err != nil || generated {
+			t.Fatalf("got %v, generated %t", err, generated)
+		}
+		// Tokens signed with JWT_KEY before key IDs are still accepted
+		if _, err := jwt.Parse(signWith(t, jwt.SigningMethodHS256, []byte("secret"), ""), k.Keyfunc); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		t.Setenv("JWT_KEYRING", "")
+		t.Setenv("JWT_KEY", "")
+		k, generated, err := FromEnv()
+		if err != nil || !generated {
+			t.Fatalf("got %v, generated %t", err, generated)
+		}
+		signed, err := k.Sign(claims())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jwt.Parse(signed, k.Keyfunc); err != nil {
+			t.Error(err)
+		}
+		other, _, _ := FromEnv()
+		if _, err := jwt.Parse(signed, other.Keyfunc); err == nil {
+			t.Error("two generated keys are the same")
+		}
+	})
+
+	t.Run("JWT_KEYRING", func(t *testing.T) {
+		dir := t.TempDir()
+		writeKeys(t, dir)
+		path := writeConfig(t, dir, Config{
+			Active: "ed",
+			Keys: []KeyConfig{
+				{ID: "ed", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "ed25519.pem"},
+				{ID: "rsa", Algorithm: AlgorithmRS256, PrivateKeyFile: "rsa.pem"},
+			},
+		})
+		t.Setenv("JWT_KEYRING", path)
+		t.Setenv("JWT_KEY", "ignored")
+		// Switches to another key without editing the file
+		t.Setenv("JWT_ACTIVE_KID", "rsa")
+		k, generated, err := FromEnv()
+		if err != nil || generated {
+			t.Fatalf("got %v, generated %t", err, generated)
+		}
+		signed, err := k.Sign(claims())
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jwt.Parse(signed, k.Keyfunc)
+		if err != nil || token.Header["kid"] != "rsa" || token.Method != jwt.SigningMethodRS256 {
+			t.Errorf("token %v, %v", token.Header, err)
+		}
+	})
+}
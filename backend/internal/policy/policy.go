@@ -0,0 +1,255 @@
+package policy
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+
+	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
+)
+
+// Fields a violation can refer to
+const (
+	FieldUsername = "username"
+	FieldPassword = "password"
+)
+
+// Rules that can be violated
+const (
+	RuleRequired         = "required"
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleCharacterClasses = "character_classes"
+	RuleBreached         = "breached"
+	RuleContainsUsername = "contains_username"
+	RuleCharset          = "charset"
+	RuleUnique           = "unique"
+)
+
+// bcrypt only uses the first 72 bytes, so longer passwords are refused
+// instead of being silently truncated
+const maxPasswordBytes = 72
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+type Violation struct {
+	Field       string
+	Rule        string
+	Description string
+}
+
+// Policy holds the rules usernames and passwords are checked against
+type Policy struct {
+	MinPasswordLength int
+	// Out of lowercase letters, uppercase letters, digits and symbols
+	MinCharacterClasses int
+	// Lowercased passwords that are known to have been leaked
+	BreachedPasswords map[string]struct{}
+
+	MinUsernameLength int
+	MaxUsernameLength int
+	UsernamePattern   *regexp.Regexp
+	// Description of UsernamePattern shown to users
+	UsernameCharset string
+}
+
+// Default returns the policy used when nothing is configured
+func Default() *Policy {
+	p := &Policy{
+		MinPasswordLength:   8,
+		MinCharacterClasses: 1,
+		BreachedPasswords:   make(map[string]struct{}),
+		MinUsernameLength:   3,
+		MaxUsernameLength:   32,
+		UsernamePattern:     regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`),
+		UsernameCharset:     "letters, digits, '.', '_' and '-', starting with a letter or digit",
+	}
+	p.addBreachedPasswords(strings.NewReader(commonPasswords))
+	return p
+}
+
+func (p *Policy) addBreachedPasswords(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		password := strings.TrimSpace(scanner.Text())
+		if password != "" {
+			p.BreachedPasswords[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return scanner.Err()
+}
+
+// FromEnv builds the policy from the default one and the environment:
+// PASSWORD_MIN_LENGTH, PASSWORD_MIN_CHARACTER_CLASSES, PASSWORD_BREACHED_LIST
+// (a file with one password per line, added to the built-in list),
+// USERNAME_MIN_LENGTH, USERNAME_MAX_LENGTH and USERNAME_PATTERN.
+func FromEnv() (*Policy, error) {
+	p := Default()
+
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"PASSWORD_MIN_LENGTH", &p.MinPasswordLength},
+		{"PASSWORD_MIN_CHARACTER_CLASSES", &p.MinCharacterClasses},
+		{"USERNAME_MIN_LENGTH", &p.MinUsernameLength},
+		{"USERNAME_MAX_LENGTH", &p.MaxUsernameLength},
+	}
+	for _, i := range ints {
+		value := os.Getenv(i.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number", i.name)
+		}
+		*i.value = n
+	}
+	if p.MinCharacterClasses > 4 {
+		return nil, errors.New("PASSWORD_MIN_CHARACTER_CLASSES can be at most 4")
+	}
+	if p.MinPasswordLength > maxPasswordBytes {
+		return nil, fmt.Errorf("PASSWORD_MIN_LENGTH can be at most %d", maxPasswordBytes)
+	}
+	if p.MaxUsernameLength < p.MinUsernameLength {
+		return nil, errors.New("USERNAME_MAX_LENGTH is smaller than USERNAME_MIN_LENGTH")
+	}
+
+	if pattern := os.Getenv("USERNAME_PATTERN"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("USERNAME_PATTERN: %w", err)
+		}
+		p.UsernamePattern = re
+		p.UsernameCharset = "the pattern " + pattern
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err = p.addBreachedPasswords(f); err != nil {
+			return nil, fmt.Errorf("PASSWORD_BREACHED_LIST: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// CheckUsername returns every rule the username violates
+func (p *Policy) CheckUsername(username string) []Violation {
+	if username == "" {
+		return []Violation{{FieldUsername, RuleRequired, "username is required"}}
+	}
+
+	var violations []Violation
+	length := utf8.RuneCountInString(username)
+	if length < p.MinUsernameLength {
+		violations = append(violations, Violation{FieldUsername, RuleMinLength,
+			fmt.Sprintf("username must be at least %d characters long", p.MinUsernameLength)})
+	}
+	if length > p.MaxUsernameLength {
+		violations = append(violations, Violation{FieldUsername, RuleMaxLength,
+			fmt.Sprintf("username must be at most %d characters long", p.MaxUsernameLength)})
+	}
+	if !p.UsernamePattern.MatchString(username) {
+		violations = append(violations, Violation{FieldUsername, RuleCharset,
+			"username may only contain " + p.UsernameCharset})
+	}
+	return violations
+}
+
+// CheckPassword returns every rule the password violates.
+// The username is passed so that passwords containing it can be refused.
+func (p *Policy) CheckPassword(password string, username string) []Violation {
+	if password == "" {
+		return []Violation{{FieldPassword, RuleRequired, "password is required"}}
+	}
+
+	var violations []Violation
+	if utf8.RuneCountInString(password) < p.MinPasswordLength {
+		violations = append(violations, Violation{FieldPassword, RuleMinLength,
+			fmt.Sprintf("password must be at least %d characters long", p.MinPasswordLength)})
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, Violation{FieldPassword, RuleMaxLength,
+			fmt.Sprintf("password must be at most %d bytes long", maxPasswordBytes)})
+	}
+	if classes := characterClasses(password); classes < p.MinCharacterClasses {
+		violations = append(violations, Violation{FieldPassword, RuleCharacterClasses,
+			fmt.Sprintf("password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", p.MinCharacterClasses)})
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, Violation{FieldPassword, RuleContainsUsername,
+			"password must not contain the username"})
+	}
+	if _, breached := p.BreachedPasswords[strings.ToLower(password)]; breached {
+		violations = append(violations, Violation{FieldPassword, RuleBreached,
+			"password is too common and has appeared in data breaches"})
+	}
+	return violations
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// NewError builds a connect error carrying the violations as a PolicyViolations detail
+func NewError(code connect.Code, violations []Violation) *connect.Error {
+	var descriptions []string
+	detail := &authv1.PolicyViolations{}
+	for _, v := range violations {
+		descriptions = append(descriptions, v.Description)
+		detail.Violations = append(detail.Violations, &authv1.PolicyViolation{
+			Field:       v.Field,
+			Rule:        v.Rule,
+			Description: v.Description,
+		})
+	}
+
+	connectErr := connect.NewError(code, errors.New(strings.Join(descriptions, "; ")))
+	if errorDetail, err := connect.NewErrorDetail(detail); err == nil {
+		connectErr.AddDetail(errorDetail)
+	}
+	return connectErr
+}
+
+// UsernameTakenError is returned when the username is already in use,
+// regardless of case
+func UsernameTakenError() *connect.Error {
+	return NewError(connect.CodeAlreadyExists, []Violation{{FieldUsername, RuleUnique, "username is already taken"}})
+}
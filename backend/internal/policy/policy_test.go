@@ -0,0 +1,172 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"connectrpc.com/connect"
+
+	authv1 "chart-organizer/backend/gen/contracts/auth/v1"
+)
+
+func rules(violations []Violation) []string {
+	var rules []string
+	for _, v := range violations {
+		rules = append(rules, v.Field+" "+v.Rule)
+	}
+	return rules
+}
+
+func TestCheckUsername(t *testing.T) {
+	for _, tt := range []struct {
+		username string
+		want     []string
+	}{
+		{"alice", nil},
+		{"a.b_c-d", nil},
+		{"Bob42", nil},
+		{"abc", nil},
+		{strings.Repeat("a", 32), nil},
+		{"", []string{"username required"}},
+		{"ab", []string{"username min_length"}},
+		{strings.Repeat("a", 33), []string{"username max_length"}},
+		{".alice", []string{"username charset"}},
+		{"alice smith", []string{"username charset"}},
+		{"alice@example.com", []string{"username charset"}},
+		// Lengths are counted in characters, not bytes
+		{"äöü", []string{"username charset"}},
+		{"é", []string{"username min_length", "username charset"}},
+		{" ", []string{"username min_length", "username charset"}},
+	} {
+		if got := rules(Default().CheckUsername(tt.username)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("CheckUsername(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	strict := Default()
+	strict.MinPasswordLength = 12
+	strict.MinCharacterClasses = 3
+
+	for _, tt := range []struct {
+		name     string
+		policy   *Policy
+		password string
+		username string
+		want     []string
+	}{
+		{"long enough", Default(), "correct horse", "alice", nil},
+		{"empty", Default(), "", "alice", []string{"password required"}},
+		{"short", Default(), "s3cr3t!", "alice", []string{"password min_length"}},
+		// Characters are counted, bytes are limited
+		{"eight characters in more bytes", Default(), "äöüäöüäö", "alice", nil},
+		{"72 bytes", Default(), strings.Repeat("x", 72), "alice", nil},
+		{"73 bytes", Default(), strings.Repeat("x", 73), "alice", []string{"password max_length"}},
+		{"more than 72 bytes in fewer characters", Default(), strings.Repeat("ä", 40), "alice", []string{"password max_length"}},
+		{"common", Default(), "password", "alice", []string{"password breached"}},
+		{"common with a digit added", Default(), "LetMeIn1", "alice", nil},
+		{"common regardless of case", Default(), "PassWord1", "alice", []string{"password breached"}},
+		{"contains the username", Default(), "xxALICExx", "alice", []string{"password contains_username"}},
+		{"without a username", Default(), "xxALICExx", "", nil},
+		{"one class", strict, "correcthorsebattery", "alice", []string{"password character_classes"}},
+		{"two classes", strict, "correcthorse42", "alice", []string{"password character_classes"}},
+		{"three classes", strict, "Correcthorse42", "alice", nil},
+		{"symbols", strict, "correct horse 42", "alice", nil},
+		{"letters of other scripts", strict, "Ωmega-straße", "alice", nil},
+		{"every rule", strict, "qwerty", "qwe", []string{"password min_length", "password character_classes", "password contains_username", "password breached"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules(tt.policy.CheckPassword(tt.password, tt.username)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(list, []byte("Tr0ub4dor&3\n\n  hunter22  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PASSWORD_MIN_LENGTH", "10")
+	t.Setenv("PASSWORD_MIN_CHARACTER_CLASSES", "2")
+	t.Setenv("PASSWORD_BREACHED_LIST", list)
+	t.Setenv("USERNAME_MIN_LENGTH", "2")
+	t.Setenv("USERNAME_MAX_LENGTH", "8")
+	t.Setenv("USERNAME_PATTERN", `^[a-z]+$`)
+
+	p, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MinPasswordLength != 10 || p.MinCharacterClasses != 2 || p.MinUsernameLength != 2 || p.MaxUsernameLength != 8 {
+		t.Errorf("policy %+v", p)
+	}
+	for _, password := range []string{"tr0ub4dor&3", "HUNTER22", "password"} {
+		if _, ok := p.BreachedPasswords[strings.ToLower(password)]; !ok {
+			t.Errorf("%q is not in the breached passwords", password)
+		}
+	}
+	if got := rules(p.CheckUsername("Alice")); !reflect.DeepEqual(got, []string{"username charset"}) {
+		t.Errorf("CheckUsername = %q", got)
+	}
+	if v := p.CheckUsername("Al"); v[0].Description != "username may only contain the pattern ^[a-z]+$" {
+		t.Errorf("description %q", v[0].Description)
+	}
+}
+
+func TestFromEnvInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{"not a number", map[string]string{"PASSWORD_MIN_LENGTH": "eight"}, "PASSWORD_MIN_LENGTH must be a non-negative number"},
+		{"negative", map[string]string{"USERNAME_MIN_LENGTH": "-1"}, "USERNAME_MIN_LENGTH must be a non-negative number"},
+		{"too many classes", map[string]string{"PASSWORD_MIN_CHARACTER_CLASSES": "5"}, "PASSWORD_MIN_CHARACTER_CLASSES can be at most 4"},
+		{"longer than bcrypt takes", map[string]string{"PASSWORD_MIN_LENGTH": "73"}, "PASSWORD_MIN_LENGTH can be at most 72"},
+		{"maximum below the minimum", map[string]string{"USERNAME_MIN_LENGTH": "10", "USERNAME_MAX_LENGTH": "9"}, "USERNAME_MAX_LENGTH is smaller than USERNAME_MIN_LENGTH"},
+		{"invalid pattern", map[string]string{"USERNAME_PATTERN": "[a-z"}, "USERNAME_PATTERN: error parsing regexp"},
+		{"missing list", map[string]string{"PASSWORD_BREACHED_LIST": filepath.Join(t.TempDir(), "missing.txt")}, "no such file or directory"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewError(t *testing.T) {
+	violations := Default().CheckPassword("qwerty", "")
+	err := NewError(connect.CodeInvalidArgument, violations)
+	if err.Code() != connect.CodeInvalidArgument || err.Message() != "password must be at least 8 characters long; password is too common and has appeared in data breaches" {
+		t.Errorf("error %v", err)
+	}
+
+	details := err.Details()
+	if len(details) != 1 {
+		t.Fatalf("%d details, want 1", len(details))
+	}
+	value, detailErr := details[0].Value()
+	if detailErr != nil {
+		t.Fatal(detailErr)
+	}
+	detail, ok := value.(*authv1.PolicyViolations)
+	if !ok || len(detail.Violations) != 2 || detail.Violations[1].Field != FieldPassword || detail.Violations[1].Rule != RuleBreached {
+		t.Errorf("detail %v", value)
+	}
+
+	var taken *connect.Error
+	if !errors.As(UsernameTakenError(), &taken) || taken.Code() != connect.CodeAlreadyExists || taken.Message() != "username is already taken" {
+		t.Errorf("UsernameTakenError() = %v", taken)
+	}
+}
@@ -0,0 +1,249 @@
+package profile
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+// HistogramBins is the number of equal-width bins of a histogram
+const HistogramBins = 10
+
+// TopValues is the number of most frequent values kept for categorical and boolean columns
+const TopValues = 10
+
+// Distinct values are only counted up to this many per column,
+// so that text columns with unique values don't use up the memory
+const maxDistinct = 100_000
+
+// Quantiles computed for numeric columns
+var Quantiles = []float64{0.05, 0.25, 0.5, 0.75, 0.95}
+
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type HistogramBin struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Count int64   `json:"count"`
+}
+
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type NumericStats struct {
+	Min       float64    `json:"min"`
+	Max       float64    `json:"max"`
+	Mean      float64    `json:"mean"`
+	Stddev    float64    `json:"stddev"`
+	Quantiles []Quantile `json:"quantiles"`
+}
+
+// DatetimeStats holds the earliest and latest value in RFC 3339
+type DatetimeStats struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+// ColumnProfile holds the statistics of one column. Numeric stats are only set
+// for integer and float columns, datetime stats for datetime columns, top values
+// for categorical and boolean columns. Histograms of datetime columns are over Unix seconds.
+type ColumnProfile struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	NullCount     int64  `json:"null_count"`
+	DistinctCount int64  `json:"distinct_count"`
+	// Set when there were too many distinct values to count them all
+	DistinctCountIsLowerBound bool           `json:"distinct_count_is_lower_bound"`
+	Numeric                   *NumericStats  `json:"numeric,omitempty"`
+	Datetime                  *DatetimeStats `json:"datetime,omitempty"`
+	TopValues                 []ValueCount   `json:"top_values,omitempty"`
+	Histogram                 []HistogramBin `json:"histogram,omitempty"`
+}
+
+type columnState struct {
+	nulls    int64
+	distinct map[string]int64
+	capped   bool
+	// Numeric values, or Unix seconds for datetime columns
+	values []float64
+}
+
+// Profile reads a CSV file with the given columns and computes the profile of every column
+func Profile(r io.Reader, columns []schema.Column) ([]ColumnProfile, error) {
+	reader := schema.NewReader(r)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) != len(columns) {
+		return nil, errors.New("the file does not match the schema")
+	}
+
+	states := make([]columnState, len(columns))
+	for i := range states {
+		states[i].distinct = make(map[string]int64)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i, value := range record {
+			s := &states[i]
+			if schema.IsMissing(value) {
+				s.nulls++
+				continue
+			}
+
+			if _, ok := s.distinct[value]; ok || len(s.distinct) < maxDistinct {
+				s.distinct[value]++
+			} else {
+				s.capped = true
+			}
+
+			switch columns[i].Type {
+			case schema.TypeInteger, schema.TypeFloat:
+				if f, ok := schema.ParseFloat(value); ok {
+					s.values = append(s.values, f)
+				}
+			case schema.TypeDatetime:
+				if t, ok := columns[i].ParseDatetime(value); ok {
+					s.values = append(s.values, float64(t.Unix()))
+				}
+			}
+		}
+	}
+
+	profiles := make([]ColumnProfile, len(columns))
+	for i, column := range columns {
+		s := &states[i]
+		p := ColumnProfile{
+			Name:                      column.Name,
+			Type:                      column.Type,
+			NullCount:                 s.nulls,
+			DistinctCount:             int64(len(s.distinct)),
+			DistinctCountIsLowerBound: s.capped,
+		}
+
+		switch column.Type {
+		case schema.TypeInteger, schema.TypeFloat:
+			if len(s.values) > 0 {
+				p.Numeric = numericStats(s.values)
+				p.Histogram = histogram(s.values, p.Numeric.Min, p.Numeric.Max)
+			}
+		case schema.TypeDatetime:
+			if len(s.values) > 0 {
+				lowest, highest := minMax(s.values)
+				p.Datetime = &DatetimeStats{
+					Min: time.Unix(int64(lowest), 0).UTC().Format(time.RFC3339),
+					Max: time.Unix(int64(highest), 0).UTC().Format(time.RFC3339),
+				}
+				p.Histogram = histogram(s.values, lowest, highest)
+			}
+		case schema.TypeCategorical, schema.TypeBoolean:
+			p.TopValues = topValues(s.distinct, TopValues)
+		}
+
+		profiles[i] = p
+	}
+
+	return profiles, nil
+}
+
+func minMax(values []float64) (float64, float64) {
+	lowest, highest := values[0], values[0]
+	for _, v := range values[1:] {
+		lowest = math.Min(lowest, v)
+		highest = math.Max(highest, v)
+	}
+	return lowest, highest
+}
+
+func numericStats(values []float64) *NumericStats {
+	// Welford's algorithm, to keep the variance accurate for large values
+	var mean, m2 float64
+	for i, v := range values {
+		delta := v - mean
+		mean += delta / float64(i+1)
+		m2 += delta * (v - mean)
+	}
+
+	stats := &NumericStats{Mean: mean}
+	if len(values) > 1 {
+		stats.Stddev = math.Sqrt(m2 / float64(len(values)-1))
+	}
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	stats.Min = sorted[0]
+	stats.Max = sorted[len(sorted)-1]
+
+	for _, q := range Quantiles {
+		stats.Quantiles = append(stats.Quantiles, Quantile{Quantile: q, Value: quantile(sorted, q)})
+	}
+	return stats
+}
+
+// Linear interpolation between the closest ranks
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(pos-float64(lower))
+}
+
+// Equal-width bins from lowest to highest. The last bin includes the highest value.
+// All values end up in a single bin if they are equal.
+func histogram(values []float64, lowest float64, highest float64) []HistogramBin {
+	if lowest == highest {
+		return []HistogramBin{{Lower: lowest, Upper: highest, Count: int64(len(values))}}
+	}
+
+	width := (highest - lowest) / HistogramBins
+	bins := make([]HistogramBin, HistogramBins)
+	for i := range bins {
+		bins[i].Lower = lowest + float64(i)*width
+		bins[i].Upper = lowest + float64(i+1)*width
+	}
+	bins[HistogramBins-1].Upper = highest
+
+	for _, v := range values {
+		i := min(int((v-lowest)/width), HistogramBins-1)
+		bins[i].Count++
+	}
+	return bins
+}
+
+// The k most frequent values, ties broken by value
+func topValues(counts map[string]int64, k int) []ValueCount {
+	var values []ValueCount
+	for value, count := range counts {
+		values = append(values, ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if len(values) > k {
+		values = values[:k]
+	}
+	return values
+}
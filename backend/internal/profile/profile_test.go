@@ -0,0 +1,94 @@
+package profile
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+func TestProfile(t *testing.T) {
+	csv := "n,x,day,color,note\n" +
+		"1,1.5,2024-01-01,red,a\n" +
+		"2,,2024-01-03,red,b\n" +
+		"3,4.5,NA,blue,c\n" +
+		"4,7.5,2024-01-02,red,\n"
+	columns := []schema.Column{
+		{Name: "n", Type: schema.TypeInteger},
+		{Name: "x", Type: schema.TypeFloat},
+		{Name: "day", Type: schema.TypeDatetime},
+		{Name: "color", Type: schema.TypeCategorical},
+		{Name: "note", Type: schema.TypeText},
+	}
+
+	profiles, err := Profile(strings.NewReader(csv), columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != len(columns) {
+		t.Fatalf("%d profiles", len(profiles))
+	}
+
+	n := profiles[0]
+	if n.NullCount != 0 || n.DistinctCount != 4 || n.Numeric == nil {
+		t.Fatalf("n: %+v", n)
+	}
+	if n.Numeric.Min != 1 || n.Numeric.Max != 4 || n.Numeric.Mean != 2.5 {
+		t.Errorf("n: %+v", n.Numeric)
+	}
+	wantQuantiles := []Quantile{{0.05, 1.15}, {0.25, 1.75}, {0.5, 2.5}, {0.75, 3.25}, {0.95, 3.85}}
+	for i, q := range n.Numeric.Quantiles {
+		if q.Quantile != wantQuantiles[i].Quantile || math.Abs(q.Value-wantQuantiles[i].Value) > 1e-9 {
+			t.Errorf("quantile %v = %v, want %v", q.Quantile, q.Value, wantQuantiles[i].Value)
+		}
+	}
+	var counted int64
+	for _, bin := range n.Histogram {
+		counted += bin.Count
+	}
+	if len(n.Histogram) != HistogramBins || counted != 4 || n.Histogram[HistogramBins-1].Upper != 4 {
+		t.Errorf("n histogram: %+v", n.Histogram)
+	}
+
+	x := profiles[1]
+	if x.NullCount != 1 || x.Numeric == nil || x.Numeric.Mean != 4.5 || x.Numeric.Stddev != 3 {
+		t.Errorf("x: %+v %+v", x, x.Numeric)
+	}
+
+	day := profiles[2]
+	want := &DatetimeStats{Min: "2024-01-01T00:00:00Z", Max: "2024-01-03T00:00:00Z"}
+	if day.NullCount != 1 || !reflect.DeepEqual(day.Datetime, want) || day.Numeric != nil {
+		t.Errorf("day: %+v %+v", day, day.Datetime)
+	}
+
+	color := profiles[3]
+	wantTop := []ValueCount{{"red", 3}, {"blue", 1}}
+	if !reflect.DeepEqual(color.TopValues, wantTop) || color.Numeric != nil || color.Histogram != nil {
+		t.Errorf("color: %+v", color)
+	}
+
+	note := profiles[4]
+	if note.NullCount != 1 || note.DistinctCount != 3 || note.TopValues != nil || note.Histogram != nil {
+		t.Errorf("note: %+v", note)
+	}
+}
+
+func TestProfileEqualValues(t *testing.T) {
+	profiles, err := Profile(strings.NewReader("n\n5\n5\n5\n"), []schema.Column{{Name: "n", Type: schema.TypeInteger}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HistogramBin{{Lower: 5, Upper: 5, Count: 3}}
+	if p := profiles[0]; !reflect.DeepEqual(p.Histogram, want) || p.Numeric.Stddev != 0 {
+		t.Errorf("%+v %+v", p.Histogram, p.Numeric)
+	}
+}
+
+func TestProfileSchemaMismatch(t *testing.T) {
+	_, err := Profile(strings.NewReader("a,b\n1,2\n"), []schema.Column{{Name: "a", Type: schema.TypeInteger}})
+	if err == nil {
+		t.Error("a file with more columns than the schema was profiled")
+	}
+}
@@ -0,0 +1,247 @@
+// Package query selects, groups and aggregates the rows of a dataset
+package query
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+// Operators of predicates
+const (
+	OpEqual          = "eq"
+	OpNotEqual       = "ne"
+	OpLess           = "lt"
+	OpLessOrEqual    = "le"
+	OpGreater        = "gt"
+	OpGreaterOrEqual = "ge"
+	OpIn             = "in"
+	OpNotIn          = "not_in"
+	// Case-insensitive substring of the text of the value
+	OpContains  = "contains"
+	OpIsNull    = "is_null"
+	OpIsNotNull = "is_not_null"
+)
+
+var Operators = []string{OpEqual, OpNotEqual, OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual, OpIn, OpNotIn, OpContains, OpIsNull, OpIsNotNull}
+
+// Predicate is a condition on the value of a column. Values are compared as
+// the type of the column: numerically, chronologically or as text.
+// Missing values only match is_null, values that don't have the type of their
+// column only match is_not_null and contains.
+type Predicate struct {
+	Column   string
+	Operator string
+	// One value, any number for in and not_in, none for is_null and is_not_null
+	Values []string
+}
+
+// Filter is either a predicate or a combination of filters
+type Filter struct {
+	Predicate *Predicate
+	// Rows that match every filter
+	All []Filter
+	// Rows that match at least one filter
+	Any []Filter
+}
+
+// Matcher reports whether a row of the dataset matches a filter
+type Matcher func(record []string) bool
+
+// Compile checks a filter against the columns of a dataset.
+// A nil filter matches every row.
+func Compile(filter *Filter, columns []schema.Column) (Matcher, error) {
+	if filter == nil {
+		return func([]string) bool { return true }, nil
+	}
+
+	switch {
+	case filter.Predicate != nil && filter.All == nil && filter.Any == nil:
+		return compilePredicate(*filter.Predicate, columns)
+	case filter.Predicate == nil && filter.All != nil && filter.Any == nil:
+		matchers, err := compileAll(filter.All, columns)
+		if err != nil {
+			return nil, err
+		}
+		return func(record []string) bool {
+			for _, m := range matchers {
+				if !m(record) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case filter.Predicate == nil && filter.All == nil && filter.Any != nil:
+		matchers, err := compileAll(filter.Any, columns)
+		if err != nil {
+			return nil, err
+		}
+		return func(record []string) bool {
+			for _, m := range matchers {
+				if m(record) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, errors.New("a filter must be either a predicate, all or any")
+}
+
+func compileAll(filters []Filter, columns []schema.Column) ([]Matcher, error) {
+	if len(filters) == 0 {
+		return nil, errors.New("all and any need at least one filter")
+	}
+	matchers := make([]Matcher, len(filters))
+	for i := range filters {
+		m, err := Compile(&filters[i], columns)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return matchers, nil
+}
+
+func compilePredicate(p Predicate, columns []schema.Column) (Matcher, error) {
+	i := slices.IndexFunc(columns, func(c schema.Column) bool { return c.Name == p.Column })
+	if i < 0 {
+		return nil, fmt.Errorf("column %q does not exist", p.Column)
+	}
+	switch p.Operator {
+	case OpIsNull, OpIsNotNull:
+		if len(p.Values) != 0 {
+			return nil, fmt.Errorf("%s takes no values", p.Operator)
+		}
+		isNull := p.Operator == OpIsNull
+		return func(record []string) bool { return schema.IsMissing(record[i]) == isNull }, nil
+	case OpIn, OpNotIn:
+		if len(p.Values) == 0 {
+			return nil, fmt.Errorf("%s needs at least one value", p.Operator)
+		}
+	case OpEqual, OpNotEqual, OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual, OpContains:
+		if len(p.Values) != 1 {
+			return nil, fmt.Errorf("%s needs exactly one value", p.Operator)
+		}
+	default:
+		return nil, fmt.Errorf("unknown operator %q, expected one of %s", p.Operator, strings.Join(Operators, ", "))
+	}
+
+	if p.Operator == OpContains {
+		substring := strings.ToLower(p.Values[0])
+		return func(record []string) bool {
+			return !schema.IsMissing(record[i]) && strings.Contains(strings.ToLower(record[i]), substring)
+		}, nil
+	}
+
+	operands := make([]comparer, len(p.Values))
+	for k, v := range p.Values {
+		c, err := newComparer(columns[i], v)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %w", p.Column, err)
+		}
+		operands[k] = c
+	}
+
+	// Compare the value to the operand, the result is the sign of the comparison
+	test := map[string]func(int) bool{
+		OpEqual:          func(c int) bool { return c == 0 },
+		OpNotEqual:       func(c int) bool { return c != 0 },
+		OpLess:           func(c int) bool { return c < 0 },
+		OpLessOrEqual:    func(c int) bool { return c <= 0 },
+		OpGreater:        func(c int) bool { return c > 0 },
+		OpGreaterOrEqual: func(c int) bool { return c >= 0 },
+	}[p.Operator]
+
+	return func(record []string) bool {
+		value := record[i]
+		if schema.IsMissing(value) {
+			return false
+		}
+		if test != nil {
+			c, ok := operands[0](value)
+			return ok && test(c)
+		}
+
+		in := false
+		for _, compare := range operands {
+			c, ok := compare(value)
+			if !ok {
+				return false
+			}
+			if c == 0 {
+				in = true
+				break
+			}
+		}
+		return in == (p.Operator == OpIn)
+	}, nil
+}
+
+// A comparer compares a value to an operand. Returns false if the value
+// doesn't have the type of the column.
+type comparer func(value string) (int, bool)
+
+func newComparer(column schema.Column, operand string) (comparer, error) {
+	switch column.Type {
+	case schema.TypeInteger, schema.TypeFloat:
+		// Integers are compared exactly, as large ones don't fit in a float
+		if n, ok := schema.ParseInteger(operand); ok && column.Type == schema.TypeInteger {
+			return func(value string) (int, bool) {
+				if v, ok := schema.ParseInteger(value); ok {
+					return cmp.Compare(v, n), true
+				}
+				v, ok := schema.ParseFloat(value)
+				return cmp.Compare(v, float64(n)), ok
+			}, nil
+		}
+		f, ok := schema.ParseFloat(operand)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", operand)
+		}
+		return func(value string) (int, bool) {
+			v, ok := schema.ParseFloat(value)
+			return cmp.Compare(v, f), ok
+		}, nil
+	case schema.TypeBoolean:
+		b, ok := schema.ParseBoolean(operand)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a boolean", operand)
+		}
+		return func(value string) (int, bool) {
+			v, ok := schema.ParseBoolean(value)
+			return compareBooleans(v, b), ok
+		}, nil
+	case schema.TypeDatetime:
+		// Operands can also be written like values without a date format
+		t, ok := column.ParseDatetime(operand)
+		if !ok {
+			t, ok = schema.ParseDatetime(operand)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%q is not a date or time", operand)
+		}
+		return func(value string) (int, bool) {
+			v, ok := column.ParseDatetime(value)
+			return v.Compare(t), ok
+		}, nil
+	}
+	return func(value string) (int, bool) {
+		return strings.Compare(value, operand), true
+	}, nil
+}
+
+// False is less than true
+func compareBooleans(a bool, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
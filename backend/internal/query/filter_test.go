@@ -0,0 +1,132 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+var filterColumns = []schema.Column{
+	{Name: "name", Type: schema.TypeText},
+	{Name: "count", Type: schema.TypeInteger},
+	{Name: "ratio", Type: schema.TypeFloat},
+	{Name: "paid", Type: schema.TypeBoolean},
+	{Name: "at", Type: schema.TypeDatetime},
+	{Name: "day", Type: schema.TypeDatetime, DateFormat: "%d.%m.%Y"},
+}
+
+func pred(column string, operator string, values ...string) *Filter {
+	return &Filter{Predicate: &Predicate{Column: column, Operator: operator, Values: values}}
+}
+
+func TestCompile(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter *Filter
+		record []string
+		want   bool
+	}{
+		{"nil filter", nil, []string{"", "", "", "", "", ""}, true},
+
+		{"eq text", pred("name", OpEqual, "Oslo"), []string{"Oslo", "", "", "", "", ""}, true},
+		{"eq text is case-sensitive", pred("name", OpEqual, "oslo"), []string{"Oslo", "", "", "", "", ""}, false},
+		{"ne text", pred("name", OpNotEqual, "Oslo"), []string{"Bergen", "", "", "", "", ""}, true},
+		{"lt text", pred("name", OpLess, "B"), []string{"Aarhus", "", "", "", "", ""}, true},
+		{"contains ignores case", pred("name", OpContains, "SL"), []string{"Oslo", "", "", "", "", ""}, true},
+		{"contains", pred("name", OpContains, "x"), []string{"Oslo", "", "", "", "", ""}, false},
+		{"contains a missing value", pred("name", OpContains, "n"), []string{"NA", "", "", "", "", ""}, false},
+
+		{"eq integer ignores leading zeros", pred("count", OpEqual, "7"), []string{"", "007", "", "", "", ""}, true},
+		{"gt integer", pred("count", OpGreater, "7"), []string{"", "10", "", "", "", ""}, true},
+		{"le integer", pred("count", OpLessOrEqual, "7"), []string{"", "7", "", "", "", ""}, true},
+		{"ge integer", pred("count", OpGreaterOrEqual, "7"), []string{"", "6", "", "", "", ""}, false},
+		{"large integers are compared exactly", pred("count", OpLess, "9007199254740993"), []string{"", "9007199254740992", "", "", "", ""}, true},
+		{"integer with a float operand", pred("count", OpGreater, "6.5"), []string{"", "7", "", "", "", ""}, true},
+		{"float in an integer column", pred("count", OpLess, "7"), []string{"", "6.5", "", "", "", ""}, true},
+		{"text in an integer column", pred("count", OpNotEqual, "7"), []string{"", "many", "", "", "", ""}, false},
+		{"missing integer", pred("count", OpNotEqual, "7"), []string{"", "", "", "", "", ""}, false},
+		{"lt float", pred("ratio", OpLess, "1e-1"), []string{"", "", "0.05", "", "", ""}, true},
+		{"eq float", pred("ratio", OpEqual, "0.5"), []string{"", "", ".50", "", "", ""}, true},
+
+		{"eq boolean", pred("paid", OpEqual, "yes"), []string{"", "", "", "TRUE", "", ""}, true},
+		{"false is less than true", pred("paid", OpLess, "true"), []string{"", "", "", "false", "", ""}, true},
+
+		{"gt datetime", pred("at", OpGreater, "2024-01-01"), []string{"", "", "", "", "2024-01-01T00:00:01Z", ""}, true},
+		{"eq datetime in another layout", pred("at", OpEqual, "2024/01/02"), []string{"", "", "", "", "2024-01-02", ""}, true},
+		{"date format", pred("day", OpLess, "02.01.2024"), []string{"", "", "", "", "", "31.12.2023"}, true},
+		{"date format with an operand without it", pred("day", OpEqual, "2024-01-02"), []string{"", "", "", "", "", "02.01.2024"}, true},
+		{"value without the date format", pred("day", OpNotEqual, "02.01.2024"), []string{"", "", "", "", "", "2024-01-03"}, false},
+
+		{"in", pred("name", OpIn, "Bergen", "Oslo"), []string{"Oslo", "", "", "", "", ""}, true},
+		{"in without a match", pred("name", OpIn, "Bergen", "Oslo"), []string{"Bern", "", "", "", "", ""}, false},
+		{"in numbers", pred("count", OpIn, "1", "2"), []string{"", "2.0", "", "", "", ""}, true},
+		{"not in", pred("count", OpNotIn, "1", "2"), []string{"", "3", "", "", "", ""}, true},
+		{"not in a missing value", pred("count", OpNotIn, "1", "2"), []string{"", "null", "", "", "", ""}, false},
+		{"not in text in an integer column", pred("count", OpNotIn, "1"), []string{"", "x", "", "", "", ""}, false},
+
+		{"is_null", pred("ratio", OpIsNull), []string{"", "", " N/A ", "", "", ""}, true},
+		{"is_null with a value", pred("ratio", OpIsNull), []string{"", "", "0", "", "", ""}, false},
+		{"is_not_null with text in a float column", pred("ratio", OpIsNotNull), []string{"", "", "x", "", "", ""}, true},
+
+		{"all", &Filter{All: []Filter{*pred("count", OpGreater, "1"), *pred("name", OpEqual, "Oslo")}},
+			[]string{"Oslo", "2", "", "", "", ""}, true},
+		{"all with a filter that doesn't match", &Filter{All: []Filter{*pred("count", OpGreater, "1"), *pred("name", OpEqual, "Oslo")}},
+			[]string{"Oslo", "1", "", "", "", ""}, false},
+		{"any", &Filter{Any: []Filter{*pred("count", OpGreater, "1"), *pred("name", OpEqual, "Oslo")}},
+			[]string{"Oslo", "1", "", "", "", ""}, true},
+		{"any without a match", &Filter{Any: []Filter{*pred("count", OpGreater, "1"), *pred("name", OpEqual, "Oslo")}},
+			[]string{"Bergen", "1", "", "", "", ""}, false},
+		{"nested", &Filter{Any: []Filter{
+			*pred("paid", OpIsNull),
+			{All: []Filter{*pred("paid", OpEqual, "true"), *pred("ratio", OpGreaterOrEqual, "0.5")}},
+		}}, []string{"", "", "0.75", "yes", "", ""}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, err := Compile(tt.filter, filterColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matches(tt.record); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter *Filter
+		err    string
+	}{
+		{"empty filter", &Filter{}, "a filter must be either a predicate, all or any"},
+		{"predicate and all", &Filter{Predicate: &Predicate{Column: "name", Operator: OpIsNull}, All: []Filter{*pred("name", OpIsNull)}},
+			"a filter must be either a predicate, all or any"},
+		{"all and any", &Filter{All: []Filter{*pred("name", OpIsNull)}, Any: []Filter{*pred("name", OpIsNull)}},
+			"a filter must be either a predicate, all or any"},
+		{"empty all", &Filter{All: []Filter{}}, "all and any need at least one filter"},
+		{"empty any", &Filter{Any: []Filter{}}, "all and any need at least one filter"},
+		{"invalid nested filter", &Filter{Any: []Filter{*pred("name", OpIsNull), *pred("country", OpIsNull)}}, `column "country" does not exist`},
+		{"unknown column", pred("Name", OpEqual, "Oslo"), `column "Name" does not exist`},
+		{"unknown operator", pred("name", "like", "O%"), `unknown operator "like"`},
+		{"upper case operator", pred("name", "EQ", "Oslo"), `unknown operator "EQ"`},
+		{"is_null with a value", pred("name", OpIsNull, ""), "is_null takes no values"},
+		{"in without values", pred("name", OpIn), "in needs at least one value"},
+		{"not_in without values", pred("name", OpNotIn), "not_in needs at least one value"},
+		{"eq without a value", pred("name", OpEqual), "eq needs exactly one value"},
+		{"contains with two values", pred("name", OpContains, "a", "b"), "contains needs exactly one value"},
+		{"text for an integer", pred("count", OpGreater, "ten"), `column "count": "ten" is not a number`},
+		{"inf for a float", pred("ratio", OpLess, "inf"), `column "ratio": "inf" is not a number`},
+		{"text for a boolean", pred("paid", OpEqual, "maybe"), `column "paid": "maybe" is not a boolean`},
+		{"text for a datetime", pred("at", OpLess, "yesterday"), `column "at": "yesterday" is not a date or time`},
+		{"one of the values of in", pred("count", OpIn, "1", "two"), `column "count": "two" is not a number`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.filter, filterColumns)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
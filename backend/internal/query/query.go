@@ -0,0 +1,490 @@
+package query
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+// Aggregate functions
+const (
+	// Rows, or present values of a column
+	FuncCount  = "count"
+	FuncSum    = "sum"
+	FuncAvg    = "avg"
+	FuncMin    = "min"
+	FuncMax    = "max"
+	FuncMedian = "median"
+)
+
+var Functions = []string{FuncCount, FuncSum, FuncAvg, FuncMin, FuncMax, FuncMedian}
+
+// Groups are kept in memory, queries with more of them fail
+const maxGroups = 1 << 20
+
+var ErrTooManyGroups = fmt.Errorf("the query has more than %d groups", maxGroups)
+
+// Aggregate computes a value from the rows of a group. Missing values and
+// values that don't have the type of their column are left out.
+type Aggregate struct {
+	Function string
+	// Empty for counting rows
+	Column string
+	// Name of the result column, function_column by default
+	Alias string
+}
+
+// Order sorts the result by one of its columns. Nulls are last.
+type Order struct {
+	Column     string
+	Descending bool
+}
+
+// Query selects rows of a dataset. Without group-by and aggregates the result
+// has the projected columns of the matching rows, otherwise a row for every
+// group with the group-by columns and the aggregates.
+type Query struct {
+	// All columns if empty. Can't be set with group-by or aggregates.
+	Columns    []string
+	Filter     *Filter
+	GroupBy    []string
+	Aggregates []Aggregate
+	OrderBy    []Order
+	Limit      int
+}
+
+// Result of a query. Values are nil for nulls, or int64, float64, bool,
+// time.Time or string. Values that don't have the type of their column are
+// text.
+type Result struct {
+	Columns []schema.Column
+	Rows    [][]any
+	// Whether there were more rows than the limit
+	Truncated bool
+}
+
+type aggregate struct {
+	function string
+	// Index of the column, -1 for counting rows
+	column int
+}
+
+// Accumulates the values of an aggregate for a group
+type accumulator struct {
+	count    int64
+	intSum   int64
+	floatSum float64
+	// Integer sums that don't fit in an int64 are floats
+	overflow bool
+	min, max any
+	values   []float64
+}
+
+type group struct {
+	values       []any
+	accumulators []accumulator
+}
+
+// Executor runs a query on the rows of a dataset that are added to it one by
+// one, so that datasets don't have to be kept in memory. Only the groups and
+// the rows that can still be in the result are.
+type Executor struct {
+	columns []schema.Column
+	matches Matcher
+	limit   int
+	result  []schema.Column
+	// Indices of the result columns to sort by, and the direction
+	order      []int
+	descending []bool
+
+	// Projected columns of the dataset, or the group-by columns
+	indices    []int
+	aggregates []aggregate
+	grouped    bool
+	groups     map[string]*group
+	// Groups in the order they were first seen
+	groupOrder []*group
+	rows       [][]any
+	truncated  bool
+	key        strings.Builder
+}
+
+// NewExecutor checks a query against the columns of a dataset
+func NewExecutor(q Query, columns []schema.Column) (*Executor, error) {
+	if q.Limit < 1 {
+		return nil, errors.New("the limit must be at least 1")
+	}
+	matches, err := Compile(q.Filter, columns)
+	if err != nil {
+		return nil, err
+	}
+	e := &Executor{
+		columns: columns,
+		matches: matches,
+		limit:   q.Limit,
+		grouped: len(q.GroupBy) > 0 || len(q.Aggregates) > 0,
+		groups:  make(map[string]*group),
+	}
+
+	names := q.Columns
+	if e.grouped {
+		if len(q.Columns) > 0 {
+			return nil, errors.New("columns can't be set with group-by or aggregates, the result has the group-by columns and the aggregates")
+		}
+		names = q.GroupBy
+	}
+	if e.indices, err = indicesOf(columns, names); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 && !e.grouped {
+		e.indices = make([]int, len(columns))
+		for i := range columns {
+			e.indices[i] = i
+		}
+	}
+	for _, i := range e.indices {
+		e.result = append(e.result, columns[i])
+	}
+
+	for _, a := range q.Aggregates {
+		agg, column, err := compileAggregate(a, columns)
+		if err != nil {
+			return nil, err
+		}
+		e.aggregates = append(e.aggregates, agg)
+		e.result = append(e.result, column)
+	}
+	for i, c := range e.result {
+		if slices.ContainsFunc(e.result[:i], func(other schema.Column) bool { return other.Name == c.Name }) {
+			return nil, fmt.Errorf("the result has more than one column %q, set an alias", c.Name)
+		}
+	}
+
+	for _, o := range q.OrderBy {
+		i := slices.IndexFunc(e.result, func(c schema.Column) bool { return c.Name == o.Column })
+		if i < 0 {
+			return nil, fmt.Errorf("can't order by %q, it is not a column of the result", o.Column)
+		}
+		e.order = append(e.order, i)
+		e.descending = append(e.descending, o.Descending)
+	}
+	return e, nil
+}
+
+func indicesOf(columns []schema.Column, names []string) ([]int, error) {
+	var indices []int
+	for _, name := range names {
+		i := slices.IndexFunc(columns, func(c schema.Column) bool { return c.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("column %q does not exist", name)
+		}
+		if slices.Contains(indices, i) {
+			return nil, fmt.Errorf("column %q is given more than once", name)
+		}
+		indices = append(indices, i)
+	}
+	return indices, nil
+}
+
+// Check an aggregate and return the column of its result
+func compileAggregate(a Aggregate, columns []schema.Column) (aggregate, schema.Column, error) {
+	if !slices.Contains(Functions, a.Function) {
+		return aggregate{}, schema.Column{}, fmt.Errorf("unknown aggregate %q, expected one of %s", a.Function, strings.Join(Functions, ", "))
+	}
+
+	agg := aggregate{function: a.Function, column: -1}
+	result := schema.Column{Name: a.Alias, Type: schema.TypeInteger}
+	if a.Column == "" {
+		if a.Function != FuncCount {
+			return aggregate{}, schema.Column{}, fmt.Errorf("%s needs a column", a.Function)
+		}
+		if result.Name == "" {
+			result.Name = FuncCount
+		}
+		return agg, result, nil
+	}
+
+	agg.column = slices.IndexFunc(columns, func(c schema.Column) bool { return c.Name == a.Column })
+	if agg.column < 0 {
+		return aggregate{}, schema.Column{}, fmt.Errorf("column %q does not exist", a.Column)
+	}
+	column := columns[agg.column]
+	if result.Name == "" {
+		result.Name = a.Function + "_" + column.Name
+	}
+
+	numeric := column.Type == schema.TypeInteger || column.Type == schema.TypeFloat
+	switch a.Function {
+	case FuncSum, FuncAvg, FuncMedian:
+		if !numeric {
+			return aggregate{}, schema.Column{}, fmt.Errorf("%s needs a column of integers or floats, %q is %s", a.Function, column.Name, column.Type)
+		}
+		result.Type = schema.TypeFloat
+		if a.Function == FuncSum {
+			result.Type = column.Type
+		}
+		result.Unit = column.Unit
+	case FuncMin, FuncMax:
+		result.Type = column.Type
+		result.DateFormat = column.DateFormat
+		result.Unit = column.Unit
+	}
+	return agg, result, nil
+}
+
+// Done reports whether later rows can't change the result
+func (e *Executor) Done() bool {
+	return !e.grouped && len(e.order) == 0 && e.truncated
+}
+
+// Add a row of the dataset. Rows that don't match the filter are skipped.
+func (e *Executor) Add(record []string) error {
+	if !e.matches(record) {
+		return nil
+	}
+	if !e.grouped {
+		e.addRow(record)
+		return nil
+	}
+
+	// Groups are told apart by their typed values, so that 1 and 01 are
+	// in the same group of an integer column
+	e.key.Reset()
+	values := make([]any, len(e.indices))
+	for k, i := range e.indices {
+		values[k], _ = e.columns[i].ParseValue(record[i])
+		fmt.Fprintf(&e.key, "%T:%v\x00", values[k], values[k])
+	}
+	g, ok := e.groups[e.key.String()]
+	if !ok {
+		if len(e.groups) == maxGroups {
+			return ErrTooManyGroups
+		}
+		g = &group{values: values, accumulators: make([]accumulator, len(e.aggregates))}
+		e.groups[e.key.String()] = g
+		e.groupOrder = append(e.groupOrder, g)
+	}
+
+	for k, a := range e.aggregates {
+		acc := &g.accumulators[k]
+		if a.column < 0 {
+			acc.count++
+			continue
+		}
+		value, ok := e.columns[a.column].ParseValue(record[a.column])
+		if value == nil || !ok {
+			continue
+		}
+		acc.add(a.function, value)
+	}
+	return nil
+}
+
+// Rows are kept until there are twice as many as the limit, then the ones
+// that are sorted after the limit are dropped
+func (e *Executor) addRow(record []string) {
+	if e.truncated && len(e.order) == 0 {
+		return
+	}
+	row := make([]any, len(e.indices))
+	for k, i := range e.indices {
+		row[k], _ = e.columns[i].ParseValue(record[i])
+	}
+	e.rows = append(e.rows, row)
+
+	if len(e.rows) > e.limit && len(e.order) == 0 {
+		e.rows = e.rows[:e.limit]
+		e.truncated = true
+	}
+	if len(e.rows) >= 2*e.limit {
+		e.sort(e.rows)
+		e.rows = e.rows[:e.limit]
+		e.truncated = true
+	}
+}
+
+func (acc *accumulator) add(function string, value any) {
+	acc.count++
+	switch function {
+	case FuncSum, FuncAvg, FuncMedian:
+		f := toFloat(value)
+		acc.floatSum += f
+		if n, ok := value.(int64); ok && !acc.overflow {
+			sum := acc.intSum + n
+			if n > 0 && sum < acc.intSum || n < 0 && sum > acc.intSum {
+				acc.overflow = true
+			}
+			acc.intSum = sum
+		}
+		if function == FuncMedian {
+			acc.values = append(acc.values, f)
+		}
+	case FuncMin:
+		if acc.min == nil || compareValues(value, acc.min) < 0 {
+			acc.min = value
+		}
+	case FuncMax:
+		if acc.max == nil || compareValues(value, acc.max) > 0 {
+			acc.max = value
+		}
+	}
+}
+
+func (acc *accumulator) result(function string, columnType string) any {
+	if function == FuncCount {
+		return acc.count
+	}
+	if acc.count == 0 {
+		return nil
+	}
+	switch function {
+	case FuncSum:
+		if columnType == schema.TypeInteger && !acc.overflow {
+			return acc.intSum
+		}
+		return acc.floatSum
+	case FuncAvg:
+		return acc.floatSum / float64(acc.count)
+	case FuncMedian:
+		slices.Sort(acc.values)
+		middle := len(acc.values) / 2
+		if len(acc.values)%2 == 1 {
+			return acc.values[middle]
+		}
+		return (acc.values[middle-1] + acc.values[middle]) / 2
+	case FuncMin:
+		return acc.min
+	case FuncMax:
+		return acc.max
+	}
+	return nil
+}
+
+func toFloat(value any) float64 {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return math.NaN()
+}
+
+// Result returns the rows of the result
+func (e *Executor) Result() Result {
+	rows := e.rows
+	if e.grouped {
+		rows = make([][]any, 0, len(e.groupOrder))
+		for _, g := range e.groupOrder {
+			row := slices.Clone(g.values)
+			for k, a := range e.aggregates {
+				var columnType string
+				if a.column >= 0 {
+					columnType = e.columns[a.column].Type
+				}
+				row = append(row, g.accumulators[k].result(a.function, columnType))
+			}
+			rows = append(rows, row)
+		}
+		// Aggregates without group-by have a row even if no row matches
+		if len(rows) == 0 && len(e.indices) == 0 {
+			row := make([]any, len(e.aggregates))
+			for k, a := range e.aggregates {
+				row[k] = (&accumulator{}).result(a.function, "")
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	e.sort(rows)
+	truncated := e.truncated
+	if len(rows) > e.limit {
+		rows = rows[:e.limit]
+		truncated = true
+	}
+	return Result{Columns: e.result, Rows: rows, Truncated: truncated}
+}
+
+// Sort rows by the order of the query. Rows that are equal stay in the order
+// they were added.
+func (e *Executor) sort(rows [][]any) {
+	if len(e.order) == 0 {
+		return
+	}
+	slices.SortStableFunc(rows, func(a, b []any) int {
+		for k, i := range e.order {
+			// Nulls are last in either direction
+			switch {
+			case a[i] == nil && b[i] == nil:
+				continue
+			case a[i] == nil:
+				return 1
+			case b[i] == nil:
+				return -1
+			}
+			c := compareValues(a[i], b[i])
+			if e.descending[k] {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+// Values of the same type are compared by value, numbers with each other.
+// Values of different types, such as text in a numeric column, are ordered
+// by their type.
+func compareValues(a, b any) int {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return cmp.Compare(x, y)
+		case float64:
+			return cmp.Compare(float64(x), y)
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return cmp.Compare(x, float64(y))
+		case float64:
+			return cmp.Compare(x, y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return compareBooleans(x, y)
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	}
+	return cmp.Compare(typeRank(a), typeRank(b))
+}
+
+func typeRank(value any) int {
+	switch value.(type) {
+	case int64, float64:
+		return 0
+	case bool:
+		return 1
+	case time.Time:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
@@ -0,0 +1,331 @@
+package query
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"chart-organizer/backend/internal/schema"
+)
+
+var salesColumns = []schema.Column{
+	{Name: "region", Type: schema.TypeCategorical},
+	{Name: "units", Type: schema.TypeInteger},
+	{Name: "price", Type: schema.TypeFloat, Unit: "EUR"},
+	{Name: "paid", Type: schema.TypeBoolean},
+	{Name: "day", Type: schema.TypeDatetime, DateFormat: "%d.%m.%Y"},
+}
+
+var sales = [][]string{
+	{"north", "3", "2.5", "yes", "01.03.2024"},
+	{"south", "1", "4", "no", "02.03.2024"},
+	{"north", "02", "", "no", "NA"},
+	{"east", "", "1.5", "", "03.03.2024"},
+	{"south", "many", "x", "maybe", "soon"},
+	{"", "5", "3", "yes", "29.02.2024"},
+}
+
+func date(day int) time.Time {
+	return time.Date(2024, 3, day, 0, 0, 0, 0, time.UTC)
+}
+
+func run(t *testing.T, q Query, columns []schema.Column, records [][]string) Result {
+	t.Helper()
+	e, err := NewExecutor(q, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if e.Done() {
+			break
+		}
+		if err := e.Add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e.Result()
+}
+
+func columnNames(columns []schema.Column) []string {
+	var names []string
+	for _, c := range columns {
+		names = append(names, c.Name+" "+c.Type)
+	}
+	return names
+}
+
+func TestExecutor(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		query     Query
+		columns   []string
+		rows      [][]any
+		truncated bool
+	}{
+		{"every column", Query{Limit: 2},
+			[]string{"region categorical", "units integer", "price float", "paid boolean", "day datetime"},
+			[][]any{{"north", int64(3), 2.5, true, date(1)}, {"south", int64(1), 4.0, false, date(2)}}, true},
+		{"projection", Query{Columns: []string{"day", "units"}, Limit: 10},
+			[]string{"day datetime", "units integer"},
+			[][]any{{date(1), int64(3)}, {date(2), int64(1)}, {nil, int64(2)}, {date(3), nil}, {"soon", "many"}, {time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), int64(5)}}, false},
+		{"filter", Query{Columns: []string{"region"}, Filter: pred("paid", OpEqual, "true"), Limit: 10},
+			[]string{"region categorical"}, [][]any{{"north"}, {nil}}, false},
+		{"exactly the limit", Query{Columns: []string{"region"}, Filter: pred("paid", OpEqual, "true"), Limit: 2},
+			[]string{"region categorical"}, [][]any{{"north"}, {nil}}, false},
+		{"order with nulls last", Query{Columns: []string{"units"}, OrderBy: []Order{{Column: "units"}}, Limit: 10},
+			[]string{"units integer"}, [][]any{{int64(1)}, {int64(2)}, {int64(3)}, {int64(5)}, {"many"}, {nil}}, false},
+		{"descending order with nulls last", Query{Columns: []string{"units"}, OrderBy: []Order{{Column: "units", Descending: true}}, Limit: 10},
+			[]string{"units integer"}, [][]any{{"many"}, {int64(5)}, {int64(3)}, {int64(2)}, {int64(1)}, {nil}}, false},
+		{"order by two columns", Query{
+			Columns: []string{"region", "paid", "units"},
+			OrderBy: []Order{{Column: "region"}, {Column: "paid", Descending: true}},
+			Limit:   10,
+		}, []string{"region categorical", "paid boolean", "units integer"},
+			[][]any{{"east", nil, nil}, {"north", true, int64(3)}, {"north", false, int64(2)}, {"south", "maybe", "many"}, {"south", false, int64(1)}, {nil, true, int64(5)}}, false},
+		// Rows that are equal stay in the order they were added
+		{"order with equal rows", Query{Columns: []string{"region", "units"}, OrderBy: []Order{{Column: "region", Descending: true}}, Limit: 10},
+			[]string{"region categorical", "units integer"},
+			[][]any{{"south", int64(1)}, {"south", "many"}, {"north", int64(3)}, {"north", int64(2)}, {"east", nil}, {nil, int64(5)}}, false},
+		{"order and limit", Query{Columns: []string{"day"}, OrderBy: []Order{{Column: "day"}}, Limit: 2},
+			[]string{"day datetime"}, [][]any{{time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)}, {date(1)}}, true},
+
+		{"group by", Query{GroupBy: []string{"region"}, Aggregates: []Aggregate{{Function: FuncCount}}, Limit: 10},
+			[]string{"region categorical", "count integer"},
+			[][]any{{"north", int64(2)}, {"south", int64(2)}, {"east", int64(1)}, {nil, int64(1)}}, false},
+		{"group by without aggregates", Query{GroupBy: []string{"paid"}, Limit: 10},
+			[]string{"paid boolean"}, [][]any{{true}, {false}, {nil}, {"maybe"}}, false},
+		{"groups of typed values", Query{GroupBy: []string{"units"}, Aggregates: []Aggregate{{Function: FuncCount}}, Limit: 10},
+			[]string{"units integer", "count integer"},
+			[][]any{{int64(3), int64(1)}, {int64(1), int64(1)}, {int64(2), int64(1)}, {nil, int64(1)}, {"many", int64(1)}, {int64(5), int64(1)}}, false},
+		{"aggregates of a column", Query{
+			GroupBy: []string{"paid"},
+			Aggregates: []Aggregate{
+				{Function: FuncCount, Column: "price"},
+				{Function: FuncSum, Column: "units"},
+				{Function: FuncAvg, Column: "price"},
+				{Function: FuncMin, Column: "day"},
+				{Function: FuncMax, Column: "units", Alias: "most"},
+				{Function: FuncMedian, Column: "price"},
+			},
+			Filter: pred("paid", OpIsNotNull),
+			Limit:  10,
+		}, []string{"paid boolean", "count_price integer", "sum_units integer", "avg_price float", "min_day datetime", "most integer", "median_price float"},
+			[][]any{
+				{true, int64(2), int64(8), 2.75, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), int64(5), 2.75},
+				{false, int64(1), int64(3), 4.0, date(2), int64(2), 4.0},
+				// Values that don't have the type of their column are left out
+				{"maybe", int64(0), nil, nil, nil, nil, nil},
+			}, false},
+		{"aggregates without group-by", Query{
+			Aggregates: []Aggregate{{Function: FuncCount}, {Function: FuncMedian, Column: "units"}, {Function: FuncMin, Column: "region"}},
+			Limit:      10,
+		}, []string{"count integer", "median_units float", "min_region categorical"},
+			[][]any{{int64(6), 2.5, "east"}}, false},
+		{"aggregates without matching rows", Query{
+			Aggregates: []Aggregate{{Function: FuncCount}, {Function: FuncSum, Column: "price"}, {Function: FuncMax, Column: "paid"}},
+			Filter:     pred("region", OpEqual, "west"),
+			Limit:      10,
+		}, []string{"count integer", "sum_price float", "max_paid boolean"},
+			[][]any{{int64(0), nil, nil}}, false},
+		{"group by without matching rows", Query{
+			GroupBy:    []string{"region"},
+			Aggregates: []Aggregate{{Function: FuncCount}},
+			Filter:     pred("region", OpEqual, "west"),
+			Limit:      10,
+		}, []string{"region categorical", "count integer"}, [][]any{}, false},
+		{"order by an aggregate", Query{
+			GroupBy:    []string{"region"},
+			Aggregates: []Aggregate{{Function: FuncSum, Column: "price", Alias: "revenue"}},
+			OrderBy:    []Order{{Column: "revenue", Descending: true}},
+			Limit:      2,
+		}, []string{"region categorical", "revenue float"},
+			[][]any{{"south", 4.0}, {nil, 3.0}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			result := run(t, tt.query, salesColumns, sales)
+			if got := columnNames(result.Columns); !reflect.DeepEqual(got, tt.columns) {
+				t.Errorf("columns %q, want %q", got, tt.columns)
+			}
+			if !reflect.DeepEqual(result.Rows, tt.rows) {
+				t.Errorf("rows\n%v\nwant\n%v", result.Rows, tt.rows)
+			}
+			if result.Truncated != tt.truncated {
+				t.Errorf("truncated %t, want %t", result.Truncated, tt.truncated)
+			}
+		})
+	}
+}
+
+// The date format and unit of a column are kept by the aggregates that have
+// values of the column
+func TestExecutorResultColumns(t *testing.T) {
+	result := run(t, Query{
+		Aggregates: []Aggregate{
+			{Function: FuncMin, Column: "day"},
+			{Function: FuncSum, Column: "price"},
+			{Function: FuncCount, Column: "price"},
+		},
+		Limit: 1,
+	}, salesColumns, nil)
+	want := []schema.Column{
+		{Name: "min_day", Type: schema.TypeDatetime, DateFormat: "%d.%m.%Y"},
+		{Name: "sum_price", Type: schema.TypeFloat, Unit: "EUR"},
+		{Name: "count_price", Type: schema.TypeInteger},
+	}
+	if !reflect.DeepEqual(result.Columns, want) {
+		t.Errorf("columns %+v, want %+v", result.Columns, want)
+	}
+}
+
+func TestExecutorSumOverflow(t *testing.T) {
+	columns := []schema.Column{{Name: "n", Type: schema.TypeInteger}}
+	q := Query{Aggregates: []Aggregate{{Function: FuncSum, Column: "n"}}, Limit: 1}
+	for _, tt := range []struct {
+		records [][]string
+		want    any
+	}{
+		{[][]string{{"9223372036854775806"}, {"1"}}, int64(math.MaxInt64)},
+		{[][]string{{"9223372036854775807"}, {"1"}}, 9223372036854775808.0},
+		{[][]string{{"-9223372036854775808"}, {"-1"}}, -9223372036854775809.0},
+		// Values after an overflow don't bring the sum back to an integer
+		{[][]string{{"9223372036854775807"}, {"1"}, {"-1"}}, float64(math.MaxInt64)},
+	} {
+		got := run(t, q, columns, tt.records).Rows[0][0]
+		if got != tt.want {
+			t.Errorf("sum of %v is %v (%T), want %v (%T)", tt.records, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+// Rows after the limit are dropped as they are added, not only at the end
+func TestExecutorKeepsFewRows(t *testing.T) {
+	columns := []schema.Column{{Name: "n", Type: schema.TypeInteger}}
+	records := make([][]string, 1000)
+	for i := range records {
+		records[i] = []string{strconv.Itoa((i * 7919) % 1000)}
+	}
+
+	e, err := NewExecutor(Query{OrderBy: []Order{{Column: "n", Descending: true}}, Limit: 3}, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := e.Add(record); err != nil {
+			t.Fatal(err)
+		}
+		if len(e.rows) >= 2*3 {
+			t.Fatalf("%d rows kept for a limit of 3", len(e.rows))
+		}
+	}
+	if e.Done() {
+		t.Error("an ordered query is done before the last row")
+	}
+	result := e.Result()
+	if want := [][]any{{int64(999)}, {int64(998)}, {int64(997)}}; !reflect.DeepEqual(result.Rows, want) || !result.Truncated {
+		t.Errorf("rows %v, truncated %t, want %v", result.Rows, result.Truncated, want)
+	}
+
+	// Without an order the query is done once there are more rows than the limit
+	e, err = NewExecutor(Query{Limit: 3}, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, record := range records {
+		if e.Done() {
+			if i != 4 {
+				t.Errorf("done after %d rows, want 4", i)
+			}
+			break
+		}
+		if err := e.Add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExecutorTooManyGroups(t *testing.T) {
+	if testing.Short() {
+		t.Skip("adds a million rows")
+	}
+	e, err := NewExecutor(Query{GroupBy: []string{"n"}, Limit: 1}, []schema.Column{{Name: "n", Type: schema.TypeText}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := make([]string, 1)
+	for i := range maxGroups {
+		record[0] = strconv.Itoa(i)
+		if err := e.Add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rows of groups that exist are still added
+	record[0] = "0"
+	if err := e.Add(record); err != nil {
+		t.Fatal(err)
+	}
+	record[0] = "new"
+	if err := e.Add(record); !errors.Is(err, ErrTooManyGroups) {
+		t.Errorf("got %v, want ErrTooManyGroups", err)
+	}
+}
+
+func TestNewExecutorInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		query Query
+		err   string
+	}{
+		{"no limit", Query{}, "the limit must be at least 1"},
+		{"invalid filter", Query{Filter: pred("country", OpIsNull), Limit: 1}, `column "country" does not exist`},
+		{"unknown column", Query{Columns: []string{"country"}, Limit: 1}, `column "country" does not exist`},
+		{"column given twice", Query{Columns: []string{"units", "units"}, Limit: 1}, `column "units" is given more than once`},
+		{"columns and group-by", Query{Columns: []string{"units"}, GroupBy: []string{"region"}, Limit: 1}, "columns can't be set with group-by or aggregates"},
+		{"columns and aggregates", Query{Columns: []string{"units"}, Aggregates: []Aggregate{{Function: FuncCount}}, Limit: 1}, "columns can't be set with group-by or aggregates"},
+		{"unknown group-by column", Query{GroupBy: []string{"country"}, Limit: 1}, `column "country" does not exist`},
+		{"unknown aggregate", Query{Aggregates: []Aggregate{{Function: "mode", Column: "units"}}, Limit: 1}, `unknown aggregate "mode"`},
+		{"sum without a column", Query{Aggregates: []Aggregate{{Function: FuncSum}}, Limit: 1}, "sum needs a column"},
+		{"aggregate of an unknown column", Query{Aggregates: []Aggregate{{Function: FuncMax, Column: "country"}}, Limit: 1}, `column "country" does not exist`},
+		{"sum of text", Query{Aggregates: []Aggregate{{Function: FuncSum, Column: "region"}}, Limit: 1}, `sum needs a column of integers or floats, "region" is categorical`},
+		{"avg of booleans", Query{Aggregates: []Aggregate{{Function: FuncAvg, Column: "paid"}}, Limit: 1}, `avg needs a column of integers or floats, "paid" is boolean`},
+		{"median of dates", Query{Aggregates: []Aggregate{{Function: FuncMedian, Column: "day"}}, Limit: 1}, `median needs a column of integers or floats, "day" is datetime`},
+		{"two aggregates with the same name", Query{Aggregates: []Aggregate{{Function: FuncCount}, {Function: FuncCount}}, Limit: 1}, `the result has more than one column "count"`},
+		{"alias of a group-by column", Query{GroupBy: []string{"region"}, Aggregates: []Aggregate{{Function: FuncCount, Alias: "region"}}, Limit: 1}, `the result has more than one column "region"`},
+		{"order by a column that isn't in the result", Query{Columns: []string{"region"}, OrderBy: []Order{{Column: "units"}}, Limit: 1}, `can't order by "units"`},
+		{"order by the column of an aggregate", Query{Aggregates: []Aggregate{{Function: FuncSum, Column: "units"}}, OrderBy: []Order{{Column: "units"}}, Limit: 1}, `can't order by "units"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewExecutor(tt.query, salesColumns)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	for _, tt := range []struct {
+		a, b any
+		want int
+	}{
+		{int64(1), int64(2), -1},
+		{int64(2), 1.5, 1},
+		{1.5, int64(2), -1},
+		{2.0, int64(2), 0},
+		{false, true, -1},
+		{date(2), date(1), 1},
+		{"a", "b", -1},
+		// Numbers, then booleans, dates and text
+		{"1", int64(2), 1},
+		{true, 3.0, 1},
+		{date(1), "a", -1},
+		{false, date(1), -1},
+	} {
+		if got := compareValues(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareValues(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KeyPrefix is prepended to every generated key so that leaked keys are easy to spot
+const KeyPrefix = "co_"
+
+// displayPrefixLength defines how many characters of a key are kept in clear text
+// so that users can tell their keys apart
+const displayPrefixLength = 8
+
+var (
+	ErrInvalidApiKey  = errors.New("invalid API key")
+	ErrApiKeyNotFound = errors.New("API key not found")
+)
+
+type ApiKey struct {
+	ID         string
+	Name       string
+	Prefix     string
+	Scopes     []string
+	CreatedAt  string
+	ExpiresAt  string
+	LastUsedAt string
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a new API key for the user.
+// An empty expiresAt means that the key never expires.
+// Returns the stored key and the key itself, which can't be recovered later
+// because only its hash is stored.
+func CreateApiKey(db *sql.DB, userId string, name string, scopes []string, expiresAt string) (ApiKey, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ApiKey{}, "", err
+	}
+	key := KeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	apiKey := ApiKey{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Prefix:    key[:len(KeyPrefix)+displayPrefixLength],
+		Scopes:    scopes,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		ExpiresAt: expiresAt,
+	}
+
+	_, err := db.Exec("INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))",
+		apiKey.ID, userId, apiKey.Name, apiKey.Prefix, hashKey(key), strings.Join(scopes, " "), apiKey.CreatedAt, apiKey.ExpiresAt)
+	if err != nil {
+		return ApiKey{}, "", err
+	}
+
+	return apiKey, key, nil
+}
+
+// Look up the owner and the granted scopes of a key.
+// Returns ErrInvalidApiKey if the key is unknown, revoked or expired, or its owner is disabled.
+func Authenticate(db *sql.DB, key string) (string, []string, error) {
+	hash := hashKey(key)
+
+	var id, userId, scopes string
+	var expiresAt sql.NullString
+	err := db.QueryRow("SELECT k.id, k.user_id, k.scopes, k.expires_at FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.key_hash = ? AND k.revoked_at IS NULL AND u.disabled_at IS NULL", hash).
+		Scan(&id, &userId, &scopes, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil, ErrInvalidApiKey
+		}
+		return "", nil, err
+	}
+
+	if expiresAt.Valid {
+		expiry, err := time.Parse(time.RFC3339, expiresAt.String)
+		if err != nil {
+			return "", nil, err
+		}
+		if time.Now().After(expiry) {
+			return "", nil, ErrInvalidApiKey
+		}
+	}
+
+	currentTime := time.Now().Format(time.RFC3339)
+	_, err = db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", currentTime, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return userId, strings.Fields(scopes), nil
+}
+
+// Get the API keys of the user that have not been revoked
+func GetAllApiKeysFromUser(db *sql.DB, userId string) ([]ApiKey, error) {
+	rows, err := db.Query("SELECT id, name, prefix, scopes, created_at, IFNULL(expires_at, ''), IFNULL(last_used_at, '') FROM api_keys WHERE user_id = ? AND revoked_at IS NULL ORDER BY created_at",
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apiKeys []ApiKey
+	for rows.Next() {
+		var k ApiKey
+		var scopes string
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		k.Scopes = strings.Fields(scopes)
+		apiKeys = append(apiKeys, k)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+// Revoke an API key of the user. Returns ErrApiKeyNotFound if the user has no such key.
+func RevokeApiKey(db *sql.DB, userId string, id string) error {
+	currentTime := time.Now().Format(time.RFC3339)
+	result, err := db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL", currentTime, id, userId)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrApiKeyNotFound
+	}
+
+	return nil
+}
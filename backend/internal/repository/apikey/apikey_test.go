@@ -0,0 +1,122 @@
+package apikey
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	"chart-organizer/backend/internal/repository/repositorytest"
+)
+
+func newTestUser(t *testing.T, db *sql.DB, username string) string {
+	t.Helper()
+	if err := authRepo.AddNewUser(db, username, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := authRepo.GetUserID(db, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestAuthenticate(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	userID := newTestUser(t, db, "alice")
+	apiKey, key, err := CreateApiKey(db, userID, "script", []string{"datasets:read", "dashboards:read"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, KeyPrefix) || !strings.HasPrefix(key, apiKey.Prefix) || len(apiKey.Prefix) != len(KeyPrefix)+displayPrefixLength {
+		t.Errorf("key %q with prefix %q", key, apiKey.Prefix)
+	}
+
+	gotUserID, scopes, err := Authenticate(db, key)
+	if err != nil || gotUserID != userID || !reflect.DeepEqual(scopes, []string{"datasets:read", "dashboards:read"}) {
+		t.Errorf("Authenticate = %q, %q, %v", gotUserID, scopes, err)
+	}
+	keys, err := GetAllApiKeysFromUser(db, userID)
+	if err != nil || len(keys) != 1 || keys[0].LastUsedAt == "" {
+		t.Errorf("keys %+v, %v after the key was used", keys, err)
+	}
+
+	// Only the hash of the key is stored
+	var stored string
+	if err := db.QueryRow("SELECT key_hash FROM api_keys WHERE id = ?", apiKey.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != hashKey(key) || strings.Contains(stored, key[len(apiKey.Prefix):]) {
+		t.Errorf("stored %q", stored)
+	}
+}
+
+func TestAuthenticateRefused(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	userID := newTestUser(t, db, "alice")
+
+	_, revoked, err := CreateApiKey(db, userID, "revoked", []string{"datasets:read"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := GetAllApiKeysFromUser(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeApiKey(db, userID, keys[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	_, expired, err := CreateApiKey(db, userID, "expired", []string{"datasets:read"}, time.Now().Add(-time.Second).Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		key  string
+	}{
+		{"revoked", revoked},
+		{"expired", expired},
+		{"unknown", KeyPrefix + "unknown"},
+		{"empty", ""},
+	} {
+		if _, _, err := Authenticate(db, tt.key); !errors.Is(err, ErrInvalidApiKey) {
+			t.Errorf("%s: got %v, want ErrInvalidApiKey", tt.name, err)
+		}
+	}
+}
+
+// Users can only see and revoke their own keys
+func TestRevokeApiKeyOfAnotherUser(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+	apiKey, key, err := CreateApiKey(db, alice, "script", []string{"datasets:write"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeApiKey(db, bob, apiKey.ID); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Errorf("got %v, want ErrApiKeyNotFound", err)
+	}
+	if keys, err := GetAllApiKeysFromUser(db, bob); err != nil || len(keys) != 0 {
+		t.Errorf("keys of bob %+v, %v", keys, err)
+	}
+	if _, _, err := Authenticate(db, key); err != nil {
+		t.Errorf("the key was revoked by another user: %v", err)
+	}
+
+	if err := RevokeApiKey(db, alice, apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Revoking twice finds no key to revoke
+	if err := RevokeApiKey(db, alice, apiKey.ID); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Errorf("revoked again: got %v, want ErrApiKeyNotFound", err)
+	}
+	if keys, err := GetAllApiKeysFromUser(db, alice); err != nil || len(keys) != 0 {
+		t.Errorf("revoked keys are listed: %+v, %v", keys, err)
+	}
+}
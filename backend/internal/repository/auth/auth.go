@@ -2,6 +2,8 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,6 +12,13 @@ import (
 
 const cost = 10
 
+// ErrUsernameTaken is returned when another user already has the username, in any letter case
+var ErrUsernameTaken = errors.New("username is already taken")
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
 func AddNewUser(db *sql.DB, username string, password string) error {
 	// Generate a UUID4 for the user ID
 	userID := uuid.New().String()
@@ -23,11 +32,25 @@ func AddNewUser(db *sql.DB, username string, password string) error {
 	// Get the current time
 	currentTime := time.Now().Format(time.RFC3339)
 
-	// Try to add the user to the table
-	_, err = db.Exec("INSERT INTO users (id, username, password_hash, created_at) VALUES (?, ?, ?, ?)", userID, username, string(hashedPassword), currentTime)
+	// Try to add the user to the table.
+	// Usernames differing only in case are refused even where the unique index
+	// couldn't be created because of older duplicates.
+	result, err := db.Exec(`INSERT INTO users (id, username, password_hash, created_at)
+		SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM users WHERE username = ? COLLATE NOCASE)`,
+		userID, username, string(hashedPassword), currentTime, username)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrUsernameTaken
+		}
+		return err
+	}
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if affected == 0 {
+		return ErrUsernameTaken
+	}
 
 	return nil
 }
@@ -56,4 +79,219 @@ func GetUserID(db *sql.DB, username string) (string, error) {
 	var userID string
 	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
 	return userID, err
-}
\ No newline at end of file
+}
+
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type User struct {
+	ID        string
+	Username  string
+	CreatedAt string
+	Role      string
+	Disabled  bool
+}
+
+const userColumns = "id, username, created_at, role, disabled_at IS NOT NULL"
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.CreatedAt, &user.Role, &user.Disabled)
+	return user, err
+}
+
+func GetUser(db *sql.DB, userID string) (User, error) {
+	return scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+}
+
+// Search users by username, ordered by username.
+// An empty query matches every user.
+func SearchUsers(db *sql.DB, query string, limit int, offset int) ([]User, error) {
+	rows, err := db.Query("SELECT "+userColumns+" FROM users WHERE username LIKE '%' || ? || '%' ESCAPE '\\' ORDER BY username LIMIT ? OFFSET ?",
+		escapeLike(query), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "%", "\\%")
+	return strings.ReplaceAll(s, "_", "\\_")
+}
+
+func SetRole(db *sql.DB, userID string, role string) error {
+	_, err := db.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID)
+	return err
+}
+
+// Make the users with the given usernames administrators, e.g. to bootstrap the first admin
+func PromoteToAdmin(db *sql.DB, usernames []string) error {
+	for _, username := range usernames {
+		_, err := db.Exec("UPDATE users SET role = ? WHERE username = ?", RoleAdmin, username)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SetDisabled(db *sql.DB, userID string, disabled bool) error {
+	var disabledAt any
+	if disabled {
+		disabledAt = time.Now().Format(time.RFC3339)
+	}
+	_, err := db.Exec("UPDATE users SET disabled_at = ? WHERE id = ?", disabledAt, userID)
+	return err
+}
+
+func CheckPassword(db *sql.DB, userID string, password string) (bool, error) {
+	var passwordHash string
+	err := db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	if err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Users created through an identity provider have no password until they set one
+func HasPassword(db *sql.DB, userID string) (bool, error) {
+	var hasPassword bool
+	err := db.QueryRow("SELECT password_hash != '' FROM users WHERE id = ?", userID).Scan(&hasPassword)
+	return hasPassword, err
+}
+
+func UpdatePassword(db *sql.DB, userID string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hashedPassword), userID)
+	return err
+}
+
+// Delete the user together with their sessions, API keys, linked identities and second factor.
+// Datasets and dashboards must be removed in the same transaction beforehand,
+// see dataset.DeleteAllDatasetsFromUser.
+func DeleteUser(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec("DELETE FROM used_refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id = ?)", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM api_keys WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM user_identities WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM organization_members WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	return err
+}
+
+// Get the user linked to a subject of an identity provider
+func GetUserIDByIdentity(db *sql.DB, issuer string, subject string) (string, error) {
+	var userID string
+	err := db.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&userID)
+	return userID, err
+}
+
+// Create a user that logs in through an identity provider and link it to the subject.
+// The user has no password and gets the first of the usernames that isn't taken,
+// ErrUsernameTaken is returned if every one is.
+// Returns the user ID and the username that was picked.
+func AddNewExternalUser(db *sql.DB, usernames []string, issuer string, subject string) (string, string, error) {
+	userID := uuid.New().String()
+	currentTime := time.Now().Format(time.RFC3339)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	username := ""
+	for _, candidate := range usernames {
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = ? COLLATE NOCASE)", candidate).Scan(&exists)
+		if err != nil {
+			return "", "", err
+		}
+		if !exists {
+			username = candidate
+			break
+		}
+	}
+	if username == "" {
+		return "", "", ErrUsernameTaken
+	}
+
+	_, err = tx.Exec("INSERT INTO users (id, username, password_hash, created_at) VALUES (?, ?, '', ?)", userID, username, currentTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)", issuer, subject, userID, currentTime)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", err
+	}
+
+	return userID, username, nil
+}
@@ -1,86 +1,330 @@
 package dataset
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-)
 
-func getDatasetStoragePath() string {
-	if path := os.Getenv("DATASET_STORAGE_PATH"); path != "" {
-		return path
-	}
-	return "./storage/datasets"
-}
+	"chart-organizer/backend/internal/profile"
+	"chart-organizer/backend/internal/repository/organization"
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
+)
 
 // Add a new dataset into our database.
 // First, an ID and timestamp is generated.
-// Then, add the file bytes into our dataset storage.
-// Dataset storage is in `datasetStorageFilePath`
-// The file name when stored should be the generated id + ".csv"
-// Finally, insert the dataset into our SQL database. Refer to init.go for the schema
-func AddNewDataset(db *sql.DB, userId string, name string, file []byte) (string, error) {
+// Then, add the file bytes into our dataset storage under the key of its first version.
+// Finally, insert the dataset and its inferred schema into our SQL database. Refer to init.go for the schema
+// An empty organizationId makes the dataset personal to the user.
+func AddNewDataset(db *sql.DB, store storage.Storage, userId string, organizationId string, name string, file []byte, datasetSchema schema.Schema) (string, error) {
+	checksum := sha256.Sum256(file)
+	return addNewDataset(db, store, userId, organizationId, name, bytes.NewReader(file), hex.EncodeToString(checksum[:]), datasetSchema, int64(len(file)))
+}
+
+func addNewDataset(db *sql.DB, store storage.Storage, userId string, organizationId string, name string, file io.Reader, checksum string, datasetSchema schema.Schema, size int64) (string, error) {
 	// Generate a UUID4 for the dataset ID
 	id := uuid.New().String()
 
+	key := datasetFileKey(id, 1)
+	if err := store.Put(key, file, size); err != nil {
+		return "", err
+	}
+
+	err := insertDataset(db, id, userId, organizationId, name, checksum, datasetSchema, size)
+	if err != nil {
+		store.Delete(key)
+		return "", err
+	}
+
+	return id, nil
+}
+
+// The first version of a dataset is stored as <id>.csv, like datasets uploaded
+// before versioning, later versions as <id>.v<version>.csv
+func datasetFileKey(id string, version int64) string {
+	if version <= 1 {
+		return id + ".csv"
+	}
+	return fmt.Sprintf("%s.v%d.csv", id, version)
+}
+
+// Create a local temporary file for a file that is still being uploaded.
+// It becomes a dataset with AddNewDatasetFromFile or a version with
+// AddDatasetVersionFromFile, and has to be removed by the caller.
+func CreateUploadFile() (*os.File, error) {
+	storagePath := storage.LocalPath()
+	if err := os.MkdirAll(storagePath, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(storagePath, uploadFilePattern)
+}
+
+const uploadFilePattern = "upload-*.tmp"
+
+// Remove the temporary files of uploads that were interrupted by a restart
+func RemoveUploadFiles() error {
+	paths, err := filepath.Glob(filepath.Join(storage.LocalPath(), uploadFilePattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add a new dataset from a completely uploaded file, see CreateUploadFile
+func AddNewDatasetFromFile(db *sql.DB, store storage.Storage, userId string, organizationId string, name string, uploadPath string, checksum string, datasetSchema schema.Schema, size int64) (string, error) {
+	file, err := os.Open(uploadPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return addNewDataset(db, store, userId, organizationId, name, file, checksum, datasetSchema, size)
+}
+
+// Insert the dataset and its inferred schema, once its file is stored
+func insertDataset(db *sql.DB, id string, userId string, organizationId string, name string, checksum string, datasetSchema schema.Schema, size int64) error {
 	// Get the current time
 	currentTime := time.Now().Format(time.RFC3339)
 
-	// Get storage path
-	storagePath := getDatasetStoragePath()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO datasets (id, user_id, name, created_at, organization_id, sha256, version) VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, 1)",
+		id, userId, name, currentTime, organizationId, checksum)
+	if err != nil {
+		return err
+	}
 
-	// Create the storage directory if it doesn't exist
-	err := os.MkdirAll(storagePath, 0755)
+	_, err = tx.Exec("INSERT INTO dataset_versions (dataset_id, version, user_id, sha256, created_at) VALUES (?, 1, ?, ?, ?)",
+		id, userId, checksum, currentTime)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	err = saveSchema(tx, id, 1, datasetSchema, size)
+	if err != nil {
+		return err
 	}
 
-	// Create the file path with the generated ID + ".csv"
-	fileName := id + ".csv"
-	filePath := filepath.Join(storagePath, fileName)
+	return tx.Commit()
+}
 
-	// Write the file bytes to storage
-	err = os.WriteFile(filePath, file, 0644)
+// Store the schema of a version. The dataset is only updated if it is the current version.
+func saveSchema(tx *sql.Tx, id string, version int64, datasetSchema schema.Schema, size int64) error {
+	_, err := tx.Exec("UPDATE dataset_versions SET row_count = ?, size_bytes = ? WHERE dataset_id = ? AND version = ?",
+		datasetSchema.RowCount, size, id, version)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	// Insert the dataset into our SQL database
-	_, err = db.Exec("INSERT INTO datasets (id, user_id, name, created_at) VALUES (?, ?, ?, ?)", id, userId, name, currentTime)
+	_, err = tx.Exec("UPDATE datasets SET row_count = ?, size_bytes = ? WHERE id = ? AND version = ?", datasetSchema.RowCount, size, id, version)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return id, nil
+	_, err = tx.Exec("DELETE FROM dataset_columns WHERE dataset_id = ? AND version = ?", id, version)
+	if err != nil {
+		return err
+	}
+
+	// The profile was computed for the old schema
+	_, err = tx.Exec("DELETE FROM dataset_profiles WHERE dataset_id = ? AND version = ?", id, version)
+	if err != nil {
+		return err
+	}
+
+	for i, column := range datasetSchema.Columns {
+		_, err = tx.Exec("INSERT INTO dataset_columns (dataset_id, version, position, name, type, null_count, date_format, unit) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			id, version, i, column.Name, column.Type, column.NullCount, column.DateFormat, column.Unit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func GetDataset(db *sql.DB, userId, id string) ([]byte, error) {
-	var datasetId string
-	err := db.QueryRow("SELECT id FROM datasets WHERE id = ? AND user_id = ?", id, userId).Scan(&datasetId)
+// Store the types, date formats and units of the columns of a version set by
+// the owner. The profile of the version is deleted, as it was computed with
+// the old types.
+func UpdateDatasetColumns(db *sql.DB, id string, version int64, columns []schema.Column) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, column := range columns {
+		result, err := tx.Exec("UPDATE dataset_columns SET type = ?, date_format = ?, unit = ? WHERE dataset_id = ? AND version = ? AND name = ?",
+			column.Type, column.DateFormat, column.Unit, id, version, column.Name)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_profiles WHERE dataset_id = ? AND version = ?", id, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Store the schema of a dataset uploaded before schemas were inferred
+func SaveDatasetSchema(db *sql.DB, id string, version int64, datasetSchema schema.Schema, size int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = saveSchema(tx, id, version, datasetSchema, size); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Store the checksum of a dataset uploaded before checksums were stored
+func SaveDatasetChecksum(db *sql.DB, id string, version int64, checksum string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE dataset_versions SET sha256 = ? WHERE dataset_id = ? AND version = ?", checksum, id, version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE datasets SET sha256 = ? WHERE id = ? AND version = ?", checksum, id, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Open the stored file of a version of a dataset for reading
+func OpenDatasetFile(store storage.Storage, id string, version int64) (io.ReadCloser, error) {
+	return store.Get(datasetFileKey(id, version), 0, -1)
+}
+
+// Open length bytes of the stored file of a version of a dataset from offset on.
+// A negative length reads to the end.
+func OpenDatasetFileRange(store storage.Storage, id string, version int64, offset int64, length int64) (io.ReadCloser, error) {
+	return store.Get(datasetFileKey(id, version), offset, length)
+}
+
+// Get the size of the stored file of a version of a dataset in bytes
+func GetDatasetFileSize(store storage.Storage, id string, version int64) (int64, error) {
+	return store.Stat(datasetFileKey(id, version))
+}
+
+// Read the whole file of a version of a dataset
+func ReadDatasetFile(store storage.Storage, id string, version int64) ([]byte, error) {
+	file, err := OpenDatasetFile(store, id, version)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	storagePath := getDatasetStoragePath()
-	filePath := filepath.Join(storagePath, id+".csv")
-	fileBytes, err := os.ReadFile(filePath)
+	return io.ReadAll(file)
+}
+
+// Get the stored schema of a version of a dataset. The row count is not filled in, see GetDatasetVersion.
+// Returns no columns for datasets uploaded before schemas were inferred.
+func GetDatasetColumns(db *sql.DB, id string, version int64) ([]schema.Column, error) {
+	rows, err := db.Query("SELECT name, type, null_count, date_format, unit FROM dataset_columns WHERE dataset_id = ? AND version = ? ORDER BY position", id, version)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	var columns []schema.Column
+	for rows.Next() {
+		var column schema.Column
+		if err := rows.Scan(&column.Name, &column.Type, &column.NullCount, &column.DateFormat, &column.Unit); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
 
-	return fileBytes, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+// The role of the user for a dataset: the owner of a personal dataset is
+// organization.RoleOwner, members of the organization of a dataset have their
+// membership role.
+const roleColumn = "CASE WHEN d.organization_id IS NULL THEN '" + organization.RoleOwner + "' ELSE m.role END"
+
+// Datasets the user can access, with the membership of the user joined as m.
+// The user ID has to be passed twice.
+const accessibleDatasets = `datasets d
+	LEFT JOIN organization_members m ON m.organization_id = d.organization_id AND m.user_id = ?
+	WHERE ((d.organization_id IS NULL AND d.user_id = ?) OR m.role IS NOT NULL)`
+
+// Get the role of the user for the dataset.
+// Returns sql.ErrNoRows if the dataset does not exist or the user can't access it.
+func GetDatasetRole(db *sql.DB, userId string, id string) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT "+roleColumn+" FROM "+accessibleDatasets+" AND d.id = ?", userId, userId, id).Scan(&role)
+	return role, err
 }
 
 type DatasetInfo struct {
 	ID   string
 	Name string
+	// Empty for personal datasets
+	OrganizationID string
+	RowCount       int64
+	SizeBytes      int64
+	CreatedAt      string
+	// The current version. Row count, size and checksum are those of the current version.
+	Version int64
+	// Hex-encoded SHA-256 of the file, empty for datasets uploaded before checksums were stored
+	Sha256      string
+	Description string
+	// Empty unless the dataset was looked up for a user
+	Role string
 }
 
-func GetAllDatasetsFromUser(db *sql.DB, userId string) ([]DatasetInfo, error) {
-	rows, err := db.Query("SELECT id, name FROM datasets WHERE user_id = ?", userId)
+// Columns scanned into DatasetInfo, to be followed by the role
+const infoColumns = "d.id, d.name, COALESCE(d.organization_id, ''), COALESCE(d.row_count, 0), COALESCE(d.size_bytes, 0), d.created_at, d.version, COALESCE(d.sha256, ''), d.description"
+
+func queryDatasets(db *sql.DB, query string, args ...any) ([]DatasetInfo, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +333,7 @@ func GetAllDatasetsFromUser(db *sql.DB, userId string) ([]DatasetInfo, error) {
 	var datasets []DatasetInfo
 	for rows.Next() {
 		var info DatasetInfo
-		if err := rows.Scan(&info.ID, &info.Name); err != nil {
+		if err := rows.Scan(&info.ID, &info.Name, &info.OrganizationID, &info.RowCount, &info.SizeBytes, &info.CreatedAt, &info.Version, &info.Sha256, &info.Description, &info.Role); err != nil {
 			return nil, err
 		}
 		datasets = append(datasets, info)
@@ -101,3 +345,396 @@ func GetAllDatasetsFromUser(db *sql.DB, userId string) ([]DatasetInfo, error) {
 
 	return datasets, nil
 }
+
+// Get the personal datasets of the user and the datasets of every
+// organization the user is a member of
+func GetAllDatasetsFromUser(db *sql.DB, userId string) ([]DatasetInfo, error) {
+	return queryDatasets(db, "SELECT "+infoColumns+", "+roleColumn+" FROM "+accessibleDatasets+" ORDER BY d.created_at",
+		userId, userId)
+}
+
+// Get a dataset the user can access.
+// Returns sql.ErrNoRows if the dataset does not exist or the user can't access it.
+func GetDatasetInfo(db *sql.DB, userId string, id string) (DatasetInfo, error) {
+	datasets, err := queryDatasets(db, "SELECT "+infoColumns+", "+roleColumn+" FROM "+accessibleDatasets+" AND d.id = ?",
+		userId, userId, id)
+	if err != nil {
+		return DatasetInfo{}, err
+	}
+	if len(datasets) == 0 {
+		return DatasetInfo{}, sql.ErrNoRows
+	}
+	return datasets[0], nil
+}
+
+// Get the datasets the user uploaded, including those uploaded into an organization
+func GetDatasetsUploadedByUser(db *sql.DB, userId string) ([]DatasetInfo, error) {
+	return queryDatasets(db, "SELECT "+infoColumns+", '' FROM datasets d WHERE d.user_id = ? ORDER BY d.created_at", userId)
+}
+
+// Delete the datasets matching the condition along with the dashboards built on them.
+// The stored files are removed once the rows are gone.
+func deleteDatasets(db *sql.DB, store storage.Storage, where string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keys, err := deleteDatasetRows(tx, where, args...)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return DeleteStoredFiles(store, keys)
+}
+
+// Delete the rows of the datasets matching the condition and of the dashboards built on them.
+// Returns the keys of their stored files, to be removed once the transaction is committed.
+func deleteDatasetRows(tx *sql.Tx, where string, args ...any) ([]string, error) {
+	keys, err := getVersionFileKeys(tx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM dashboards WHERE dataset_id IN (SELECT id FROM datasets WHERE "+where+")", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_columns WHERE dataset_id IN (SELECT id FROM datasets WHERE "+where+")", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_profiles WHERE dataset_id IN (SELECT id FROM datasets WHERE "+where+")", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_tags WHERE dataset_id IN (SELECT id FROM datasets WHERE "+where+")", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_versions WHERE dataset_id IN (SELECT id FROM datasets WHERE "+where+")", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM datasets WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Both *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// Get the keys of the files of every version of the datasets matching the condition
+func getVersionFileKeys(db querier, where string, args ...any) ([]string, error) {
+	rows, err := db.Query("SELECT dataset_id, version FROM dataset_versions WHERE dataset_id IN (SELECT id FROM datasets WHERE "+where+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var id string
+		var version int64
+		if err := rows.Scan(&id, &version); err != nil {
+			return nil, err
+		}
+		keys = append(keys, datasetFileKey(id, version))
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Remove stored files, e.g. those of a deleted account
+func DeleteStoredFiles(store storage.Storage, keys []string) error {
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete every personal dataset of the user along with the dashboards built on them,
+// in the transaction that deletes the account. Datasets the user uploaded into an
+// organization stay with the organization.
+// Returns the keys of the stored files, see DeleteStoredFiles.
+func DeleteAllDatasetsFromUser(tx *sql.Tx, userId string) ([]string, error) {
+	return deleteDatasetRows(tx, "user_id = ? AND organization_id IS NULL", userId)
+}
+
+// Delete every dataset of the organization along with the dashboards built on them
+func DeleteAllDatasetsFromOrganization(db *sql.DB, store storage.Storage, organizationId string) error {
+	return deleteDatasets(db, store, "organization_id = ?", organizationId)
+}
+
+// Get the size of the stored files of every version of a dataset in bytes
+func GetDatasetStorageSize(db *sql.DB, store storage.Storage, id string) (int64, error) {
+	keys, err := getVersionFileKeys(db, "id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, key := range keys {
+		size, err := store.Stat(key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// Delete a dataset along with the files of all its versions. Dashboards built on it are
+// deleted as well if cascade is set, otherwise DatasetInUseError is returned
+// while there are any. Returns sql.ErrNoRows if the dataset does not exist.
+func DeleteDataset(db *sql.DB, store storage.Storage, id string, cascade bool) error {
+	keys, err := getVersionFileKeys(db, "id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !cascade {
+		var dashboards int
+		err = tx.QueryRow("SELECT COUNT(*) FROM dashboards WHERE dataset_id = ?", id).Scan(&dashboards)
+		if err != nil {
+			return err
+		}
+		if dashboards > 0 {
+			return &DatasetInUseError{Dashboards: dashboards}
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM dashboards WHERE dataset_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_columns WHERE dataset_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_profiles WHERE dataset_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_tags WHERE dataset_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_versions WHERE dataset_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM datasets WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return DeleteStoredFiles(store, keys)
+}
+
+// DatasetInUseError is returned when deleting a dataset that dashboards are built on
+type DatasetInUseError struct {
+	Dashboards int
+}
+
+func (e *DatasetInUseError) Error() string {
+	return fmt.Sprintf("the dataset is used by %d dashboards", e.Dashboards)
+}
+
+// Rename a dataset. Returns sql.ErrNoRows if the dataset does not exist.
+func RenameDataset(db *sql.DB, id string, name string) error {
+	result, err := db.Exec("UPDATE datasets SET name = ? WHERE id = ?", name, id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Replace the description and tags of a dataset.
+// Returns sql.ErrNoRows if the dataset does not exist.
+func UpdateDatasetMetadata(db *sql.DB, id string, description string, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE datasets SET description = ? WHERE id = ?", description, id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("DELETE FROM dataset_tags WHERE dataset_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT OR IGNORE INTO dataset_tags (dataset_id, tag) VALUES (?, ?)", id, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get the tags of the datasets, sorted, by dataset ID
+func GetDatasetTags(db *sql.DB, ids ...string) (map[string][]string, error) {
+	tags := make(map[string][]string)
+	if len(ids) == 0 {
+		return tags, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+
+	rows, err := db.Query("SELECT dataset_id, tag FROM dataset_tags WHERE dataset_id IN ("+placeholders+") ORDER BY tag", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		tags[id] = append(tags[id], tag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// Status of the profile of a dataset
+const (
+	ProfileStatusPending = "pending"
+	ProfileStatusReady   = "ready"
+	ProfileStatusFailed  = "failed"
+)
+
+type DatasetProfile struct {
+	// The version of the dataset the profile is of
+	Version   int64
+	Status    string
+	Columns   []profile.ColumnProfile
+	Error     string
+	UpdatedAt string
+}
+
+// Mark the profile of a version of a dataset as pending unless it already exists.
+// Returns true if the caller should compute it.
+func StartProfile(db *sql.DB, id string, version int64) (bool, error) {
+	result, err := db.Exec("INSERT OR IGNORE INTO dataset_profiles (dataset_id, version, status, updated_at) VALUES (?, ?, ?, ?)",
+		id, version, ProfileStatusPending, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Store a computed profile. Nothing is stored if the profile was dropped in
+// the meantime, e.g. because the dataset was deleted or the types of its columns changed.
+func SaveProfile(db *sql.DB, id string, version int64, columns []profile.ColumnProfile) error {
+	profileJson, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE dataset_profiles SET status = ?, profile = ?, error = NULL, updated_at = ? WHERE dataset_id = ? AND version = ?",
+		ProfileStatusReady, string(profileJson), time.Now().Format(time.RFC3339), id, version)
+	return err
+}
+
+func FailProfile(db *sql.DB, id string, version int64, message string) error {
+	_, err := db.Exec("UPDATE dataset_profiles SET status = ?, profile = NULL, error = ?, updated_at = ? WHERE dataset_id = ? AND version = ?",
+		ProfileStatusFailed, message, time.Now().Format(time.RFC3339), id, version)
+	return err
+}
+
+// Get the profile of a version of a dataset. Returns sql.ErrNoRows if it was never started.
+func GetProfile(db *sql.DB, id string, version int64) (DatasetProfile, error) {
+	var p DatasetProfile
+	var profileJson, message sql.NullString
+	err := db.QueryRow("SELECT version, status, profile, error, updated_at FROM dataset_profiles WHERE dataset_id = ? AND version = ?", id, version).
+		Scan(&p.Version, &p.Status, &profileJson, &message, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+
+	p.Error = message.String
+	if profileJson.Valid {
+		if err = json.Unmarshal([]byte(profileJson.String), &p.Columns); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
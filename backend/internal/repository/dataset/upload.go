@@ -0,0 +1,372 @@
+package dataset
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"chart-organizer/backend/internal/ingest"
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
+)
+
+// UploadSessionTTL defines how long an upload session is kept after its last chunk
+const UploadSessionTTL = 24 * time.Hour
+
+var ErrUploadSessionNotFound = errors.New("unknown or expired upload session")
+
+type UploadSession struct {
+	ID             string
+	UserID         string
+	OrganizationID string
+	// Set when a new version of the dataset is uploaded
+	DatasetID string
+	Filename  string
+	SizeBytes int64
+	CreatedAt string
+	ExpiresAt string
+	// How the file is read once it is complete
+	ImportOptions ingest.Options
+}
+
+// ByteRange is a range of bytes of a file, End is exclusive
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Every chunk of a session is stored as an object of its own, so that
+// chunks can be received by any replica of the backend
+func uploadChunkKey(sessionId string, r ByteRange) string {
+	return fmt.Sprintf("session-%s.%d-%d.part", sessionId, r.Start, r.End)
+}
+
+// Start a resumable upload of a file of the given size.
+// An empty organizationId uploads into the personal space of the user.
+// A new version of the dataset datasetId is uploaded unless it is empty.
+func CreateUploadSession(db *sql.DB, userId string, organizationId string, datasetId string, filename string, size int64, options ingest.Options) (UploadSession, error) {
+	currentTime := time.Now()
+	session := UploadSession{
+		ID:             uuid.New().String(),
+		UserID:         userId,
+		OrganizationID: organizationId,
+		DatasetID:      datasetId,
+		Filename:       filename,
+		SizeBytes:      size,
+		CreatedAt:      currentTime.Format(time.RFC3339),
+		ExpiresAt:      currentTime.Add(UploadSessionTTL).Format(time.RFC3339),
+		ImportOptions:  options,
+	}
+
+	optionsJson, err := json.Marshal(options)
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	_, err = db.Exec("INSERT INTO upload_sessions (id, user_id, organization_id, dataset_id, filename, size_bytes, created_at, expires_at, import_options) VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?, ?)",
+		session.ID, session.UserID, session.OrganizationID, session.DatasetID, session.Filename, session.SizeBytes, session.CreatedAt, session.ExpiresAt, string(optionsJson))
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	return session, nil
+}
+
+// Get an upload session of the user.
+// Returns ErrUploadSessionNotFound if it belongs to someone else or has expired.
+func GetUploadSession(db *sql.DB, userId string, id string) (UploadSession, error) {
+	var s UploadSession
+	var optionsJson string
+	err := db.QueryRow(`SELECT id, user_id, COALESCE(organization_id, ''), COALESCE(dataset_id, ''), filename, size_bytes, created_at, expires_at, import_options
+		FROM upload_sessions WHERE id = ? AND user_id = ? AND expires_at > ?`,
+		id, userId, time.Now().Format(time.RFC3339)).
+		Scan(&s.ID, &s.UserID, &s.OrganizationID, &s.DatasetID, &s.Filename, &s.SizeBytes, &s.CreatedAt, &s.ExpiresAt, &optionsJson)
+	if err == sql.ErrNoRows {
+		return UploadSession{}, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	err = json.Unmarshal([]byte(optionsJson), &s.ImportOptions)
+	return s, err
+}
+
+// Store a chunk and record it as received. Writing the same chunk
+// again is harmless. The session is kept alive for another UploadSessionTTL.
+// Returns the new expiry time.
+func WriteUploadChunk(db *sql.DB, store storage.Storage, id string, offset int64, data []byte) (string, error) {
+	chunk := ByteRange{Start: offset, End: offset + int64(len(data))}
+	// The chunk must be stored before it is reported as received
+	if err := store.Put(uploadChunkKey(id, chunk), bytes.NewReader(data), int64(len(data))); err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(UploadSessionTTL).Format(time.RFC3339)
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE upload_sessions SET expires_at = ? WHERE id = ?", expiresAt, id)
+	if err != nil {
+		return "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = ErrUploadSessionNotFound
+		}
+		return "", err
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO upload_chunks (session_id, start, end) VALUES (?, ?, ?)", id, chunk.Start, chunk.End)
+	if err != nil {
+		return "", err
+	}
+
+	return expiresAt, tx.Commit()
+}
+
+// Get the received chunks of a session, ordered by their start
+func getUploadChunks(db querier, id string) ([]ByteRange, error) {
+	rows, err := db.Query("SELECT start, end FROM upload_chunks WHERE session_id = ? ORDER BY start, end", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []ByteRange
+	for rows.Next() {
+		var r ByteRange
+		if err := rows.Scan(&r.Start, &r.End); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// Get the received parts of the file, with overlapping and adjacent chunks merged
+func GetReceivedRanges(db *sql.DB, id string) ([]ByteRange, error) {
+	chunks, err := getUploadChunks(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []ByteRange
+	for _, r := range chunks {
+		if last := len(ranges) - 1; last >= 0 && r.Start <= ranges[last].End {
+			ranges[last].End = max(ranges[last].End, r.End)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Put the received chunks of a session together in a temporary file, see
+// CreateUploadFile. Every chunk must have been received.
+func AssembleUploadSession(db *sql.DB, store storage.Storage, session UploadSession) (*os.File, error) {
+	chunks, err := getUploadChunks(db, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := CreateUploadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	var position int64
+	for _, chunk := range chunks {
+		// Chunks that overlap were sent again, their bytes are the same
+		if chunk.End <= position {
+			continue
+		}
+		if chunk.Start > position {
+			err = fmt.Errorf("bytes %d to %d have not been received", position, chunk.Start)
+			break
+		}
+
+		var part io.ReadCloser
+		part, err = store.Get(uploadChunkKey(session.ID, chunk), position-chunk.Start, -1)
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(file, part)
+		part.Close()
+		if err != nil {
+			break
+		}
+		position = chunk.End
+	}
+	if err == nil && position != session.SizeBytes {
+		err = fmt.Errorf("only %d of %d bytes have been received", position, session.SizeBytes)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Turn a completely received upload, assembled with AssembleUploadSession
+// and converted to CSV at uploadPath, into a dataset or a new version of
+// one, and end the session. Returns the dataset ID and version.
+// Returns ErrUploadSessionNotFound if the session has already been committed.
+func CommitUploadSession(db *sql.DB, store storage.Storage, session UploadSession, uploadPath string, checksum string, datasetSchema schema.Schema, size int64) (string, int64, error) {
+	chunks, err := getUploadChunks(db, session.ID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Claim the session first, so that it can only become one dataset
+	if err = deleteUploadSession(db, session.ID); err != nil {
+		return "", 0, err
+	}
+	defer deleteUploadChunks(store, session.ID, chunks)
+
+	id, version := session.DatasetID, int64(1)
+	if id != "" {
+		version, err = AddDatasetVersionFromFile(db, store, session.UserID, id, uploadPath, checksum, datasetSchema, size)
+	} else {
+		id, err = AddNewDatasetFromFile(db, store, session.UserID, session.OrganizationID, session.Filename, uploadPath, checksum, datasetSchema, size)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return id, version, nil
+}
+
+func deleteUploadChunks(store storage.Storage, sessionId string, chunks []ByteRange) error {
+	for _, chunk := range chunks {
+		if err := store.Delete(uploadChunkKey(sessionId, chunk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteUploadSession(db *sql.DB, id string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM upload_chunks WHERE session_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("DELETE FROM upload_sessions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUploadSessionNotFound
+	}
+
+	return tx.Commit()
+}
+
+// Remove upload sessions that haven't received a chunk for UploadSessionTTL, with their chunks
+func RemoveExpiredUploadSessions(db *sql.DB, store storage.Storage) error {
+	return removeUploadSessions(db, store, "expires_at <= ?", time.Now().Format(time.RFC3339))
+}
+
+// Remove the unfinished uploads of the user in the transaction that deletes the account.
+// Returns the keys of the stored chunks, see DeleteStoredFiles.
+func RemoveUploadSessionsFromUser(tx *sql.Tx, userId string) ([]string, error) {
+	rows, err := tx.Query("SELECT c.session_id, c.start, c.end FROM upload_chunks c JOIN upload_sessions s ON s.id = c.session_id WHERE s.user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for rows.Next() {
+		var sessionId string
+		var r ByteRange
+		if err := rows.Scan(&sessionId, &r.Start, &r.End); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, uploadChunkKey(sessionId, r))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM upload_chunks WHERE session_id IN (SELECT id FROM upload_sessions WHERE user_id = ?)", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM upload_sessions WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func removeUploadSessions(db *sql.DB, store storage.Storage, where string, args ...any) error {
+	rows, err := db.Query("SELECT id FROM upload_sessions WHERE "+where, args...)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		chunks, err := getUploadChunks(db, id)
+		if err != nil {
+			return err
+		}
+		if err = deleteUploadSession(db, id); err != nil {
+			if errors.Is(err, ErrUploadSessionNotFound) {
+				continue
+			}
+			return err
+		}
+		if err = deleteUploadChunks(store, id, chunks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
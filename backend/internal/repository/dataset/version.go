@@ -0,0 +1,192 @@
+package dataset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
+)
+
+type DatasetVersion struct {
+	Version int64
+	// The user who uploaded the version, empty if the account has been deleted
+	UserID    string
+	Username  string
+	RowCount  int64
+	SizeBytes int64
+	// Empty for versions uploaded before checksums were stored
+	Sha256    string
+	CreatedAt string
+}
+
+const versionColumns = "v.version, v.user_id, COALESCE(u.username, ''), COALESCE(v.row_count, 0), COALESCE(v.size_bytes, 0), COALESCE(v.sha256, ''), v.created_at"
+
+func scanVersion(row interface{ Scan(...any) error }) (DatasetVersion, error) {
+	var v DatasetVersion
+	err := row.Scan(&v.Version, &v.UserID, &v.Username, &v.RowCount, &v.SizeBytes, &v.Sha256, &v.CreatedAt)
+	return v, err
+}
+
+// Get every version of a dataset, the newest first
+func GetDatasetVersions(db *sql.DB, id string) ([]DatasetVersion, error) {
+	rows, err := db.Query("SELECT "+versionColumns+" FROM dataset_versions v LEFT JOIN users u ON u.id = v.user_id WHERE v.dataset_id = ? AND v.pending = 0 ORDER BY v.version DESC", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []DatasetVersion
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// Get a version of a dataset. Returns sql.ErrNoRows if it does not exist or is still pending.
+func GetDatasetVersion(db *sql.DB, id string, version int64) (DatasetVersion, error) {
+	return scanVersion(db.QueryRow("SELECT "+versionColumns+" FROM dataset_versions v LEFT JOIN users u ON u.id = v.user_id WHERE v.dataset_id = ? AND v.version = ? AND v.pending = 0",
+		id, version))
+}
+
+// Add a new version of a dataset, which becomes its current version.
+// Returns the number of the new version.
+func AddDatasetVersion(db *sql.DB, store storage.Storage, userId string, id string, file []byte, datasetSchema schema.Schema) (int64, error) {
+	checksum := sha256.Sum256(file)
+	return addDatasetVersion(db, store, userId, id, bytes.NewReader(file), hex.EncodeToString(checksum[:]), datasetSchema, int64(len(file)))
+}
+
+// Add a new version of a dataset from a completely uploaded file, see CreateUploadFile.
+// Returns the number of the new version.
+func AddDatasetVersionFromFile(db *sql.DB, store storage.Storage, userId string, id string, uploadPath string, checksum string, datasetSchema schema.Schema, size int64) (int64, error) {
+	file, err := os.Open(uploadPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return addDatasetVersion(db, store, userId, id, file, checksum, datasetSchema, size)
+}
+
+// The version number is reserved before the file is stored, so that the
+// database isn't locked while a large file is transferred. The version is
+// pending until the file is stored.
+func addDatasetVersion(db *sql.DB, store storage.Storage, userId string, id string, file io.Reader, checksum string, datasetSchema schema.Schema, size int64) (int64, error) {
+	version, err := reserveVersion(db, userId, id, checksum)
+	if err != nil {
+		return 0, err
+	}
+
+	key := datasetFileKey(id, version)
+	err = store.Put(key, file, size)
+	if err == nil {
+		err = setCurrentVersion(db, id, version, datasetSchema, size)
+		if err != nil {
+			store.Delete(key)
+		}
+	}
+	if err != nil {
+		db.Exec("DELETE FROM dataset_versions WHERE dataset_id = ? AND version = ?", id, version)
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// Insert the row of the next version of a dataset as pending.
+// Returns sql.ErrNoRows if the dataset does not exist.
+func reserveVersion(db *sql.DB, userId string, id string, checksum string) (int64, error) {
+	currentTime := time.Now().Format(time.RFC3339)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var version int64
+	err = tx.QueryRow("SELECT COALESCE(MAX(v.version), 0) + 1 FROM datasets d LEFT JOIN dataset_versions v ON v.dataset_id = d.id WHERE d.id = ? GROUP BY d.id", id).
+		Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("INSERT INTO dataset_versions (dataset_id, version, user_id, sha256, created_at, pending) VALUES (?, ?, ?, ?, ?, 1)",
+		id, version, userId, checksum, currentTime)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, tx.Commit()
+}
+
+// Make a stored version the current one, with its schema
+func setCurrentVersion(db *sql.DB, id string, version int64, datasetSchema schema.Schema, size int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE dataset_versions SET pending = 0 WHERE dataset_id = ? AND version = ?", id, version)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE datasets SET version = ?, sha256 = (SELECT sha256 FROM dataset_versions WHERE dataset_id = ? AND version = ?) WHERE id = ?",
+		version, id, version, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+
+	if err = saveSchema(tx, id, version, datasetSchema, size); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Make an earlier version the current version of a dataset. Later versions are kept.
+// Returns sql.ErrNoRows if the version does not exist or is still pending.
+func RestoreDatasetVersion(db *sql.DB, id string, version int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE datasets SET version = v.version, row_count = v.row_count, size_bytes = v.size_bytes, sha256 = v.sha256
+		FROM dataset_versions v WHERE v.dataset_id = datasets.id AND datasets.id = ? AND v.version = ? AND v.pending = 0`, id, version)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,138 @@
+package dataset
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"testing"
+
+	"chart-organizer/backend/internal/repository/repositorytest"
+	"chart-organizer/backend/internal/schema"
+	"chart-organizer/backend/internal/storage"
+)
+
+// hookedStorage calls beforePut before every object is stored, and fails
+// to store it if that returns an error
+type hookedStorage struct {
+	storage.Storage
+	beforePut func(key string) error
+}
+
+func (h *hookedStorage) Put(key string, r io.Reader, size int64) error {
+	if h.beforePut != nil {
+		if err := h.beforePut(key); err != nil {
+			return err
+		}
+	}
+	return h.Storage.Put(key, r, size)
+}
+
+func TestVersionIsPendingUntilItsFileIsStored(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	store := &hookedStorage{Storage: storage.NewLocal(t.TempDir())}
+	datasetSchema := schema.Schema{Columns: []schema.Column{{Name: "a", Type: schema.TypeInteger}}, RowCount: 1}
+
+	id, err := AddNewDataset(db, store, "user", "", "data", []byte("a\n1\n"), datasetSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkHidden := func(version int64) {
+		t.Helper()
+		versions, err := GetDatasetVersions(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 || versions[0].Version != 1 {
+			t.Errorf("versions %v, want only version 1", versions)
+		}
+		if _, err := GetDatasetVersion(db, id, version); err != sql.ErrNoRows {
+			t.Errorf("GetDatasetVersion(%d): got %v, want sql.ErrNoRows", version, err)
+		}
+		if err := RestoreDatasetVersion(db, id, version); err != sql.ErrNoRows {
+			t.Errorf("RestoreDatasetVersion(%d): got %v, want sql.ErrNoRows", version, err)
+		}
+	}
+
+	store.beforePut = func(key string) error {
+		checkHidden(2)
+		return nil
+	}
+	version, err := AddDatasetVersion(db, store, "user", id, []byte("a\n2\n"), datasetSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetDatasetVersion(db, id, version); err != nil || v.Version != 2 {
+		t.Fatalf("stored version: got %v, %v", v, err)
+	}
+
+	// A version whose file couldn't be stored never shows up
+	errStorage := errors.New("storage unavailable")
+	store.beforePut = func(key string) error { return errStorage }
+	if _, err := AddDatasetVersion(db, store, "user", id, []byte("a\n3\n"), datasetSchema); !errors.Is(err, errStorage) {
+		t.Fatalf("got %v, want the error of the storage", err)
+	}
+	versions, err := GetDatasetVersions(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 {
+		t.Errorf("versions %v, want 2 and 1", versions)
+	}
+}
+
+// Each version has a profile of its own, which is kept when another version
+// becomes current and dropped when the types of its columns change
+func TestProfilePerVersion(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	store := storage.NewLocal(t.TempDir())
+	datasetSchema := schema.Schema{Columns: []schema.Column{{Name: "a", Type: schema.TypeInteger}}, RowCount: 1}
+
+	id, err := AddNewDataset(db, store, "user", "", "data", []byte("a\n1\n"), datasetSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := func(version int64) (DatasetProfile, error) {
+		t.Helper()
+		if started, err := StartProfile(db, id, version); err != nil || !started {
+			t.Fatalf("StartProfile(%d) = %t, %v", version, started, err)
+		}
+		if err := SaveProfile(db, id, version, nil); err != nil {
+			t.Fatal(err)
+		}
+		return GetProfile(db, id, version)
+	}
+	if p, err := profile(1); err != nil || p.Version != 1 || p.Status != ProfileStatusReady {
+		t.Fatalf("profile of version 1 %+v, %v", p, err)
+	}
+
+	version, err := AddDatasetVersion(db, store, "user", id, []byte("a\n1\n2\n"), datasetSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetProfile(db, id, version); err != sql.ErrNoRows {
+		t.Errorf("profile of the new version: got %v, want sql.ErrNoRows", err)
+	}
+	if p, err := profile(version); err != nil || p.Version != version {
+		t.Errorf("profile of version %d %+v, %v", version, p, err)
+	}
+
+	// Restoring the first version finds its profile again
+	if err := RestoreDatasetVersion(db, id, 1); err != nil {
+		t.Fatal(err)
+	}
+	if started, err := StartProfile(db, id, 1); err != nil || started {
+		t.Errorf("StartProfile of the restored version = %t, %v", started, err)
+	}
+
+	columns := []schema.Column{{Name: "a", Type: schema.TypeFloat}}
+	if err := UpdateDatasetColumns(db, id, 1, columns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetProfile(db, id, 1); err != sql.ErrNoRows {
+		t.Errorf("profile with the old types: got %v, want sql.ErrNoRows", err)
+	}
+	if _, err := GetProfile(db, id, version); err != nil {
+		t.Errorf("profile of another version: %v", err)
+	}
+}
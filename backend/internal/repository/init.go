@@ -4,36 +4,311 @@ import (
 	"database/sql"
 )
 
+// Add a column to a table created before the column existed
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// Columns used to be stored for a single version of a dataset. Adding the
+// version to the primary key needs the table to be rebuilt.
+func addVersionToDatasetColumns(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info('dataset_columns') WHERE name = 'version')").Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE dataset_columns_versioned
+			(dataset_id TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 1,
+			position INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			null_count INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (dataset_id, version, position),
+			FOREIGN KEY (dataset_id) REFERENCES datasets (id)
+			);`,
+		`INSERT INTO dataset_columns_versioned (dataset_id, version, position, name, type, null_count)
+			SELECT dataset_id, 1, position, name, type, null_count FROM dataset_columns`,
+		"DROP TABLE dataset_columns",
+		"ALTER TABLE dataset_columns_versioned RENAME TO dataset_columns",
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Profiles used to be stored for a single version of a dataset. They are
+// computed again on request, so the table is dropped rather than rebuilt.
+func addVersionToDatasetProfiles(db *sql.DB) error {
+	var keyed bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info('dataset_profiles') WHERE name = 'version' AND pk > 0)").Scan(&keyed)
+	if err != nil || keyed {
+		return err
+	}
+
+	_, err = db.Exec("DROP TABLE IF EXISTS dataset_profiles")
+	return err
+}
+
 func InitDatabase(db *sql.DB) error {
 	// Create each table
 	createUserTbl := `CREATE TABLE IF NOT EXISTS users 
 					(id TEXT NOT NULL PRIMARY KEY, 
 					username TEXT NOT NULL UNIQUE,
 					password_hash TEXT NOT NULL,
-					created_at TEXT NOT NULL
+					created_at TEXT NOT NULL,
+					role TEXT NOT NULL DEFAULT 'user',
+					disabled_at TEXT
 					);`
 	_, err := db.Exec(createUserTbl)
 	if err != nil {
 		return err
 	}
 
+	err = addColumnIfMissing(db, "users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "users", "disabled_at", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	// Usernames are unique regardless of case. Databases that already hold
+	// such duplicates are left without the index.
+	var hasDuplicates bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM users GROUP BY username COLLATE NOCASE HAVING COUNT(*) > 1)").Scan(&hasDuplicates)
+	if err != nil {
+		return err
+	}
+	if !hasDuplicates {
+		_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_username_nocase ON users (username COLLATE NOCASE)")
+		if err != nil {
+			return err
+		}
+	}
+
 	createDatasetTbl := `CREATE TABLE IF NOT EXISTS datasets
 						(id TEXT NOT NULL PRIMARY KEY,
 						user_id TEXT NOT NULL,
 						name TEXT NOT NULL,
 						created_at TEXT NOT NULL,
-						FOREIGN KEY (user_id) REFERENCES users (id)
+						organization_id TEXT,
+						row_count INTEGER,
+						size_bytes INTEGER,
+						FOREIGN KEY (user_id) REFERENCES users (id),
+						FOREIGN KEY (organization_id) REFERENCES organizations (id)
 						);`
 	_, err = db.Exec(createDatasetTbl)
 	if err != nil {
 		return err
 	}
 
+	// The schema inferred when a version of the dataset was uploaded, one row per column
+	createDatasetColumnTbl := `CREATE TABLE IF NOT EXISTS dataset_columns
+						(dataset_id TEXT NOT NULL,
+						version INTEGER NOT NULL DEFAULT 1,
+						position INTEGER NOT NULL,
+						name TEXT NOT NULL,
+						type TEXT NOT NULL,
+						null_count INTEGER NOT NULL DEFAULT 0,
+						PRIMARY KEY (dataset_id, version, position),
+						FOREIGN KEY (dataset_id) REFERENCES datasets (id)
+						);`
+	_, err = db.Exec(createDatasetColumnTbl)
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "dataset_columns", "null_count", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = addVersionToDatasetColumns(db)
+	if err != nil {
+		return err
+	}
+
+	// Set by the owner, see UpdateDatasetColumns. Added after the rebuild,
+	// which only knows the columns that existed before versions.
+	err = addColumnIfMissing(db, "dataset_columns", "date_format", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "dataset_columns", "unit", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	// The version of the dataset that is read unless another one is asked for
+	err = addColumnIfMissing(db, "datasets", "version", "INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		return err
+	}
+
+	// Every uploaded version of a dataset. The row count, size and checksum of
+	// the current version are copied into the dataset.
+	createDatasetVersionTbl := `CREATE TABLE IF NOT EXISTS dataset_versions
+						(dataset_id TEXT NOT NULL,
+						version INTEGER NOT NULL,
+						user_id TEXT NOT NULL,
+						row_count INTEGER,
+						size_bytes INTEGER,
+						sha256 TEXT,
+						created_at TEXT NOT NULL,
+						PRIMARY KEY (dataset_id, version),
+						FOREIGN KEY (dataset_id) REFERENCES datasets (id)
+						);`
+	_, err = db.Exec(createDatasetVersionTbl)
+	if err != nil {
+		return err
+	}
+
+	// Set while the file of a version is being stored. Pending versions are
+	// never listed, selected or restored, and one whose upload failed stays
+	// pending if it couldn't be removed.
+	err = addColumnIfMissing(db, "dataset_versions", "pending", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	// Datasets uploaded before schemas were inferred have neither, see dataset.SaveDatasetSchema
+	err = addColumnIfMissing(db, "datasets", "row_count", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "datasets", "size_bytes", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	// Hex-encoded SHA-256 of the stored file, unknown for older datasets
+	err = addColumnIfMissing(db, "datasets", "sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "datasets", "description", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	// Datasets uploaded before versioning become their first version
+	_, err = db.Exec(`INSERT INTO dataset_versions (dataset_id, version, user_id, row_count, size_bytes, sha256, created_at)
+		SELECT id, 1, user_id, row_count, size_bytes, sha256, created_at FROM datasets d
+		WHERE NOT EXISTS (SELECT 1 FROM dataset_versions v WHERE v.dataset_id = d.id)`)
+	if err != nil {
+		return err
+	}
+
+	createDatasetTagTbl := `CREATE TABLE IF NOT EXISTS dataset_tags
+						(dataset_id TEXT NOT NULL,
+						tag TEXT NOT NULL,
+						PRIMARY KEY (dataset_id, tag),
+						FOREIGN KEY (dataset_id) REFERENCES datasets (id)
+						);`
+	_, err = db.Exec(createDatasetTagTbl)
+	if err != nil {
+		return err
+	}
+
+	err = addVersionToDatasetProfiles(db)
+	if err != nil {
+		return err
+	}
+
+	// Column statistics of each version, computed in the background after upload.
+	// Profiles interrupted by a restart are dropped so that they get computed again.
+	createDatasetProfileTbl := `CREATE TABLE IF NOT EXISTS dataset_profiles
+						(dataset_id TEXT NOT NULL,
+						version INTEGER NOT NULL,
+						status TEXT NOT NULL,
+						profile TEXT,
+						error TEXT,
+						updated_at TEXT NOT NULL,
+						PRIMARY KEY (dataset_id, version),
+						FOREIGN KEY (dataset_id) REFERENCES datasets (id)
+						);`
+	_, err = db.Exec(createDatasetProfileTbl)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM dataset_profiles WHERE status = 'pending'")
+	if err != nil {
+		return err
+	}
+
+	// Resumable uploads and the byte ranges received so far, end exclusive
+	createUploadSessionTbl := `CREATE TABLE IF NOT EXISTS upload_sessions
+						(id TEXT NOT NULL PRIMARY KEY,
+						user_id TEXT NOT NULL,
+						organization_id TEXT,
+						filename TEXT NOT NULL,
+						size_bytes INTEGER NOT NULL,
+						created_at TEXT NOT NULL,
+						expires_at TEXT NOT NULL,
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createUploadSessionTbl)
+	if err != nil {
+		return err
+	}
+
+	// Set for uploads of a new version of an existing dataset
+	err = addColumnIfMissing(db, "upload_sessions", "dataset_id", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	// JSON of how the file is read, see ingest.Options
+	err = addColumnIfMissing(db, "upload_sessions", "import_options", "TEXT NOT NULL DEFAULT '{}'")
+	if err != nil {
+		return err
+	}
+
+	createUploadChunkTbl := `CREATE TABLE IF NOT EXISTS upload_chunks
+						(session_id TEXT NOT NULL,
+						start INTEGER NOT NULL,
+						end INTEGER NOT NULL,
+						PRIMARY KEY (session_id, start, end),
+						FOREIGN KEY (session_id) REFERENCES upload_sessions (id)
+						);`
+	_, err = db.Exec(createUploadChunkTbl)
+	if err != nil {
+		return err
+	}
+
 	createDashboardTbl := `CREATE TABLE IF NOT EXISTS dashboards
 						(id TEXT NOT NULL PRIMARY KEY, 
 						dataset_id TEXT NOT NULL,
 						visualizations TEXT NOT NULL,
 						created_at TEXT NOT NULL,
+						user_id TEXT,
+						organization_id TEXT,
 						FOREIGN KEY (dataset_id) REFERENCES datasets (id)
 						);`
 	_, err = db.Exec(createDashboardTbl)
@@ -41,5 +316,194 @@ func InitDatabase(db *sql.DB) error {
 		return err
 	}
 
+	createOrganizationTbl := `CREATE TABLE IF NOT EXISTS organizations
+						(id TEXT NOT NULL PRIMARY KEY,
+						name TEXT NOT NULL,
+						created_at TEXT NOT NULL
+						);`
+	_, err = db.Exec(createOrganizationTbl)
+	if err != nil {
+		return err
+	}
+
+	// Role is "owner", "editor" or "viewer"
+	createOrganizationMemberTbl := `CREATE TABLE IF NOT EXISTS organization_members
+						(organization_id TEXT NOT NULL,
+						user_id TEXT NOT NULL,
+						role TEXT NOT NULL,
+						created_at TEXT NOT NULL,
+						PRIMARY KEY (organization_id, user_id),
+						FOREIGN KEY (organization_id) REFERENCES organizations (id),
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createOrganizationMemberTbl)
+	if err != nil {
+		return err
+	}
+
+	// Datasets without an organization are personal to the user who uploaded them.
+	// Dashboards belong to the organization of their dataset and remember who created them.
+	err = addColumnIfMissing(db, "datasets", "organization_id", "TEXT REFERENCES organizations (id)")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "dashboards", "user_id", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(db, "dashboards", "organization_id", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE dashboards SET user_id = (SELECT user_id FROM datasets WHERE datasets.id = dashboards.dataset_id) WHERE user_id IS NULL")
+	if err != nil {
+		return err
+	}
+
+	// The version of the dataset the dashboard is pinned to, NULL to follow the current version
+	err = addColumnIfMissing(db, "dashboards", "dataset_version", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	// Only hashes of refresh tokens are stored
+	createSessionTbl := `CREATE TABLE IF NOT EXISTS sessions
+						(id TEXT NOT NULL PRIMARY KEY,
+						user_id TEXT NOT NULL,
+						refresh_token_hash TEXT NOT NULL UNIQUE,
+						user_agent TEXT NOT NULL,
+						created_at TEXT NOT NULL,
+						last_used_at TEXT NOT NULL,
+						expires_at TEXT NOT NULL,
+						revoked_at TEXT,
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createSessionTbl)
+	if err != nil {
+		return err
+	}
+
+	// Every refresh token a session has rotated out, so that replaying any
+	// of them can be detected
+	createUsedRefreshTokenTbl := `CREATE TABLE IF NOT EXISTS used_refresh_tokens
+						(token_hash TEXT NOT NULL PRIMARY KEY,
+						session_id TEXT NOT NULL,
+						used_at TEXT NOT NULL,
+						FOREIGN KEY (session_id) REFERENCES sessions (id)
+						);`
+	_, err = db.Exec(createUsedRefreshTokenTbl)
+	if err != nil {
+		return err
+	}
+
+	// Scopes are stored space separated. As with sessions, only key hashes are stored.
+	createApiKeyTbl := `CREATE TABLE IF NOT EXISTS api_keys
+						(id TEXT NOT NULL PRIMARY KEY,
+						user_id TEXT NOT NULL,
+						name TEXT NOT NULL,
+						prefix TEXT NOT NULL,
+						key_hash TEXT NOT NULL UNIQUE,
+						scopes TEXT NOT NULL,
+						created_at TEXT NOT NULL,
+						expires_at TEXT,
+						last_used_at TEXT,
+						revoked_at TEXT,
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createApiKeyTbl)
+	if err != nil {
+		return err
+	}
+
+	// Failed logins per username and per client IP.
+	// Lockouts are kept as a separate history so that they can be reviewed.
+	createLoginFailureTbl := `CREATE TABLE IF NOT EXISTS login_failures
+						(key_type TEXT NOT NULL,
+						key TEXT NOT NULL,
+						failures INTEGER NOT NULL,
+						last_failure_at TEXT NOT NULL,
+						locked_until TEXT,
+						PRIMARY KEY (key_type, key)
+						);`
+	_, err = db.Exec(createLoginFailureTbl)
+	if err != nil {
+		return err
+	}
+
+	createLockoutTbl := `CREATE TABLE IF NOT EXISTS lockouts
+						(id TEXT NOT NULL PRIMARY KEY,
+						key_type TEXT NOT NULL,
+						key TEXT NOT NULL,
+						failures INTEGER NOT NULL,
+						locked_at TEXT NOT NULL,
+						locked_until TEXT NOT NULL
+						);`
+	_, err = db.Exec(createLockoutTbl)
+	if err != nil {
+		return err
+	}
+
+	// Links users to the subject they have at an OpenID Connect provider
+	createUserIdentityTbl := `CREATE TABLE IF NOT EXISTS user_identities
+						(issuer TEXT NOT NULL,
+						subject TEXT NOT NULL,
+						user_id TEXT NOT NULL,
+						created_at TEXT NOT NULL,
+						PRIMARY KEY (issuer, subject),
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createUserIdentityTbl)
+	if err != nil {
+		return err
+	}
+
+	// Pending OpenID Connect logins, kept until the provider redirects back
+	createOidcLoginStateTbl := `CREATE TABLE IF NOT EXISTS oidc_login_states
+						(state TEXT NOT NULL PRIMARY KEY,
+						nonce TEXT NOT NULL,
+						code_verifier TEXT NOT NULL,
+						created_at TEXT NOT NULL
+						);`
+	_, err = db.Exec(createOidcLoginStateTbl)
+	if err != nil {
+		return err
+	}
+
+	// Set for logins that confirm a sensitive change instead of starting a session
+	err = addColumnIfMissing(db, "oidc_login_states", "reauthenticate", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	// TOTP secrets are pending until enabled_at is set.
+	// last_used_step prevents the same code from being used twice.
+	createUserTotpTbl := `CREATE TABLE IF NOT EXISTS user_totp
+						(user_id TEXT NOT NULL PRIMARY KEY,
+						secret TEXT NOT NULL,
+						created_at TEXT NOT NULL,
+						enabled_at TEXT,
+						last_used_step INTEGER NOT NULL,
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createUserTotpTbl)
+	if err != nil {
+		return err
+	}
+
+	createTotpRecoveryCodeTbl := `CREATE TABLE IF NOT EXISTS totp_recovery_codes
+						(user_id TEXT NOT NULL,
+						code_hash TEXT NOT NULL,
+						used_at TEXT,
+						PRIMARY KEY (user_id, code_hash),
+						FOREIGN KEY (user_id) REFERENCES users (id)
+						);`
+	_, err = db.Exec(createTotpRecoveryCodeTbl)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,163 @@
+package repository
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+func columnNames(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// A database from before versions, null counts, date formats and units gets
+// all of them without losing its columns
+func TestInitDatabaseMigratesDatasetColumns(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE dataset_columns
+		(dataset_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		PRIMARY KEY (dataset_id, position)
+		);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO dataset_columns (dataset_id, position, name, type) VALUES ('d1', 0, 'city', 'text'), ('d1', 1, 'at', 'datetime')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"dataset_id", "version", "position", "name", "type", "null_count", "date_format", "unit"}
+	// Twice, the second time on a database that is up to date
+	for range 2 {
+		if err := InitDatabase(db); err != nil {
+			t.Fatal(err)
+		}
+		if got := columnNames(t, db, "dataset_columns"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("columns %q, want %q", got, want)
+		}
+	}
+
+	_, err = db.Exec("UPDATE dataset_columns SET date_format = '%d.%m.%Y', unit = 'km' WHERE name = 'at'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT dataset_id, version, position, name, type, null_count, date_format, unit FROM dataset_columns ORDER BY position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got [][]any
+	for rows.Next() {
+		var id, name, typ, dateFormat, unit string
+		var version, position, nullCount int64
+		if err := rows.Scan(&id, &version, &position, &name, &typ, &nullCount, &dateFormat, &unit); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, []any{id, version, position, name, typ, nullCount, dateFormat, unit})
+	}
+	wantRows := [][]any{
+		{"d1", int64(1), int64(0), "city", "text", int64(0), "", ""},
+		{"d1", int64(1), int64(1), "at", "datetime", int64(0), "%d.%m.%Y", "km"},
+	}
+	if !reflect.DeepEqual(got, wantRows) {
+		t.Errorf("rows %v, want %v", got, wantRows)
+	}
+}
+
+func TestInitDatabaseNew(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := []string{"dataset_id", "version", "position", "name", "type", "null_count", "date_format", "unit"}
+	for range 2 {
+		if err := InitDatabase(db); err != nil {
+			t.Fatal(err)
+		}
+		if got := columnNames(t, db, "dataset_columns"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("columns %q, want %q", got, want)
+		}
+	}
+}
+
+// Profiles from when they were kept for one version per dataset are dropped,
+// new ones are kept for every version
+func TestInitDatabaseMigratesDatasetProfiles(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE dataset_profiles
+		(dataset_id TEXT NOT NULL PRIMARY KEY,
+		status TEXT NOT NULL,
+		profile TEXT,
+		error TEXT,
+		updated_at TEXT NOT NULL,
+		version INTEGER NOT NULL DEFAULT 1
+		);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO dataset_profiles (dataset_id, status, updated_at) VALUES ('d1', 'ready', '2024-01-01T00:00:00Z')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() int {
+		t.Helper()
+		var profiles int
+		if err := db.QueryRow("SELECT COUNT(*) FROM dataset_profiles").Scan(&profiles); err != nil {
+			t.Fatal(err)
+		}
+		return profiles
+	}
+	if err := InitDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("%d old profiles kept", n)
+	}
+
+	_, err = db.Exec("INSERT INTO dataset_profiles (dataset_id, version, status, updated_at) VALUES ('d1', 1, 'ready', '2024-01-01T00:00:00Z'), ('d1', 2, 'ready', '2024-01-01T00:00:00Z')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// On a database that is up to date
+	if err := InitDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("%d profiles, want 2", n)
+	}
+}
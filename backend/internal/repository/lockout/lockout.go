@@ -0,0 +1,186 @@
+package lockout
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Failed logins are tracked separately per username and per client IP.
+// Wrong second factor codes are tracked per user.
+const (
+	KeyTypeUsername = "username"
+	KeyTypeIP       = "ip"
+	KeyTypeTotp     = "totp"
+)
+
+// Policy decides when failed logins lock a key and for how long.
+// Once MaxAttempts failures have been recorded, every further failure locks the
+// key for BaseLockout, doubled per failure up to MaxLockout.
+// Failures older than ResetAfter are forgotten.
+type Policy struct {
+	MaxAttempts int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	ResetAfter  time.Duration
+}
+
+var UsernamePolicy = Policy{
+	MaxAttempts: 5,
+	BaseLockout: 30 * time.Second,
+	MaxLockout:  time.Hour,
+	ResetAfter:  24 * time.Hour,
+}
+
+// Many users can share an IP behind a NAT, so IPs get more attempts
+var IPPolicy = Policy{
+	MaxAttempts: 20,
+	BaseLockout: 30 * time.Second,
+	MaxLockout:  time.Hour,
+	ResetAfter:  24 * time.Hour,
+}
+
+// A six digit code is easy to guess, so few wrong codes are allowed
+var TotpPolicy = Policy{
+	MaxAttempts: 5,
+	BaseLockout: time.Minute,
+	MaxLockout:  time.Hour,
+	ResetAfter:  24 * time.Hour,
+}
+
+type Lockout struct {
+	ID          string
+	KeyType     string
+	Key         string
+	Failures    int
+	LockedAt    string
+	LockedUntil string
+}
+
+// Get the time until which the key is locked.
+// The zero time is returned if the key is not locked.
+func GetLockedUntil(db *sql.DB, keyType string, key string) (time.Time, error) {
+	var lockedUntil sql.NullString
+	err := db.QueryRow("SELECT locked_until FROM login_failures WHERE key_type = ? AND key = ?", keyType, key).Scan(&lockedUntil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if !lockedUntil.Valid {
+		return time.Time{}, nil
+	}
+
+	until, err := time.Parse(time.RFC3339, lockedUntil.String)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if time.Now().After(until) {
+		return time.Time{}, nil
+	}
+
+	return until, nil
+}
+
+// Record a failed login for the key.
+// Returns the time until which the key is now locked, or the zero time if it is not locked.
+// Every lockout is also recorded in the lockouts table.
+func RecordFailure(db *sql.DB, policy Policy, keyType string, key string) (time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	currentTime := time.Now()
+
+	failures := 0
+	var lastFailureAt string
+	err = tx.QueryRow("SELECT failures, last_failure_at FROM login_failures WHERE key_type = ? AND key = ?", keyType, key).Scan(&failures, &lastFailureAt)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+	if err == nil {
+		last, err := time.Parse(time.RFC3339, lastFailureAt)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if currentTime.Sub(last) > policy.ResetAfter {
+			failures = 0
+		}
+	}
+	failures++
+
+	var lockedUntil time.Time
+	if failures >= policy.MaxAttempts {
+		// Double the lockout for every failure past the limit
+		exponent := float64(failures - policy.MaxAttempts)
+		duration := time.Duration(math.Min(float64(policy.BaseLockout)*math.Pow(2, exponent), float64(policy.MaxLockout)))
+		lockedUntil = currentTime.Add(duration)
+	}
+
+	var lockedUntilValue any
+	if !lockedUntil.IsZero() {
+		lockedUntilValue = lockedUntil.Format(time.RFC3339)
+	}
+
+	_, err = tx.Exec(`INSERT INTO login_failures (key_type, key, failures, last_failure_at, locked_until) VALUES (?, ?, ?, ?, ?)
+					ON CONFLICT (key_type, key) DO UPDATE SET failures = excluded.failures, last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+		keyType, key, failures, currentTime.Format(time.RFC3339), lockedUntilValue)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !lockedUntil.IsZero() {
+		_, err = tx.Exec("INSERT INTO lockouts (id, key_type, key, failures, locked_at, locked_until) VALUES (?, ?, ?, ?, ?, ?)",
+			uuid.New().String(), keyType, key, failures, currentTime.Format(time.RFC3339), lockedUntil.Format(time.RFC3339))
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+
+	return lockedUntil, nil
+}
+
+// Forget the failed logins of the key, e.g. after a successful login
+func ResetFailures(db *sql.DB, keyType string, key string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE key_type = ? AND key = ?", keyType, key)
+	return err
+}
+
+// Forget the failed logins of the key in the transaction that deletes the account
+func ResetFailuresTx(tx *sql.Tx, keyType string, key string) error {
+	_, err := tx.Exec("DELETE FROM login_failures WHERE key_type = ? AND key = ?", keyType, key)
+	return err
+}
+
+// Get the most recent lockouts, newest first
+func GetLockouts(db *sql.DB, limit int) ([]Lockout, error) {
+	rows, err := db.Query("SELECT id, key_type, key, failures, locked_at, locked_until FROM lockouts ORDER BY locked_at DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []Lockout
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.ID, &l.KeyType, &l.Key, &l.Failures, &l.LockedAt, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lockouts, nil
+}
@@ -0,0 +1,115 @@
+package lockout
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"chart-organizer/backend/internal/repository/repositorytest"
+)
+
+var testPolicy = Policy{
+	MaxAttempts: 3,
+	BaseLockout: time.Minute,
+	MaxLockout:  5 * time.Minute,
+	ResetAfter:  time.Hour,
+}
+
+// Record a failure and return for how long the key is now locked
+func lockedFor(t *testing.T, db *sql.DB, key string) time.Duration {
+	t.Helper()
+	before := time.Now().Truncate(time.Second)
+	until, err := RecordFailure(db, testPolicy, KeyTypeUsername, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until.IsZero() {
+		return 0
+	}
+	// Times are stored with a precision of seconds
+	return until.Sub(before).Round(time.Minute)
+}
+
+func TestRecordFailureDoublesLockout(t *testing.T) {
+	db := repositorytest.NewDB(t)
+
+	want := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, w := range want {
+		if got := lockedFor(t, db, "alice"); got != w {
+			t.Errorf("failure %d: locked for %v, want %v", i+1, got, w)
+		}
+	}
+
+	until, err := GetLockedUntil(db, KeyTypeUsername, "alice")
+	if err != nil || until.IsZero() {
+		t.Errorf("GetLockedUntil = %v, %v", until, err)
+	}
+	// Keys are locked separately per type and key
+	for _, tt := range []struct{ keyType, key string }{{KeyTypeUsername, "bob"}, {KeyTypeIP, "alice"}} {
+		if until, err := GetLockedUntil(db, tt.keyType, tt.key); err != nil || !until.IsZero() {
+			t.Errorf("%s %s locked until %v, %v", tt.keyType, tt.key, until, err)
+		}
+	}
+
+	lockouts, err := GetLockouts(db, 10)
+	if err != nil || len(lockouts) != 5 || lockouts[0].Key != "alice" {
+		t.Errorf("lockouts %+v, %v", lockouts, err)
+	}
+}
+
+func TestRecordFailureAfterResetAfter(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	for range testPolicy.MaxAttempts - 1 {
+		lockedFor(t, db, "alice")
+	}
+
+	// The last failure is older than ResetAfter, so counting starts over
+	_, err := db.Exec("UPDATE login_failures SET last_failure_at = ? WHERE key = ?", time.Now().Add(-testPolicy.ResetAfter-time.Minute).Format(time.RFC3339), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lockedFor(t, db, "alice"); got != 0 {
+		t.Errorf("locked for %v after the failures were forgotten", got)
+	}
+	var failures int
+	if err := db.QueryRow("SELECT failures FROM login_failures WHERE key = ?", "alice").Scan(&failures); err != nil || failures != 1 {
+		t.Errorf("%d failures, %v", failures, err)
+	}
+}
+
+func TestResetFailures(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	for range testPolicy.MaxAttempts {
+		lockedFor(t, db, "alice")
+	}
+
+	// A successful login forgets the failures and lifts the lockout
+	if err := ResetFailures(db, KeyTypeUsername, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if until, err := GetLockedUntil(db, KeyTypeUsername, "alice"); err != nil || !until.IsZero() {
+		t.Errorf("locked until %v, %v after the reset", until, err)
+	}
+	if got := lockedFor(t, db, "alice"); got != 0 {
+		t.Errorf("locked for %v on the first failure after the reset", got)
+	}
+
+	// Lockouts stay in the history
+	if lockouts, err := GetLockouts(db, 10); err != nil || len(lockouts) != 1 {
+		t.Errorf("lockouts %+v, %v", lockouts, err)
+	}
+}
+
+func TestGetLockedUntilExpired(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	for range testPolicy.MaxAttempts {
+		lockedFor(t, db, "alice")
+	}
+	_, err := db.Exec("UPDATE login_failures SET locked_until = ? WHERE key = ?", time.Now().Add(-time.Second).Format(time.RFC3339), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until, err := GetLockedUntil(db, KeyTypeUsername, "alice"); err != nil || !until.IsZero() {
+		t.Errorf("an expired lockout is locked until %v, %v", until, err)
+	}
+}
@@ -0,0 +1,43 @@
+package oidc
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"chart-organizer/backend/internal/oidc"
+)
+
+// LoginStateTTL defines how long a user has to complete the login at the identity provider
+const LoginStateTTL = 10 * time.Minute
+
+var ErrInvalidLoginState = errors.New("unknown or expired login state")
+
+// Store the state of a login until the identity provider redirects back
+func AddLoginState(db *sql.DB, s oidc.LoginState) error {
+	currentTime := time.Now().Format(time.RFC3339)
+	_, err := db.Exec("INSERT INTO oidc_login_states (state, nonce, code_verifier, reauthenticate, created_at) VALUES (?, ?, ?, ?, ?)",
+		s.State, s.Nonce, s.CodeVerifier, s.Reauthenticate, currentTime)
+	return err
+}
+
+// Get and delete the state of a login, so that it can only be used once.
+// Expired states are cleaned up along the way.
+func TakeLoginState(db *sql.DB, state string) (oidc.LoginState, error) {
+	cutoff := time.Now().Add(-LoginStateTTL).Format(time.RFC3339)
+	_, err := db.Exec("DELETE FROM oidc_login_states WHERE created_at < ?", cutoff)
+	if err != nil {
+		return oidc.LoginState{}, err
+	}
+
+	s := oidc.LoginState{State: state}
+	err = db.QueryRow("DELETE FROM oidc_login_states WHERE state = ? RETURNING nonce, code_verifier, reauthenticate", state).Scan(&s.Nonce, &s.CodeVerifier, &s.Reauthenticate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return oidc.LoginState{}, ErrInvalidLoginState
+		}
+		return oidc.LoginState{}, err
+	}
+
+	return s, nil
+}
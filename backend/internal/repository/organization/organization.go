@@ -0,0 +1,254 @@
+package organization
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles a member can have, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var Roles = []string{RoleOwner, RoleEditor, RoleViewer}
+
+var (
+	ErrNotMember     = errors.New("not a member of the organization")
+	ErrAlreadyMember = errors.New("user is already a member of the organization")
+	ErrLastOwner     = errors.New("the organization needs at least one other owner")
+)
+
+// CanWrite reports whether the role may upload datasets and create dashboards
+func CanWrite(role string) bool {
+	return role == RoleOwner || role == RoleEditor
+}
+
+type Organization struct {
+	ID        string
+	Name      string
+	CreatedAt string
+	// Role of the user the organization was looked up for
+	Role string
+}
+
+type Member struct {
+	UserID    string
+	Username  string
+	Role      string
+	CreatedAt string
+}
+
+// Create an organization with the user as its first owner
+func CreateOrganization(db *sql.DB, userId string, name string) (Organization, error) {
+	org := Organization{
+		ID:        uuid.New().String(),
+		Name:      name,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Role:      RoleOwner,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Organization{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO organizations (id, name, created_at) VALUES (?, ?, ?)", org.ID, org.Name, org.CreatedAt)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	_, err = tx.Exec("INSERT INTO organization_members (organization_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		org.ID, userId, RoleOwner, org.CreatedAt)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	return org, tx.Commit()
+}
+
+// Get every organization the user is a member of
+func GetOrganizationsOfUser(db *sql.DB, userId string) ([]Organization, error) {
+	rows, err := db.Query("SELECT o.id, o.name, o.created_at, m.role FROM organizations o JOIN organization_members m ON m.organization_id = o.id WHERE m.user_id = ? ORDER BY o.name",
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []Organization
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.CreatedAt, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orgs, nil
+}
+
+// Get the role of the user in the organization.
+// Returns ErrNotMember if the user is not a member or the organization does not exist.
+func GetMemberRole(db *sql.DB, organizationId string, userId string) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM organization_members WHERE organization_id = ? AND user_id = ?", organizationId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	return role, err
+}
+
+func GetMembers(db *sql.DB, organizationId string) ([]Member, error) {
+	rows, err := db.Query("SELECT m.user_id, u.username, m.role, m.created_at FROM organization_members m JOIN users u ON u.id = m.user_id WHERE m.organization_id = ? ORDER BY u.username",
+		organizationId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+func AddMember(db *sql.DB, organizationId string, userId string, role string) (string, error) {
+	createdAt := time.Now().Format(time.RFC3339)
+	_, err := db.Exec("INSERT INTO organization_members (organization_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		organizationId, userId, role, createdAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return "", ErrAlreadyMember
+		}
+		return "", err
+	}
+	return createdAt, nil
+}
+
+// Check that changing the member leaves the organization with an owner
+func checkOtherOwner(tx *sql.Tx, organizationId string, userId string) error {
+	var role string
+	err := tx.QueryRow("SELECT role FROM organization_members WHERE organization_id = ? AND user_id = ?", organizationId, userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+	if role != RoleOwner {
+		return nil
+	}
+
+	var otherOwners int
+	err = tx.QueryRow("SELECT COUNT(*) FROM organization_members WHERE organization_id = ? AND user_id != ? AND role = ?",
+		organizationId, userId, RoleOwner).Scan(&otherOwners)
+	if err != nil {
+		return err
+	}
+	if otherOwners == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// Change the role of a member. The last owner can't be demoted.
+func SetMemberRole(db *sql.DB, organizationId string, userId string, role string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role != RoleOwner {
+		if err = checkOtherOwner(tx, organizationId, userId); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("UPDATE organization_members SET role = ? WHERE organization_id = ? AND user_id = ?", role, organizationId, userId)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotMember
+	}
+
+	return tx.Commit()
+}
+
+// Remove a member. The last owner can't be removed.
+func RemoveMember(db *sql.DB, organizationId string, userId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkOtherOwner(tx, organizationId, userId); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM organization_members WHERE organization_id = ? AND user_id = ?", organizationId, userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Check whether the user is the only owner of an organization, which would
+// be left without an owner if the user went away
+func IsSoleOwnerOfAny(db *sql.DB, userId string) (bool, error) {
+	var soleOwner bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM organization_members m WHERE m.user_id = ? AND m.role = ?
+		AND NOT EXISTS (SELECT 1 FROM organization_members o WHERE o.organization_id = m.organization_id AND o.user_id != m.user_id AND o.role = ?))`,
+		userId, RoleOwner, RoleOwner).Scan(&soleOwner)
+	return soleOwner, err
+}
+
+// Delete an organization and its memberships.
+// Its datasets have to be deleted first, see dataset.DeleteAllDatasetsFromOrganization.
+func DeleteOrganization(db *sql.DB, organizationId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM organization_members WHERE organization_id = ?", organizationId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM organizations WHERE id = ?", organizationId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,112 @@
+package organization
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	"chart-organizer/backend/internal/repository/repositorytest"
+)
+
+func newTestUser(t *testing.T, db *sql.DB, username string) string {
+	t.Helper()
+	if err := authRepo.AddNewUser(db, username, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := authRepo.GetUserID(db, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCanWrite(t *testing.T) {
+	for role, want := range map[string]bool{RoleOwner: true, RoleEditor: true, RoleViewer: false, "": false} {
+		if got := CanWrite(role); got != want {
+			t.Errorf("CanWrite(%q) = %t, want %t", role, got, want)
+		}
+	}
+}
+
+func TestMembers(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+	carol := newTestUser(t, db, "carol")
+
+	org, err := CreateOrganization(db, alice, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddMember(db, org.ID, bob, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddMember(db, org.ID, bob, RoleEditor); !errors.Is(err, ErrAlreadyMember) {
+		t.Errorf("adding a member again: got %v, want ErrAlreadyMember", err)
+	}
+
+	for _, tt := range []struct {
+		userId string
+		role   string
+		err    error
+	}{
+		{alice, RoleOwner, nil},
+		{bob, RoleViewer, nil},
+		{carol, "", ErrNotMember},
+	} {
+		if role, err := GetMemberRole(db, org.ID, tt.userId); role != tt.role || !errors.Is(err, tt.err) {
+			t.Errorf("GetMemberRole = %q, %v, want %q, %v", role, err, tt.role, tt.err)
+		}
+	}
+	if _, err := GetMemberRole(db, "unknown", alice); !errors.Is(err, ErrNotMember) {
+		t.Errorf("unknown organization: got %v, want ErrNotMember", err)
+	}
+	if err := SetMemberRole(db, org.ID, carol, RoleEditor); !errors.Is(err, ErrNotMember) {
+		t.Errorf("SetMemberRole of a non-member: got %v, want ErrNotMember", err)
+	}
+	if err := RemoveMember(db, org.ID, carol); !errors.Is(err, ErrNotMember) {
+		t.Errorf("RemoveMember of a non-member: got %v, want ErrNotMember", err)
+	}
+}
+
+func TestLastOwner(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+
+	org, err := CreateOrganization(db, alice, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddMember(db, org.ID, bob, RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+
+	if soleOwner, err := IsSoleOwnerOfAny(db, alice); err != nil || !soleOwner {
+		t.Errorf("IsSoleOwnerOfAny(alice) = %t, %v", soleOwner, err)
+	}
+	if soleOwner, err := IsSoleOwnerOfAny(db, bob); err != nil || soleOwner {
+		t.Errorf("IsSoleOwnerOfAny(bob) = %t, %v", soleOwner, err)
+	}
+	if err := SetMemberRole(db, org.ID, alice, RoleEditor); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("demoting the last owner: got %v, want ErrLastOwner", err)
+	}
+	if err := RemoveMember(db, org.ID, alice); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("removing the last owner: got %v, want ErrLastOwner", err)
+	}
+
+	// With another owner, alice can step down
+	if err := SetMemberRole(db, org.ID, bob, RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if soleOwner, err := IsSoleOwnerOfAny(db, alice); err != nil || soleOwner {
+		t.Errorf("IsSoleOwnerOfAny(alice) = %t, %v with two owners", soleOwner, err)
+	}
+	if err := RemoveMember(db, org.ID, alice); err != nil {
+		t.Errorf("removing an owner: %v", err)
+	}
+	if err := SetMemberRole(db, org.ID, bob, RoleViewer); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("demoting the new last owner: got %v, want ErrLastOwner", err)
+	}
+}
@@ -0,0 +1,28 @@
+// Package repositorytest provides databases for the tests of the repositories
+// and the handlers using them.
+package repositorytest
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"chart-organizer/backend/internal/repository"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+// Open a database with every table in a temporary directory of the test.
+// It is closed when the test finishes.
+func NewDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := repository.InitDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,235 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefreshTokenTTL defines how long a session can be kept alive without logging in again
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+type Session struct {
+	ID         string
+	UserAgent  string
+	CreatedAt  string
+	LastUsedAt string
+	ExpiresAt  string
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a new session for the user.
+// Returns the session ID and the refresh token. Only the hash of the refresh
+// token is stored, so the token itself can't be recovered later.
+func CreateSession(db *sql.DB, userId string, userAgent string) (string, string, error) {
+	id := uuid.New().String()
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	currentTime := time.Now()
+	createdAt := currentTime.Format(time.RFC3339)
+	expiresAt := currentTime.Add(RefreshTokenTTL).Format(time.RFC3339)
+
+	_, err = db.Exec("INSERT INTO sessions (id, user_id, refresh_token_hash, user_agent, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, userId, hashRefreshToken(refreshToken), userAgent, createdAt, createdAt, expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+
+	return id, refreshToken, nil
+}
+
+// Rotate the refresh token of the session it belongs to.
+// Returns the session ID, user ID and the new refresh token.
+// Presenting any refresh token that was already rotated out means it has been
+// copied somewhere, so the whole session is revoked.
+func RotateRefreshToken(db *sql.DB, refreshToken string) (string, string, string, error) {
+	hash := hashRefreshToken(refreshToken)
+
+	var id, userId, expiresAt string
+	var revokedAt sql.NullString
+	err := db.QueryRow("SELECT id, user_id, expires_at, revoked_at FROM sessions WHERE refresh_token_hash = ?", hash).
+		Scan(&id, &userId, &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		var reusedId string
+		err = db.QueryRow("SELECT session_id FROM used_refresh_tokens WHERE token_hash = ?", hash).Scan(&reusedId)
+		if err == sql.ErrNoRows {
+			return "", "", "", ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return "", "", "", err
+		}
+		if err = revoke(db, "id = ?", reusedId); err != nil {
+			return "", "", "", err
+		}
+		return "", "", "", ErrRefreshTokenReused
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if revokedAt.Valid {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return "", "", "", err
+	}
+	if time.Now().After(expiry) {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+
+	newToken, err := newRefreshToken()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", "", err
+	}
+	defer tx.Rollback()
+
+	// Only rotate if nobody else rotated the same token in the meantime
+	currentTime := time.Now().Format(time.RFC3339)
+	result, err := tx.Exec("UPDATE sessions SET refresh_token_hash = ?, last_used_at = ? WHERE id = ? AND refresh_token_hash = ?",
+		hashRefreshToken(newToken), currentTime, id, hash)
+	if err != nil {
+		return "", "", "", err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return "", "", "", err
+	}
+	if affected == 0 {
+		return "", "", "", ErrInvalidRefreshToken
+	}
+
+	_, err = tx.Exec("INSERT INTO used_refresh_tokens (token_hash, session_id, used_at) VALUES (?, ?, ?)", hash, id, currentTime)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", "", "", err
+	}
+
+	return id, userId, newToken, nil
+}
+
+// Revoke the session a refresh token belongs to
+func RevokeSessionByRefreshToken(db *sql.DB, refreshToken string) error {
+	var id string
+	err := db.QueryRow("SELECT id FROM sessions WHERE refresh_token_hash = ? AND revoked_at IS NULL", hashRefreshToken(refreshToken)).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidRefreshToken
+		}
+		return err
+	}
+
+	return revoke(db, "id = ?", id)
+}
+
+// Check whether the session exists, belongs to the user and has not been revoked or expired.
+// Sessions of disabled users are never active.
+func IsSessionActive(db *sql.DB, userId string, id string) (bool, error) {
+	var expiresAt string
+	err := db.QueryRow("SELECT s.expires_at FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.id = ? AND s.user_id = ? AND s.revoked_at IS NULL AND u.disabled_at IS NULL",
+		id, userId).Scan(&expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Now().Before(expiry), nil
+}
+
+func revoke(db *sql.DB, where string, args ...any) error {
+	currentTime := time.Now().Format(time.RFC3339)
+	_, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE revoked_at IS NULL AND "+where, append([]any{currentTime}, args...)...)
+	return err
+}
+
+// Revoke one session of the user. Returns ErrSessionNotFound if the user has no such active session.
+func RevokeSession(db *sql.DB, userId string, id string) error {
+	active, err := IsSessionActive(db, userId, id)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrSessionNotFound
+	}
+
+	return revoke(db, "id = ? AND user_id = ?", id, userId)
+}
+
+// Revoke every session of the user
+func RevokeAllSessions(db *sql.DB, userId string) error {
+	return revoke(db, "user_id = ?", userId)
+}
+
+// Get the active sessions of the user, most recently used first
+func GetActiveSessions(db *sql.DB, userId string) ([]Session, error) {
+	currentTime := time.Now().Format(time.RFC3339)
+	rows, err := db.Query("SELECT id, user_agent, created_at, last_used_at, expires_at FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC",
+		userId, currentTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Revoke every session of the user except the given one
+func RevokeOtherSessions(db *sql.DB, userId string, keepId string) error {
+	return revoke(db, "user_id = ? AND id != ?", userId, keepId)
+}
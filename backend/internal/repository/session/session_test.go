@@ -0,0 +1,199 @@
+package session
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	authRepo "chart-organizer/backend/internal/repository/auth"
+	"chart-organizer/backend/internal/repository/repositorytest"
+)
+
+func newTestUser(t *testing.T, db *sql.DB, username string) string {
+	t.Helper()
+	if err := authRepo.AddNewUser(db, username, "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := authRepo.GetUserID(db, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func isActive(t *testing.T, db *sql.DB, userID string, id string) bool {
+	t.Helper()
+	active, err := IsSessionActive(db, userID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return active
+}
+
+// A session is used by one client at a time, which rotates its refresh token
+// on every refresh. Each step presents one of the tokens the session was
+// given, the first one is the token of CreateSession.
+func TestRotateRefreshToken(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// Index of the token presented at each step
+		steps []int
+		// Errors of the last step, nil for the others
+		err    error
+		active bool
+	}{
+		{"first rotation", []int{0}, nil, true},
+		{"rotated several times", []int{0, 1, 2, 3}, nil, true},
+		// The client and whoever copied the token both used it
+		{"previous token", []int{0, 1, 1}, ErrRefreshTokenReused, false},
+		{"previous token after one rotation", []int{0, 0}, ErrRefreshTokenReused, false},
+		{"older token", []int{0, 1, 0}, ErrRefreshTokenReused, false},
+		{"oldest of many tokens", []int{0, 1, 2, 3, 0}, ErrRefreshTokenReused, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db := repositorytest.NewDB(t)
+			userID := newTestUser(t, db, "alice")
+			id, token, err := CreateSession(db, userID, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tokens := []string{token}
+			for i, step := range tt.steps {
+				gotID, gotUserID, newToken, err := RotateRefreshToken(db, tokens[step])
+				if i < len(tt.steps)-1 || tt.err == nil {
+					if err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if gotID != id || gotUserID != userID || newToken == "" || newToken == tokens[step] {
+						t.Fatalf("step %d: rotated to %q, %q, %q", i, gotID, gotUserID, newToken)
+					}
+					tokens = append(tokens, newToken)
+					continue
+				}
+				if !errors.Is(err, tt.err) || newToken != "" {
+					t.Fatalf("step %d: got %q, %v, want %v", i, newToken, err, tt.err)
+				}
+			}
+
+			if active := isActive(t, db, userID, id); active != tt.active {
+				t.Errorf("session active %t, want %t", active, tt.active)
+			}
+			// The token of the session after the last step, if there still is one
+			_, _, _, err = RotateRefreshToken(db, tokens[len(tokens)-1])
+			if tt.active && err != nil {
+				t.Errorf("the current token was refused: %v", err)
+			}
+			if !tt.active && !errors.Is(err, ErrInvalidRefreshToken) {
+				t.Errorf("the current token of a revoked session: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotateRefreshTokenRefused(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		setup func(db *sql.DB, id string, token string) error
+	}{
+		{"expired", func(db *sql.DB, id string, token string) error {
+			_, err := db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Second).Format(time.RFC3339), id)
+			return err
+		}},
+		{"logged out", func(db *sql.DB, id string, token string) error {
+			return RevokeSessionByRefreshToken(db, token)
+		}},
+		{"revoked", func(db *sql.DB, id string, token string) error {
+			_, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ?", time.Now().Format(time.RFC3339), id)
+			return err
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db := repositorytest.NewDB(t)
+			userID := newTestUser(t, db, "alice")
+			id, token, err := CreateSession(db, userID, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.setup(db, id, token); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err := RotateRefreshToken(db, token); !errors.Is(err, ErrInvalidRefreshToken) {
+				t.Errorf("got %v, want ErrInvalidRefreshToken", err)
+			}
+		})
+	}
+
+	db := repositorytest.NewDB(t)
+	for _, token := range []string{"", "unknown"} {
+		if _, _, _, err := RotateRefreshToken(db, token); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("%q: got %v, want ErrInvalidRefreshToken", token, err)
+		}
+	}
+}
+
+// Reusing a token only revokes the session it belongs to
+func TestRefreshTokenReuseRevokesOnlyItsSession(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	alice := newTestUser(t, db, "alice")
+	bob := newTestUser(t, db, "bob")
+	laptop, laptopToken, err := CreateSession(db, alice, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, phoneToken, err := CreateSession(db, alice, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := CreateSession(db, bob, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := RotateRefreshToken(db, laptopToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := RotateRefreshToken(db, laptopToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("got %v, want ErrRefreshTokenReused", err)
+	}
+	if isActive(t, db, alice, laptop) || !isActive(t, db, alice, phone) || !isActive(t, db, bob, other) {
+		t.Error("reusing a token revoked other sessions or kept its own")
+	}
+	if _, _, _, err := RotateRefreshToken(db, phoneToken); err != nil {
+		t.Errorf("the token of another session was refused: %v", err)
+	}
+
+	sessions, err := GetActiveSessions(db, alice)
+	if err != nil || len(sessions) != 1 || sessions[0].ID != phone || sessions[0].UserAgent != "phone" {
+		t.Errorf("active sessions %+v, %v", sessions, err)
+	}
+}
+
+// Only the hash of refresh tokens is stored
+func TestRefreshTokenIsHashed(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	userID := newTestUser(t, db, "alice")
+	id, token, err := CreateSession(db, userID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, rotated, err := RotateRefreshToken(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var current string
+	err = db.QueryRow("SELECT refresh_token_hash FROM sessions WHERE id = ?", id).Scan(&current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var used string
+	err = db.QueryRow("SELECT token_hash FROM used_refresh_tokens WHERE session_id = ?", id).Scan(&used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != hashRefreshToken(rotated) || used != hashRefreshToken(token) || current == rotated || used == token {
+		t.Errorf("stored %q and %q", current, used)
+	}
+}
@@ -0,0 +1,119 @@
+package totp
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+type Totp struct {
+	Secret  string
+	Enabled bool
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get the TOTP secret of the user. Returns sql.ErrNoRows if the user never enrolled.
+func GetTotp(db *sql.DB, userId string) (Totp, error) {
+	var t Totp
+	var enabledAt sql.NullString
+	err := db.QueryRow("SELECT secret, enabled_at FROM user_totp WHERE user_id = ?", userId).Scan(&t.Secret, &enabledAt)
+	t.Enabled = enabledAt.Valid
+	return t, err
+}
+
+// Check whether the user has to pass a second factor when logging in
+func IsTotpEnabled(db *sql.DB, userId string) (bool, error) {
+	t, err := GetTotp(db, userId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return t.Enabled, err
+}
+
+// Store a new secret and recovery codes for the user.
+// They only take effect once activated with EnableTotp.
+func AddPendingTotp(db *sql.DB, userId string, secret string, recoveryCodes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	currentTime := time.Now().Format(time.RFC3339)
+	_, err = tx.Exec(`INSERT INTO user_totp (user_id, secret, created_at, last_used_step) VALUES (?, ?, ?, 0)
+					ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at, enabled_at = NULL, last_used_step = 0`,
+		userId, secret, currentTime)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", userId, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func EnableTotp(db *sql.DB, userId string) error {
+	currentTime := time.Now().Format(time.RFC3339)
+	_, err := db.Exec("UPDATE user_totp SET enabled_at = ? WHERE user_id = ?", currentTime, userId)
+	return err
+}
+
+// Remove the secret and recovery codes of the user
+func DeleteTotp(db *sql.DB, userId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Mark a time step as used so that an intercepted code can't be replayed.
+// Returns false if the step, or a later one, has already been used.
+func UseStep(db *sql.DB, userId string, step int64) (bool, error) {
+	result, err := db.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?", step, userId, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// Use up a recovery code. Returns false if the code is unknown or was already used.
+func UseRecoveryCode(db *sql.DB, userId string, code string) (bool, error) {
+	currentTime := time.Now().Format(time.RFC3339)
+	result, err := db.Exec("UPDATE totp_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		currentTime, userId, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
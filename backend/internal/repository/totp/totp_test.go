@@ -0,0 +1,109 @@
+package totp
+
+import (
+	"database/sql"
+	"testing"
+
+	"chart-organizer/backend/internal/repository/repositorytest"
+)
+
+func TestUseStep(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	if err := AddPendingTotp(db, "user", "JBSWY3DPEHPK3PXP", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		step int64
+		want bool
+	}{
+		{100, true},
+		// Codes can't be replayed, nor can earlier ones be used after a later one
+		{100, false},
+		{99, false},
+		{101, true},
+	} {
+		if ok, err := UseStep(db, "user", tt.step); err != nil || ok != tt.want {
+			t.Errorf("UseStep(%d) = %t, %v, want %t", tt.step, ok, err, tt.want)
+		}
+	}
+	if ok, err := UseStep(db, "other", 200); err != nil || ok {
+		t.Errorf("UseStep for a user without TOTP = %t, %v", ok, err)
+	}
+
+	// Enrolling again starts over
+	if err := AddPendingTotp(db, "user", "JBSWY3DPEHPK3PXQ", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := UseStep(db, "user", 50); err != nil || !ok {
+		t.Errorf("UseStep after enrolling again = %t, %v", ok, err)
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	if err := AddPendingTotp(db, "user", "JBSWY3DPEHPK3PXP", []string{"abcd-efgh-jkmn", "pqrs-tuvw-xyz2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		user string
+		code string
+		want bool
+	}{
+		{"other", "abcd-efgh-jkmn", false},
+		// Case and surrounding spaces don't matter
+		{"user", " ABCD-efgh-jkmn ", true},
+		{"user", "abcd-efgh-jkmn", false},
+		{"user", "abcd-efgh-jkmm", false},
+		{"user", "pqrs-tuvw-xyz2", true},
+	} {
+		if ok, err := UseRecoveryCode(db, tt.user, tt.code); err != nil || ok != tt.want {
+			t.Errorf("UseRecoveryCode(%q, %q) = %t, %v, want %t", tt.user, tt.code, ok, err, tt.want)
+		}
+	}
+
+	// Enrolling again replaces the codes, deleting removes them
+	if err := AddPendingTotp(db, "user", "JBSWY3DPEHPK3PXP", []string{"2345-6789-abcd"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := UseRecoveryCode(db, "user", "pqrs-tuvw-xyz2"); ok {
+		t.Error("a code of the previous enrollment was accepted")
+	}
+	if err := DeleteTotp(db, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := UseRecoveryCode(db, "user", "2345-6789-abcd"); ok {
+		t.Error("a code was accepted after TOTP was removed")
+	}
+	if enabled, err := IsTotpEnabled(db, "user"); err != nil || enabled {
+		t.Errorf("IsTotpEnabled = %t, %v", enabled, err)
+	}
+}
+
+func TestEnableTotp(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	if err := AddPendingTotp(db, "user", "JBSWY3DPEHPK3PXP", nil); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := IsTotpEnabled(db, "user"); err != nil || enabled {
+		t.Errorf("pending TOTP is enabled: %t, %v", enabled, err)
+	}
+	if err := EnableTotp(db, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if totp, err := GetTotp(db, "user"); err != nil || !totp.Enabled || totp.Secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("GetTotp = %+v, %v", totp, err)
+	}
+
+	// A new secret is pending until it is enabled again
+	if err := AddPendingTotp(db, "user", "JBSWY3DPEHPK3PXQ", nil); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := IsTotpEnabled(db, "user"); err != nil || enabled {
+		t.Errorf("TOTP with a new secret is enabled: %t, %v", enabled, err)
+	}
+	if _, err := GetTotp(db, "other"); err != sql.ErrNoRows {
+		t.Errorf("GetTotp of a user without TOTP: %v", err)
+	}
+}
@@ -10,7 +10,18 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
-func AddNewDashboard(db *sql.DB, userId string, datasetId string, visualizations []*vizv1.Visualization) (string, error) {
+type Dashboard struct {
+	Visualizations []*vizv1.Visualization
+	DatasetID      string
+	// The version of the dataset the dashboard is pinned to, 0 to follow the current version
+	DatasetVersion int64
+	// Empty for dashboards of personal datasets
+	OrganizationID string
+}
+
+// Add a new dashboard. It belongs to the organization of its dataset.
+// A datasetVersion of 0 makes the dashboard follow the current version of the dataset.
+func AddNewDashboard(db *sql.DB, userId string, datasetId string, datasetVersion int64, visualizations []*vizv1.Visualization) (string, error) {
 	// Generate a UUID4 for the dataset ID
 	id := uuid.New().String()
 
@@ -38,7 +49,8 @@ func AddNewDashboard(db *sql.DB, userId string, datasetId string, visualizations
 	visualizationsJson += "]"
 
 	// Insert the dataset into our SQL database
-	_, err := db.Exec("INSERT INTO dashboards (id, dataset_id, visualizations, created_at) VALUES (?, ?, ?, ?)", id, datasetId, visualizationsJson, currentTime)
+	_, err := db.Exec("INSERT INTO dashboards (id, dataset_id, visualizations, created_at, user_id, organization_id, dataset_version) SELECT ?, id, ?, ?, ?, organization_id, NULLIF(?, 0) FROM datasets WHERE id = ?",
+		id, visualizationsJson, currentTime, userId, datasetVersion, datasetId)
 	if err != nil {
 		return "", err
 	}
@@ -46,35 +58,69 @@ func AddNewDashboard(db *sql.DB, userId string, datasetId string, visualizations
 	return id, nil
 }
 
-func GetDashboard(db *sql.DB, id string) ([]*vizv1.Visualization, string, error) {
+// Get a dashboard. Returns sql.ErrNoRows if the dashboard does not exist.
+func GetDashboard(db *sql.DB, id string) (Dashboard, error) {
+	var dashboard Dashboard
 	var visualizationsJson string
-	var datasetId string
-	row := db.QueryRow("SELECT visualizations, dataset_id FROM dashboards WHERE id = ?", id)
-	err := row.Scan(&visualizationsJson, &datasetId)
+	row := db.QueryRow("SELECT visualizations, dataset_id, COALESCE(dataset_version, 0), COALESCE(organization_id, '') FROM dashboards WHERE id = ?", id)
+	err := row.Scan(&visualizationsJson, &dashboard.DatasetID, &dashboard.DatasetVersion, &dashboard.OrganizationID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, "", nil
-		}
-		return nil, "", err
+		return Dashboard{}, err
 	}
 
 	// First, unmarshal as raw JSON to get the array structure
 	var rawVizs []json.RawMessage
 	err = json.Unmarshal([]byte(visualizationsJson), &rawVizs)
 	if err != nil {
-		return nil, "", err
+		return Dashboard{}, err
 	}
 
 	// Then unmarshal each visualization using protojson
-	var visualizations []*vizv1.Visualization
 	for _, rawViz := range rawVizs {
 		viz := &vizv1.Visualization{}
 		err = protojson.Unmarshal(rawViz, viz)
 		if err != nil {
-			return nil, "", err
+			return Dashboard{}, err
 		}
-		visualizations = append(visualizations, viz)
+		dashboard.Visualizations = append(dashboard.Visualizations, viz)
+	}
+
+	return dashboard, nil
+}
+
+// Pin a dashboard to a version of its dataset, or make it follow the current version with 0.
+// Returns sql.ErrNoRows if the dashboard does not exist.
+func SetDashboardDatasetVersion(db *sql.DB, id string, datasetVersion int64) error {
+	result, err := db.Exec("UPDATE dashboards SET dataset_version = NULLIF(?, 0) WHERE id = ?", datasetVersion, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Delete a dashboard. Returns sql.ErrNoRows if the dashboard does not exist.
+func DeleteDashboard(db *sql.DB, id string) error {
+	result, err := db.Exec("DELETE FROM dashboards WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
 	}
 
-	return visualizations, datasetId, nil
+	return nil
 }
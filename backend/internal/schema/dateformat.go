@@ -0,0 +1,103 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Directives of date formats, as in strftime, and their Go layouts
+var dateDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'%': "%",
+}
+
+// Text of a Go layout that is not taken literally
+var layoutWords = []string{"Jan", "Mon", "MST", "PM", "pm"}
+
+// Layouts of the date formats that have been converted
+var datetimeLayoutCache sync.Map
+
+// DatetimeLayout converts a date format in the syntax of strftime, such as
+// %d.%m.%Y %H:%M, to a Go time layout. Fractions of seconds after %S are
+// accepted without a directive.
+func DatetimeLayout(format string) (string, error) {
+	if layout, ok := datetimeLayoutCache.Load(format); ok {
+		return layout.(string), nil
+	}
+
+	var layout strings.Builder
+	var literal strings.Builder
+	flush := func() error {
+		text := literal.String()
+		literal.Reset()
+		if strings.ContainsFunc(text, unicode.IsDigit) {
+			return fmt.Errorf("the date format can't have digits outside of directives, %q does", text)
+		}
+		for _, word := range layoutWords {
+			if strings.Contains(text, word) {
+				return fmt.Errorf("the date format can't have %q outside of directives", word)
+			}
+		}
+		layout.WriteString(text)
+		return nil
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		if i+1 == len(format) {
+			return "", fmt.Errorf("the date format %q ends with %%", format)
+		}
+		i++
+		directive, ok := dateDirectives[format[i]]
+		if !ok {
+			return "", fmt.Errorf("unknown directive %%%c in the date format", format[i])
+		}
+		if err := flush(); err != nil {
+			return "", err
+		}
+		layout.WriteString(directive)
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+	if !strings.Contains(format, "%") {
+		return "", fmt.Errorf("the date format %q has no directives", format)
+	}
+
+	datetimeLayoutCache.Store(format, layout.String())
+	return layout.String(), nil
+}
+
+// ParseDatetime parses a value of the column, with its date format if it has one
+func (c Column) ParseDatetime(value string) (time.Time, bool) {
+	if c.DateFormat == "" {
+		return ParseDatetime(value)
+	}
+	layout, err := DatetimeLayout(c.DateFormat)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(layout, strings.TrimSpace(value))
+	return t, err == nil
+}
@@ -0,0 +1,67 @@
+package schema
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDatetimeLayout(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		layout string
+		err    string
+	}{
+		{"%d.%m.%Y", "02.01.2006", ""},
+		{"%Y-%m-%dT%H:%M:%S%z", "2006-01-02T15:04:05-0700", ""},
+		{"%e %B %Y, %I:%M %p", "_2 January 2006, 03:04 PM", ""},
+		{"%a %d %b %y %Z", "Mon 02 Jan 06 MST", ""},
+		{"%j/%Y", "002/2006", ""},
+		{"100%% on %d.%m.", "", `the date format can't have digits outside of directives, "100" does`},
+		{"%Y in Jan", "", `the date format can't have "Jan" outside of directives`},
+		{"%H:%M pm", "", `the date format can't have "pm" outside of directives`},
+		{"%d.%m.%", "", `the date format "%d.%m.%" ends with %`},
+		{"%d.%m.%Q", "", "unknown directive %Q in the date format"},
+		{"dd.mm.yyyy", "", `the date format "dd.mm.yyyy" has no directives`},
+		{"", "", `the date format "" has no directives`},
+	} {
+		layout, err := DatetimeLayout(tt.format)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("DatetimeLayout(%q): got %q, %v, want %q", tt.format, layout, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || layout != tt.layout {
+			t.Errorf("DatetimeLayout(%q) = %q, %v, want %q", tt.format, layout, err, tt.layout)
+		}
+		// From the cache the second time
+		if again, err := DatetimeLayout(tt.format); err != nil || again != layout {
+			t.Errorf("DatetimeLayout(%q) = %q, %v the second time", tt.format, again, err)
+		}
+	}
+}
+
+func TestColumnParseDatetime(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		value  string
+		want   time.Time
+		ok     bool
+	}{
+		{"", "2024-02-01", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), true},
+		{"", "01.02.2024", time.Time{}, false},
+		{"%d.%m.%Y", " 01.02.2024 ", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), true},
+		{"%d.%m.%Y", "2024-02-01", time.Time{}, false},
+		{"%d.%m.%Y", "30.02.2024", time.Time{}, false},
+		{"%d/%m/%Y %H:%M:%S", "01/02/2024 13:14:15.25", time.Date(2024, 2, 1, 13, 14, 15, 250000000, time.UTC), true},
+		{"%Y-%m-%d %H:%M%z", "2024-02-01 13:14+0100", time.Date(2024, 2, 1, 12, 14, 0, 0, time.UTC), true},
+		{"%b %e, %Y", "Feb  1, 2024", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), true},
+		// A date format that can't be converted matches nothing
+		{"%Q", "2024-02-01", time.Time{}, false},
+	} {
+		got, ok := Column{Type: TypeDatetime, DateFormat: tt.format}.ParseDatetime(tt.value)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("ParseDatetime(%q) with %q = %v, %t, want %v, %t", tt.value, tt.format, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column types that can be inferred
+const (
+	TypeInteger     = "integer"
+	TypeFloat       = "float"
+	TypeBoolean     = "boolean"
+	TypeDatetime    = "datetime"
+	TypeCategorical = "categorical"
+	TypeText        = "text"
+)
+
+var Types = []string{TypeInteger, TypeFloat, TypeBoolean, TypeDatetime, TypeCategorical, TypeText}
+
+// A column is categorical if it has at most this many distinct values,
+// each used at least twice on average
+const maxCategories = 50
+
+// Layouts tried when checking for date/time values
+var datetimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02",
+	"01/02/2006 15:04:05",
+	"01/02/2006",
+}
+
+type Column struct {
+	Name string
+	Type string
+	// Number of missing values, see IsMissing
+	NullCount int64
+	// Format of datetime values set by the owner, see DatetimeLayout.
+	// Values are read with the inferred layouts if it is empty.
+	DateFormat string
+	// Unit of the values, such as EUR or kg
+	Unit string
+}
+
+type Schema struct {
+	Columns  []Column
+	RowCount int64
+}
+
+// ParseError is a malformed CSV file. Line and Column start at 1, Column is 0 if unknown.
+type ParseError struct {
+	Line    int
+	Column  int
+	Problem string
+}
+
+func (e *ParseError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Problem)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Problem)
+}
+
+// IsMissing reports whether a value stands for a missing value
+func IsMissing(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "na", "n/a", "null", "nan":
+		return true
+	}
+	return false
+}
+
+func ParseInteger(value string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return n, err == nil
+}
+
+// ParseFloat only accepts finite numbers, so that words like "inf" stay text
+func ParseFloat(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if !strings.ContainsAny(value, "0123456789") {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	return f, err == nil
+}
+
+func ParseBoolean(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes":
+		return true, true
+	case "false", "no":
+		return false, true
+	}
+	return false, false
+}
+
+func ParseDatetime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range datetimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ParseValue converts a value to the Go type of the column type: int64,
+// float64, bool, time.Time or string, and nil for missing values.
+// Values that don't have the type are returned as text with ok false.
+func (c Column) ParseValue(value string) (any, bool) {
+	if IsMissing(value) {
+		return nil, true
+	}
+
+	switch c.Type {
+	case TypeInteger:
+		if n, ok := ParseInteger(value); ok {
+			return n, true
+		}
+	case TypeFloat:
+		if f, ok := ParseFloat(value); ok {
+			return f, true
+		}
+	case TypeBoolean:
+		if b, ok := ParseBoolean(value); ok {
+			return b, true
+		}
+	case TypeDatetime:
+		if t, ok := c.ParseDatetime(value); ok {
+			return t, true
+		}
+	case TypeCategorical, TypeText:
+		return value, true
+	}
+	return value, false
+}
+
+var byteOrderMark = []byte{0xEF, 0xBB, 0xBF}
+
+// NewReader returns an RFC 4180 reader that skips a leading byte order mark.
+// Every record must have as many fields as the header.
+func NewReader(r io.Reader) *csv.Reader {
+	reader, _ := newReader(r)
+	return reader
+}
+
+// Also returns the length of the skipped byte order mark
+func newReader(r io.Reader) (*csv.Reader, int64) {
+	br := bufio.NewReader(r)
+	var skipped int64
+	if bom, err := br.Peek(len(byteOrderMark)); err == nil && bytes.Equal(bom, byteOrderMark) {
+		br.Discard(len(byteOrderMark))
+		skipped = int64(len(byteOrderMark))
+	}
+
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = 0
+	reader.ReuseRecord = true
+	return reader, skipped
+}
+
+// RowReader reads the data rows of a CSV file starting at a byte offset,
+// so that large files can be read page by page without reading them from the start
+type RowReader struct {
+	reader *csv.Reader
+	base   int64
+	fields int
+}
+
+// NewRowReader starts after the header if offset is 0, otherwise at offset,
+// which must be an offset returned by RowReader.Offset for the same file.
+// r must start at offset. Rows must have fields fields.
+func NewRowReader(r io.Reader, offset int64, fields int) (*RowReader, error) {
+	if offset == 0 {
+		reader, skipped := newReader(r)
+		if _, err := reader.Read(); err != nil {
+			if err == io.EOF {
+				return nil, &ParseError{Line: 1, Problem: "file is empty"}
+			}
+			return nil, wrapReadError(err)
+		}
+		return &RowReader{reader: reader, base: skipped, fields: fields}, nil
+	}
+
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = fields
+	reader.ReuseRecord = true
+	return &RowReader{reader: reader, base: offset, fields: fields}, nil
+}
+
+// Read the next row. Returns io.EOF after the last one.
+// Line numbers of errors are relative to the offset the reader started at.
+func (rr *RowReader) Read() ([]string, error) {
+	record, err := rr.reader.Read()
+	if err != nil {
+		return nil, wrapReadError(err)
+	}
+	if len(record) != rr.fields {
+		return nil, &ParseError{Problem: "row has a different number of fields than the schema"}
+	}
+	return record, nil
+}
+
+// Offset of the next row in the file
+func (rr *RowReader) Offset() int64 {
+	return rr.base + rr.reader.InputOffset()
+}
+
+// Convert errors of the CSV reader to a ParseError
+func wrapReadError(err error) error {
+	var csvErr *csv.ParseError
+	if errors.As(err, &csvErr) {
+		problem := csvErr.Err.Error()
+		if errors.Is(csvErr.Err, csv.ErrFieldCount) {
+			problem = "row has a different number of fields than the header"
+			return &ParseError{Line: csvErr.Line, Problem: problem}
+		}
+		return &ParseError{Line: csvErr.Line, Column: csvErr.Column, Problem: problem}
+	}
+	return err
+}
+
+type columnState struct {
+	// Whether every value seen so far could be of the type
+	integer, float, boolean, datetime bool
+	values                            int
+	missing                           int64
+	// Nil once there are too many distinct values for a categorical column
+	distinct map[string]struct{}
+}
+
+// Inferrer infers the schema of a CSV file row by row, so that files don't
+// have to be kept in memory
+type Inferrer struct {
+	names  []string
+	states []columnState
+	rows   int64
+}
+
+// NewInferrer checks the header. Column names must be present and unique.
+func NewInferrer(header []string) (*Inferrer, error) {
+	in := &Inferrer{}
+	seen := make(map[string]int)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, &ParseError{Line: 1, Column: i + 1, Problem: "column name is empty"}
+		}
+		if first, ok := seen[name]; ok {
+			return nil, &ParseError{Line: 1, Column: i + 1, Problem: fmt.Sprintf("column name %q is already used by column %d", name, first)}
+		}
+		seen[name] = i + 1
+
+		in.names = append(in.names, name)
+		in.states = append(in.states, columnState{
+			integer: true, float: true, boolean: true, datetime: true,
+			distinct: make(map[string]struct{}),
+		})
+	}
+	return in, nil
+}
+
+// Add a data row. It must have as many fields as the header.
+func (in *Inferrer) Add(record []string) {
+	in.rows++
+	for i, value := range record {
+		s := &in.states[i]
+		if IsMissing(value) {
+			s.missing++
+			continue
+		}
+
+		s.values++
+		if s.integer {
+			_, s.integer = ParseInteger(value)
+		}
+		if s.float {
+			_, s.float = ParseFloat(value)
+		}
+		if s.boolean {
+			_, s.boolean = ParseBoolean(value)
+		}
+		if s.datetime {
+			_, s.datetime = ParseDatetime(value)
+		}
+		if s.distinct != nil {
+			s.distinct[value] = struct{}{}
+			if len(s.distinct) > maxCategories {
+				s.distinct = nil
+			}
+		}
+	}
+}
+
+// Schema returns the inferred schema of the rows added so far.
+// Columns without any values are text.
+func (in *Inferrer) Schema() Schema {
+	schema := Schema{RowCount: in.rows}
+	for i, name := range in.names {
+		s := in.states[i]
+		columnType := TypeText
+		switch {
+		case s.values == 0:
+		case s.boolean:
+			columnType = TypeBoolean
+		case s.integer:
+			columnType = TypeInteger
+		case s.float:
+			columnType = TypeFloat
+		case s.datetime:
+			columnType = TypeDatetime
+		case s.distinct != nil && len(s.distinct)*2 <= s.values:
+			columnType = TypeCategorical
+		}
+		schema.Columns = append(schema.Columns, Column{Name: name, Type: columnType, NullCount: s.missing})
+	}
+	return schema
+}
+
+// Infer reads a whole CSV file and infers its schema.
+// Malformed files are reported with a ParseError.
+func Infer(r io.Reader) (Schema, error) {
+	reader := NewReader(r)
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return Schema{}, &ParseError{Line: 1, Problem: "file is empty"}
+	}
+	if err != nil {
+		return Schema{}, wrapReadError(err)
+	}
+
+	in, err := NewInferrer(header)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Schema{}, wrapReadError(err)
+		}
+		in.Add(record)
+	}
+
+	return in.Schema(), nil
+}
+
+// InvalidValue is a present value that doesn't have the type of its column.
+// Line starts at 1 with the header, Column is the index of the column.
+type InvalidValue struct {
+	Line   int
+	Column int
+	Value  string
+}
+
+// Validate reads a whole CSV file and checks the values of the columns with
+// the given indices against their types. Returns the first limit values that
+// don't have the type, and how many there are.
+func Validate(r io.Reader, columns []Column, checked []int, limit int) ([]InvalidValue, int64, error) {
+	reader := NewReader(r)
+	if _, err := reader.Read(); err != nil {
+		if err == io.EOF {
+			return nil, 0, &ParseError{Line: 1, Problem: "file is empty"}
+		}
+		return nil, 0, wrapReadError(err)
+	}
+
+	var invalid []InvalidValue
+	var count int64
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, wrapReadError(err)
+		}
+		if len(record) != len(columns) {
+			line, _ := reader.FieldPos(0)
+			return nil, 0, &ParseError{Line: line, Problem: "row has a different number of fields than the schema"}
+		}
+
+		for _, i := range checked {
+			if _, ok := columns[i].ParseValue(record[i]); ok {
+				continue
+			}
+			count++
+			if len(invalid) < limit {
+				line, _ := reader.FieldPos(i)
+				invalid = append(invalid, InvalidValue{Line: line, Column: i, Value: record[i]})
+			}
+		}
+	}
+	return invalid, count, nil
+}
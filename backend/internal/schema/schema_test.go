@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var validatedColumns = []Column{
+	{Name: "name", Type: TypeText},
+	{Name: "count", Type: TypeInteger},
+	{Name: "ratio", Type: TypeFloat},
+	{Name: "paid", Type: TypeBoolean},
+	{Name: "day", Type: TypeDatetime, DateFormat: "%d.%m.%Y"},
+}
+
+func TestValidate(t *testing.T) {
+	const file = "name,count,ratio,paid,day\n" +
+		"a,1,0.5,yes,01.02.2024\n" +
+		"b,NA,,,\n" +
+		"\"c\nd\",1.5,x,maybe,2024-02-01\n" +
+		"e, 7 ,inf,FALSE,31.02.2024\n"
+
+	for _, tt := range []struct {
+		name    string
+		checked []int
+		limit   int
+		invalid []InvalidValue
+		count   int64
+	}{
+		{"no columns", nil, 10, nil, 0},
+		{"text", []int{0}, 10, nil, 0},
+		// Values after a line break in a quoted field are on the next line.
+		// Spaces around values are allowed.
+		{"integers", []int{1}, 10, []InvalidValue{{Line: 5, Column: 1, Value: "1.5"}}, 1},
+		{"floats", []int{2}, 10, []InvalidValue{{Line: 5, Column: 2, Value: "x"}, {Line: 6, Column: 2, Value: "inf"}}, 2},
+		{"booleans", []int{3}, 10, []InvalidValue{{Line: 5, Column: 3, Value: "maybe"}}, 1},
+		// Values must have the date format, and be valid dates
+		{"date format", []int{4}, 10, []InvalidValue{{Line: 5, Column: 4, Value: "2024-02-01"}, {Line: 6, Column: 4, Value: "31.02.2024"}}, 2},
+		{"every column", []int{0, 1, 2, 3, 4}, 10, []InvalidValue{
+			{Line: 5, Column: 1, Value: "1.5"},
+			{Line: 5, Column: 2, Value: "x"},
+			{Line: 5, Column: 3, Value: "maybe"},
+			{Line: 5, Column: 4, Value: "2024-02-01"},
+			{Line: 6, Column: 2, Value: "inf"},
+			{Line: 6, Column: 4, Value: "31.02.2024"},
+		}, 6},
+		{"limit", []int{4, 2}, 3, []InvalidValue{
+			{Line: 5, Column: 4, Value: "2024-02-01"},
+			{Line: 5, Column: 2, Value: "x"},
+			{Line: 6, Column: 4, Value: "31.02.2024"},
+		}, 4},
+		{"count only", []int{1, 2, 3, 4}, 0, nil, 6},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			invalid, count, err := Validate(strings.NewReader(file), validatedColumns, tt.checked, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(invalid, tt.invalid) || count != tt.count {
+				t.Errorf("got %+v and %d, want %+v and %d", invalid, count, tt.invalid, tt.count)
+			}
+		})
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		file string
+		want ParseError
+	}{
+		{"empty", "", ParseError{Line: 1, Problem: "file is empty"}},
+		{"more fields than the schema", "a,b,c,d,e,f\n1,2,3,4,5,6\n", ParseError{Line: 2, Problem: "row has a different number of fields than the schema"}},
+		{"fewer fields than the header", "name,count,ratio,paid,day\na,1,0.5,yes\n", ParseError{Line: 2, Problem: "row has a different number of fields than the header"}},
+		{"bare quote", "name,count,ratio,paid,day\na,1,0\"5,yes,01.02.2024\n", ParseError{Line: 2, Column: 6, Problem: `bare " in non-quoted-field`}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Validate(strings.NewReader(tt.file), validatedColumns, []int{1}, 10)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) || *parseErr != tt.want {
+				t.Errorf("got %v, want %v", err, &tt.want)
+			}
+		})
+	}
+}
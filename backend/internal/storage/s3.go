@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config of an S3-compatible object storage such as AWS S3 or MinIO
+type S3Config struct {
+	// e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Prepended to every key, e.g. "datasets/"
+	Prefix string
+	// Address the bucket in the path instead of the host name, as MinIO expects by default
+	PathStyle bool
+}
+
+// S3ConfigFromEnv reads the S3 configuration from the environment.
+// The endpoint defaults to AWS S3 in the configured region.
+func S3ConfigFromEnv() (S3Config, error) {
+	config := S3Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		Prefix:          os.Getenv("S3_PREFIX"),
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if pathStyle := os.Getenv("S3_PATH_STYLE"); pathStyle != "" {
+		var err error
+		config.PathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return S3Config{}, fmt.Errorf("S3_PATH_STYLE must be true or false, got %q", pathStyle)
+		}
+	}
+	if config.Bucket == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return S3Config{}, errors.New("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the s3 storage backend")
+	}
+	return config, nil
+}
+
+// S3 keeps objects in a bucket of an S3-compatible object storage.
+// Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	config S3Config
+	// The bucket, including the prefix for path-style requests
+	base   *url.URL
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3 uses a client without an overall timeout if client is nil, as
+// objects can take long to transfer
+func NewS3(config S3Config, client *http.Client) (*S3, error) {
+	if client == nil {
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		}}
+	}
+
+	base, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q, expected an http or https URL", config.Endpoint)
+	}
+	if config.PathStyle {
+		base.Path += "/" + config.Bucket
+	} else {
+		base.Host = config.Bucket + "." + base.Host
+	}
+
+	return &S3{config: config, base: base, client: client, now: time.Now}, nil
+}
+
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.base
+	u.Path += "/" + s.config.Prefix + key
+	// Sent exactly as it is signed
+	u.RawPath = uriEncodePath(u.Path)
+	return &u
+}
+
+// Objects are stored with a single PUT, which S3 allows for objects of up to 5 GiB
+func (s *S3) Put(key string, r io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	res, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res, key)
+	}
+	return nil
+}
+
+func (s *S3) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := s.do(req, emptyPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing is left after the offset
+		res.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	default:
+		defer res.Body.Close()
+		return nil, responseError(res, key)
+	}
+}
+
+func (s *S3) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(req, emptyPayload)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return responseError(res, key)
+	}
+	return nil
+}
+
+func (s *S3) Stat(key string) (int64, error) {
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(key).String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.do(req, emptyPayload)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, responseError(res, key)
+	}
+	return res.ContentLength, nil
+}
+
+// S3 describes errors in an XML body, except for HEAD requests
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func responseError(res *http.Response, key string) error {
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	var e s3Error
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: %s %q: %s: %s", res.Request.Method, key, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3: %s %q: unexpected status %s", res.Request.Method, key, res.Status)
+}
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// SHA-256 of an empty body
+	emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash)
+	return s.client.Do(req)
+}
+
+// Sign a request with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+
+	req.Header.Set("x-amz-date", timestamp)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// Only headers we set are signed, others may be changed by proxies
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headerValues := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           timestamp,
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		signedHeaders = []string{"host", "range", "x-amz-content-sha256", "x-amz-date"}
+		headerValues["range"] = r
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(headerValues[h]) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// URI-encode every byte except the unreserved characters and slashes
+func uriEncodePath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps the files of datasets as objects addressed by a key
+type Storage interface {
+	// Store an object of size bytes, replacing it if it exists. The object
+	// is only visible once it has been stored completely.
+	Put(key string, r io.Reader, size int64) error
+	// Stream length bytes of an object from offset on. A negative length reads to the end.
+	// Returns ErrNotFound if the object does not exist.
+	Get(key string, offset int64, length int64) (io.ReadCloser, error)
+	// Delete an object. Deleting an object that does not exist is not an error.
+	Delete(key string) error
+	// Get the size of an object in bytes. Returns ErrNotFound if it does not exist.
+	Stat(key string) (int64, error)
+}
+
+// FromEnv creates the storage selected by STORAGE_BACKEND, "local" by default
+// or "s3" for an S3-compatible object storage, see S3ConfigFromEnv.
+func FromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return NewLocal(LocalPath()), nil
+	case "s3":
+		config, err := S3ConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewS3(config, nil)
+	default:
+		return nil, fmt.Errorf("STORAGE_BACKEND must be local or s3, got %q", backend)
+	}
+}
+
+// LocalPath is the directory of the local storage, which also holds temporary files of uploads
+func LocalPath() string {
+	if path := os.Getenv("DATASET_STORAGE_PATH"); path != "" {
+		return path
+	}
+	return "./storage/datasets"
+}
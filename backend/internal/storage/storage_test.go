@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readObject(t *testing.T, s Storage, key string, offset int64, length int64) string {
+	t.Helper()
+	r, err := s.Get(key, offset, length)
+	if err != nil {
+		t.Fatalf("Get(%q, %d, %d): %v", key, offset, length, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Check the behaviour every storage shares
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+
+	// Keys can have characters that have to be encoded in URLs
+	const key = "dataset-1.v 2+ü.csv"
+	const content = "a,b\n1,2\n3,4\n"
+	if err := s.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("empty", strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, content},
+		{4, 4, "1,2\n"},
+		{8, -1, "3,4\n"},
+		{8, 100, "3,4\n"},
+		{0, 0, ""},
+		{int64(len(content)), -1, ""},
+	}
+	for _, test := range tests {
+		if got := readObject(t, s, key, test.offset, test.length); got != test.want {
+			t.Errorf("Get(%d, %d) = %q, want %q", test.offset, test.length, got, test.want)
+		}
+	}
+
+	size, err := s.Stat(key)
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("Stat = %d, %v, want %d", size, err, len(content))
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(key, 0, -1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.Stat(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete: got %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, NewLocal(t.TempDir()))
+}
@@ -0,0 +1,129 @@
+package totp
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// The SHA-1 secret of the test vectors of RFC 6238, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The test vectors of RFC 6238 have 8 digits, codes are their last 6
+func TestValidateRFC6238(t *testing.T) {
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		at := time.Unix(tt.unix, 0)
+		step, ok := Validate(rfcSecret, tt.code, at)
+		if !ok || step != tt.unix/30 {
+			t.Errorf("Validate(%q) at %d = %d, %t, want %d, true", tt.code, tt.unix, step, ok, tt.unix/30)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// 287082 is the code of step 1, from 30 to 59 seconds, 081804 the one of
+	// the step of 1111111109
+	for _, tt := range []struct {
+		name   string
+		secret string
+		code   string
+		unix   int64
+		step   int64
+		ok     bool
+	}{
+		{"current step", rfcSecret, "287082", 45, 1, true},
+		{"previous step", rfcSecret, "287082", 60, 1, true},
+		{"next step", rfcSecret, "287082", 29, 1, true},
+		{"two steps later", rfcSecret, "287082", 90, 0, false},
+		{"two steps earlier", rfcSecret, "081804", 1111111109 - 60, 0, false},
+		{"spaces", rfcSecret, "287 082", 45, 1, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", 45, 1, true},
+		{"wrong code", rfcSecret, "287083", 45, 0, false},
+		{"too short", rfcSecret, "28708", 45, 0, false},
+		{"8 digits of RFC 6238", rfcSecret, "94287082", 45, 0, false},
+		{"empty", rfcSecret, "", 45, 0, false},
+		{"secret that isn't base32", "not base32!", "287082", 45, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(tt.secret, tt.code, time.Unix(tt.unix, 0))
+			if step != tt.step || ok != tt.ok {
+				t.Errorf("got %d, %t, want %d, %t", step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+	other, _ := GenerateSecret()
+	if other == secret {
+		t.Error("two secrets are the same")
+	}
+
+	// Codes generated for the secret are accepted
+	now := time.Now()
+	if _, ok := Validate(secret, code(key, step(now)), now); !ok {
+		t.Error("the code of the secret was refused")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Chart Organizer", "alice@example.com", rfcSecret)
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Chart Organizer:alice@example.com" {
+		t.Errorf("URI %s", uri)
+	}
+	want := url.Values{
+		"secret":    {rfcSecret},
+		"issuer":    {"Chart Organizer"},
+		"algorithm": {"SHA1"},
+		"digits":    {"6"},
+		"period":    {"30"},
+	}
+	if got := u.Query(); got.Encode() != want.Encode() {
+		t.Errorf("query %v, want %v", got, want)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("%d codes, want 10", len(codes))
+	}
+	// Without letters and digits that are easily confused
+	format := regexp.MustCompile(`^[a-hjkmnp-z2-9]{4}-[a-hjkmnp-z2-9]{4}-[a-hjkmnp-z2-9]{4}$`)
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if !format.MatchString(c) {
+			t.Errorf("code %q", c)
+		}
+		if seen[c] {
+			t.Errorf("code %q is given twice", c)
+		}
+		seen[c] = true
+	}
+}